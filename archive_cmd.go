@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Kethsar/ytarchive/pkg/ytarchive"
+)
+
+/*
+Export every record in the archive database as CSV or JSON lines,
+to stdout or the given file.
+*/
+func runExportCommand(args []string) int {
+	exportFlags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbFile := exportFlags.String("archive-db", os.Getenv(ytarchive.ArchiveDBEnv), "Archive database to export.")
+	format := exportFlags.String("format", ytarchive.ExportCSV, "Export format, csv or jsonl.")
+	outFile := exportFlags.String("output", "", "File to write to instead of stdout.")
+	exportFlags.StringVar(outFile, "o", "", "File to write to instead of stdout.")
+	exportFlags.Parse(args)
+
+	if len(*dbFile) == 0 {
+		ytarchive.LogError("No archive database given. Use --archive-db or set %s.", ytarchive.ArchiveDBEnv)
+		return 1
+	}
+
+	if *format != ytarchive.ExportCSV && *format != ytarchive.ExportJSONL {
+		ytarchive.LogError("--format must be csv or jsonl")
+		return 1
+	}
+
+	records, err := ytarchive.ReadArchiveDB(*dbFile)
+	if err != nil {
+		ytarchive.LogError("Failed to read the archive database: %s", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if len(*outFile) > 0 {
+		out, err = os.Create(*outFile)
+		if err != nil {
+			ytarchive.LogError("Failed to create %s: %s", *outFile, err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	err = ytarchive.WriteArchiveRecords(out, *format, records)
+	if err != nil {
+		ytarchive.LogError("Failed to export the archive database: %s", err)
+		return 1
+	}
+
+	return 0
+}
+
+var archiveDateRegex = regexp.MustCompile(`^\d{4}-?\d{2}-?\d{2}$`)
+
+/*
+Search the archive database and print the matching captures, with their
+files and capture stats.
+*/
+func runSearchCommand(args []string) int {
+	searchFlags := flag.NewFlagSet("search", flag.ExitOnError)
+	dbFile := searchFlags.String("archive-db", os.Getenv(ytarchive.ArchiveDBEnv), "Archive database to search.")
+	query := &ytarchive.ArchiveQuery{}
+	searchFlags.StringVar(&query.Title, "title", "", "Only match titles containing this.")
+	searchFlags.StringVar(&query.Channel, "channel", "", "Only match channel names containing this, or this channel ID.")
+	searchFlags.StringVar(&query.VideoID, "id", "", "Only match this video ID.")
+	searchFlags.StringVar(&query.From, "from", "", "Only match streams starting on or after this date.")
+	searchFlags.StringVar(&query.To, "to", "", "Only match streams starting on or before this date.")
+	searchFlags.Parse(args)
+	query.Text = strings.Join(searchFlags.Args(), " ")
+
+	if len(*dbFile) == 0 {
+		ytarchive.LogError("No archive database given. Use --archive-db or set %s.", ytarchive.ArchiveDBEnv)
+		return 1
+	}
+
+	for _, date := range []string{query.From, query.To} {
+		if len(date) > 0 && !archiveDateRegex.MatchString(date) {
+			ytarchive.LogError("Invalid date %s, use YYYYMMDD or YYYY-MM-DD", date)
+			return 1
+		}
+	}
+
+	records, err := ytarchive.ReadArchiveDB(*dbFile)
+	if err != nil {
+		ytarchive.LogError("Failed to read the archive database: %s", err)
+		return 1
+	}
+
+	matches := ytarchive.SearchArchive(records, query)
+	for _, rec := range matches {
+		fmt.Printf("%s  %s  [%s]  %s\n", rec.VideoID, rec.Title, rec.Channel, rec.StartDate)
+		fmt.Printf("\tduration: %s, fragments: %d, size: %s, captured: %s\n",
+			ytarchive.SecondsToDurationStr(rec.DurationSecs), rec.Fragments, ytarchive.FormatSize(rec.Bytes), rec.CapturedAt)
+		for _, file := range rec.Files {
+			fmt.Printf("\t%s\n", file)
+		}
+	}
+
+	if len(matches) == 0 {
+		ytarchive.LogGeneral("No matching captures found")
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Kethsar/ytarchive/pkg/ytarchive"
+)
+
+/*
+Print the downloads of the ytarchive listening on the control socket, as a
+table or as JSON for scripts.
+*/
+func runStatusCommand(args []string) int {
+	statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := statusFlags.String("control-socket", ytarchive.DefaultControlSocket(), "Control socket of the running ytarchive.")
+	asJson := statusFlags.Bool("json", false, "Print the status as JSON.")
+	statusFlags.Parse(args)
+
+	resp, err := ytarchive.SendControlRequest(*socket, &ytarchive.ControlRequest{Command: ytarchive.ControlStatus})
+	if err != nil {
+		ytarchive.LogError("Failed to get the status from %s: %s", *socket, err)
+		return 1
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(resp.Downloads)
+		return 0
+	}
+
+	if len(resp.Downloads) == 0 {
+		fmt.Println("Nothing is being downloaded")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tFRAGMENTS\tSIZE\tTITLE")
+	for _, dl := range resp.Downloads {
+		state := dl.State
+		if dl.Paused {
+			state += " (paused)"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", dl.VideoID, state, dl.Fragments, ytarchive.FormatSize(dl.Bytes), dl.Title)
+	}
+	tw.Flush()
+
+	return 0
+}
+
+/*
+Stop one download of the ytarchive listening on the control socket, muxing
+what it downloaded.
+*/
+func runStopCommand(args []string) int {
+	stopFlags := flag.NewFlagSet("stop", flag.ExitOnError)
+	socket := stopFlags.String("control-socket", ytarchive.DefaultControlSocket(), "Control socket of the running ytarchive.")
+	stopFlags.Parse(args)
+
+	if stopFlags.NArg() != 1 {
+		ytarchive.LogError("Usage: ytarchive stop [--control-socket PATH] VIDEO_ID")
+		return 1
+	}
+
+	videoId := stopFlags.Arg(0)
+	_, err := ytarchive.SendControlRequest(*socket, &ytarchive.ControlRequest{
+		Command: ytarchive.ControlStop,
+		VideoID: videoId,
+	})
+	if err != nil {
+		ytarchive.LogError("Failed to stop %s: %s", videoId, err)
+		return 1
+	}
+
+	ytarchive.LogGeneral("Stopping %s, what was downloaded will be muxed", videoId)
+	return 0
+}
+
+/*
+Show the status line of a download of the ytarchive listening on the
+control socket as it goes, until it finishes or Ctrl+C detaches.
+*/
+func runAttachCommand(args []string) int {
+	attachFlags := flag.NewFlagSet("attach", flag.ExitOnError)
+	socket := attachFlags.String("control-socket", ytarchive.DefaultControlSocket(), "Control socket of the running ytarchive.")
+	attachFlags.Parse(args)
+
+	if attachFlags.NArg() > 1 {
+		ytarchive.LogError("Usage: ytarchive attach [--control-socket PATH] [VIDEO_ID]")
+		return 1
+	}
+
+	attached := false
+	err := ytarchive.AttachControl(*socket, attachFlags.Arg(0), func(dl *ytarchive.DownloadStatus) {
+		if !attached {
+			attached = true
+			fmt.Fprintf(os.Stderr, "Attached to %s (%s), press Ctrl+C to detach\n", dl.VideoID, dl.Title)
+		}
+
+		status := dl.Status
+		if len(status) == 0 || dl.State != ytarchive.StateName(ytarchive.StateDownloading) {
+			status = fmt.Sprintf("%s: %s", dl.VideoID, dl.State)
+		}
+		if dl.Paused {
+			status += " (paused)"
+		}
+
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", status)
+	})
+
+	if attached {
+		fmt.Fprintln(os.Stderr)
+		ytarchive.LogGeneral("The download is no longer running")
+		return 0
+	}
+
+	ytarchive.LogError("Failed to attach: %s", err)
+	return 1
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Kethsar/ytarchive/pkg/ytarchive"
+)
+
+const (
+	DoctorOk = iota
+	DoctorWarn
+	DoctorFail
+)
+
+const (
+	DoctorYoutubeURL     = "https://www.youtube.com/"
+	DoctorGooglevideoURL = "https://redirector.googlevideo.com/report_mapping"
+)
+
+/*
+Result of a single diagnostic check
+*/
+type DoctorResult struct {
+	Name   string
+	Status int
+	Detail string
+	Hint   string
+}
+
+func (r *DoctorResult) Print() {
+	label := "\033[32m[ OK ]\033[0m"
+	switch r.Status {
+	case DoctorWarn:
+		label = "\033[33m[WARN]\033[0m"
+	case DoctorFail:
+		label = "\033[31m[FAIL]\033[0m"
+	}
+
+	fmt.Printf("%s %s: %s\n", label, r.Name, r.Detail)
+	if len(r.Hint) > 0 && r.Status != DoctorOk {
+		fmt.Printf("       %s\n", r.Hint)
+	}
+}
+
+func checkConnectivity(name, checkUrl string) *DoctorResult {
+	res := &DoctorResult{Name: name}
+	start := time.Now()
+
+	resp, err := ytarchive.DefaultHttpClient().Get(checkUrl)
+	if err != nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("request failed: %s", err)
+		res.Hint = "Check your network connection and proxy settings. Try -4 or -6 if only one IP version works."
+		return res
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if resp.StatusCode != http.StatusOK {
+		res.Status = DoctorWarn
+		res.Detail = fmt.Sprintf("HTTP %d %s in %s", resp.StatusCode, http.StatusText(resp.StatusCode), elapsed)
+		res.Hint = "The server responded but not as expected. You might be rate limited or blocked, try a different IP or proxy."
+		return res
+	}
+
+	res.Detail = fmt.Sprintf("HTTP 200 in %s", elapsed)
+	return res
+}
+
+func checkCookies(fname string, secrets ytarchive.SecretStore) *DoctorResult {
+	res := &DoctorResult{Name: "Cookies"}
+	if len(fname) == 0 {
+		res.Status = DoctorWarn
+		res.Detail = "no cookies file given"
+		res.Hint = "Members-only and age restricted streams need --cookies with a Netscape format cookies.txt file."
+		return res
+	}
+
+	info := ytarchive.NewDownloadInfo()
+	info.Secrets = secrets
+	jar, err := info.ParseNetscapeCookiesFile(fname)
+	if err != nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("failed to load %s: %s", fname, err)
+		res.Hint = "Make sure the path is correct and the file is readable."
+		return res
+	}
+
+	if info.CookiesURL == nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("no youtube.com cookies found in %s", fname)
+		res.Hint = "Export the cookies while logged in to youtube.com, in Netscape cookies.txt format."
+		return res
+	}
+
+	cookies := jar.Cookies(info.CookiesURL)
+	expired := 0
+	hasAuth := false
+
+	// The jar drops expired cookies, so look at the file for those
+	data, err := info.ReadCookies(fname)
+	if err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		now := time.Now().Unix()
+		for scanner.Scan() {
+			parts := strings.Split(scanner.Text(), "\t")
+			if len(parts) != ytarchive.CookiePieces || !strings.Contains(parts[ytarchive.CookieDomain], "youtube.com") {
+				continue
+			}
+
+			var expire int64
+			fmt.Sscan(parts[ytarchive.CookieExpiration], &expire)
+			if expire > 0 && expire < now {
+				expired += 1
+			}
+		}
+	}
+
+	for _, cookie := range cookies {
+		if cookie.Name == "SAPISID" || cookie.Name == "__Secure-3PAPISID" {
+			hasAuth = true
+		}
+	}
+
+	res.Detail = fmt.Sprintf("%d youtube.com cookie(s) loaded", len(cookies))
+	if !hasAuth {
+		res.Status = DoctorFail
+		res.Detail += ", but no login cookies (SAPISID) found"
+		res.Hint = "Export the cookies again while logged in to youtube.com."
+	} else if expired > 0 {
+		res.Status = DoctorWarn
+		res.Detail += fmt.Sprintf(", %d expired", expired)
+		res.Hint = "Some cookies have expired. If downloads fail, export a fresh cookies file."
+	}
+
+	return res
+}
+
+func checkFFmpeg(path string) *DoctorResult {
+	res := &DoctorResult{Name: "FFmpeg"}
+
+	fullPath, err := exec.LookPath(path)
+	if errors.Is(err, exec.ErrDot) {
+		err = nil
+	}
+
+	if err != nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("%s not found", path)
+		res.Hint = "Install ffmpeg or provide its location with --ffmpeg-path. Without it, the final file cannot be muxed."
+		return res
+	}
+
+	cmd := exec.Command(path, "-version")
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("%s failed to run: %s", fullPath, err)
+		res.Hint = "Make sure the ffmpeg binary works on this system."
+		return res
+	}
+
+	version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	res.Detail = fmt.Sprintf("%s (%s)", version, fullPath)
+	return res
+}
+
+func checkWritable(name, dir string) *DoctorResult {
+	res := &DoctorResult{Name: name}
+	absDir, err := filepath.Abs(dir)
+	if err == nil {
+		dir = absDir
+	}
+
+	if !ytarchive.Exists(dir) {
+		res.Status = DoctorWarn
+		res.Detail = fmt.Sprintf("%s does not exist yet", dir)
+		res.Hint = "It will be created when downloading. Make sure its parent directory is writable."
+		return res
+	}
+
+	f, err := os.CreateTemp(dir, ".ytarchive-doctor-")
+	if err != nil {
+		res.Status = DoctorFail
+		res.Detail = fmt.Sprintf("cannot write to %s: %s", dir, err)
+		res.Hint = "Fix the directory permissions or choose a different directory."
+		return res
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+	res.Detail = fmt.Sprintf("%s is writable", dir)
+	return res
+}
+
+/*
+Run a series of checks for common problems and print what to do about them.
+Returns 1 if any check failed.
+*/
+func RunDoctor(opts *ytarchive.Options) int {
+	var results []*DoctorResult
+
+	outDir := opts.OutputFormat
+	if idx := strings.Index(outDir, "%("); idx >= 0 {
+		outDir = outDir[:idx]
+	}
+	outDir = filepath.Dir(outDir + "x")
+
+	fmt.Println("Running diagnostics...")
+	results = append(results,
+		checkConnectivity("youtube.com", DoctorYoutubeURL),
+		checkConnectivity("googlevideo.com", DoctorGooglevideoURL),
+		checkCookies(opts.CookieFile, opts.Secrets),
+		checkFFmpeg(opts.FFmpegPath),
+		checkWritable("Output directory", outDir),
+	)
+
+	if len(opts.TempDir) > 0 {
+		results = append(results, checkWritable("Temporary directory", opts.TempDir))
+	}
+
+	retcode := 0
+	for _, res := range results {
+		res.Print()
+		if res.Status == DoctorFail {
+			retcode = 1
+		}
+	}
+
+	return retcode
+}
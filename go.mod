@@ -7,8 +7,7 @@ require (
 	github.com/mattn/go-colorable v0.1.11
 	github.com/xhit/go-str2duration/v2 v2.1.0
 	github.com/dannav/hhmmss v1.0.0
+	github.com/mattn/go-isatty v0.0.14
 	golang.org/x/net v0.0.0-20210510120150-4163338589ed
 	golang.org/x/sys v0.3.0
 )
-
-require github.com/mattn/go-isatty v0.0.14 // indirect
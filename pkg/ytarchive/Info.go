@@ -1,7 +1,8 @@
-package main
+package ytarchive
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,6 +34,8 @@ const (
 type VideoItag struct {
 	H264 int
 	VP9  int
+	// Shared by both frame rates of a resolution, see av1Itag
+	AV1 int
 }
 
 // https://gist.github.com/AgentOak/34d47c65b1d28829bb17c24c04a0096f
@@ -43,18 +46,18 @@ var (
 
 	VideoLabelItags = map[string]VideoItag{
 		"audio_only": {H264: 0, VP9: 0},
-		"144p":       {H264: 160, VP9: 278},
-		"240p":       {H264: 133, VP9: 242},
-		"360p":       {H264: 134, VP9: 243},
-		"480p":       {H264: 135, VP9: 244},
-		"720p":       {H264: 136, VP9: 247},
-		"720p60":     {H264: 298, VP9: 302},
-		"1080p":      {H264: 137, VP9: 248},
-		"1080p60":    {H264: 299, VP9: 303},
-		"1440p":      {H264: 264, VP9: 271},
-		"1440p60":    {H264: 304, VP9: 308},
-		"2160p":      {H264: 266, VP9: 313},
-		"2160p60":    {H264: 305, VP9: 315},
+		"144p":       {H264: 160, VP9: 278, AV1: 394},
+		"240p":       {H264: 133, VP9: 242, AV1: 395},
+		"360p":       {H264: 134, VP9: 243, AV1: 396},
+		"480p":       {H264: 135, VP9: 244, AV1: 397},
+		"720p":       {H264: 136, VP9: 247, AV1: 398},
+		"720p60":     {H264: 298, VP9: 302, AV1: 398},
+		"1080p":      {H264: 137, VP9: 248, AV1: 399},
+		"1080p60":    {H264: 299, VP9: 303, AV1: 399},
+		"1440p":      {H264: 264, VP9: 271, AV1: 400},
+		"1440p60":    {H264: 304, VP9: 308, AV1: 400},
+		"2160p":      {H264: 266, VP9: 313, AV1: 401},
+		"2160p60":    {H264: 305, VP9: 315, AV1: 401},
 	}
 
 	VideoQualities = []string{
@@ -101,10 +104,26 @@ Fragment information/data
 type Fragment struct {
 	Seq         int
 	FileName    string
+	Spool       *SpoolEntry
 	XHeadSeqNum int
 	Data        *bytes.Buffer
 	Slow        bool
 	MimeType    string
+	// From X-Walltime-Ms if sent, and when the download finished
+	Produced   time.Time
+	Downloaded time.Time
+}
+
+/*
+Codec, framerate, and bitrate details of a single format
+*/
+type FormatDetails struct {
+	Itag    int
+	Codecs  string
+	Fps     int
+	Bitrate int
+	// Estimated from downloaded fragments, see MeasureFormats
+	MeasuredBitrate int
 }
 
 type seqChanInfo struct {
@@ -126,6 +145,8 @@ type fragThreadState struct {
 	Is403        bool
 	ToFile       bool
 	SleepTime    time.Duration
+	// System sleeps seen so far, see resetAfterSleep
+	Resumes int
 }
 
 type MediaDLInfo struct {
@@ -136,6 +157,36 @@ type MediaDLInfo struct {
 	DataType    string
 	Finished    bool
 	URLHost     string
+
+	// Per-host request stats for failing over to another host, see recordHostResult
+	HostStats   map[string]*HostStats
+	ErrorStreak int
+	// 403 and 404 responses in a row, see recordURLResult
+	DeadStreak int
+	// Itag downloaded instead of the chosen one, see FullRefresh
+	SwitchedItag int
+	// Fragments written to the data file so far
+	Written int
+
+	FragStats FragmentStats
+	// Fragments skipped to catch up with the stream, see CatchUpFrags
+	Gaps []FragmentGap
+	// Where fragments wait to be written instead of their own files
+	Spool *FragSpool
+	// Second copy of the data file being written, and whether the data file
+	// itself failed so only the copy is complete, see CopyDir
+	CopyFile     string
+	DataFileLost bool
+}
+
+/*
+A range of fragments that was skipped, from StartSeq to EndSeq inclusive,
+after Written fragments were written to the file
+*/
+type FragmentGap struct {
+	StartSeq int
+	EndSeq   int
+	Written  int
 }
 
 /*
@@ -154,27 +205,61 @@ Miscellaneous information
 */
 type DownloadInfo struct {
 	sync.RWMutex
+	stateLock  sync.Mutex
+	sleep      sleepWatch
+	network    networkWatch
+	cancel     context.CancelFunc
 	FormatInfo FormatInfo
 	Metadata   MetaInfo
 	CookiesURL *url.URL
+	CookieJar  http.CookieJar
+	CookieFile string
+	Secrets    SecretStore
+	Client     HttpClient
 	Ytcfg      *YTCFG
 	PoToken    string
 
+	// What Archiver.Downloads shows, as it can not wait on the main lock
+	// while GetVideoInfo holds it
+	summaryLock sync.Mutex
+	summary     downloadSummary
+
+	// The latest player response as YouTube served it, see WriteInfoJSON
+	PlayerResponseData []byte
+
+	// Sends the fragment requests to googlevideo instead of Client if set
+	MediaClient HttpClient
+
+	// Why no quality was picked, if the user cancelled the quality prompt
+	pickErr error
+
 	Stopping         bool
+	Finishing        bool
+	Paused           bool
 	InProgress       bool
 	Live             bool
 	VP9              bool
+	AV1              bool
 	H264             bool
 	Unavailable      bool
+	NeedsMembership  bool
+	RegionLocked     bool
+	Filtered         bool
 	GVideoDDL        bool
 	FragFiles        bool
+	FragShard        bool
+	FragSpool        bool
+	FragCompress     bool
 	LiveURL          bool
 	AudioOnly        bool
 	VideoOnly        bool
 	MembersOnly      bool
 	InfoPrinted      bool
+	PostLive         bool
 	DisableSaveState bool
+	StatusNewlines   bool
 	LiveFromVal      string
+	FragNameFormat   string
 	LiveFromSq       int
 
 	Thumbnail           string
@@ -182,20 +267,53 @@ type DownloadInfo struct {
 	URL                 string
 	SelectedQuality     string
 	Status              string
+	StatusFunc          func(status string)
+	StateFunc           func(state int)
+	FragmentFunc        func(dataType string, seq int, offset int64, data []byte)
+	SourceFunc          func(kind string, data []byte)
+	RawFragmentFunc     func(dataType string, seq int, data []byte)
 	CaptureDurationSecs int
+	PreallocateSecs     int
 	StartDelaySecs      int
 
 	FragMaxTries   uint
+	State          int
 	Wait           int
 	Quality        int
 	RetrySecs      int
 	Jobs           int
+	BurstJobs      int // Jobs while catching up to the live edge
+	CatchUpFrags   int
 	TargetDuration int
 	LastSq         int
 	LastUpdated    time.Time
-
-	MDLInfo map[string]*MediaDLInfo
-	DLState map[int]*DownloadState
+	PausedAt       time.Time
+	// Last FullRefresh
+	fullRefreshAt time.Time
+	// Noted with addDiscontinuity
+	discontinuities discontinuityLog
+	fragCompression fragCompressStats
+
+	MDLInfo         map[string]*MediaDLInfo
+	StreamOutputs   map[string]io.Writer
+	RestreamOutputs map[string]io.Writer
+	LiveOutputs     map[string]io.Writer
+	DLState         map[int]*DownloadState
+	FormatDetails   map[int]*FormatDetails
+	// Fragment URL format of every itag the stream offers
+	FormatURLs map[int]string
+
+	// Limits how fast fragments are read, nil for no limit
+	RateLimit *RateLimiter
+
+	// Where the times of written fragments are recorded, nil for nowhere
+	FragTimes *FragTimeLog
+
+	// Which streams found on a channel are archived, nil for all of them
+	Filter *StreamFilter
+
+	// Where to write a second copy of each data file, see RedundantFile
+	CopyDir string
 
 	FileMode os.FileMode
 	DirMode  os.FileMode
@@ -214,7 +332,8 @@ func NewDownloadInfo() *DownloadInfo {
 			DtypeVideo: {},
 			DtypeAudio: {},
 		},
-		DLState: make(map[int]*DownloadState),
+		DLState:       make(map[int]*DownloadState),
+		FormatDetails: make(map[int]*FormatDetails),
 	}
 }
 
@@ -239,6 +358,7 @@ func NewFormatInfo() FormatInfo {
 		"publish_date": "",
 		"description":  "",
 		"url":          "",
+		"view":         "",
 	}
 }
 
@@ -251,13 +371,45 @@ func NewMetaInfo() MetaInfo {
 	}
 }
 
+// The client to send requests with, falling back to the default one
+func (di *DownloadInfo) HttpClient() HttpClient {
+	if di.Client != nil {
+		return di.Client
+	}
+
+	return DefaultHttpClient()
+}
+
+// Client for fragment downloads
+func (di *DownloadInfo) MediaHttpClient() HttpClient {
+	if di.MediaClient != nil {
+		return di.MediaClient
+	}
+
+	return di.HttpClient()
+}
+
 func (di *DownloadInfo) IsStopping() bool {
 	di.RLock()
 	defer di.RUnlock()
 	return di.Stopping
 }
 
+/*
+Derive a context that is cancelled when the download is stopped.
+Must be called before anything uses the DownloadInfo.
+*/
+func (di *DownloadInfo) WithCancel(ctx context.Context) context.Context {
+	ctx, di.cancel = context.WithCancel(ctx)
+	return ctx
+}
+
+// Stop immediately, aborting any requests in progress
 func (di *DownloadInfo) Stop() {
+	if di.cancel != nil {
+		di.cancel()
+	}
+
 	di.Lock()
 	defer di.Unlock()
 	di.Stopping = true
@@ -265,6 +417,77 @@ func (di *DownloadInfo) Stop() {
 	di.SetFinished(DtypeVideo)
 }
 
+func (di *DownloadInfo) IsFinishing() bool {
+	di.RLock()
+	defer di.RUnlock()
+	return di.Finishing
+}
+
+// Stop queueing new fragments, but let the ones already being
+// downloaded finish so they can be written out.
+func (di *DownloadInfo) Finish() {
+	di.Lock()
+	defer di.Unlock()
+	di.Finishing = true
+}
+
+func (di *DownloadInfo) IsPaused() bool {
+	di.RLock()
+	defer di.RUnlock()
+	return di.Paused
+}
+
+/*
+Stop starting new fragment downloads until Resume is called.
+Fragments already being downloaded are allowed to finish. Sequence numbers
+are kept as-is, so resuming picks up where the download left off as long
+as the fragments are still within the stream's seekable window.
+*/
+func (di *DownloadInfo) Pause() {
+	di.Lock()
+	defer di.Unlock()
+
+	if di.Paused {
+		return
+	}
+
+	di.Paused = true
+	di.PausedAt = time.Now()
+
+	di.summaryLock.Lock()
+	di.summary.Paused = true
+	di.summaryLock.Unlock()
+}
+
+func (di *DownloadInfo) Resume() {
+	di.Lock()
+	defer di.Unlock()
+
+	if !di.Paused {
+		return
+	}
+
+	pausedFor := time.Since(di.PausedAt)
+	if pausedFor > LiveMaximumSeekable*time.Second {
+		LogWarn("Download was paused for %s, older fragments are likely no longer available.", SecondsToDurationStr(int(pausedFor.Seconds())))
+	}
+
+	di.Paused = false
+
+	di.summaryLock.Lock()
+	di.summary.Paused = false
+	di.summaryLock.Unlock()
+}
+
+// Block while the download is paused, unless it is being stopped
+func (di *DownloadInfo) WaitWhilePaused(ctx context.Context) {
+	for di.IsPaused() && !di.IsFinishing() {
+		if !SleepContext(ctx, 250*time.Millisecond) {
+			return
+		}
+	}
+}
+
 func (di *DownloadInfo) IsLive() bool {
 	di.RLock()
 	defer di.RUnlock()
@@ -277,6 +500,12 @@ func (di *DownloadInfo) IsUnavailable() bool {
 	return di.Unavailable
 }
 
+func (di *DownloadInfo) IsRegionLocked() bool {
+	di.RLock()
+	defer di.RUnlock()
+	return di.RegionLocked
+}
+
 func (di *DownloadInfo) IsGVideoDDL() bool {
 	di.RLock()
 	defer di.RUnlock()
@@ -331,6 +560,12 @@ func (di *DownloadInfo) GetBaseFilePath(dataType string) string {
 	return di.MDLInfo[dataType].BasePath
 }
 
+func (di *DownloadInfo) getFragSpool(dataType string) *FragSpool {
+	di.MDLInfo[dataType].RLock()
+	defer di.MDLInfo[dataType].RUnlock()
+	return di.MDLInfo[dataType].Spool
+}
+
 func (di *DownloadInfo) SetBaseFilePath(dataType, fpath string) {
 	di.MDLInfo[dataType].Lock()
 	defer di.MDLInfo[dataType].Unlock()
@@ -377,6 +612,15 @@ func (fi FormatInfo) SetInfo(player_response *PlayerResponse) {
 	fi["description"] = strings.TrimSpace(player_response.VideoDetails.ShortDescription)
 }
 
+// Set the format info, keeping the title for Archiver.Downloads. Needs the lock held
+func (di *DownloadInfo) setFormatInfo(pr *PlayerResponse) {
+	di.FormatInfo.SetInfo(pr)
+
+	di.summaryLock.Lock()
+	di.summary.Title = di.FormatInfo["title"]
+	di.summaryLock.Unlock()
+}
+
 func (mi MetaInfo) SetInfo(fi FormatInfo) {
 	for k, v := range mi {
 		val, err := FormatPythonMapString(v, fi)
@@ -404,7 +648,9 @@ func (di *DownloadInfo) printChannelAndTitle(pr *PlayerResponse) {
 }
 
 func (di *DownloadInfo) printStatusWithoutLock() {
-	if loglevel >= LoglevelError {
+	if di.StatusFunc != nil {
+		di.StatusFunc(di.Status)
+	} else if GetLogLevel() >= LoglevelError {
 		fmt.Print(di.Status)
 	}
 }
@@ -414,6 +660,10 @@ func (di *DownloadInfo) SetStatus(status string) {
 	defer di.Unlock()
 	di.Status = status
 	di.printStatusWithoutLock()
+
+	di.summaryLock.Lock()
+	di.summary.Status = status
+	di.summaryLock.Unlock()
 }
 
 func (di *DownloadInfo) PrintStatus() {
@@ -680,19 +930,20 @@ Attempts to grab from the Web API player response as well as desktop,
 favouring Web API. Any formats not found in the Web API are looked for in the
 desktop player response.
 */
-func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
+func (di *DownloadInfo) GetDownloadUrls(ctx context.Context, pr *PlayerResponse) map[int]string {
 	urls := make(map[int]string)
-	WebPlayerResponse, err := di.DownloadWebPlayerResponse()
+	di.FormatDetails = make(map[int]*FormatDetails)
+	WebPlayerResponse, err := di.DownloadWebPlayerResponse(ctx)
 
 	if err != nil {
 		LogDebug("Error getting Web API player response: %s", err.Error())
 	} else {
 		if len(WebPlayerResponse.StreamingData.DashManifestURL) > 0 {
 			LogDebug("Retrieving URLs from Web API DASH manifest")
-			manifest := DownloadData(WebPlayerResponse.StreamingData.DashManifestURL)
+			manifest := DownloadData(ctx, di.HttpClient(), WebPlayerResponse.StreamingData.DashManifestURL)
 			if len(manifest) > 0 {
 				// we store the LastSq to calculate 5 days past
-				urls, di.LastSq = GetUrlsFromManifest(manifest, di.PoToken)
+				urls, di.FormatDetails, di.LastSq = GetUrlsFromManifest(manifest, di.PoToken)
 			}
 
 			for itag := range urls {
@@ -711,6 +962,7 @@ func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
 				}
 
 				urls[fmt.Itag] = strings.ReplaceAll(fmt.URL, "%", "%%") + "&sq=%d"
+				di.setFormatDetails(fmt.Itag, fmt.MimeType, fmt.Fps, fmt.Bitrate)
 				LogTrace("Setting itag %d from Web API adaptive formats", fmt.Itag)
 			}
 		}
@@ -718,10 +970,10 @@ func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
 
 	if len(pr.StreamingData.DashManifestURL) > 0 {
 		LogDebug("Retrieving URLs from web DASH manifest")
-		manifest := DownloadData(pr.StreamingData.DashManifestURL)
+		manifest := DownloadData(ctx, di.HttpClient(), pr.StreamingData.DashManifestURL)
 		if len(manifest) > 0 {
 			// we store the LastSq to calculate 5 days past
-			dashUrls, lastSq := GetUrlsFromManifest(manifest, di.PoToken)
+			dashUrls, dashDetails, lastSq := GetUrlsFromManifest(manifest, di.PoToken)
 			if lastSq > di.LastSq {
 				di.LastSq = lastSq
 			}
@@ -732,6 +984,7 @@ func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
 				}
 
 				urls[itag] = url
+				di.FormatDetails[itag] = dashDetails[itag]
 				LogTrace("Setting itag %d from web adaptive formats", itag)
 			}
 		}
@@ -748,6 +1001,7 @@ func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
 			}
 
 			urls[fmt.Itag] = strings.ReplaceAll(fmt.URL, "%", "%%") + "&sq=%d"
+			di.setFormatDetails(fmt.Itag, fmt.MimeType, fmt.Fps, fmt.Bitrate)
 			LogTrace("Setting itag %d from web adaptive formats", fmt.Itag)
 		}
 	}
@@ -755,6 +1009,93 @@ func (di *DownloadInfo) GetDownloadUrls(pr *PlayerResponse) map[int]string {
 	return urls
 }
 
+// Map each quality label to a summary of the format that would be downloaded for it
+func (di *DownloadInfo) describeQualities(qualities []string, dlUrls map[int]string) map[string]string {
+	descriptions := make(map[string]string)
+
+	for _, qlabel := range qualities {
+		itag := di.qualityItag(qlabel, dlUrls)
+		if details, ok := di.FormatDetails[itag]; ok && details != nil {
+			descriptions[qlabel] = details.String()
+		} else {
+			descriptions[qlabel] = DescribeQualityLabel(qlabel)
+		}
+	}
+
+	return descriptions
+}
+
+// The itag that would be downloaded for a quality label
+func (di *DownloadInfo) qualityItag(qlabel string, dlUrls map[int]string) int {
+	if qlabel == "audio_only" {
+		return AudioItag
+	}
+
+	videoItag := VideoLabelItags[qlabel]
+	_, vp9Ok := dlUrls[videoItag.VP9]
+	_, h264Ok := dlUrls[videoItag.H264]
+
+	if av1 := di.av1Itag(qlabel, dlUrls); av1 != 0 && (di.AV1 || (!vp9Ok && !h264Ok)) && !di.H264 {
+		return av1
+	}
+	if vp9Ok && (di.VP9 || !h264Ok) && !di.H264 {
+		return videoItag.VP9
+	}
+
+	return videoItag.H264
+}
+
+/*
+The AV1 itag of a quality if the stream offers it, or 0. AV1 formats use the
+same itag at 30 and 60fps, so the frame rate of the format has to match the
+quality's, with an unknown one taken as 30fps.
+*/
+func (di *DownloadInfo) av1Itag(qlabel string, dlUrls map[int]string) int {
+	itag := VideoLabelItags[qlabel].AV1
+	if _, ok := dlUrls[itag]; !ok || itag == 0 {
+		return 0
+	}
+
+	if di.highFrameRate(itag) != strings.HasSuffix(qlabel, "p60") {
+		return 0
+	}
+
+	return itag
+}
+
+// Whether a format is above 30fps, taking an unknown frame rate as 30fps
+func (di *DownloadInfo) highFrameRate(itag int) bool {
+	details, ok := di.FormatDetails[itag]
+	return ok && details != nil && details.Fps > 30
+}
+
+func (di *DownloadInfo) setFormatDetails(itag int, mimeType string, fps, bitrate int) {
+	codecs := ""
+	if idx := strings.Index(mimeType, `codecs="`); idx >= 0 {
+		codecs = strings.TrimSuffix(mimeType[idx+len(`codecs="`):], `"`)
+	}
+
+	di.FormatDetails[itag] = &FormatDetails{
+		Itag:    itag,
+		Codecs:  codecs,
+		Fps:     fps,
+		Bitrate: bitrate,
+	}
+}
+
+// Parse a duration string such as 1h30m, or a HH:MM:SS time string
+func ParseDurationStr(durationVal string) (time.Duration, error) {
+	duration, err := str2duration.ParseDuration(durationVal)
+	if err != nil {
+		duration, err = hhmmss.Parse(durationVal)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse %s as either a duration or a time string", durationVal)
+		}
+	}
+
+	return duration, nil
+}
+
 func (di *DownloadInfo) ParseCaptureDurationStrVal(durationVal string) error {
 	if durationVal == "" {
 		return nil
@@ -796,7 +1137,7 @@ func (di *DownloadInfo) ParseStartDelayStrVal(durationVal string) error {
 }
 
 // Get necessary video info such as video/audio URLs
-func (di *DownloadInfo) GetVideoInfo() bool {
+func (di *DownloadInfo) GetVideoInfo(ctx context.Context) bool {
 	di.Lock()
 	defer di.Unlock()
 
@@ -804,7 +1145,7 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 		No point retrieving information if we know it's not available, or there
 		is nothing useful to be gotten
 	*/
-	if di.GVideoDDL || di.Stopping || di.Unavailable {
+	if di.GVideoDDL || di.Stopping || di.Unavailable || ctx.Err() != nil {
 		return false
 	}
 
@@ -814,7 +1155,7 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 		return false
 	}
 
-	retrieved, pr, selQaulities := di.GetPlayablePlayerResponse()
+	retrieved, pr, selQaulities := di.GetPlayablePlayerResponse(ctx)
 	di.LastUpdated = time.Now()
 	if retrieved == PlayerResponseNotFound {
 		di.Live = false
@@ -832,12 +1173,13 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 	if targetDur > 0 {
 		di.TargetDuration = targetDur
 	}
-	dlUrls := di.GetDownloadUrls(pr)
+	dlUrls := di.GetDownloadUrls(ctx, pr)
 
 	if len(dlUrls) == 0 {
 		LogError("No download URLs found")
 		return false
 	}
+	di.FormatURLs = dlUrls
 
 	if di.Quality < 0 {
 		var qualities []string
@@ -849,7 +1191,7 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 			_, vp9Ok := dlUrls[videoItag.VP9]
 			_, h264Ok := dlUrls[videoItag.H264]
 
-			if Contains(qualities, qlabel) || (!vp9Ok && !h264Ok) {
+			if Contains(qualities, qlabel) || (!vp9Ok && !h264Ok && di.av1Itag(qlabel, dlUrls) == 0) {
 				continue
 			}
 			qualities = append(qualities, qlabel)
@@ -857,7 +1199,10 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 
 		for !found {
 			if len(selQaulities) == 0 {
-				selQaulities = GetQualityFromUser(qualities, false)
+				selQaulities, di.pickErr = GetQualityFromUser(qualities, di.describeQualities(qualities, dlUrls), false)
+				if di.pickErr != nil {
+					return false
+				}
 			}
 
 			for _, q := range selQaulities {
@@ -865,6 +1210,8 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 
 				if q == "best" {
 					q = qualities[len(qualities)-1]
+				} else if q == AutoQuality {
+					q = di.pickAutoQuality(ctx, qualities, dlUrls)
 				} else if q == "audio" {
 					q = "audio_only"
 				}
@@ -885,8 +1232,16 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 
 				_, vp9Ok := dlUrls[videoItag.VP9]
 				_, h264Ok := dlUrls[videoItag.H264]
+				av1 := di.av1Itag(q, dlUrls)
 
-				if vp9Ok && (di.VP9 || !h264Ok) && !di.H264 { // Sometimes a quality is VP9 only apparently
+				// Some high resolution streams are only offered in AV1
+				if av1 != 0 && (di.AV1 || (!vp9Ok && !h264Ok)) && !di.H264 {
+					di.SetDownloadUrl(DtypeVideo, dlUrls[av1])
+					di.Quality = av1
+					found = true
+					LogGeneral("Selected quality: %s (AV1)\n", q)
+					break
+				} else if vp9Ok && (di.VP9 || !h264Ok) && !di.H264 { // Sometimes a quality is VP9 only apparently
 					di.SetDownloadUrl(DtypeVideo, dlUrls[videoItag.VP9])
 					di.Quality = videoItag.VP9
 					found = true
@@ -922,16 +1277,17 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 		}
 
 		if !aonly {
-			_, vidOk := dlUrls[di.Quality]
-			if vidOk && IsFragmented(dlUrls[di.Quality]) {
-				di.SetDownloadUrl(DtypeVideo, dlUrls[di.Quality])
+			vItag := di.videoItag()
+			_, vidOk := dlUrls[vItag]
+			if vidOk && IsFragmented(dlUrls[vItag]) {
+				di.SetDownloadUrl(DtypeVideo, dlUrls[vItag])
 			}
 		}
 	}
 
 	if !di.InProgress {
 		LogGeneral("Stream started at time %s", pmfr.LiveBroadcastDetails.StartTimestamp)
-		di.FormatInfo.SetInfo(pr)
+		di.setFormatInfo(pr)
 		di.Metadata.SetInfo(di.FormatInfo)
 		if len(pmfr.Thumbnail.Thumbnails) > 0 {
 			di.Thumbnail = pmfr.Thumbnail.Thumbnails[0].URL
@@ -944,7 +1300,7 @@ func (di *DownloadInfo) GetVideoInfo() bool {
 	return true
 }
 
-func (di *DownloadInfo) WaitForStartDelay() bool {
+func (di *DownloadInfo) WaitForStartDelay(ctx context.Context) bool {
 	if di.Live && di.StartDelaySecs > 0 {
 		fragDur := float64(di.TargetDuration)
 		secondsRoundedToFragLength := int(math.Ceil(float64(di.StartDelaySecs)/fragDur) * fragDur) // Rounds up to next frag interval time
@@ -954,26 +1310,36 @@ func (di *DownloadInfo) WaitForStartDelay() bool {
 		LogGeneral("Waiting %s before starting to download...", SecondsToDurationAndTimeStr(secondsRoundedToFragLength))
 		LogDebug("Will start from sequence %d [current is %d]", di.LiveFromSq, di.LastSq)
 
-		time.Sleep(time.Duration(secondsRoundedToFragLength) * time.Second) // Waits for the specified length of time.
+		// Waits for the specified length of time.
+		if !SleepContext(ctx, time.Duration(secondsRoundedToFragLength)*time.Second) {
+			return false
+		}
 
 		if secondsRoundedToFragLength > DefaultPollTime {
-			return di.GetVideoInfo() // Re-grab video information.
+			return di.GetVideoInfo(ctx) // Re-grab video information.
 		}
 	}
 
 	return true
 }
 
-func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<- *Fragment) {
+func (di *DownloadInfo) downloadFragment(ctx context.Context, state *fragThreadState, dataChan chan<- *Fragment) {
 	state.Tries = 0
 	state.FullRetries = 3
 	state.Is403 = false
-	fname := fmt.Sprintf("%s.frag%d.ts", state.BaseFilePath, state.SeqNum)
+	fname := ""
+	spool := di.getFragSpool(state.DataType)
+	if state.ToFile && spool == nil {
+		fname = di.fragFilePath(state.BaseFilePath, state.DataType, state.SeqNum)
+	}
+	// Tries gets reset while the stream is live, so count retries separately
+	retries := -1
 
 	for state.Tries < int(di.FragMaxTries) || di.FragMaxTries == 0 {
-		if di.IsStopping() {
+		if ctx.Err() != nil {
 			return
 		}
+		retries += 1
 		if di.FragMaxTries == 0 {
 			state.Tries = 0 // just in case someone actually somehow lets something run long enough to cause an overflow
 		}
@@ -981,7 +1347,8 @@ func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<-
 		baseUrl := di.GetDownloadUrl(state.DataType)
 		seqUrl := fmt.Sprintf(baseUrl, state.SeqNum)
 
-		req, err := http.NewRequest("GET", seqUrl, nil)
+		reqCtx, cancelReq := di.network.requestContext(ctx)
+		req, err := http.NewRequestWithContext(reqCtx, "GET", seqUrl, nil)
 		if err != nil {
 			LogDebug("%s: error creating request: %s", state.Name, err.Error())
 		}
@@ -999,48 +1366,92 @@ func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<-
 			req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:87.0) Gecko/20100101 Firefox/87.0")
 			req.Header.Add("Origin", "https://www.youtube.com")
 
-			resp, err = client.Do(req)
-		} else {
-			resp, err = client.Get(seqUrl)
+			resp, err = di.MediaHttpClient().Do(req)
+		}
+
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			cancelReq()
+			return
 		}
 
 		if err != nil {
+			// Cut short by the network changing, try again over the new one
+			netChanged := reqCtx.Err() != nil
+			cancelReq()
+			if netChanged {
+				LogDebug("%s: Retrying fragment %d after the network changed", state.Name, state.SeqNum)
+				continue
+			}
+
 			HandleFragDownloadError(di, state, err)
 
 			state.Tries += 1
-			if !ContinueFragmentDownload(di, state) {
+			if !ContinueFragmentDownload(ctx, di, state) {
 				return
 			}
 
-			time.Sleep(state.SleepTime)
+			if !SleepContext(ctx, state.SleepTime) {
+				return
+			}
 			continue
 		}
 
-		respData, err := io.ReadAll(resp.Body)
+		respData, err := io.ReadAll(di.RateLimit.Reader(ctx, resp.Body))
 		resp.Body.Close()
+		netChanged := ctx.Err() == nil && reqCtx.Err() != nil
+		cancelReq()
 		dlDuration := time.Since(dlStart)
 
 		if err != nil {
+			if netChanged {
+				LogDebug("%s: Retrying fragment %d after the network changed", state.Name, state.SeqNum)
+				continue
+			}
+
 			HandleFragDownloadError(di, state, err)
 
 			state.Tries += 1
-			if !ContinueFragmentDownload(di, state) {
+			if !ContinueFragmentDownload(ctx, di, state) {
 				return
 			}
 
-			time.Sleep(state.SleepTime)
+			if !SleepContext(ctx, state.SleepTime) {
+				return
+			}
+			continue
+		}
+
+		// A body cut short would otherwise go straight into the data file
+		if resp.StatusCode < 400 && resp.ContentLength >= 0 && int64(len(respData)) != resp.ContentLength {
+			LogDebug("%s: Fragment %d is %d bytes, but %d were expected", state.Name, state.SeqNum, len(respData), resp.ContentLength)
+			di.PrintStatus()
+
+			state.Tries += 1
+			if !ContinueFragmentDownload(ctx, di, state) {
+				return
+			}
+
+			if !SleepContext(ctx, state.SleepTime) {
+				return
+			}
 			continue
 		}
 
+		di.recordHostResult(state.DataType, baseUrl, resp.StatusCode >= 500)
 		if resp.StatusCode >= 400 {
-			HandleFragHttpError(di, state, resp.StatusCode, baseUrl)
+			HandleFragHttpError(ctx, di, state, resp.StatusCode, baseUrl)
 
 			state.Tries += 1
-			if !ContinueFragmentDownload(di, state) {
+			if !ContinueFragmentDownload(ctx, di, state) {
 				return
 			}
 
-			time.Sleep(state.SleepTime)
+			if !SleepContext(ctx, state.SleepTime) {
+				return
+			}
 			continue
 		}
 
@@ -1050,14 +1461,19 @@ func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<-
 		*/
 		if len(respData) == 0 {
 			state.Tries += 1
-			if !ContinueFragmentDownload(di, state) {
+			if !ContinueFragmentDownload(ctx, di, state) {
 				return
 			}
 
-			time.Sleep(state.SleepTime)
+			if !SleepContext(ctx, state.SleepTime) {
+				return
+			}
 			continue
 		}
 
+		di.MDLInfo[state.DataType].FragStats.Add(dlDuration, len(respData), retries)
+		di.recordURLResult(ctx, state.DataType, false)
+
 		var data *bytes.Buffer
 		headerSeqnum := -1
 		headerSeqnumStr := resp.Header.Get("X-Head-Seqnum")
@@ -1071,19 +1487,33 @@ func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<-
 			LogTrace("%s: fragment %d has unknown MIME type '%s'", state.Name, state.SeqNum, mimeType)
 		}
 
+		var spoolEntry *SpoolEntry
 		if state.ToFile {
-			err = os.WriteFile(fname, respData, di.FileMode)
+			stored := respData
+			err = nil
+			if di.FragCompress {
+				stored, err = di.compressFragment(respData)
+			}
+
+			if err == nil && spool != nil {
+				spoolEntry, err = spool.Append(state.SeqNum, stored)
+			} else if err == nil {
+				err = os.WriteFile(fname, stored, di.FileMode)
+			}
 			if err != nil {
 				LogDebug("%s: Failed to write fragment %d to file: %s", state.Name, state.SeqNum, err)
 				di.PrintStatus()
 
 				state.Tries += 1
-				if !ContinueFragmentDownload(di, state) {
+				if !ContinueFragmentDownload(ctx, di, state) {
 					TryDelete(fname)
 					return
 				}
 
-				time.Sleep(state.SleepTime)
+				if !SleepContext(ctx, state.SleepTime) {
+					TryDelete(fname)
+					return
+				}
 				continue
 			}
 		} else {
@@ -1096,20 +1526,28 @@ func (di *DownloadInfo) downloadFragment(state *fragThreadState, dataChan chan<-
 			isSlow = dlDuration > (time.Duration(float64(di.TargetDuration)*1.5) * time.Second)
 		}
 
+		var produced time.Time
+		if ms, err := strconv.ParseInt(resp.Header.Get("X-Walltime-Ms"), 10, 64); err == nil {
+			produced = time.UnixMilli(ms)
+		}
+
 		dataChan <- &Fragment{
 			Seq:         state.SeqNum,
 			XHeadSeqNum: headerSeqnum,
 			FileName:    fname,
+			Spool:       spoolEntry,
 			Data:        data,
 			Slow:        isSlow,
 			MimeType:    mimeType,
+			Produced:    produced,
+			Downloaded:  ServerNow(),
 		}
 
 		return
 	}
 }
 
-func (di *DownloadInfo) DownloadFrags(dataType string, seqChan <-chan *seqChanInfo, dataChan chan<- *Fragment, name string) {
+func (di *DownloadInfo) DownloadFrags(ctx context.Context, dataType string, seqChan <-chan *seqChanInfo, dataChan chan<- *Fragment, name string) {
 	defer di.DecrementJobs(dataType)
 	state := NewFragThreadState(
 		name,
@@ -1121,7 +1559,7 @@ func (di *DownloadInfo) DownloadFrags(dataType string, seqChan <-chan *seqChanIn
 
 	var endSeq int // End seq to stop on for the --capture-duration option.
 	for seqInfo := range seqChan {
-		if di.IsStopping() || di.IsFinished(dataType) {
+		if ctx.Err() != nil || di.IsFinishing() || di.IsFinished(dataType) {
 			break
 		}
 
@@ -1139,7 +1577,12 @@ func (di *DownloadInfo) DownloadFrags(dataType string, seqChan <-chan *seqChanIn
 			}
 		}
 
-		if seqInfo.MaxSequence > -1 && !di.IsLive() && seqInfo.CurSequence >= seqInfo.MaxSequence {
+		// With --post-live the highest sequence is the last fragment, which is still needed
+		stopSeq := seqInfo.MaxSequence
+		if di.PostLive {
+			stopSeq += 1
+		}
+		if seqInfo.MaxSequence > -1 && !di.IsLive() && seqInfo.CurSequence >= stopSeq {
 			LogDebug("%s: Stream is finished and highest sequence reached", name)
 			di.SetFinished(dataType)
 			break
@@ -1148,16 +1591,26 @@ func (di *DownloadInfo) DownloadFrags(dataType string, seqChan <-chan *seqChanIn
 		state.SeqNum = seqInfo.CurSequence
 		state.MaxSeq = seqInfo.MaxSequence
 
-		di.downloadFragment(state, dataChan)
+		di.WaitWhilePaused(ctx)
+		if ctx.Err() != nil || di.IsFinishing() {
+			break
+		}
+
+		di.downloadFragment(ctx, state, dataChan)
 	}
 
 	LogDebug("%s: exiting", name)
 	di.PrintStatus()
 }
 
-func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan chan<- *ProgressInfo, done chan<- struct{}) {
-	dataChan := make(chan *Fragment, di.Jobs*2)
-	seqChan := make(chan *seqChanInfo, di.Jobs*2)
+func (di *DownloadInfo) DownloadStream(ctx context.Context, dataType, dataFile string, progressChan chan<- *ProgressInfo, done chan<- struct{}) {
+	jobs := di.Jobs
+	maxJobs := di.Jobs
+	if di.BurstJobs > maxJobs {
+		maxJobs = di.BurstJobs
+	}
+	dataChan := make(chan *Fragment, maxJobs*2)
+	seqChan := make(chan *seqChanInfo, maxJobs*2)
 	closed := false
 	curFrag := 0
 	startFrag := 0
@@ -1171,7 +1624,8 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 	dataToWrite := make([]*Fragment, 0, di.Jobs)
 	deletingFrags := make([]string, 0, 1)
 	logName := fmt.Sprintf("%s-download", dataType)
-	var f *os.File
+	var f dataSink
+	var file *os.File
 	var err error
 	defer func() { done <- struct{}{} }()
 
@@ -1192,7 +1646,7 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 			}
 		}
 
-		f, err = os.OpenFile(dataFile, os.O_RDWR, 0666)
+		file, err = os.OpenFile(dataFile, os.O_RDWR, 0666)
 		if err != nil {
 			if !errors.Is(err, os.ErrNotExist) {
 				LogWarn("%s: Failed to open %s to resume download: %s", dataType, dataFile, err)
@@ -1200,19 +1654,19 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 			} else {
 				resumedState = true
 			}
-			f, err = os.Create(dataFile)
+			file, err = os.Create(dataFile)
 		} else {
-			_, err = f.Seek(di.DLState[itag].Size, 0)
+			_, err = file.Seek(di.DLState[itag].Size, 0)
 			if err != nil {
 				LogWarn("%s: Failed to seek %s to resume download: %s", dataType, dataFile, err)
 				LogWarn("%s: Will truncate and start from the beginning", dataType)
-				f, err = os.Create(dataFile)
+				file, err = os.Create(dataFile)
 			} else {
 				resumedState = true
 			}
 		}
 	} else {
-		f, err = os.Create(dataFile)
+		file, err = os.Create(dataFile)
 	}
 
 	if resumedState {
@@ -1256,22 +1710,57 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 		di.Stop()
 		return
 	}
+	f = di.withDataCopy(dataType, dataFile, file)
 	defer f.Close()
 
-	for di.GetActiveJobCount(dataType) < di.Jobs {
+	preallocated := false
+	if di.PreallocateSecs > 0 {
+		offset, _ := f.Seek(0, io.SeekCurrent)
+		size := int64(float64(di.formatBitrate(itag))/8*float64(di.PreallocateSecs)*DiskSpaceHeadroom) - offset
+		if size > 0 {
+			err := preallocateSink(f, offset, size)
+			if err != nil {
+				LogWarn("%s: Failed to preallocate %s: %s", logName, dataFile, err)
+			} else {
+				LogDebug("%s: Preallocated %s for %s", logName, FormatSize(size), dataFile)
+				preallocated = true
+			}
+		}
+	}
+
+	if di.FragFiles && di.FragSpool {
+		spool, err := OpenFragSpool(di.GetBaseFilePath(dataType), di.FileMode)
+		if err != nil {
+			LogWarn("%s: Failed to create the fragment spool, using a file per fragment: %s", logName, err)
+		} else {
+			di.MDLInfo[dataType].Lock()
+			di.MDLInfo[dataType].Spool = spool
+			di.MDLInfo[dataType].Unlock()
+			defer spool.Close()
+		}
+	}
+
+	// More threads while catching up to the live edge, see BurstJobs
+	bursting := di.BurstJobs > jobs && di.IsLive() && !di.PostLive && maxSeqs-curSeq > di.BurstJobs
+	if bursting {
+		LogInfo("%s: %d fragments behind the stream, catching up with %d threads", logName, maxSeqs-curSeq, di.BurstJobs)
+		jobs = di.BurstJobs
+	}
+
+	for di.GetActiveJobCount(dataType) < jobs && (!di.PostLive || curSeq <= maxSeqs) {
 		jobName := fmt.Sprintf("%s%d", dataType, jobNum)
 		di.IncrementJobs(dataType)
 		seqChan <- &seqChanInfo{curSeq, maxSeqs}
 		curSeq += 1
 		activeDownloads += 1
 		jobNum += 1
-		go di.DownloadFrags(dataType, seqChan, dataChan, jobName)
+		go di.DownloadFrags(ctx, dataType, seqChan, dataChan, jobName)
 	}
 
 	for {
 		dataReceived := false
 		downloading := di.GetActiveJobCount(dataType) > 0
-		stopping := di.IsStopping()
+		stopping := ctx.Err() != nil || di.IsFinishing()
 
 		if stopping || !downloading || di.IsFinished(dataType) {
 			if !closed {
@@ -1279,7 +1768,7 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 				closed = true
 			}
 		} else if slowFrags >= 10 {
-			RefreshURL(di, dataType, "")
+			RefreshURL(ctx, di, dataType, "")
 			slowFrags = 0
 		}
 
@@ -1295,12 +1784,52 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 					continue
 				}
 
-				if data.XHeadSeqNum > maxSeqs {
+				// The last fragment of an ended stream is already known
+				if data.XHeadSeqNum > maxSeqs && !di.PostLive {
 					maxSeqs = data.XHeadSeqNum
 				}
 
-				if maxSeqs > 0 {
-					for (curSeq <= maxSeqs+1 && activeDownloads < di.Jobs) || activeDownloads < 1 {
+				// Give up on the fragments in between to get back to the newest one
+				if di.CatchUpFrags > 0 && di.IsLive() && maxSeqs-curFrag > di.CatchUpFrags {
+					LogWarn("%s: %d fragments behind the stream, skipping ahead to sequence %d", logName, maxSeqs-curFrag, maxSeqs)
+					di.PrintStatus()
+
+					di.MDLInfo[dataType].Lock()
+					di.MDLInfo[dataType].Gaps = append(di.MDLInfo[dataType].Gaps, FragmentGap{curFrag, maxSeqs - 1, curFrag - startFrag})
+					di.MDLInfo[dataType].Unlock()
+					di.addDiscontinuity(Discontinuity{
+						Kind:     DiscontinuitySkip,
+						DataType: dataType,
+						Fragment: curFrag - startFrag,
+						Duration: (maxSeqs - curFrag) * di.TargetDuration,
+						StartSeq: curFrag,
+						EndSeq:   maxSeqs - 1,
+					})
+
+					// Keeps startFrag + fragments written pointing at the next one for resuming
+					startFrag += maxSeqs - curFrag
+					curFrag = maxSeqs
+					if curSeq < curFrag {
+						curSeq = curFrag
+					}
+				}
+
+				// The extra threads are left waiting once caught up
+				if bursting && maxSeqs-curSeq <= jobs {
+					LogInfo("%s: Caught up with the stream, going back to %d threads", logName, di.Jobs)
+					di.PrintStatus()
+					bursting = false
+					jobs = di.Jobs
+				}
+
+				if di.PostLive {
+					for curSeq <= maxSeqs && activeDownloads < jobs {
+						seqChan <- &seqChanInfo{curSeq, maxSeqs}
+						curSeq += 1
+						activeDownloads += 1
+					}
+				} else if maxSeqs > 0 {
+					for (curSeq <= maxSeqs+1 && activeDownloads < jobs) || activeDownloads < 1 {
 						seqChan <- &seqChanInfo{curSeq, maxSeqs}
 						curSeq += 1
 						activeDownloads += 1
@@ -1329,7 +1858,7 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 		}
 
 		if (len(dataToWrite) == 0 || !dataReceived) && downloading {
-			if !stopping && activeDownloads <= 0 {
+			if !stopping && activeDownloads <= 0 && (!di.PostLive || curSeq <= maxSeqs) {
 				LogDebug("%s: Somehow no active downloads and no data to write", logName)
 				LogDebug("%s: Fragment this happened at: %d", logName, curFrag)
 				di.PrintStatus()
@@ -1348,13 +1877,28 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 		i := 0
 		for i < len(dataToWrite) && tries > 0 {
 			data := dataToWrite[i]
+			if data.Seq < curFrag {
+				// Skipped over to catch up with the stream
+				data.discard()
+				dataToWrite = append(dataToWrite[:i], dataToWrite[i+1:]...)
+				continue
+			}
+
 			if data.Seq != curFrag {
 				i += 1
 				continue
 			}
 
 			if di.FragFiles {
-				readBytes, err := os.ReadFile(data.FileName)
+				var readBytes []byte
+				if data.Spool != nil {
+					readBytes, err = data.Spool.Read()
+				} else {
+					readBytes, err = os.ReadFile(data.FileName)
+				}
+				if err == nil && di.FragCompress {
+					readBytes, err = decompressFragment(readBytes)
+				}
 
 				if err != nil {
 					tries -= 1
@@ -1372,8 +1916,15 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 				data.Data = bytes.NewBuffer(readBytes)
 			}
 
+			// Reading from the buffer leaves what it holds intact
+			rawData := data.Data.Bytes()
 			bytesWritten := 0
+			fragOffset, _ := f.Seek(0, io.SeekCurrent)
 			buf := make([]byte, BufferSize)
+			var fragBuf *bytes.Buffer
+			if di.HasStreamOutput(dataType) || di.FragmentFunc != nil {
+				fragBuf = &bytes.Buffer{}
+			}
 
 			rc, _ := data.Data.Read(buf)
 
@@ -1391,6 +1942,9 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 
 			count, err := f.Write(writeBuf)
 			bytesWritten += count
+			if fragBuf != nil {
+				fragBuf.Write(writeBuf[:count])
+			}
 
 			if err != nil {
 				tries -= 1
@@ -1417,6 +1971,9 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 
 				count, err = f.Write(buf[:count])
 				bytesWritten += count
+				if fragBuf != nil {
+					fragBuf.Write(buf[:count])
+				}
 
 				if err != nil {
 					tries -= 1
@@ -1439,10 +1996,32 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 				continue
 			}
 
+			if fragBuf != nil {
+				di.writeStreamOutput(dataType, fragBuf.Bytes())
+			}
+			if di.FragmentFunc != nil {
+				di.FragmentFunc(dataType, curFrag, fragOffset, fragBuf.Bytes())
+			}
+			if di.RawFragmentFunc != nil {
+				di.RawFragmentFunc(dataType, curFrag, rawData)
+			}
+
 			curFrag += 1
+			di.MDLInfo[dataType].Lock()
+			written := di.MDLInfo[dataType].Written
+			di.MDLInfo[dataType].Written += 1
+			di.MDLInfo[dataType].Unlock()
+			di.FragTimes.Add(dataType, data.Seq, written*di.TargetDuration, data.Produced, data.Downloaded)
 			progressChan <- &ProgressInfo{itag, bytesWritten, maxSeqs, startFrag}
 
-			if di.FragFiles {
+			// Every fragment of the ended stream is written
+			if di.PostLive && curFrag > maxSeqs {
+				di.SetFinished(dataType)
+			}
+
+			if data.Spool != nil {
+				data.Spool.Release()
+			} else if di.FragFiles {
 				err = os.Remove(data.FileName)
 				if err != nil {
 					LogWarn("%s: Error deleting fragment %d: %s", logName, data.Seq, err)
@@ -1463,7 +2042,7 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 
 		updateDelta := di.GetTimeSinceUpdated()
 		if !stopping && !di.IsUnavailable() && updateDelta > time.Hour {
-			di.GetVideoInfo()
+			di.GetVideoInfo(ctx)
 		}
 
 		if tries <= 0 {
@@ -1473,9 +2052,25 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 		}
 	}
 
+	// Give back the space reserved past what was written
+	if preallocated {
+		if offset, err := f.Seek(0, io.SeekCurrent); err == nil {
+			f.Truncate(offset)
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		LogWarn("%s: Error flushing %s: %s", logName, dataFile, err)
+	}
+
+	if len(dataToWrite) > 0 {
+		LogDebug("%s: %d fragment(s) after sequence %d could not be written", logName, len(dataToWrite), curFrag)
+	}
+
 	if di.FragFiles {
 		for _, d := range dataToWrite {
-			TryDelete(d.FileName)
+			d.discard()
 		}
 	}
 
@@ -1484,6 +2079,10 @@ func (di *DownloadInfo) DownloadStream(dataType, dataFile string, progressChan c
 		TryDelete(d)
 	}
 
+	if di.FragFiles && di.FragShard {
+		removeFragShards(di.GetBaseFilePath(dataType))
+	}
+
 	LogDebug("%s thread closing", logName)
 	di.PrintStatus()
 }
@@ -0,0 +1,214 @@
+package ytarchive
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment variable giving the default archive database location
+const ArchiveDBEnv = "YTARCHIVE_ARCHIVE_DB"
+
+// Formats for WriteArchiveRecords
+const (
+	ExportCSV   = "csv"
+	ExportJSONL = "jsonl"
+)
+
+/*
+What was captured of a single stream. The archive database is a file with
+one of these per line as JSON, appended to after each finished capture.
+*/
+type ArchiveRecord struct {
+	VideoID      string   `json:"id"`
+	Title        string   `json:"title"`
+	Channel      string   `json:"channel"`
+	ChannelID    string   `json:"channel_id"`
+	URL          string   `json:"url"`
+	StartDate    string   `json:"start_date"`
+	StartedAt    string   `json:"started_at"`
+	CapturedAt   string   `json:"captured_at"`
+	Itag         int      `json:"itag"`
+	DurationSecs int      `json:"duration"`
+	Fragments    int      `json:"fragments"`
+	Bytes        int64    `json:"bytes"`
+	Files        []string `json:"files"`
+	// Copies of the files left in place after storing them elsewhere
+	LocalFiles []string `json:"local_files,omitempty"`
+}
+
+var archiveCSVHeader = []string{
+	"id", "title", "channel", "channel_id", "url", "start_date", "started_at",
+	"captured_at", "itag", "duration", "fragments", "bytes", "files",
+}
+
+// Append a record to the archive database, creating it if needed
+func AppendArchiveRecord(dbFile string, rec *ArchiveRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(dbFile)
+	if dir != "." {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(dbFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	// A single write keeps lines whole if several captures finish at once
+	_, err = f.Write(append(data, '\n'))
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Read every record in the archive database, skipping lines that are not valid
+func ReadArchiveDB(dbFile string) ([]*ArchiveRecord, error) {
+	f, err := os.Open(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*ArchiveRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := &ArchiveRecord{}
+		err = json.Unmarshal([]byte(line), rec)
+		if err != nil {
+			LogWarn("Skipping invalid archive database line %d: %s", lineNum, err)
+			continue
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+// Write records as CSV with a header row, or as JSON lines
+func WriteArchiveRecords(w io.Writer, format string, records []*ArchiveRecord) error {
+	switch format {
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			err := enc.Encode(rec)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(archiveCSVHeader)
+		for _, rec := range records {
+			cw.Write([]string{
+				rec.VideoID,
+				rec.Title,
+				rec.Channel,
+				rec.ChannelID,
+				rec.URL,
+				rec.StartDate,
+				rec.StartedAt,
+				rec.CapturedAt,
+				strconv.Itoa(rec.Itag),
+				strconv.Itoa(rec.DurationSecs),
+				strconv.Itoa(rec.Fragments),
+				strconv.FormatInt(rec.Bytes, 10),
+				strings.Join(rec.Files, ";"),
+			})
+		}
+
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown export format %s, use csv or jsonl", format)
+}
+
+/*
+What to look for in the archive database. Text matches any of the title,
+channel, or video ID. Matching is case insensitive, and empty fields match
+everything. From and To are inclusive YYYYMMDD or YYYY-MM-DD start dates.
+*/
+type ArchiveQuery struct {
+	Text    string
+	Title   string
+	Channel string
+	VideoID string
+	From    string
+	To      string
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func (q *ArchiveQuery) Matches(rec *ArchiveRecord) bool {
+	if len(q.Text) > 0 && !containsFold(rec.Title, q.Text) && !containsFold(rec.Channel, q.Text) && !containsFold(rec.VideoID, q.Text) {
+		return false
+	}
+	if len(q.Title) > 0 && !containsFold(rec.Title, q.Title) {
+		return false
+	}
+	if len(q.Channel) > 0 && !containsFold(rec.Channel, q.Channel) && rec.ChannelID != q.Channel {
+		return false
+	}
+	if len(q.VideoID) > 0 && rec.VideoID != q.VideoID {
+		return false
+	}
+
+	date := rec.StartDate
+	if len(date) == 0 && len(rec.CapturedAt) >= 10 {
+		date = strings.ReplaceAll(rec.CapturedAt[:10], "-", "")
+	}
+
+	from := strings.ReplaceAll(q.From, "-", "")
+	to := strings.ReplaceAll(q.To, "-", "")
+	if len(from) > 0 && date < from {
+		return false
+	}
+	if len(to) > 0 && (len(date) == 0 || date > to) {
+		return false
+	}
+
+	return true
+}
+
+// Get the records matching the query, in the order they were captured
+func SearchArchive(records []*ArchiveRecord, q *ArchiveQuery) []*ArchiveRecord {
+	var matches []*ArchiveRecord
+	for _, rec := range records {
+		if q.Matches(rec) {
+			matches = append(matches, rec)
+		}
+	}
+
+	return matches
+}
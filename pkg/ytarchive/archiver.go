@@ -0,0 +1,2692 @@
+package ytarchive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alessio/shellescape"
+)
+
+// Action enum
+const (
+	ActionAsk = iota
+	ActionDo
+	ActionDoNot
+)
+
+/*
+Options for an Archiver. Mirrors the command line options of ytarchive.
+Use NewOptions to get the same defaults the command line uses.
+*/
+type Options struct {
+	// Livestream, channel, or googlevideo URL. Prompted for if empty.
+	URL string
+	// Several streams to archive at once in place of URL, each with a job
+	// of its own sharing the Threads
+	URLs []string
+	// File listing streams to archive after URL, one after another, or all
+	// at once like URLs with BatchConcurrent. See ReadBatchFile
+	BatchFile       string
+	BatchConcurrent bool
+	// Slash-delimited list of qualities, e.g. "1080p60/best". Prompted for if empty.
+	Quality string
+	// googlevideo URLs for the audio and video fragments
+	AudioURL string
+	VideoURL string
+
+	CookieFile      string
+	OutputFormat    string
+	TempDir         string
+	FFmpegPath      string
+	LiveFrom        string
+	StartDelay      string
+	CaptureDuration string
+	PoToken         string
+	Proxy           *url.URL
+	Network         string
+	Metadata        map[string]string
+
+	// Proxies to fail over to in order when Proxy keeps failing to connect,
+	// see ProxyChain
+	ProxyFallbacks []*url.URL
+	// Ignore HTTP_PROXY, HTTPS_PROXY and NO_PROXY, which are used otherwise
+	// when no Proxy is set
+	IgnoreEnvProxy bool
+
+	// Where CookieFile and PoToken are read from when they are SecretPrefix
+	// followed by the name of a secret
+	Secrets SecretStore
+
+	// Proxy for the fragment downloads from googlevideo instead of Proxy,
+	// so the video does not have to go through the same exit as the API
+	// calls. With NoMediaProxy, fragments are downloaded without a proxy.
+	MediaProxy   *url.URL
+	NoMediaProxy bool
+
+	// Download fragments over HTTP/3, see HTTP3Transport. Experimental, and
+	// only for programs using ytarchive as a library that provide QUIC.
+	HTTP3 bool
+
+	// Write the streams muxed into matroska here as they download, instead
+	// of muxing a final file. OutputFormat is still used for temporary files.
+	StreamOutput io.Writer
+
+	// Also push the streams to this RTMP or SRT URL as they download
+	RestreamURL string
+
+	// Also interleave the streams into a single mp4 or ts file next to the
+	// final files as they download, which is deleted once the final mux works
+	LiveOutput string
+
+	// Serve the downloaded fragments as HLS on this address while archiving
+	ServeAddr string
+
+	// Record the HTTP traffic into a WARC file next to the final files
+	WARC bool
+
+	// Record every request and response into this HAR file, for debugging
+	DebugHAR string
+
+	// Save the raw watch page and player responses next to the final files
+	WriteSource bool
+
+	// Write a manifest of fragment hashes next to the final files, signed
+	// with the Ed25519 private key in ManifestKey if set
+	HashManifest bool
+	ManifestKey  string
+
+	// RFC 3161 timestamp authority to get a token over the final files from
+	TimestampURL string
+
+	// Pack the raw fragments into a tar or zip file next to the final files
+	KeepFrags string
+
+	// Save a JPEG frame from the video this often, e.g. 10m
+	SnapshotInterval string
+
+	// Generate a storyboard sprite sheet and WebVTT track after muxing
+	WriteStoryboard bool
+
+	// Write every skip, format change, sleep, and network change during the
+	// download to a JSON file next to the final file, see Discontinuity
+	WriteDiscontinuities bool
+
+	// Record the UTC time every fragment was produced and downloaded to a CSV
+	// file next to the final file, see FragTimeLog
+	WriteFragmentTimes bool
+
+	// Save the live chat to a JSON lines file next to the final file while a
+	// live stream downloads, see CaptureLiveChat
+	WriteLiveChat bool
+
+	// Add a subtitle track showing the wall-clock time to the final file,
+	// soft or burned into the video, in TimestampZone. See WriteTimestampTrack
+	TimestampTrack string
+	TimestampZone  string
+
+	// Print the stream's formats with their measured bitrates instead of
+	// downloading
+	ListFormats bool
+
+	// How long the download is expected to last, e.g. 3h, for checking that
+	// it fits on disk. With FitToDisk, lower qualities are picked until one
+	// does instead of only warning.
+	ExpectedDuration string
+	FitToDisk        bool
+
+	// Reserve the disk space for the expected duration of the download in
+	// the data files up front, so they are less fragmented
+	Preallocate bool
+
+	// Stop downloading once the audio and video together reach this many
+	// bytes, and mux what was downloaded as usual
+	MaxFileSize int64
+
+	// Also write the data files to this directory while downloading, such as
+	// one on another disk, to carry on from if the first copy fails. The
+	// copies are deleted once the final file is muxed. See RedundantFile
+	CopyDir string
+
+	// Print the estimated size of the final file for every quality before
+	// downloading, and give up if the selected one's is over MaxEstimatedSize
+	EstimateSize     bool
+	MaxEstimatedSize int64
+
+	// Run this program when a live download starts falling behind the
+	// stream and when it catches up, see ThroughputMonitor
+	BehindCommand string
+
+	// Listen for status and stop requests on this unix socket, see
+	// ControlServer
+	ControlSocket string
+
+	// Append a record of each finished capture to this file, see ArchiveRecord
+	ArchiveDB string
+
+	// When monitoring a channel, start a job waiting for every stream live or
+	// scheduled on its streams tab, instead of following only /live
+	MonitorScheduled bool
+	// Bytes the jobs of MonitorScheduled may download between them, see
+	// diskBudget. 0 for no limit.
+	DiskBudget int64
+
+	// Regular expressions the titles and descriptions of streams must match
+	// and must not match, the categories and languages they must be in, and
+	// bounds on how long they run, to be archived. See StreamFilter
+	MatchTitle        string
+	RejectTitle       string
+	MatchDescription  string
+	RejectDescription string
+	MatchCategories   []string
+	MatchLanguages    []string
+	MinDuration       time.Duration
+	MaxDuration       time.Duration
+	// JSON file of the above for each channel ID, see streamFilterSpec
+	ChannelFilters string
+
+	// Also archive the other feeds of a multiview broadcast in parallel.
+	// View is the value of the view format field, set for the other feeds.
+	Multiview bool
+	View      string
+
+	// Keep the queue of streams to download in this file, see Queue. URL is
+	// added to it unless monitoring a channel, and a download left unfinished
+	// by a stop is kept resumable and picked up again on the next run.
+	QueueFile string
+	// Priority of the streams this adds to the queue, higher goes first. Jobs
+	// with a lower priority are paused first when DiskBudget runs out.
+	Priority int
+
+	// Where to put the final files, see OpenStorage. Overridden by Storage.
+	// StorageDir is an output format for the directory to store them under.
+	StorageURL         string
+	StorageDir         string
+	Storage            Storage
+	StorageDeleteLocal bool
+
+	// Limits on the local copies of stored files, applied using ArchiveDB
+	// after each capture instead of deleting them with StorageDeleteLocal
+	Retention RetentionPolicy
+
+	// Sends all requests instead of a client using Proxy. Cookies from
+	// CookieFile are only used for authorization headers in that case.
+	Client HttpClient
+
+	// Skip ahead to the newest fragment when a live download falls this many
+	// fragments behind, for when being current matters more than being complete
+	CatchUpFrags int
+
+	// Download a stream that already ended, finding its last fragment up
+	// front and using at least PostLiveThreads threads, see preparePostLive
+	PostLive bool
+
+	// Name of the files fragments wait in, see DefaultFragNameFormat, and
+	// whether to spread them over a subdirectory per FragShardSize fragments
+	FragNameFormat string
+	FragShard      bool
+
+	// Append fragments to a spool file per data type instead of writing a
+	// file for each, see FragSpool
+	FragSpool bool
+
+	// Compress fragments while they wait on disk, see FragCompressStats
+	FragCompress bool
+
+	// Bytes per second each download may read fragments at, and all of them
+	// together, shared evenly through RateGroup. 0 for no limit. Set
+	// RateGroup to share one cap between several archivers.
+	RateLimit       int64
+	GlobalRateLimit int64
+	RateGroup       *RateGroup
+
+	Threads      uint
+	BurstThreads uint // Threads while catching up to a live stream's newest fragment
+	FragMaxTries uint
+	RetrySecs    int
+	FileMode     os.FileMode
+	DirMode      os.FileMode
+
+	// Action enum values deciding what to do instead of prompting
+	Wait              int
+	MergeOnCancel     int
+	SaveFilesOnCancel int
+	SaveStateOnCancel int
+
+	Thumbnail        bool
+	AddMetadata      bool
+	WriteDescription bool
+	WriteInfoJSON    bool
+	WriteThumbnail   bool
+	WriteMuxFile     bool
+	NoFragFiles      bool
+	AudioOnly        bool
+	VideoOnly        bool
+	MKV              bool
+	AttachFiles      bool
+	NormalizeAudio   bool
+	FillGaps         bool
+	AtomicMove       bool
+	KeepTSFiles      bool
+	SeparateAudio    bool
+	MonitorChannel   bool
+	VP9              bool
+	AV1              bool
+	H264             bool
+	MembersOnly      bool
+	NoUpdateCookies  bool
+	DisableSaveState bool
+	LookalikeChars   bool
+	StatusNewlines   bool
+
+	// With no URL, resume the downloads that left checkpoints in TempDir,
+	// see Checkpoint
+	Resume bool
+
+	// Mux mp4 files with MuxMP4 rather than ffmpeg, which is also done when
+	// ffmpeg can not be found. Other containers are still muxed with ffmpeg.
+	NativeMux bool
+
+	// Container for the final file, mp4, mkv, webm, or ts. Overrides MKV
+	MergeFormat string
+
+	// Functions to call as the archive progresses
+	Callbacks Callbacks
+
+	// Where to write progress as JSON lines instead of printing the status
+	// line, nil to print it. Shared by the jobs of the archiver.
+	ProgressJSON *ProgressJSONWriter
+
+	// URLs to POST lifecycle events to, and which events to send, see
+	// WebhookEvents. No events means all of them.
+	Webhooks      []string
+	WebhookEvents []string
+
+	// Stop on SIGINT/SIGTERM and pause on SIGUSR1, like the command line does.
+	// Library users will usually want to call Stop, Pause, and Resume instead.
+	HandleSignals bool
+}
+
+// Exit codes for streams that could not be accessed
+const (
+	// Members-only, and the cookies do not give access to it
+	RetcodeMembersOnly = 3
+	// Not available in the country the requests come from
+	RetcodeRegionLocked = 4
+	// Left out by the StreamFilter
+	RetcodeFiltered = 5
+)
+
+/*
+Outcome of an archive run
+*/
+type Result struct {
+	// 0 on success, 1 on error, 2 if stopped without merging, RetcodeMembersOnly
+	// or RetcodeRegionLocked if the stream could not be accessed,
+	// RetcodeFiltered if it was not wanted, otherwise the ffmpeg exit code
+	Retcode   int
+	Cancelled bool
+	FinalFile string
+	AudioFile string
+}
+
+/*
+Archives a single livestream, or each stream on a channel when monitoring.
+*/
+type Archiver struct {
+	sync.Mutex
+	Options *Options
+
+	info          *DownloadInfo
+	result        *Result
+	queue         *Queue
+	queueItem     *QueueItem
+	views         []*Archiver
+	har           *HARRecorder
+	cancelled     bool
+	videoStopped  bool
+	stopRequested bool
+	stopChan      chan os.Signal
+	pauseChan     chan os.Signal
+	done          chan struct{}
+	// Webhooks still being sent
+	webhooks sync.WaitGroup
+}
+
+func NewOptions() *Options {
+	return &Options{
+		OutputFormat:      DefaultFilenameFormat,
+		FFmpegPath:        "ffmpeg",
+		Network:           NetworkBoth,
+		Metadata:          make(map[string]string),
+		Threads:           1,
+		FragMaxTries:      10,
+		FileMode:          0644,
+		DirMode:           0755,
+		Wait:              ActionAsk,
+		MergeOnCancel:     ActionAsk,
+		SaveFilesOnCancel: ActionAsk,
+		SaveStateOnCancel: ActionAsk,
+	}
+}
+
+func NewArchiver(opts *Options) *Archiver {
+	return &Archiver{
+		Options:   opts,
+		result:    &Result{},
+		stopChan:  make(chan os.Signal, 1),
+		pauseChan: make(chan os.Signal, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+func (a *Archiver) setInfo(di *DownloadInfo) {
+	a.Lock()
+	defer a.Unlock()
+	a.info = di
+}
+
+// Information about the stream currently being archived, or nil if not started
+func (a *Archiver) Info() *DownloadInfo {
+	a.Lock()
+	defer a.Unlock()
+	return a.info
+}
+
+func (a *Archiver) isStopRequested() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.stopRequested
+}
+
+/*
+Stop the download as if the process received the given signal.
+os.Interrupt prompts for what to do with the downloaded data unless the
+relevant options are set, anything else finishes without prompting.
+*/
+func (a *Archiver) Signal(sig os.Signal) {
+	a.Lock()
+	a.stopRequested = true
+	a.Unlock()
+
+	for _, view := range a.getViews() {
+		view.Signal(sig)
+	}
+
+	// Nothing to finish before the download starts, so stop right away
+	if di := a.Info(); di != nil && di.GetState() < StateDownloading {
+		di.Stop()
+	}
+
+	select {
+	case a.stopChan <- sig:
+	default:
+	}
+}
+
+// Finish the fragments in progress, then stop and mux what was downloaded
+func (a *Archiver) Stop() {
+	a.Signal(syscall.SIGTERM)
+}
+
+/*
+Stop only the download of the given video, like Stop, leaving the other
+views and scheduled jobs running. A monitored channel goes back to waiting
+for its next stream and a queue moves on to its next item. Returns false if
+no running download has that video ID.
+*/
+func (a *Archiver) StopVideo(videoID string) bool {
+	for _, view := range a.getViews() {
+		if view.StopVideo(videoID) {
+			return true
+		}
+	}
+
+	di := a.Info()
+	if di == nil || di.VideoID != videoID || di.GetState() >= StateMuxing {
+		return false
+	}
+
+	LogInfo("Stopping the download of %s", videoID)
+	a.Lock()
+	a.videoStopped = true
+	a.Unlock()
+
+	if di.GetState() < StateDownloading {
+		di.Stop()
+		return true
+	}
+
+	select {
+	case a.stopChan <- syscall.SIGTERM:
+	default:
+	}
+
+	return true
+}
+
+// Whether a stop request is still waiting to be picked up by a download
+func (a *Archiver) StopPending() bool {
+	return len(a.stopChan) > 0
+}
+
+func (a *Archiver) Pause() {
+	if di := a.Info(); di != nil {
+		di.Pause()
+	}
+
+	for _, view := range a.getViews() {
+		view.Pause()
+	}
+}
+
+func (a *Archiver) Resume() {
+	if di := a.Info(); di != nil {
+		di.Resume()
+	}
+
+	for _, view := range a.getViews() {
+		view.Resume()
+	}
+}
+
+/*
+Run the archiver in the background.
+Use Wait to get the result once it is done.
+*/
+func (a *Archiver) Start() {
+	go func() {
+		a.Run()
+		close(a.done)
+	}()
+}
+
+// Wait for an archiver started with Start to finish
+func (a *Archiver) Wait() *Result {
+	<-a.done
+	return a.result
+}
+
+/*
+Archive the stream, blocking until done. When monitoring a channel, keeps
+going back to waiting for the next stream until stopped.
+*/
+func (a *Archiver) Run() *Result {
+	lastExitTime := time.Now()
+	defer a.webhooks.Wait()
+
+	// Made before any views or jobs copy the options, so they all share it
+	if a.Options.GlobalRateLimit > 0 && a.Options.RateGroup == nil {
+		a.Options.RateGroup = NewRateGroup(a.Options.GlobalRateLimit)
+	}
+
+	if len(a.Options.ControlSocket) > 0 {
+		control, err := StartControlServer(a.Options.ControlSocket, a)
+		if err != nil {
+			LogWarn("Not listening on the control socket: %s", err)
+		} else {
+			LogInfo("Listening for control requests on %s", a.Options.ControlSocket)
+			defer control.Close()
+		}
+	}
+
+	// Other views and scheduled jobs share the HAR file of this archiver
+	if len(a.Options.DebugHAR) > 0 && a.har == nil {
+		har, err := NewHARRecorder(a.Options.DebugHAR, a.Options.FileMode)
+		if err != nil {
+			a.result = &Result{Retcode: a.fail("Failed to create the HAR file: %s", err)}
+			return a.result
+		}
+
+		a.har = har
+		defer func() {
+			err := har.Close()
+			if err != nil {
+				LogWarn("Error closing the HAR file: %s", err)
+			}
+			LogGeneral("HAR file: %s", a.Options.DebugHAR)
+		}()
+	}
+
+	if a.Options.Resume && len(a.Options.URL) == 0 {
+		a.result = &Result{}
+		a.result.Retcode = a.runCheckpoints()
+		return a.result
+	}
+
+	var batch []string
+	if len(a.Options.BatchFile) > 0 {
+		urls, err := ReadBatchFile(a.Options.BatchFile)
+		if err != nil {
+			a.result = &Result{Retcode: a.fail("Failed to read the batch file: %s", err)}
+			return a.result
+		}
+		LogInfo("Read %d URLs from %s", len(urls), a.Options.BatchFile)
+
+		if a.Options.BatchConcurrent {
+			if len(a.Options.URLs) == 0 && len(a.Options.URL) > 0 {
+				a.Options.URLs = []string{a.Options.URL}
+			}
+			a.Options.URLs = append(a.Options.URLs, urls...)
+			if len(a.Options.URLs) == 1 {
+				a.Options.URL = a.Options.URLs[0]
+			}
+		} else {
+			batch = urls
+		}
+	}
+
+	if a.Options.MonitorChannel {
+		channels := MonitorURLs(a.Options.URL)
+		if len(channels) > 1 {
+			a.result = &Result{}
+			a.result.Retcode = a.runChannels(channels)
+			return a.result
+		}
+		if len(channels) == 1 {
+			a.Options.URL = channels[0]
+		}
+	} else if len(a.Options.URLs) > 1 {
+		a.result = &Result{}
+		a.result.Retcode = a.runURLs(a.Options.URLs)
+		return a.result
+	} else {
+		a.Options.URL = ExpandChannelURL(a.Options.URL)
+	}
+
+	if len(a.Options.QueueFile) > 0 {
+		err := a.loadQueue()
+		if err != nil {
+			a.result = &Result{Retcode: a.fail("Failed to load the queue: %s", err)}
+			return a.result
+		}
+	}
+
+	if IsPlaylistUrl(a.Options.URL) {
+		err := a.enqueuePlaylist()
+		if err != nil {
+			a.result = &Result{Retcode: a.fail("%s", err)}
+			return a.result
+		}
+	}
+
+	if len(a.Options.BatchFile) > 0 && !a.Options.BatchConcurrent {
+		err := a.enqueueBatch(batch)
+		if err != nil {
+			a.result = &Result{Retcode: a.fail("%s", err)}
+			return a.result
+		}
+	}
+
+	if a.Options.MonitorChannel && a.Options.MonitorScheduled {
+		a.result = &Result{}
+		a.result.Retcode = a.runScheduled()
+		return a.result
+	}
+
+	for {
+		a.queueItem = nil
+		if a.queue != nil {
+			a.queueItem = a.queue.Next()
+		}
+
+		a.cancelled = false
+		a.result = &Result{}
+		a.result.Retcode = a.run()
+		a.result.Cancelled = a.cancelled
+
+		// Only the one download was stopped if StopVideo asked for it
+		a.Lock()
+		videoStopped := a.videoStopped
+		a.videoStopped = false
+		a.Unlock()
+
+		stopped := (a.cancelled && !videoStopped) || a.isStopRequested()
+		if a.queue != nil {
+			a.queue.Finish(stopped || a.result.Retcode == 2, a.result.Retcode == 1 && !stopped)
+		}
+
+		if stopped {
+			break
+		}
+
+		// Work through the queue before going back to the channel
+		if a.queue != nil && a.queue.Len() > 0 {
+			continue
+		}
+
+		if !a.Options.MonitorChannel || (a.queueItem == nil && !a.Info().LiveURL) {
+			break
+		}
+
+		retrySecs := a.Info().RetrySecs
+		if time.Since(lastExitTime) < (time.Duration(retrySecs) * time.Second) {
+			LogDebug("Last run exited before the set wait time. Waiting before running again...")
+			time.Sleep(time.Duration(JitterSecs(retrySecs)) * time.Second)
+		}
+		lastExitTime = time.Now()
+	}
+
+	return a.result
+}
+
+/*
+Run the archiver, stopping it like Stop once ctx is done. What was already
+downloaded is still muxed according to the options, so the result comes
+after the mux rather than right when ctx is done.
+*/
+func (a *Archiver) RunContext(ctx context.Context) *Result {
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Stop()
+		case <-finished:
+		}
+	}()
+
+	return a.Run()
+}
+
+/*
+The entry point for programs embedding ytarchive, an Archiver whose Run
+takes a context and stops the download like Stop once it is done. The
+Archiver's other methods, such as Pause and Downloads, work the same.
+*/
+type Downloader struct {
+	*Archiver
+}
+
+func NewDownloader(opts *Options) *Downloader {
+	return &Downloader{Archiver: NewArchiver(opts)}
+}
+
+// Archive the stream, blocking until done, see RunContext
+func (d *Downloader) Run(ctx context.Context) *Result {
+	return d.RunContext(ctx)
+}
+
+/*
+Load the queue file, adding the given URL to it unless monitoring a channel
+or downloading a playlist.
+*/
+func (a *Archiver) loadQueue() error {
+	queue, err := LoadQueue(a.Options.QueueFile, a.Options.FileMode)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.queue = queue
+	a.Unlock()
+
+	if !a.Options.MonitorChannel && len(a.Options.URL) > 0 && !IsPlaylistUrl(a.Options.URL) {
+		err = queue.AddWithPriority(a.Options.URL, a.Options.Quality, a.Options.Priority)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n := queue.Len(); n > 0 {
+		LogInfo("Loaded %d queued streams from %s", n, a.Options.QueueFile)
+	}
+
+	return nil
+}
+
+/*
+Queue up every live and upcoming stream in the playlist given as the URL,
+keeping the queue in memory if there is no queue file.
+*/
+func (a *Archiver) enqueuePlaylist() error {
+	o := a.Options
+	if o.MonitorChannel {
+		return errors.New("playlists cannot be monitored, use a channel URL with --monitor-channel")
+	}
+
+	di := NewDownloadInfo()
+	httpClient, _ := o.newHttpClient()
+	di.Client = httpClient
+	if o.Client != nil {
+		di.Client = o.Client
+	}
+	di.Secrets = o.Secrets
+
+	if len(o.CookieFile) > 0 {
+		cjar, err := di.ParseNetscapeCookiesFile(o.CookieFile)
+		if err != nil {
+			return fmt.Errorf("failed to load cookies file: %w", err)
+		}
+		httpClient.Jar = cjar
+	}
+
+	// Upcoming streams are what playlists are queued for
+	if o.Wait == ActionAsk {
+		o.Wait = ActionDo
+	}
+
+	streams, err := GetPlaylistStreams(context.Background(), di.HttpClient(), o.URL)
+	if err != nil {
+		return fmt.Errorf("failed to get the playlist: %w", err)
+	}
+
+	if a.queue == nil {
+		queue, _ := LoadQueue("", o.FileMode)
+		a.Lock()
+		a.queue = queue
+		a.Unlock()
+	}
+
+	for _, stream := range streams {
+		err = a.queue.AddWithPriority(stream.URL, o.Quality, o.Priority)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.queue.Len() == 0 {
+		return errors.New("no live or upcoming streams found in the playlist")
+	}
+
+	LogGeneral("Found %d live or upcoming streams in the playlist", len(streams))
+	return nil
+}
+
+/*
+Add a stream to the queue of a running archiver, to be downloaded once it
+is done with the current one. Only works with Options.QueueFile set or
+when downloading a playlist.
+*/
+func (a *Archiver) Enqueue(url, quality string) error {
+	return a.EnqueueWithPriority(url, quality, 0)
+}
+
+// Like Enqueue, with streams of a higher priority downloaded first
+func (a *Archiver) EnqueueWithPriority(url, quality string, priority int) error {
+	a.Lock()
+	queue := a.queue
+	a.Unlock()
+
+	if queue == nil {
+		return errors.New("no queue file set")
+	}
+
+	return queue.AddWithPriority(url, quality, priority)
+}
+
+// Log an error and pass it on to the error callback
+func (a *Archiver) fail(format string, args ...interface{}) int {
+	LogError(format, args...)
+	a.reportError(fmt.Errorf(format, args...))
+	return 1
+}
+
+/*
+Close the WARC file and move it next to the final files. If the download
+never got far enough to know where those go, it is left where it is.
+*/
+func (a *Archiver) finishWARC(warc *WARCWriter, finalFile string) {
+	err := warc.Close()
+	if err != nil {
+		LogWarn("Error closing the WARC file: %s", err)
+	}
+
+	if len(finalFile) == 0 || TryMove(warc.Name(), finalFile) != nil {
+		LogGeneral("WARC file: %s", warc.Name())
+		return
+	}
+
+	LogGeneral("WARC file: %s", finalFile)
+}
+
+func (a *Archiver) reportError(err error) {
+	if a.Options.Callbacks.Error != nil {
+		a.Options.Callbacks.Error(err)
+	}
+	a.notify(a.Info(), WebhookError, nil, err)
+}
+
+/*
+Warn about a live download falling behind the stream, or catching back up,
+and pass it on to the callback and BehindCommand.
+*/
+func (a *Archiver) reportBehind(info *DownloadInfo, behind *BehindInfo) {
+	o := a.Options
+	fmt.Fprintln(os.Stderr)
+	if behind.Behind {
+		LogWarn("The download is %s behind the stream and falling further behind.", SecondsToDurationStr(behind.LagSecs))
+		LogWarn("Downloading at %s/s while the stream needs %s/s. Try more --threads or a lower quality.",
+			FormatSize(int64(behind.BytesPerSec)), FormatSize(int64(behind.BitrateNeeded)))
+	} else {
+		LogGeneral("The download has caught back up with the stream")
+	}
+	info.PrintStatus()
+
+	if o.Callbacks.Behind != nil {
+		o.Callbacks.Behind(behind)
+	}
+
+	if len(o.BehindCommand) > 0 {
+		go runBehindCommand(o.BehindCommand, info.VideoID, behind)
+	}
+}
+
+/*
+Check if the download is at its maximum size, counting the fragments that
+are likely still downloading at the average fragment size so that they do
+not push it over.
+*/
+func (a *Archiver) reachedMaxFileSize(info *DownloadInfo, activeDownloads int) bool {
+	var size int64
+	frags := 0
+	for _, state := range info.DLState {
+		size += state.Size
+		frags += state.Fragments
+	}
+	if frags == 0 {
+		return false
+	}
+
+	inFlight := size / int64(frags) * int64(info.Jobs*activeDownloads)
+	return size+inFlight >= a.Options.MaxFileSize
+}
+
+/*
+Sidecar files to attach to an mkv mux, so the one file holds everything
+written for the download. An embedded thumbnail is already attached.
+*/
+func (a *Archiver) attachmentFiles(source *SourceWriter, descFile, thumbnail string, thumbnailEmbedded bool) []string {
+	var files []string
+	if Exists(descFile) {
+		files = append(files, descFile)
+	}
+	if !thumbnailEmbedded && Exists(thumbnail) {
+		files = append(files, thumbnail)
+	}
+	if source != nil {
+		files = append(files, source.Files()...)
+	}
+
+	return files
+}
+
+/*
+Move finished files out of the temp directory, as pairs of source and
+destination. The sidecar files go first so the outputs showing up means
+everything is there, and the outputs are moved atomically.
+*/
+func publishFiles(sidecars, outputs [][2]string) error {
+	for _, move := range sidecars {
+		if err := TryMove(move[0], move[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, move := range outputs {
+		if err := AtomicMove(move[0], move[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Archiver) run() int {
+	o := a.Options
+	info := NewDownloadInfo()
+	ctx := info.WithCancel(context.Background())
+	defer info.cancel()
+	info.StatusFunc = o.Callbacks.Status
+	info.StateFunc = o.Callbacks.State
+	if o.ProgressJSON != nil {
+		info.withProgressJSON(o.ProgressJSON)
+	}
+	if a.wantsWebhook(WebhookWaiting) {
+		stateFunc := info.StateFunc
+		info.StateFunc = func(state int) {
+			if state == StateWaiting {
+				a.notify(info, WebhookWaiting, nil, nil)
+			}
+			if stateFunc != nil {
+				stateFunc(state)
+			}
+		}
+	}
+	var source *SourceWriter
+	if o.WriteSource {
+		source = NewSourceWriter(o.FileMode)
+		info.SourceFunc = source.Add
+	}
+	a.setInfo(info)
+	info.SetState(StateStarting)
+	defer info.SetState(StateFinished)
+	mergeOnCancel := o.MergeOnCancel
+	saveFilesOnCancel := o.SaveFilesOnCancel
+	saveStateOnCancel := o.SaveStateOnCancel
+	audioOnly := o.AudioOnly
+	tempDir := o.TempDir
+	downloadThumbnail := o.Thumbnail
+	writeThumbnail := o.WriteThumbnail
+	var moveErrs []error
+
+	httpClient, proxyChain := o.newHttpClient()
+	info.Client = httpClient
+	if o.Client != nil {
+		info.Client = o.Client
+	}
+
+	if o.HTTP3 {
+		if o.MediaProxy != nil {
+			return a.fail("HTTP/3 cannot be used through a media proxy")
+		}
+
+		h3Client, err := NewHTTP3Client()
+		if err != nil {
+			return a.fail("%s", err)
+		}
+
+		if o.Proxy != nil && !o.NoMediaProxy {
+			LogWarn("Fragments are downloaded over HTTP/3 without going through the proxy")
+		}
+		info.MediaClient = h3Client
+	} else if o.MediaProxy != nil || o.NoMediaProxy {
+		info.MediaClient = o.newMediaHttpClient()
+	}
+
+	var manifest *Manifest
+	if o.HashManifest {
+		manifest = NewManifest("", "")
+		if len(o.ManifestKey) > 0 {
+			err := manifest.LoadKey(o.ManifestKey)
+			if err != nil {
+				return a.fail("Failed to load the manifest key: %s", err)
+			}
+		}
+	}
+
+	var snapshotSecs int
+	if len(o.SnapshotInterval) > 0 {
+		interval, err := ParseDurationStr(o.SnapshotInterval)
+		if err != nil || interval < time.Second {
+			return a.fail("Invalid snapshot interval: %s", o.SnapshotInterval)
+		}
+		snapshotSecs = int(interval.Seconds())
+	}
+
+	var warc *WARCWriter
+	var finalWarcFile string
+	if o.WARC {
+		var err error
+		warc, err = NewWARCWriter(o.TempDir, info.Client)
+		if err != nil {
+			return a.fail("Failed to create the WARC file: %s", err)
+		}
+
+		info.Client = warc
+		if info.MediaClient != nil {
+			info.MediaClient = warc.Through(info.MediaClient)
+		}
+		defer func() {
+			if warc != nil {
+				a.finishWARC(warc, finalWarcFile)
+			}
+		}()
+	}
+
+	if a.har != nil {
+		info.Client = a.har.Through(info.Client)
+		if info.MediaClient != nil {
+			info.MediaClient = a.har.Through(info.MediaClient)
+		}
+	}
+
+	info.VP9 = o.VP9
+	info.AV1 = o.AV1
+	info.StatusNewlines = o.StatusNewlines
+	info.H264 = o.H264
+	info.RetrySecs = o.RetrySecs
+	info.FragMaxTries = o.FragMaxTries
+	info.RateLimit = NewRateLimiter(o.RateLimit, o.RateGroup, o.Priority)
+	info.CatchUpFrags = o.CatchUpFrags
+	info.MembersOnly = o.MembersOnly
+	filter, err := o.StreamFilter()
+	if err != nil {
+		return a.fail("%s", err)
+	}
+	info.Filter = filter
+	info.FileMode = o.FileMode
+	info.DirMode = o.DirMode
+	info.DisableSaveState = o.DisableSaveState
+	info.LiveFromVal = o.LiveFrom
+	info.PoToken = o.PoToken
+	info.Secrets = o.Secrets
+	if name, ok := SecretName(o.PoToken); ok {
+		if o.Secrets == nil {
+			return a.fail("No secret store to get the PO Token %s from", o.PoToken)
+		}
+
+		poToken, err := o.Secrets.Get(name)
+		if err != nil {
+			return a.fail("Failed to get the PO Token %s: %s", o.PoToken, err)
+		}
+		info.PoToken = strings.TrimSpace(string(poToken))
+	}
+
+	info.Wait = o.Wait
+
+	for k, v := range o.Metadata {
+		info.Metadata[k] = v
+	}
+
+	if o.DisableSaveState {
+		saveStateOnCancel = ActionDoNot
+	}
+
+	if audioOnly {
+		info.Quality = AudioOnlyQuality
+		info.AudioOnly = true
+	}
+
+	if o.VideoOnly {
+		info.VideoOnly = true
+	}
+
+	if o.NoFragFiles {
+		info.FragFiles = false
+	}
+
+	if len(o.FragNameFormat) > 0 {
+		if err := CheckFragNameFormat(o.FragNameFormat); err != nil {
+			return a.fail("Invalid fragment file name format: %s", err)
+		}
+		info.FragNameFormat = o.FragNameFormat
+	}
+	info.FragShard = o.FragShard
+	info.FragSpool = o.FragSpool
+	info.FragCompress = o.FragCompress
+
+	if info.RetrySecs > 0 && info.RetrySecs < DefaultPollTime {
+		info.RetrySecs = DefaultPollTime
+	}
+
+	if o.Threads > 1 {
+		info.Jobs = int(o.Threads)
+	}
+	info.BurstJobs = int(o.BurstThreads)
+
+	// Nothing to ask about when streaming, what was streamed is already out
+	if o.StreamOutput != nil {
+		mergeOnCancel = ActionDo
+	}
+
+	// Leave stopped downloads for the queue to resume, unless told otherwise
+	if len(o.QueueFile) > 0 && mergeOnCancel == ActionAsk {
+		mergeOnCancel = ActionDoNot
+		if saveFilesOnCancel == ActionAsk {
+			saveFilesOnCancel = ActionDoNot
+		}
+		if saveStateOnCancel == ActionAsk {
+			saveStateOnCancel = ActionDo
+		}
+	}
+
+	if o.MonitorChannel {
+		if info.RetrySecs < MinimumMonitorTime {
+			info.RetrySecs = DefaultMonitorTime
+		}
+		if mergeOnCancel == ActionAsk {
+			mergeOnCancel = ActionDo
+		}
+	}
+
+	if len(o.VideoURL) > 0 {
+		gvVideoUrl, itag := ParseGvideoUrl(o.VideoURL, DtypeVideo)
+		if itag == 0 {
+			return a.fail("Invalid video URL given")
+		}
+
+		info.URL = gvVideoUrl
+		info.SetDownloadUrl(DtypeVideo, gvVideoUrl)
+	}
+
+	if len(o.AudioURL) > 0 {
+		gvAudioUrl, itag := ParseGvideoUrl(o.AudioURL, DtypeAudio)
+		if itag == 0 {
+			return a.fail("Invalid audio URL given")
+		}
+
+		if len(info.URL) == 0 {
+			info.URL = gvAudioUrl
+		}
+
+		info.SetDownloadUrl(DtypeAudio, gvAudioUrl)
+	}
+
+	if o.MonitorChannel && (len(o.URL) == 0 || len(o.Quality) == 0) {
+		return a.fail("You must specify a channel AND quality when choosing to monitor a channel")
+	}
+
+	if len(info.URL) == 0 && a.queueItem != nil {
+		info.URL = a.queueItem.URL
+		info.SelectedQuality = a.queueItem.Quality
+		if len(info.SelectedQuality) == 0 {
+			info.SelectedQuality = o.Quality
+		}
+	}
+
+	if len(info.URL) == 0 {
+		if len(o.URL) > 0 {
+			info.URL = o.URL
+			info.SelectedQuality = o.Quality
+		} else {
+			info.URL = GetUserInput("Enter a youtube livestream URL: ")
+		}
+	}
+
+	err = info.ParseInputUrl()
+	if err != nil {
+		return a.fail("%s", err)
+	}
+
+	_, err = FormatFilename(o.OutputFormat, info.FormatInfo, o.LookalikeChars)
+	if err != nil {
+		return a.fail("%s", err)
+	}
+
+	storage := o.Storage
+	if storage == nil && len(o.StorageURL) > 0 {
+		storage, err = OpenStorage(o.StorageURL)
+		if err != nil {
+			return a.fail("Invalid storage: %s", err)
+		}
+	}
+
+	_, err = FormatFilename(o.StorageDir, info.FormatInfo, o.LookalikeChars)
+	if err != nil {
+		return a.fail("Invalid storage directory format: %s", err)
+	}
+
+	if len(o.CookieFile) > 0 {
+		cjar, err := info.ParseNetscapeCookiesFile(o.CookieFile)
+		if err != nil {
+			return a.fail("Failed to load cookies file: %s", err)
+		}
+
+		info.CookieJar = cjar
+		if !o.NoUpdateCookies {
+			info.CookieJar = NewCookieRecorder(cjar)
+			defer func() {
+				if err := info.SaveCookies(); err != nil {
+					LogWarn("Failed to save the updated cookies: %s", err)
+				}
+			}()
+		}
+		info.CookieFile = o.CookieFile
+		httpClient.Jar = info.CookieJar
+		LogInfo("Loaded cookie file %s", o.CookieFile)
+	}
+
+	if o.StartDelay != "" {
+		// Not supported when also using --live-from
+		if o.LiveFrom != "" {
+			return a.fail("You cannot use both --start-delay and --live-from at the same time.")
+		}
+
+		err = info.ParseStartDelayStrVal(o.StartDelay)
+		if err != nil {
+			a.reportError(err)
+			return 1
+		}
+	}
+
+	if o.CaptureDuration != "" {
+		err = info.ParseCaptureDurationStrVal(o.CaptureDuration)
+		if err != nil {
+			a.reportError(err)
+			return 1
+		}
+		LogGeneral("Downloading a minimum of %s of content and then exiting...", SecondsToDurationAndTimeStr(info.CaptureDurationSecs))
+	}
+
+	expectedSecs := 0
+	if o.ExpectedDuration != "" {
+		expected, err := ParseDurationStr(o.ExpectedDuration)
+		if err != nil {
+			return a.fail("Invalid expected duration: %s", err)
+		}
+		expectedSecs = int(expected.Seconds())
+	}
+
+	if o.ListFormats {
+		if info.GVideoDDL {
+			return a.fail("Formats can only be listed for YouTube URLs")
+		}
+
+		// Only the list is wanted, so do not prompt for a quality
+		if len(info.SelectedQuality) == 0 {
+			info.SelectedQuality = DefaultVideoQuality
+		}
+	}
+
+	if !info.GVideoDDL {
+		DiscoverInnertubeConfig(ctx, info.HttpClient())
+	}
+
+	if !info.GVideoDDL && !info.GetVideoInfo(ctx) {
+		if errors.Is(info.pickErr, ErrQualityPickCancelled) {
+			return 1
+		} else if info.NeedsMembership {
+			a.reportError(errors.New(info.URL + " is a members-only stream"))
+			return RetcodeMembersOnly
+		} else if info.RegionLocked {
+			a.reportError(errors.New(info.URL + " is not available in this country"))
+			return RetcodeRegionLocked
+		} else if info.Filtered {
+			return RetcodeFiltered
+		}
+
+		a.reportError(errors.New("could not get a usable stream from " + info.URL))
+		return 1
+	}
+	if info.IsLive() {
+		a.notify(info, WebhookLive, nil, nil)
+	}
+
+	if o.ListFormats {
+		LogGeneral("Measuring the bitrate of each format...")
+		info.MeasureFormats(ctx)
+		info.PrintFormats()
+		return 0
+	}
+
+	if o.LiveFrom != "" {
+		err = info.ParseLiveFromStrVal()
+		if err != nil {
+			a.reportError(err)
+			return 1
+		}
+	}
+
+	if o.PostLive && !info.GVideoDDL {
+		err = info.preparePostLive(ctx)
+		if err != nil {
+			return a.fail("%s", err)
+		}
+	}
+
+	if o.Multiview && !info.GVideoDDL {
+		a.startViews(ctx, info)
+		defer a.waitViews()
+	} else if len(o.View) > 0 {
+		info.FormatInfo["view"] = o.View
+	}
+
+	info.DLState[AudioItag] = &DownloadState{}
+	info.DLState[info.Quality] = &DownloadState{}
+	audioOnly = info.Quality == AudioOnlyQuality
+
+	// We checked if there would be errors earlier, should be good
+	fullFPath, _ := FormatFilename(o.OutputFormat, info.FormatInfo, o.LookalikeChars)
+	fdir := filepath.Dir(fullFPath)
+	tmpDir := ""
+	var absDir string
+
+	if !strings.HasPrefix(o.OutputFormat, string(os.PathSeparator)) {
+		fdir = strings.TrimLeft(fdir, string(os.PathSeparator))
+	}
+	if len(strings.TrimSpace(fdir)) == 0 {
+		fdir = "."
+	}
+
+	// Keep the directories from the output format when storing elsewhere
+	storeDir := ""
+	if len(o.StorageDir) > 0 {
+		storeDir, _ = FormatFilename(o.StorageDir, info.FormatInfo, o.LookalikeChars)
+		storeDir = strings.Trim(filepath.ToSlash(storeDir), "/")
+	} else if !filepath.IsAbs(fdir) && fdir != "." {
+		storeDir = fdir
+	}
+
+	absDir, err = filepath.Abs(fdir)
+	if err == nil {
+		fdir = absDir
+	}
+
+	fname := filepath.Base(fullFPath)
+	fname = SterilizeFilename(fname, o.LookalikeChars)
+
+	if strings.HasPrefix(fname, "-") {
+		fname = "_" + fname
+	}
+
+	if fname == "." || len(strings.TrimSpace(fname)) == 0 {
+		LogError("Output file name appears to be empty after formatting.")
+		return a.fail("Expanded output file path: %s", fullFPath)
+	}
+
+	if fdir != "." {
+		err = os.MkdirAll(fdir, info.DirMode)
+		if err != nil {
+			LogWarn("Error creating final file directory: %s", err)
+			LogWarn("The final file will be placed in the current working directory")
+			fdir = "."
+		}
+	}
+
+	if source != nil {
+		source.SetOutput(fdir, fname)
+	}
+
+	if len(tempDir) > 0 && tempDir != "." {
+		err = os.MkdirAll(tempDir, info.DirMode)
+		if err != nil {
+			LogWarn("Error creating temporary directory: %s", err)
+			LogWarn("Temporary files will be placed in the current working directory")
+			tempDir = "."
+		}
+	}
+
+	if len(o.CopyDir) > 0 {
+		err = os.MkdirAll(o.CopyDir, info.DirMode)
+		if err != nil {
+			return a.fail("Error creating the copy directory: %s", err)
+		}
+		info.CopyDir = o.CopyDir
+	}
+
+	// Fall back to the capture duration, or the length of a finished stream
+	if expectedSecs == 0 {
+		expectedSecs = info.CaptureDurationSecs
+	}
+	if expectedSecs == 0 && !info.IsLive() && !info.IsGVideoDDL() {
+		expectedSecs = info.LastSq * info.TargetDuration
+	}
+
+	if (o.EstimateSize || o.MaxEstimatedSize > 0) && !info.IsGVideoDDL() {
+		LogGeneral("Estimating the size of the final file...")
+		err = info.CheckEstimatedSize(ctx, expectedSecs, o.MaxEstimatedSize)
+		if err != nil {
+			return a.fail("Not downloading, %s", err)
+		}
+	}
+
+	// A download being resumed has to keep its quality
+	resuming := !o.DisableSaveState && Exists(filepath.Join(tempDir, fmt.Sprintf("%s.f%d.state", info.VideoID, info.Quality)))
+	if expectedSecs > 0 && !resuming {
+		dlDir := tempDir
+		if len(dlDir) == 0 {
+			dlDir = fdir
+		}
+		info.FitDiskSpace(dlDir, fdir, expectedSecs, o.StreamOutput == nil, o.FitToDisk)
+	}
+
+	if o.Preallocate {
+		if expectedSecs > 0 {
+			info.PreallocateSecs = expectedSecs
+		} else {
+			LogWarn("Not preallocating the data files, as how long the download will last is not known. Set it with --expected-duration.")
+		}
+	}
+
+	if !o.DisableSaveState {
+		info.DLState[AudioItag].File = filepath.Join(tempDir, fmt.Sprintf("%s.f%d.state", info.VideoID, AudioItag))
+		info.DLState[info.Quality].File = filepath.Join(tempDir, fmt.Sprintf("%s.f%d.state", info.VideoID, info.Quality))
+		if Exists(info.DLState[AudioItag].File) {
+			stateData, err := os.ReadFile(info.DLState[AudioItag].File)
+			if err == nil {
+				err = json.Unmarshal(stateData, info.DLState[AudioItag])
+			}
+			if err == nil {
+				tmpDir = info.DLState[AudioItag].TempDir
+			}
+		}
+		if Exists(info.DLState[info.Quality].File) {
+			stateData, err := os.ReadFile(info.DLState[info.Quality].File)
+			if err == nil {
+				err = json.Unmarshal(stateData, info.DLState[info.Quality])
+			}
+			if err == nil && len(tmpDir) == 0 {
+				tmpDir = info.DLState[info.Quality].TempDir
+			}
+		}
+	}
+
+	if a.queue != nil {
+		var stateFiles []string
+		if !o.DisableSaveState {
+			stateFiles = []string{info.DLState[AudioItag].File, info.DLState[info.Quality].File}
+		}
+		watchUrl := fmt.Sprintf("https://www.youtube.com/watch?v=%s", info.VideoID)
+		a.queue.Started(watchUrl, info.SelectedQuality, info.VideoID, stateFiles)
+	}
+
+	// --start-delay, do not process if resuming a download.
+	if info.StartDelaySecs != 0 && (info.DLState[AudioItag].Fragments != 0 || info.DLState[info.Quality].Fragments != 0) {
+		LogWarn("Option --start-delay is being ignored as a download is being resumed.")
+	} else {
+		if !info.WaitForStartDelay(ctx) {
+			return a.fail("Got an error when re-grabbing video info after the delay period elapsed. Exiting.")
+		}
+	}
+
+	if len(tmpDir) == 0 {
+		if len(tempDir) == 0 {
+			tmpDir = fdir
+		} else {
+			tmpDir = tempDir
+		}
+		tmpDir, err = os.MkdirTemp(tmpDir, fmt.Sprintf("%s", info.VideoID))
+		if err != nil {
+			LogWarn("Error creating temp directory: %s", err)
+			LogWarn("Will download data directly to %s instead", fdir)
+			tmpDir = fdir
+		}
+
+		if !o.DisableSaveState {
+			for _, state := range info.DLState {
+				state.TempDir = tmpDir
+			}
+		}
+	}
+
+	// Check if file name is too long, truncate if so
+	if len(fname) > MaxFileNameLength {
+		return a.fail("fname len: %d", len(fname))
+	}
+
+	afileName := fmt.Sprintf("%s.f%d", fname, AudioItag)
+	vfileName := fmt.Sprintf("%s.f%d", fname, info.Quality)
+	thmbnlName := fmt.Sprintf("%s.jpg", fname)
+	descFileName := fmt.Sprintf("%s.description", fname)
+	infoFileName := fmt.Sprintf("%s.info.json", fname)
+	muxFileName := fmt.Sprintf("%s.ffmpeg.txt", fname)
+
+	finalAudioFile := filepath.Join(fdir, fmt.Sprintf("%s.ts", afileName))
+	finalVideoFile := filepath.Join(fdir, fmt.Sprintf("%s.ts", vfileName))
+	finalThumbnail := filepath.Join(fdir, thmbnlName)
+	finalDescFile := filepath.Join(fdir, descFileName)
+	finalInfoFile := filepath.Join(fdir, infoFileName)
+	finalMuxFile := filepath.Join(fdir, muxFileName)
+	finalWarcFile = filepath.Join(fdir, fmt.Sprintf("%s.warc.gz", fname))
+	finalManifest := filepath.Join(fdir, fmt.Sprintf("%s.manifest.json", fname))
+	finalFragTimes := filepath.Join(fdir, fmt.Sprintf("%s.fragtimes.csv", fname))
+	finalLiveChat := filepath.Join(fdir, fmt.Sprintf("%s.live_chat.jsonl", fname))
+	finalDiscontinuities := filepath.Join(fdir, fmt.Sprintf("%s.discontinuities.json", fname))
+	var metadata MetaInfo
+	if o.AddMetadata {
+		metadata = info.Metadata
+	}
+	var mergeItags []int
+	if !o.VideoOnly {
+		mergeItags = append(mergeItags, AudioItag)
+	}
+	if !audioOnly {
+		mergeItags = append(mergeItags, info.Quality)
+	}
+	mergeFormat := info.resolveMergeFormat(o.MergeFormat, o.MKV, mergeItags...)
+	audioMergeFormat := mergeFormat
+	if CheckMergeFormat(mergeFormat, info.formatCodecs(AudioItag)) != nil {
+		audioMergeFormat = MergeFormatMP4
+	}
+
+	ffmpegArgs := GetFFmpegArgs(finalAudioFile, finalVideoFile, finalThumbnail, fdir, fname, audioOnly, o.VideoOnly, downloadThumbnail, mergeFormat, metadata)
+	audioFFMpegArgs := GetFFmpegArgs(finalAudioFile, "", finalThumbnail, fdir, fname, true, false, downloadThumbnail, audioMergeFormat, metadata)
+	ffmpegCmd := fmt.Sprintf("%s %s", o.FFmpegPath, shellescape.QuoteCommand(ffmpegArgs.Args))
+
+	info.MDLInfo[DtypeAudio].BasePath = filepath.Join(tmpDir, afileName)
+	info.MDLInfo[DtypeVideo].BasePath = filepath.Join(tmpDir, vfileName)
+
+	checkpoint := ""
+	if !o.DisableSaveState {
+		checkpoint, err = info.writeCheckpoint(tempDir, o.OutputFormat)
+		if err != nil {
+			LogWarn("Failed to write the checkpoint, the download can only be resumed by giving its URL again: %s", err)
+			checkpoint = ""
+		}
+	}
+
+	afile := info.MDLInfo[DtypeAudio].BasePath + ".ts"
+	vfile := info.MDLInfo[DtypeVideo].BasePath + ".ts"
+	thmbnlFile := filepath.Join(tmpDir, thmbnlName)
+	descFile := filepath.Join(tmpDir, descFileName)
+	infoFile := filepath.Join(tmpDir, infoFileName)
+	muxFile := filepath.Join(tmpDir, muxFileName)
+
+	progressChan := make(chan *ProgressInfo, info.Jobs*2)
+	var totalBytes int64
+	frags := map[string]int{
+		DtypeAudio: 0,
+		DtypeVideo: 0,
+	}
+
+	if (downloadThumbnail || writeThumbnail) && len(info.Thumbnail) > 0 {
+		downloaded := DownloadThumbnail(ctx, info.HttpClient(), info.Thumbnail, thmbnlFile, info.FileMode)
+
+		if !downloaded {
+			TryDelete(thmbnlFile)
+			downloadThumbnail = false
+			writeThumbnail = false
+		}
+	} else {
+		downloadThumbnail = false
+		writeThumbnail = false
+	}
+
+	if o.WriteDescription && len(info.Metadata["comment"]) > 0 {
+		err = os.WriteFile(descFile, []byte(info.Metadata["comment"]), info.FileMode)
+
+		if err != nil {
+			LogWarn("Error writing description file: %s", err)
+			TryDelete(descFile)
+		}
+	}
+
+	if o.WriteInfoJSON {
+		var infoItags []int
+		if !audioOnly {
+			infoItags = append(infoItags, info.Quality)
+		}
+		if !o.VideoOnly {
+			infoItags = append(infoItags, AudioItag)
+		}
+
+		err = info.WriteInfoJSON(infoFile, infoItags)
+		if err != nil {
+			LogWarn("Error writing info json file: %s", err)
+			TryDelete(infoFile)
+		}
+	}
+
+	err = os.WriteFile(muxFile, []byte(ffmpegCmd), info.FileMode)
+	if err != nil {
+		LogWarn("Failed to write initial mux file: %s", err)
+		TryDelete(muxFile)
+	}
+
+	var dataTypes []string
+	for _, dataType := range []string{DtypeVideo, DtypeAudio} {
+		if len(info.GetDownloadUrl(dataType)) > 0 {
+			dataTypes = append(dataTypes, dataType)
+		}
+	}
+
+	var muxer *streamMuxer
+	if o.StreamOutput != nil {
+		muxer, err = startStreamMuxer(o.FFmpegPath, o.StreamOutput, dataTypes)
+		if err != nil {
+			if tmpDir != fdir {
+				os.RemoveAll(tmpDir)
+			}
+			return a.fail("Failed to start the stream output: %s", err)
+		}
+
+		info.StreamOutputs = muxer.inputs
+	}
+
+	var restream *streamMuxer
+	if len(o.RestreamURL) > 0 && len(dataTypes) > 0 {
+		restream, err = startRestream(o.FFmpegPath, o.RestreamURL, dataTypes)
+		if err != nil {
+			LogWarn("Failed to start restreaming, continuing without it: %s", err)
+		} else {
+			LogInfo("Restreaming to %s", o.RestreamURL)
+			info.RestreamOutputs = restream.inputs
+			defer func() {
+				if restream != nil {
+					restream.Close()
+				}
+			}()
+		}
+	}
+
+	var liveOutput *streamMuxer
+	liveFile := ""
+	if len(o.LiveOutput) > 0 && len(dataTypes) > 0 {
+		codecs := info.formatCodecs(info.Quality, AudioItag)
+		liveFile = filepath.Join(fdir, fmt.Sprintf("%s.live.%s", fname, o.LiveOutput))
+		liveOutput, err = startLiveOutput(o.FFmpegPath, o.LiveOutput, liveFile, codecs, dataTypes)
+		if err != nil {
+			LogWarn("Failed to start the live output file, continuing without it: %s", err)
+			liveFile = ""
+		} else {
+			LogInfo("Writing the streams to %s as they download", liveFile)
+			info.LiveOutputs = liveOutput.inputs
+			defer func() {
+				if liveOutput != nil {
+					liveOutput.Close()
+				}
+			}()
+		}
+	}
+
+	if manifest != nil {
+		manifest.VideoID = info.VideoID
+		manifest.URL = info.URL
+		manifest.SetStream(DtypeAudio, finalAudioFile, AudioItag)
+		manifest.SetStream(DtypeVideo, finalVideoFile, info.Quality)
+		for _, dataType := range []string{DtypeAudio, DtypeVideo} {
+			if len(info.GetDownloadUrl(dataType)) == 0 {
+				delete(manifest.Streams, dataType)
+			}
+		}
+		info.OnFragment(manifest.AddFragment)
+	}
+
+	var fragArchive *FragArchive
+	if len(o.KeepFrags) > 0 {
+		itags := map[string]int{DtypeAudio: AudioItag, DtypeVideo: info.Quality}
+		archiveFile := filepath.Join(fdir, fmt.Sprintf("%s.frags.%s", fname, o.KeepFrags))
+		fragArchive, err = NewFragArchive(archiveFile, o.KeepFrags, info.VideoID, itags, info.FileMode)
+		if err != nil {
+			LogWarn("Failed to create the fragment archive, fragments will not be kept: %s", err)
+		} else {
+			info.OnRawFragment(fragArchive.AddFragment)
+			defer fragArchive.Close()
+		}
+	}
+
+	var snapshotter *Snapshotter
+	if snapshotSecs > 0 && len(info.GetDownloadUrl(DtypeVideo)) > 0 {
+		snapshotDir := filepath.Join(fdir, fmt.Sprintf("%s.snapshots", fname))
+		snapshotter = NewSnapshotter(o.FFmpegPath, snapshotDir, fname, snapshotSecs, info.TargetDuration)
+		snapshotter.DirMode = info.DirMode
+		info.OnRawFragment(snapshotter.AddFragment)
+		LogInfo("Saving a snapshot every %s to %s", SecondsToDurationStr(snapshotSecs), snapshotDir)
+	} else if snapshotSecs > 0 {
+		LogWarn("Not downloading video, so no snapshots will be taken")
+	}
+
+	var hlsServer *HLSServer
+	if len(o.ServeAddr) > 0 && len(dataTypes) > 0 {
+		files := map[string]string{DtypeAudio: afile, DtypeVideo: vfile}
+		for _, dataType := range []string{DtypeAudio, DtypeVideo} {
+			if len(info.GetDownloadUrl(dataType)) == 0 {
+				delete(files, dataType)
+			}
+		}
+
+		bandwidth := 0
+		for _, itag := range []int{AudioItag, info.Quality} {
+			if details, ok := info.FormatDetails[itag]; ok {
+				bandwidth += details.Bitrate
+			}
+		}
+		if bandwidth == 0 {
+			bandwidth = HLSDefaultBandwidth
+		}
+
+		hlsServer = NewHLSServer(o.ServeAddr)
+		err = hlsServer.Start(files, info.TargetDuration, bandwidth)
+		if err != nil {
+			LogWarn("Failed to start the HLS server, continuing without it: %s", err)
+			hlsServer = nil
+		} else {
+			LogGeneral("Serving the recording at %s", hlsServer.URL())
+			info.OnFragment(hlsServer.AddFragment)
+			defer func() {
+				if hlsServer != nil {
+					hlsServer.Close()
+				}
+			}()
+		}
+	}
+
+	fragTimesFile := filepath.Join(tmpDir, filepath.Base(finalFragTimes))
+	if o.WriteFragmentTimes || len(o.TimestampTrack) > 0 {
+		info.FragTimes, err = NewFragTimeLog(fragTimesFile, info.FileMode)
+		if err != nil {
+			LogWarn("Failed to create the fragment times file, continuing without it: %s", err)
+			info.FragTimes = nil
+		}
+	}
+
+	dlDoneChan := make(chan struct{}, 2)
+	activeDownloads := 0
+	startedAt := time.Now()
+	info.SetState(StateDownloading)
+	a.notify(info, WebhookDownloadStarted, nil, nil)
+
+	if len(info.GetDownloadUrl(DtypeAudio)) > 0 {
+		LogInfo("Starting download to %s", afile)
+		go info.DownloadStream(ctx, DtypeAudio, afile, progressChan, dlDoneChan)
+		activeDownloads += 1
+	}
+
+	if len(info.GetDownloadUrl(DtypeVideo)) > 0 {
+		LogInfo("Starting download to %s", vfile)
+		go info.DownloadStream(ctx, DtypeVideo, vfile, progressChan, dlDoneChan)
+		activeDownloads += 1
+	}
+
+	if activeDownloads == 0 {
+		LogError("Neither audio nor video downloads were started.")
+		if tmpDir != fdir {
+			os.RemoveAll(tmpDir)
+		}
+		return a.fail("Make sure you did not have both --no-video and --no-audio set.")
+	}
+
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	go info.WatchSleep(watchCtx)
+	go info.WatchNetwork(watchCtx)
+	if !info.IsGVideoDDL() {
+		go info.KeepURLsFresh(watchCtx)
+	}
+	if info.IsLive() && !info.IsGVideoDDL() {
+		go info.WatchHeartbeat(watchCtx)
+		if info.CookieJar != nil {
+			go info.KeepSessionFresh(watchCtx)
+		}
+	}
+
+	var liveChatDone chan struct{}
+	if o.WriteLiveChat {
+		if info.IsLive() && !info.IsGVideoDDL() {
+			liveChatDone = make(chan struct{})
+			go func() {
+				defer close(liveChatDone)
+				err := info.CaptureLiveChat(watchCtx, finalLiveChat)
+				if err != nil {
+					LogWarn("Failed to capture the live chat: %s", err)
+				}
+			}()
+		} else {
+			LogWarn("The live chat is only captured while the stream is live")
+		}
+	}
+
+	// Drop any signal left over from a previous monitor run
+	if !a.isStopRequested() {
+		select {
+		case <-a.stopChan:
+		default:
+		}
+	}
+	if o.HandleSignals {
+		signal.Notify(a.stopChan, os.Interrupt, syscall.SIGTERM)
+		NotifyPauseSignal(a.pauseChan)
+		defer signal.Stop(a.pauseChan)
+	}
+
+	var throughput *ThroughputMonitor
+	if info.IsLive() && !info.IsGVideoDDL() {
+		var bitrates []int
+		for _, itag := range []int{info.Quality, AudioItag} {
+			if details, ok := info.FormatDetails[itag]; ok && info.DLState[itag] != nil {
+				bitrates = append(bitrates, details.Bitrate)
+			}
+		}
+		throughput = NewThroughputMonitor(info.TargetDuration, bitrates...)
+	}
+
+	maxSeq := -1
+	handleProgress := func(progress *ProgressInfo) {
+		info.DLState[progress.Itag].Size += int64(progress.ByteCount)
+		info.DLState[progress.Itag].Fragments += 1
+		info.DLState[progress.Itag].StartFrag = progress.StartFrag
+		totalBytes += int64(progress.ByteCount)
+		info.SaveState(progress.Itag)
+
+		if progress.MaxSeq > maxSeq {
+			maxSeq = progress.MaxSeq
+		}
+
+		if o.MaxFileSize > 0 && !info.IsFinishing() && a.reachedMaxFileSize(info, activeDownloads) {
+			fmt.Fprintln(os.Stderr)
+			LogGeneral("Reached the maximum file size of %s, finishing fragments in progress...", FormatSize(o.MaxFileSize))
+			info.Finish()
+		}
+
+		lag := maxSeq - (progress.StartFrag + info.DLState[progress.Itag].Fragments)
+		if behind := throughput.Add(progress.ByteCount, lag); behind != nil {
+			a.reportBehind(info, behind)
+		}
+
+		status := "\r"
+		if o.StatusNewlines {
+			status = ""
+		}
+
+		status += fmt.Sprintf("Video Fragments: %d; Audio Fragments: %d; ", info.DLState[info.Quality].Fragments, info.DLState[AudioItag].Fragments)
+		if GetLogLevel() >= LoglevelInfo {
+			status += fmt.Sprintf("Max Fragments: %d; Max Sequence: %d; ", (maxSeq - progress.StartFrag), maxSeq)
+		}
+
+		status += fmt.Sprintf("Total Downloaded: %s", FormatSize(totalBytes))
+		if bitrate := info.MeasuredBitrate(); bitrate > 0 {
+			status += fmt.Sprintf("; Bitrate: %s", FormatBitrate(bitrate))
+		}
+		if o.StatusNewlines {
+			status += "\n"
+		} else {
+			status += "\033[K"
+		}
+
+		info.SetStatus(status)
+		if o.Callbacks.Progress != nil {
+			o.Callbacks.Progress(&Progress{
+				ProgressInfo:   *progress,
+				VideoFragments: info.DLState[info.Quality].Fragments,
+				AudioFragments: info.DLState[AudioItag].Fragments,
+				MaxSeq:         maxSeq,
+				TotalBytes:     totalBytes,
+				Lag:            lag,
+			})
+		}
+		if o.ProgressJSON != nil {
+			o.ProgressJSON.Write(&ProgressEvent{
+				Event:   ProgressEventProgress,
+				VideoID: info.VideoID,
+				ProgressCounts: &ProgressCounts{
+					Itag:           progress.Itag,
+					VideoFragments: info.DLState[info.Quality].Fragments,
+					AudioFragments: info.DLState[AudioItag].Fragments,
+					MaxSeq:         maxSeq,
+					TotalBytes:     totalBytes,
+					Bitrate:        info.MeasuredBitrate(),
+					LagFragments:   lag,
+					LagSecs:        lag * info.TargetDuration,
+				},
+			})
+		}
+	}
+
+	for {
+		select {
+		case progress := <-progressChan:
+			handleProgress(progress)
+		case <-a.pauseChan:
+			fmt.Fprintln(os.Stderr)
+			if info.IsPaused() {
+				info.Resume()
+				LogGeneral("Resuming download")
+			} else {
+				info.Pause()
+				LogGeneral("Download paused, fragments in progress will still finish. Send the signal again to resume.")
+			}
+			info.PrintStatus()
+		case sig := <-a.stopChan:
+			// Only an interactive interrupt can be answered with prompts
+			interactive := sig == os.Interrupt
+			a.cancelled = true
+			info.Finish()
+			fmt.Fprintln(os.Stderr)
+			LogWarn("Received %s, finishing fragments in progress before stopping...", sig)
+			LogWarn("Send it again to stop immediately.")
+
+			// Keep the state files up to date with everything that gets written
+			for activeDownloads > 0 {
+				select {
+				case progress := <-progressChan:
+					handleProgress(progress)
+				case <-a.stopChan:
+					LogWarn("Stopping download immediately...")
+					info.Stop()
+				case <-dlDoneChan:
+					activeDownloads -= 1
+				}
+			}
+			signal.Stop(a.stopChan)
+
+			fmt.Fprintln(os.Stderr)
+			merge := false
+			if mergeOnCancel == ActionAsk {
+				if interactive {
+					merge = GetYesNo("\nDownload stopped prematurely. Would you like to merge the currently downloaded data?")
+				} else {
+					merge = true
+				}
+			} else if mergeOnCancel == ActionDo {
+				merge = true
+			}
+
+			if !merge {
+				saveFiles := false
+				saveState := false
+
+				// Nothing more gets written to the sidecars, same as after a full download
+				stopWatching()
+				if liveChatDone != nil {
+					<-liveChatDone
+				}
+				if info.FragTimes != nil {
+					if err := info.FragTimes.Close(); err != nil {
+						LogWarn("The fragment times file may be incomplete: %s", err)
+					}
+					info.FragTimes = nil
+				}
+
+				if saveFilesOnCancel == ActionAsk && interactive {
+					saveFiles = GetYesNo("\nWould you like to save any created files?")
+				} else if saveFilesOnCancel == ActionDo {
+					saveFiles = true
+				}
+
+				if !saveFiles {
+					if saveStateOnCancel == ActionAsk {
+						// Nobody is around to answer, so leave things resumable
+						saveState = !interactive || GetYesNo("\nWould you like to leave files to resume downloading later?")
+					} else if saveStateOnCancel == ActionDo {
+						saveState = true
+					}
+				}
+
+				if saveFiles {
+					ok := true
+
+					err = TryMove(afile, finalAudioFile)
+					moveErrs = append(moveErrs, err)
+
+					err = TryMove(vfile, finalVideoFile)
+					moveErrs = append(moveErrs, err)
+
+					err = TryMove(thmbnlFile, finalThumbnail)
+					moveErrs = append(moveErrs, err)
+
+					err = TryMove(descFile, finalDescFile)
+					moveErrs = append(moveErrs, err)
+
+					err = TryMove(infoFile, finalInfoFile)
+					moveErrs = append(moveErrs, err)
+
+					// Only kept for the timestamp track otherwise, which is not made
+					if o.WriteFragmentTimes {
+						err = TryMove(fragTimesFile, finalFragTimes)
+						moveErrs = append(moveErrs, err)
+					} else {
+						TryDelete(fragTimesFile)
+					}
+
+					if o.WriteDiscontinuities {
+						err = info.WriteDiscontinuities(finalDiscontinuities, o.FillGaps)
+						if err != nil {
+							LogError("Failed to write the discontinuities: %s", err)
+						}
+					}
+
+					for _, err = range moveErrs {
+						if err != nil {
+							ok = false
+							break
+						}
+					}
+
+					if !ok {
+						LogError("At least one error occurred when moving files. Will not delete them.")
+					} else if tmpDir != fdir {
+						os.RemoveAll(tmpDir)
+					}
+
+					if !o.DisableSaveState {
+						for _, state := range info.DLState {
+							TryDelete(state.File)
+						}
+						TryDelete(checkpoint)
+					}
+				} else if !saveState {
+					if tmpDir != fdir {
+						os.RemoveAll(tmpDir)
+					}
+
+					if !o.DisableSaveState {
+						for _, state := range info.DLState {
+							TryDelete(state.File)
+						}
+						TryDelete(checkpoint)
+					}
+				}
+
+				return 2
+			}
+		case <-dlDoneChan:
+			activeDownloads -= 1
+		}
+
+		if activeDownloads <= 0 {
+			break
+		}
+	}
+
+	stopWatching()
+	signal.Stop(a.stopChan)
+	if liveChatDone != nil {
+		<-liveChatDone
+	}
+	if info.FragTimes != nil {
+		if err := info.FragTimes.Close(); err != nil {
+			LogWarn("The fragment times file may be incomplete: %s", err)
+		}
+		if o.WriteFragmentTimes {
+			if err := TryMove(fragTimesFile, finalFragTimes); err != nil {
+				LogWarn("Failed to move the fragment times file: %s", err)
+			} else {
+				fragTimesFile = finalFragTimes
+			}
+		}
+		info.FragTimes = nil
+	} else {
+		fragTimesFile = ""
+	}
+	// Written before the mux so they are kept even if it fails or is skipped
+	if o.WriteDiscontinuities {
+		err = info.WriteDiscontinuities(finalDiscontinuities, o.FillGaps)
+		if err != nil {
+			LogError("Failed to write the discontinuities: %s", err)
+		}
+	}
+	if liveOutput != nil {
+		if err := liveOutput.Close(); err != nil {
+			LogWarn("The live output file may be incomplete: %s", err)
+		}
+		liveOutput = nil
+	}
+	if !o.DisableSaveState {
+		for _, state := range info.DLState {
+			TryDelete(state.File)
+		}
+		TryDelete(checkpoint)
+	}
+	if GetLogLevel() > LoglevelQuiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	LogGeneral("Download Finished")
+	if !a.cancelled {
+		var dataFiles []string
+		for _, dataFile := range []string{afile, vfile} {
+			if Exists(dataFile) {
+				dataFiles = append(dataFiles, dataFile)
+			}
+		}
+		a.notify(info, WebhookStreamEnded, dataFiles, nil)
+	}
+	proxyChain.LogPeriods()
+	for _, dataType := range []string{DtypeVideo, DtypeAudio} {
+		stats := &info.MDLInfo[dataType].FragStats
+		if count := stats.Count(); count > 0 {
+			LogGeneral("Stats for %d %s fragments:", count, dataType)
+			for _, line := range stats.Summary() {
+				LogGeneral("\t%s", line)
+			}
+
+			itag := info.Quality
+			if dataType == DtypeAudio {
+				itag = AudioItag
+			}
+			bitrate := fmt.Sprintf("bitrate %s", FormatBitrate(stats.Bitrate(info.TargetDuration)))
+			if details, ok := info.FormatDetails[itag]; ok && details.Bitrate > 0 {
+				bitrate += fmt.Sprintf(", %s in the manifest", FormatBitrate(details.Bitrate))
+			}
+			LogGeneral("\t%s", bitrate)
+
+			gaps := info.MDLInfo[dataType].Gaps
+			for _, gap := range gaps {
+				LogGeneral("\tskipped sequences %d-%d to catch up (%s)", gap.StartSeq, gap.EndSeq,
+					SecondsToDurationStr((gap.EndSeq-gap.StartSeq+1)*info.TargetDuration))
+			}
+		}
+	}
+	if raw, stored := info.FragCompressStats(); raw > 0 {
+		LogGeneral("Fragment compression saved %s of %s (%.1f%%)", FormatSize(raw-stored), FormatSize(raw),
+			float64(raw-stored)*100/float64(raw))
+	}
+
+	if warc != nil {
+		a.finishWARC(warc, finalWarcFile)
+		warc = nil
+	}
+
+	if snapshotter != nil {
+		snapshotter.Wait()
+	}
+
+	if fragArchive != nil {
+		err = fragArchive.Close()
+		if err != nil {
+			LogError("Error finishing the fragment archive: %s", err)
+		} else {
+			LogGeneral("Raw fragments kept in %s", fragArchive.Name())
+		}
+	}
+
+	err = info.restoreDataFiles(map[string]string{DtypeAudio: afile, DtypeVideo: vfile})
+	if err != nil {
+		return a.fail("%s", err)
+	}
+
+	if manifest != nil {
+		for dataType, dataFile := range map[string]string{DtypeAudio: afile, DtypeVideo: vfile} {
+			if _, ok := manifest.Streams[dataType]; ok {
+				err = manifest.HashStream(dataType, dataFile)
+				if err != nil {
+					LogWarn("Failed to hash the %s data file: %s", dataType, err)
+				}
+			}
+		}
+
+		err = manifest.Write(finalManifest, info.FileMode)
+		if err != nil {
+			LogError("Failed to write the hash manifest: %s", err)
+		}
+	}
+
+	if !audioOnly && !o.VideoOnly && frags[DtypeAudio] != frags[DtypeVideo] {
+		LogWarn("Mismatched number of video and audio fragments.")
+		LogWarn("The files should still be mergable but data might be missing.")
+	}
+
+	if hlsServer != nil {
+		hlsServer.Close()
+		hlsServer = nil
+	}
+
+	if restream != nil {
+		err = restream.Close()
+		restream = nil
+		if err != nil {
+			LogWarn("Restream ffmpeg exited with: %s", err)
+		}
+	}
+
+	if muxer != nil {
+		err = muxer.Close()
+		if err != nil {
+			LogDebug("Stream output ffmpeg exited with: %s", err)
+		}
+
+		filesToDel := []string{thmbnlFile, descFile, infoFile, muxFile}
+		if o.KeepTSFiles {
+			moveErrs = append(moveErrs, TryMove(afile, finalAudioFile), TryMove(vfile, finalVideoFile))
+		} else {
+			filesToDel = append(filesToDel, afile, vfile)
+		}
+
+		CleanupFiles(filesToDel)
+		if tmpDir != fdir {
+			os.RemoveAll(tmpDir)
+		}
+
+		for _, err = range moveErrs {
+			if err != nil {
+				return a.fail("Failed to keep the .ts files: %s", err)
+			}
+		}
+
+		CleanupFiles(info.dataCopies())
+		return 0
+	}
+
+	// Mux inside the temp directory and only move the results over once the
+	// mux worked, so nothing watching the output directory sees partial files
+	atomicMove := o.AtomicMove && !o.WriteMuxFile
+	if atomicMove && tmpDir == fdir {
+		LogWarn("There is no temp directory to mux in, files will be written to %s as they are made", fdir)
+		atomicMove = false
+	}
+
+	movesOk := true
+	moveInputs := func() {
+		moveErrs = append(moveErrs, TryMove(afile, finalAudioFile))
+		moveErrs = append(moveErrs, TryMove(vfile, finalVideoFile))
+		moveErrs = append(moveErrs, TryMove(thmbnlFile, finalThumbnail))
+		moveErrs = append(moveErrs, TryMove(descFile, finalDescFile))
+		moveErrs = append(moveErrs, TryMove(infoFile, finalInfoFile))
+		moveErrs = append(moveErrs, TryMove(muxFile, finalMuxFile))
+	}
+	if !atomicMove {
+		moveInputs()
+	}
+
+	for _, err = range moveErrs {
+		if err != nil {
+			movesOk = false
+			break
+		}
+	}
+
+	filesToDel := make([]string, 0, 4)
+	filesToDel = append(filesToDel, finalMuxFile)
+	if !o.KeepTSFiles {
+		filesToDel = append(filesToDel, finalAudioFile, finalVideoFile)
+	}
+	if !writeThumbnail {
+		filesToDel = append(filesToDel, finalThumbnail)
+	}
+	if len(liveFile) > 0 {
+		filesToDel = append(filesToDel, liveFile)
+	}
+
+	retcode := 0
+	if o.WriteMuxFile {
+		if !movesOk {
+			LogError("At least one error occurred when moving files. Will not delete them.")
+			retcode = 1
+		} else if tmpDir != fdir {
+			os.RemoveAll(tmpDir)
+		}
+
+		return retcode
+	}
+
+	_, err = exec.LookPath(o.FFmpegPath)
+	// Allow for binaries in the current working directory
+	if errors.Is(err, exec.ErrDot) {
+		err = nil
+	}
+
+	nativeMux := o.NativeMux && mergeFormat == MergeFormatMP4
+	if o.NativeMux && !nativeMux {
+		LogWarn("The built-in muxer only writes mp4, muxing %s with ffmpeg", mergeFormat)
+	}
+	if err != nil && !nativeMux && mergeFormat == MergeFormatMP4 {
+		LogWarn("%s not found, muxing with the built-in muxer instead", o.FFmpegPath)
+		nativeMux = true
+		err = nil
+	}
+
+	if err != nil {
+		a.fail("%s not found. Please install ffmpeg or provide a location using --ffmpeg-path", o.FFmpegPath)
+
+		if !movesOk {
+			LogError("At least one error occurred when moving files. Will not delete them.")
+		} else if tmpDir != fdir {
+			os.RemoveAll(tmpDir)
+		}
+
+		return 1
+	}
+
+	finalFile := ffmpegArgs.FileName
+	finalSeparateAudio := audioFFMpegArgs.FileName
+	attachDesc, attachThumbnail := finalDescFile, finalThumbnail
+	if atomicMove {
+		staged := map[string]string{
+			finalAudioFile: afile,
+			finalVideoFile: vfile,
+			finalThumbnail: thmbnlFile,
+		}
+		ffmpegArgs.Relocate(tmpDir, staged)
+		audioFFMpegArgs.Relocate(tmpDir, staged)
+		attachDesc, attachThumbnail = descFile, thmbnlFile
+	}
+
+	audioInput, videoInput := finalAudioFile, finalVideoFile
+	if atomicMove {
+		audioInput, videoInput = afile, vfile
+	}
+
+	if nativeMux {
+		var left []string
+		if o.AddMetadata {
+			left = append(left, "the metadata")
+		}
+		if o.AttachFiles {
+			left = append(left, "the attachments")
+		}
+		if len(o.TimestampTrack) > 0 {
+			left = append(left, "the timestamp track")
+		}
+		if o.NormalizeAudio {
+			left = append(left, "audio normalization")
+		}
+		if len(left) > 0 {
+			LogWarn("The built-in muxer leaves out %s", strings.Join(left, ", "))
+		}
+	}
+
+	if o.FillGaps && !nativeMux {
+		inputs := map[string]string{DtypeAudio: audioInput, DtypeVideo: videoInput}
+		for dataType, input := range inputs {
+			gaps := info.MDLInfo[dataType].Gaps
+			if len(gaps) == 0 {
+				continue
+			}
+
+			listFile := input + ".ffconcat"
+			err := writeGapConcatList(listFile, input, gaps, info.TargetDuration, info.FileMode)
+			if err != nil {
+				LogWarn("Failed to write the concat list keeping the skipped %s in place: %s", dataType, err)
+				continue
+			}
+
+			ffmpegArgs.ConcatInput(input, listFile)
+			audioFFMpegArgs.ConcatInput(input, listFile)
+			filesToDel = append(filesToDel, listFile)
+		}
+	}
+
+	if o.AttachFiles && !nativeMux {
+		if mergeFormat == MergeFormatMKV {
+			ffmpegArgs.AddAttachments(a.attachmentFiles(source, attachDesc, attachThumbnail, downloadThumbnail))
+		} else {
+			LogWarn("Files can only be attached when muxing to mkv, not %s", mergeFormat)
+		}
+	}
+
+	if len(o.TimestampTrack) > 0 && len(fragTimesFile) > 0 && !nativeMux {
+		trackFile := filepath.Join(tmpDir, fname+".timestamps.vtt")
+		err := info.writeTimestampTrack(trackFile, fragTimesFile, o.TimestampZone, o.FillGaps)
+		if err == nil && audioOnly && o.TimestampTrack == TimestampTrackBurn {
+			err = errors.New("there is no video to burn it onto")
+		}
+		if err == nil {
+			err = ffmpegArgs.AddTimestampTrack(trackFile, o.TimestampTrack, mergeFormat)
+		}
+		if err != nil {
+			LogWarn("Failed to add the timestamp track: %s", err)
+		}
+
+		filesToDel = append(filesToDel, trackFile)
+		if !o.WriteFragmentTimes {
+			filesToDel = append(filesToDel, fragTimesFile)
+		}
+	}
+
+	if o.NormalizeAudio && !o.VideoOnly && !nativeMux {
+		LogGeneral("Measuring the loudness of the audio...")
+		measured, err := MeasureLoudness(o.FFmpegPath, audioInput)
+		if err != nil {
+			LogWarn("Failed to measure the loudness of the audio, it will not be normalized: %s", err)
+		} else {
+			LogDebug("Measured loudness: %s LUFS, %s dBTP, %s LU", measured.InputI, measured.InputTP, measured.InputLRA)
+			ffmpegArgs.NormalizeAudio(measured, mergeFormat)
+			audioFFMpegArgs.NormalizeAudio(measured, audioMergeFormat)
+		}
+	}
+
+	// The video goes first, as ffmpeg would put it
+	var muxInputs []string
+	if !audioOnly {
+		muxInputs = append(muxInputs, videoInput)
+	}
+	if !o.VideoOnly {
+		muxInputs = append(muxInputs, audioInput)
+	}
+	cover := ""
+	if downloadThumbnail {
+		cover = attachThumbnail
+	}
+
+	info.SetState(StateMuxing)
+	LogGeneral("Muxing final file...")
+	if nativeMux {
+		err = MuxMP4(ffmpegArgs.FileName, cover, muxInputs...)
+		if err != nil {
+			retcode = a.fail("The built-in muxer failed: %s", err)
+			LogError("The .ts files will not be deleted in case the final file is broken.")
+		}
+	} else {
+		fRetcode := Execute(o.FFmpegPath, ffmpegArgs.Args)
+		if fRetcode != 0 {
+			retcode = fRetcode
+			a.fail("Execute returned code %d. Something must have gone wrong with ffmpeg.", retcode)
+			LogError("The .ts files will not be deleted in case the final file is broken.")
+			LogError("Finally, the ffmpeg command was either written to a file or output above.")
+		}
+	}
+
+	if o.SeparateAudio && nativeMux {
+		LogGeneral("Creating separate audio file...")
+		err = MuxMP4(audioFFMpegArgs.FileName, cover, audioInput)
+		if err != nil {
+			retcode = a.fail("The built-in muxer failed: %s", err)
+			LogError("The .ts files will not be deleted in case the final file is broken.")
+		}
+	} else if o.SeparateAudio {
+		LogGeneral("Creating separate audio file...")
+		aRetcode := Execute(o.FFmpegPath, audioFFMpegArgs.Args)
+		if aRetcode != 0 {
+			retcode = aRetcode
+			a.fail("Execute returned code %d. Something must have gone wrong with ffmpeg.", retcode)
+			LogError("The .ts files will not be deleted in case the final file is broken.")
+		}
+	}
+
+	if atomicMove {
+		if retcode == 0 {
+			sidecars := [][2]string{{descFile, finalDescFile}, {infoFile, finalInfoFile}}
+			if o.KeepTSFiles {
+				sidecars = append(sidecars, [2]string{afile, finalAudioFile}, [2]string{vfile, finalVideoFile})
+			}
+			if writeThumbnail {
+				sidecars = append(sidecars, [2]string{thmbnlFile, finalThumbnail})
+			}
+
+			var outputs [][2]string
+			if o.SeparateAudio {
+				outputs = append(outputs, [2]string{audioFFMpegArgs.FileName, finalSeparateAudio})
+			}
+			outputs = append(outputs, [2]string{ffmpegArgs.FileName, finalFile})
+
+			err = publishFiles(sidecars, outputs)
+			if err != nil {
+				retcode = a.fail("Failed to move the final files to %s: %s", fdir, err)
+				LogError("The temp directory %s will be kept.", tmpDir)
+				moveErrs = append(moveErrs, err)
+			} else {
+				ffmpegArgs.FileName = finalFile
+				audioFFMpegArgs.FileName = finalSeparateAudio
+			}
+		} else {
+			// Leave the inputs where a normal run would, for muxing by hand
+			moveInputs()
+		}
+
+		for _, err = range moveErrs {
+			if err != nil {
+				movesOk = false
+				break
+			}
+		}
+	}
+
+	if !movesOk {
+		LogError("At least one error occurred when moving files. Will not delete them.")
+	} else if tmpDir != fdir {
+		os.RemoveAll(tmpDir)
+	}
+
+	if retcode != 0 {
+		return retcode
+	}
+
+	CleanupFiles(filesToDel)
+	if movesOk {
+		CleanupFiles(info.dataCopies())
+	}
+
+	var storyboardFiles []string
+	if o.WriteStoryboard && !audioOnly {
+		LogGeneral("Generating storyboard...")
+		duration := info.DLState[info.Quality].Fragments * info.TargetDuration
+		storyboardFiles, err = GenerateStoryboard(o.FFmpegPath, ffmpegArgs.FileName, filepath.Join(fdir, fname), duration, info.FileMode)
+		if err != nil {
+			LogError("Failed to generate the storyboard: %s", err)
+		}
+	}
+
+	finalFiles := []string{ffmpegArgs.FileName}
+	if o.SeparateAudio {
+		finalFiles = append(finalFiles, audioFFMpegArgs.FileName)
+	}
+
+	if manifest != nil {
+		for _, finalFile := range finalFiles {
+			err = manifest.AddFinalFile(finalFile)
+			if err != nil {
+				LogWarn("Failed to hash the final file: %s", err)
+			}
+		}
+
+		err = manifest.Write(finalManifest, info.FileMode)
+		if err != nil {
+			LogError("Failed to write the hash manifest: %s", err)
+		} else {
+			finalFiles = append(finalFiles, finalManifest)
+		}
+	}
+
+	var tsrFiles []string
+	if len(o.TimestampURL) > 0 {
+		var tsaClient HttpClient = httpClient
+		if o.Client != nil {
+			tsaClient = o.Client
+		}
+
+		LogGeneral("Requesting trusted timestamps from %s...", o.TimestampURL)
+		for _, finalFile := range finalFiles {
+			tsrFile, err := TimestampFile(ctx, tsaClient, o.TimestampURL, finalFile, info.FileMode)
+			if err != nil {
+				LogError("Failed to timestamp %s: %s", finalFile, err)
+				continue
+			}
+
+			LogInfo("Wrote timestamp token %s", tsrFile)
+			tsrFiles = append(tsrFiles, tsrFile)
+		}
+	}
+
+	var localCopies []string
+	if storage != nil {
+		outputs := []string{ffmpegArgs.FileName}
+		if o.SeparateAudio {
+			outputs = append(outputs, audioFFMpegArgs.FileName)
+		}
+		if writeThumbnail {
+			outputs = append(outputs, finalThumbnail)
+		}
+		if o.WriteDescription && Exists(finalDescFile) {
+			outputs = append(outputs, finalDescFile)
+		}
+		if o.WriteInfoJSON && Exists(finalInfoFile) {
+			outputs = append(outputs, finalInfoFile)
+		}
+		if o.WARC && Exists(finalWarcFile) {
+			outputs = append(outputs, finalWarcFile)
+		}
+		if o.WriteFragmentTimes && Exists(finalFragTimes) {
+			outputs = append(outputs, finalFragTimes)
+		}
+		if o.WriteDiscontinuities && Exists(finalDiscontinuities) {
+			outputs = append(outputs, finalDiscontinuities)
+		}
+		if o.WriteLiveChat && Exists(finalLiveChat) {
+			outputs = append(outputs, finalLiveChat)
+		}
+		if source != nil {
+			outputs = append(outputs, source.Files()...)
+		}
+		if manifest != nil {
+			for _, manifestFile := range []string{finalManifest, finalManifest + ".sig"} {
+				if Exists(manifestFile) {
+					outputs = append(outputs, manifestFile)
+				}
+			}
+		}
+		outputs = append(outputs, tsrFiles...)
+		outputs = append(outputs, storyboardFiles...)
+		if fragArchive != nil && Exists(fragArchive.Name()) {
+			outputs = append(outputs, fragArchive.Name())
+		}
+		if snapshotter != nil {
+			snapshots, _ := filepath.Glob(filepath.Join(snapshotter.Dir, "*.jpg"))
+			outputs = append(outputs, snapshots...)
+		}
+		if o.KeepTSFiles {
+			for _, tsFile := range []string{finalAudioFile, finalVideoFile} {
+				if Exists(tsFile) {
+					outputs = append(outputs, tsFile)
+				}
+			}
+		}
+
+		LogGeneral("Storing final files...")
+		locations, err := StoreFiles(ctx, storage, storeDir, outputs)
+		if err != nil {
+			LogError("The files that were not stored are still in %s", fdir)
+			return a.fail("%s", err)
+		}
+
+		if o.StorageDeleteLocal {
+			CleanupFiles(outputs)
+		} else {
+			// Some backends move the files instead of copying them
+			for _, output := range outputs {
+				if Exists(output) {
+					localCopies = append(localCopies, output)
+				}
+			}
+		}
+
+		ffmpegArgs.FileName = locations[0]
+		if o.SeparateAudio {
+			audioFFMpegArgs.FileName = locations[1]
+		}
+	}
+
+	a.result.FinalFile = ffmpegArgs.FileName
+	LogGeneral("%[1]sFinal file: %[2]s%[1]s", "\n", ffmpegArgs.FileName)
+	muxedFiles := []string{ffmpegArgs.FileName}
+	if o.SeparateAudio {
+		a.result.AudioFile = audioFFMpegArgs.FileName
+		LogGeneral("%[1]sFinal audio file: %[2]s%[1]s", "\n", audioFFMpegArgs.FileName)
+		muxedFiles = append(muxedFiles, audioFFMpegArgs.FileName)
+	}
+	a.notify(info, WebhookMuxComplete, muxedFiles, nil)
+
+	if len(o.ArchiveDB) > 0 {
+		itag := info.Quality
+		if audioOnly {
+			itag = AudioItag
+		}
+
+		files := []string{ffmpegArgs.FileName}
+		if o.SeparateAudio {
+			files = append(files, audioFFMpegArgs.FileName)
+		}
+
+		err = AppendArchiveRecord(o.ArchiveDB, &ArchiveRecord{
+			VideoID:      info.VideoID,
+			Title:        info.FormatInfo["title"],
+			Channel:      info.FormatInfo["channel"],
+			ChannelID:    info.FormatInfo["channel_id"],
+			URL:          info.FormatInfo["url"],
+			StartDate:    info.FormatInfo["start_date"],
+			StartedAt:    startedAt.UTC().Format(time.RFC3339),
+			CapturedAt:   time.Now().UTC().Format(time.RFC3339),
+			Itag:         itag,
+			DurationSecs: info.DLState[itag].Fragments * info.TargetDuration,
+			Fragments:    info.DLState[itag].Fragments,
+			Bytes:        totalBytes,
+			Files:        files,
+			LocalFiles:   localCopies,
+		})
+		if err != nil {
+			LogWarn("Failed to add the capture to the archive database: %s", err)
+		}
+
+		if o.Retention.Enabled() {
+			removed, err := ApplyRetention(o.ArchiveDB, &o.Retention)
+			if err != nil {
+				LogWarn("Failed to apply the retention policy: %s", err)
+			} else if removed > 0 {
+				LogGeneral("Removed the local copies of %d older captures", removed)
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,118 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Quality label that picks the highest quality the connection can keep up with
+	AutoQuality = "auto"
+	// How much faster than the stream the measured throughput must be
+	AutoQualityHeadroom = 1.5
+	// Most fragments downloaded at once to measure the throughput
+	AutoQualityMaxSamples = 8
+)
+
+/*
+Measure how fast fragments can be downloaded, in bits per second, by
+downloading the newest fragments of the given format at once, one for each
+download thread. Returns 0 if none could be downloaded.
+*/
+func (di *DownloadInfo) MeasureThroughput(ctx context.Context, url string) int {
+	di.RLock()
+	client, lastSq, jobs := di.MediaHttpClient(), di.LastSq, di.Jobs
+	di.RUnlock()
+
+	return measureThroughput(ctx, client, url, lastSq, jobs)
+}
+
+// MeasureThroughput for the fragments before lastSq, without the info lock
+func measureThroughput(ctx context.Context, client HttpClient, url string, lastSq, jobs int) int {
+	samples := jobs
+	if samples < 1 {
+		samples = 1
+	} else if samples > AutoQualityMaxSamples {
+		samples = AutoQualityMaxSamples
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	total := 0
+	start := time.Now()
+
+	// The newest fragment may still be being written
+	for seq := lastSq - 1; seq >= 0 && seq >= lastSq-samples; seq-- {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			data := DownloadData(ctx, client, fmt.Sprintf(url, seq))
+			lock.Lock()
+			total += len(data)
+			lock.Unlock()
+		}(seq)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	if total == 0 || elapsed <= 0 {
+		return 0
+	}
+
+	return int(float64(total*8) / elapsed)
+}
+
+/*
+Pick the highest of the available qualities whose bitrate, along with the
+audio's, fits in the measured throughput with some headroom. The measured
+bitrate of a format is used over the one in the manifest when known. Falls
+back to the lowest quality if even that does not fit, or to the highest if
+nothing could be measured. Called with the lock held, which is let go of
+while measuring so status requests and the like are not held up.
+*/
+func (di *DownloadInfo) pickAutoQuality(ctx context.Context, qualities []string, dlUrls map[int]string) string {
+	var videoQualities []string
+	for _, q := range qualities {
+		if q != "audio_only" {
+			videoQualities = append(videoQualities, q)
+		}
+	}
+	if len(videoQualities) == 0 {
+		return "audio_only"
+	}
+
+	best := videoQualities[len(videoQualities)-1]
+	if di.LastSq < 1 {
+		LogWarn("Stream has no fragments to measure the connection with yet, selecting %s", best)
+		return best
+	}
+
+	url := dlUrls[di.qualityItag(best, dlUrls)]
+	client, lastSq, jobs := di.MediaHttpClient(), di.LastSq, di.Jobs
+	di.Unlock()
+	throughput := measureThroughput(ctx, client, url, lastSq, jobs)
+	di.Lock()
+	if throughput == 0 {
+		LogWarn("Could not measure the connection's throughput, selecting %s", best)
+		return best
+	}
+	LogInfo("Measured throughput: %s", FormatBitrate(throughput))
+
+	audioBitrate := 0
+	if !di.VideoOnly {
+		audioBitrate = di.formatBitrate(AudioItag)
+	}
+
+	for i := len(videoQualities) - 1; i >= 0; i-- {
+		q := videoQualities[i]
+		needed := float64(di.formatBitrate(di.qualityItag(q, dlUrls))+audioBitrate) * AutoQualityHeadroom
+		if needed <= float64(throughput) {
+			return q
+		}
+	}
+
+	LogWarn("The connection may not keep up with even the lowest quality, selecting %s", videoQualities[0])
+	return videoQualities[0]
+}
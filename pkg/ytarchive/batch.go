@@ -0,0 +1,75 @@
+package ytarchive
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+Read the URLs listed in a batch file, one per line. Blank lines and lines
+starting with # or ; are skipped, as is anything after a # preceded by a
+space. "-" reads the list from stdin.
+*/
+func ReadBatchFile(fname string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if fname != "-" {
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if idx := strings.Index(line, " #"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		urls = append(urls, ExpandChannelURL(line))
+	}
+
+	return urls, scanner.Err()
+}
+
+/*
+Queue up the streams of the batch file after the given URL, keeping the
+queue in memory if there is no queue file, to be downloaded one after
+another.
+*/
+func (a *Archiver) enqueueBatch(urls []string) error {
+	o := a.Options
+	if a.queue == nil {
+		queue, _ := LoadQueue("", o.FileMode)
+		a.Lock()
+		a.queue = queue
+		a.Unlock()
+	}
+
+	// The given URL goes first, as it does with a queue file
+	if len(o.URL) > 0 && !IsPlaylistUrl(o.URL) {
+		urls = append([]string{o.URL}, urls...)
+	}
+
+	for _, streamUrl := range urls {
+		err := a.queue.AddWithPriority(streamUrl, o.Quality, o.Priority)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.queue.Len() == 0 {
+		return errors.New("the batch file has no URLs in it")
+	}
+
+	return nil
+}
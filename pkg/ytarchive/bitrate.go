@@ -0,0 +1,173 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// How many of the newest fragments of each format MeasureFormats downloads
+const BitrateSampleFrags = 3
+
+// Human readable bitrate from bits per second
+func FormatBitrate(bps int) string {
+	if bps >= 1000000 {
+		return fmt.Sprintf("%.2fMbps", float64(bps)/1000000)
+	}
+
+	return fmt.Sprintf("%dkbps", bps/1000)
+}
+
+/*
+Estimate the real bitrate of the fragments downloaded so far, in bits per
+second. The bandwidth in the manifest is often far off for live streams.
+*/
+func (fs *FragmentStats) Bitrate(fragDuration int) int {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if len(fs.Sizes) == 0 || fragDuration <= 0 {
+		return 0
+	}
+
+	return int(fs.TotalSize * 8 / int64(len(fs.Sizes)*fragDuration))
+}
+
+// Bitrate of a format, preferring the measured one over the manifest's
+func (di *DownloadInfo) formatBitrate(itag int) int {
+	details, ok := di.FormatDetails[itag]
+	if !ok {
+		return 0
+	}
+	if details.MeasuredBitrate > 0 {
+		return details.MeasuredBitrate
+	}
+
+	return details.Bitrate
+}
+
+// Estimated bitrate of everything being downloaded, for the status line
+func (di *DownloadInfo) MeasuredBitrate() int {
+	bitrate := 0
+	for _, mdl := range di.MDLInfo {
+		bitrate += mdl.FragStats.Bitrate(di.TargetDuration)
+	}
+
+	return bitrate
+}
+
+/*
+Download the newest few fragments of every format the stream offers and
+set their MeasuredBitrate from the sizes. Fragments that fail to download
+are skipped, leaving formats without any at 0.
+*/
+func (di *DownloadInfo) MeasureFormats(ctx context.Context) {
+	if di.LastSq < 0 || di.TargetDuration <= 0 {
+		return
+	}
+
+	for itag, url := range di.FormatURLs {
+		details, ok := di.FormatDetails[itag]
+		if !ok {
+			details = &FormatDetails{Itag: itag}
+			di.FormatDetails[itag] = details
+		}
+
+		total := 0
+		frags := 0
+		// The newest fragment may still be being written
+		for seq := di.LastSq - 1; seq >= 0 && seq >= di.LastSq-BitrateSampleFrags; seq-- {
+			data := DownloadData(ctx, di.MediaHttpClient(), fmt.Sprintf(url, seq))
+			if ctx.Err() != nil {
+				return
+			}
+
+			if len(data) > 0 {
+				total += len(data)
+				frags += 1
+			}
+		}
+
+		if frags > 0 {
+			details.MeasuredBitrate = total * 8 / (frags * di.TargetDuration)
+		}
+	}
+}
+
+/*
+Print every format the stream offers with its quality label, codecs, and
+bitrates, from the lowest to the highest quality.
+*/
+func (di *DownloadInfo) PrintFormats() {
+	// Order by position in VideoQualities, with unknown itags last
+	labels := make(map[int]string)
+	ranks := make(map[int]int)
+	for rank, quality := range VideoQualities {
+		itags := VideoLabelItags[quality]
+		if quality == "audio_only" {
+			labels[AudioItag] = quality
+			ranks[AudioItag] = rank
+			continue
+		}
+
+		labels[itags.H264] = quality + " (h264)"
+		labels[itags.VP9] = quality + " (vp9)"
+		ranks[itags.H264] = rank
+		ranks[itags.VP9] = rank
+		// Shared between frame rates, so labelled by the format's
+		if di.itagQuality(itags.AV1) == quality {
+			labels[itags.AV1] = quality + " (av1)"
+			ranks[itags.AV1] = rank
+		}
+	}
+
+	var itags []int
+	for itag := range di.FormatURLs {
+		itags = append(itags, itag)
+	}
+	sort.Slice(itags, func(i, j int) bool {
+		ri, iok := ranks[itags[i]]
+		rj, jok := ranks[itags[j]]
+		if !iok {
+			ri = len(VideoQualities)
+		}
+		if !jok {
+			rj = len(VideoQualities)
+		}
+		if ri != rj {
+			return ri < rj
+		}
+
+		return itags[i] < itags[j]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ITAG\tQUALITY\tCODECS\tFPS\tBITRATE\tMEASURED")
+	for _, itag := range itags {
+		label := labels[itag]
+		if len(label) == 0 {
+			label = "-"
+		}
+
+		codecs, fps, bitrate, measured := "-", "-", "-", "-"
+		if details, ok := di.FormatDetails[itag]; ok {
+			if len(details.Codecs) > 0 {
+				codecs = details.Codecs
+			}
+			if details.Fps > 0 {
+				fps = fmt.Sprint(details.Fps)
+			}
+			if details.Bitrate > 0 {
+				bitrate = FormatBitrate(details.Bitrate)
+			}
+			if details.MeasuredBitrate > 0 {
+				measured = FormatBitrate(details.MeasuredBitrate)
+			}
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", itag, label, codecs, fps, bitrate, measured)
+	}
+	w.Flush()
+}
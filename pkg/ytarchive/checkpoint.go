@@ -0,0 +1,210 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Added to the video ID for the name of a download's checkpoint file
+const CheckpointSuffix = ".checkpoint.json"
+
+/*
+What is needed to resume a download that was cut short, by a crash or
+otherwise, without being given the stream again. Written next to the state
+files when the download starts and deleted along with them. How far each
+format got is kept in its state file, which is rewritten after every
+fragment, see DownloadState.
+*/
+type Checkpoint struct {
+	VideoID string `json:"video_id"`
+	URL     string `json:"url"`
+	// Label of the video quality being downloaded, such as 1080p60
+	Quality      string            `json:"quality"`
+	Itags        []int             `json:"itags"`
+	OutputFormat string            `json:"output_format"`
+	TempDir      string            `json:"temp_dir"`
+	BasePaths    map[string]string `json:"base_paths"`
+	StateFiles   []string          `json:"state_files"`
+	StartedAt    string            `json:"started_at"`
+}
+
+func checkpointFile(dir, videoID string) string {
+	return filepath.Join(dir, videoID+CheckpointSuffix)
+}
+
+// The quality label an itag is downloaded for, audio_only for AudioOnlyQuality
+func (di *DownloadInfo) itagQualityLabel(itag int) string {
+	if itag == AudioOnlyQuality {
+		return "audio_only"
+	}
+
+	return di.itagQuality(itag)
+}
+
+// Record the download in dir, keeping the start time of an earlier checkpoint
+func (di *DownloadInfo) writeCheckpoint(dir, outputFormat string) (string, error) {
+	itags := []int{AudioItag}
+	if di.Quality != AudioOnlyQuality {
+		itags = append(itags, di.Quality)
+	}
+
+	cp := &Checkpoint{
+		VideoID:      di.VideoID,
+		URL:          fmt.Sprintf("https://www.youtube.com/watch?v=%s", di.VideoID),
+		Quality:      di.itagQualityLabel(di.Quality),
+		Itags:        itags,
+		OutputFormat: outputFormat,
+		TempDir:      di.DLState[AudioItag].TempDir,
+		BasePaths:    make(map[string]string),
+		StartedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+
+	for dataType, mdl := range di.MDLInfo {
+		cp.BasePaths[dataType] = mdl.BasePath
+	}
+	for _, itag := range itags {
+		if state := di.DLState[itag]; state != nil && len(state.File) > 0 {
+			cp.StateFiles = append(cp.StateFiles, state.File)
+		}
+	}
+
+	fpath := checkpointFile(dir, di.VideoID)
+	if old, err := LoadCheckpoint(fpath); err == nil && len(old.StartedAt) > 0 {
+		cp.StartedAt = old.StartedAt
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return fpath, os.WriteFile(fpath, data, di.FileMode)
+}
+
+func LoadCheckpoint(fpath string) (*Checkpoint, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", fpath, err)
+	}
+
+	return cp, nil
+}
+
+/*
+Find the checkpoints of downloads that can be resumed in dir, oldest first.
+Checkpoints that can not be read are skipped after saying why.
+*/
+func FindCheckpoints(dir string) ([]*Checkpoint, error) {
+	if len(dir) == 0 {
+		dir = "."
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+CheckpointSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoints []*Checkpoint
+	for _, fpath := range files {
+		cp, err := LoadCheckpoint(fpath)
+		if err != nil {
+			LogWarn("Skipping checkpoint: %s", err)
+			continue
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+
+	sort.SliceStable(checkpoints, func(i, j int) bool {
+		return checkpoints[i].StartedAt < checkpoints[j].StartedAt
+	})
+
+	return checkpoints, nil
+}
+
+/*
+The sequence number each format of the download picks up at, from its state
+file. Formats with no state file yet start over.
+*/
+func (cp *Checkpoint) NextSequences() map[int]int {
+	seqs := make(map[int]int)
+	for i, stateFile := range cp.StateFiles {
+		if i >= len(cp.Itags) {
+			break
+		}
+
+		data, err := os.ReadFile(stateFile)
+		if err != nil {
+			continue
+		}
+
+		state := &DownloadState{}
+		if json.Unmarshal(data, state) == nil {
+			seqs[cp.Itags[i]] = state.StartFrag + state.Fragments
+		}
+	}
+
+	return seqs
+}
+
+/*
+Resume the downloads that have checkpoints in the temp directory, one after
+another, oldest first. Each is downloaded as it was started: from its watch
+page, in the same quality and codec, and to the same file names.
+*/
+func (a *Archiver) runCheckpoints() int {
+	o := a.Options
+	checkpoints, err := FindCheckpoints(o.TempDir)
+	if err != nil {
+		return a.fail("Failed to look for downloads to resume: %s", err)
+	}
+	if len(checkpoints) == 0 {
+		dir := o.TempDir
+		if len(dir) == 0 {
+			dir = "the current directory"
+		}
+		return a.fail("No downloads to resume in %s", dir)
+	}
+
+	retcode := 0
+	for _, cp := range checkpoints {
+		if a.isStopRequested() {
+			break
+		}
+
+		LogGeneral("Resuming %s in %s", cp.VideoID, cp.Quality)
+		for itag, seq := range cp.NextSequences() {
+			LogInfo("Itag %d picks up at fragment %d", itag, seq)
+		}
+
+		o.URL = cp.URL
+		o.Quality = cp.Quality
+		if len(cp.OutputFormat) > 0 {
+			o.OutputFormat = cp.OutputFormat
+		}
+		if itags, ok := VideoLabelItags[cp.Quality]; ok && len(cp.Itags) > 1 {
+			o.VP9 = cp.Itags[1] == itags.VP9
+			o.AV1 = cp.Itags[1] == itags.AV1
+			o.H264 = cp.Itags[1] == itags.H264
+		}
+
+		a.result = &Result{}
+		a.result.Retcode = a.run()
+		a.result.Cancelled = a.cancelled
+		if a.result.Retcode != 0 {
+			LogWarn("Resuming %s finished with exit code %d", cp.VideoID, a.result.Retcode)
+			retcode = a.result.Retcode
+		}
+	}
+
+	return retcode
+}
@@ -0,0 +1,67 @@
+package ytarchive
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+How far the local clock can be off from YouTube's before it is warned about
+and made up for. The Date header only has whole seconds and the response
+takes a while to arrive, so smaller differences are just noise.
+*/
+const ClockSkewThreshold = 30 * time.Second
+
+var (
+	clockLock   sync.RWMutex
+	clockOffset time.Duration
+	clockWarned bool
+)
+
+/*
+Compare the local clock with the Date header of a response from YouTube.
+If it is off by more than ClockSkewThreshold, warn about it once and keep
+the difference for ServerNow.
+*/
+func CheckClockSkew(resp *http.Response) {
+	host := resp.Request.URL.Hostname()
+	if !strings.HasSuffix(host, "youtube.com") && !strings.HasSuffix(host, "googlevideo.com") {
+		return
+	}
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	// The header is truncated to the second, so aim for the middle of it
+	offset := serverTime.Add(500 * time.Millisecond).Sub(time.Now())
+	if offset < ClockSkewThreshold && offset > -ClockSkewThreshold {
+		offset = 0
+	}
+
+	clockLock.Lock()
+	defer clockLock.Unlock()
+
+	clockOffset = offset
+	if offset != 0 && !clockWarned {
+		clockWarned = true
+		direction := "behind"
+		if offset < 0 {
+			direction = "ahead of"
+			offset = -offset
+		}
+
+		LogWarn("The local clock is %s %s YouTube's. Making up for it in scheduled start times and signed requests, but consider syncing the clock.",
+			SecondsToDurationStr(int(offset.Round(time.Second).Seconds())), direction)
+	}
+}
+
+// The current time according to YouTube, as far as is known
+func ServerNow() time.Time {
+	clockLock.RLock()
+	defer clockLock.RUnlock()
+	return time.Now().Add(clockOffset)
+}
@@ -0,0 +1,330 @@
+package ytarchive
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands understood by the control socket
+const (
+	ControlStatus = "status"
+	ControlStop   = "stop"
+	ControlAttach = "attach"
+)
+
+const (
+	// How long a control client waits for the daemon to answer
+	ControlTimeout = 10 * time.Second
+	// How often an attached client is sent the download's status
+	ControlAttachInterval = time.Second
+)
+
+/*
+A request sent to the control socket, one JSON object per line.
+VideoID picks the download for ControlStop and ControlAttach. An attached
+connection is sent a response every ControlAttachInterval until the
+download is gone or the client disconnects.
+*/
+type ControlRequest struct {
+	Command string `json:"command"`
+	VideoID string `json:"video_id,omitempty"`
+}
+
+// The answer to a ControlRequest, also one JSON object per line
+type ControlResponse struct {
+	OK        bool             `json:"ok"`
+	Error     string           `json:"error,omitempty"`
+	Downloads []DownloadStatus `json:"downloads,omitempty"`
+}
+
+/*
+Where a download running in an archiver is at. The archiver's own download
+comes first, then its other views or scheduled jobs.
+*/
+type DownloadStatus struct {
+	VideoID   string `json:"video_id"`
+	Title     string `json:"title,omitempty"`
+	State     string `json:"state"`
+	Paused    bool   `json:"paused,omitempty"`
+	Fragments int    `json:"fragments"`
+	Bytes     int64  `json:"bytes"`
+	// The status line printed to the console, without terminal codes
+	Status string `json:"status,omitempty"`
+}
+
+// The parts of a DownloadInfo shown by Archiver.Downloads
+type downloadSummary struct {
+	Title  string
+	Status string
+	Paused bool
+}
+
+// Never takes the main lock, which GetVideoInfo holds while waiting for a stream
+func (di *DownloadInfo) getSummary() downloadSummary {
+	di.summaryLock.Lock()
+	defer di.summaryLock.Unlock()
+	return di.summary
+}
+
+// The status of every download the archiver is running
+func (a *Archiver) Downloads() []DownloadStatus {
+	var downloads []DownloadStatus
+	if di := a.Info(); di != nil && len(di.VideoID) > 0 {
+		summary := di.getSummary()
+		status := DownloadStatus{
+			VideoID: di.VideoID,
+			Title:   summary.Title,
+			State:   StateName(di.GetState()),
+			Paused:  summary.Paused,
+			Status:  strings.TrimSpace(strings.TrimSuffix(summary.Status, "\033[K")),
+		}
+		for _, mdl := range di.MDLInfo {
+			status.Fragments += mdl.FragStats.Count()
+			status.Bytes += mdl.FragStats.Size()
+		}
+
+		downloads = append(downloads, status)
+	}
+
+	for _, view := range a.getViews() {
+		downloads = append(downloads, view.Downloads()...)
+	}
+
+	return downloads
+}
+
+// The control socket used when none is given
+func DefaultControlSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if len(dir) > 0 {
+		return filepath.Join(dir, "ytarchive.sock")
+	}
+
+	// Windows has no user IDs
+	if uid := os.Getuid(); uid >= 0 {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("ytarchive-%d.sock", uid))
+	}
+
+	return filepath.Join(os.TempDir(), "ytarchive.sock")
+}
+
+/*
+Lets local scripts check on and stop the downloads of a running archiver
+through a unix socket, see ControlRequest. Only the user running the
+archiver can connect.
+*/
+type ControlServer struct {
+	listener net.Listener
+	archiver *Archiver
+	wg       sync.WaitGroup
+}
+
+/*
+Listen on the socket at path. A socket left behind by an archiver that is
+no longer running is replaced, one still in use is an error.
+*/
+func StartControlServer(path string, a *Archiver) (*ControlServer, error) {
+	if Exists(path) {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another ytarchive", path)
+		}
+
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	cs := &ControlServer{
+		listener: listener,
+		archiver: a,
+	}
+	cs.wg.Add(1)
+	go cs.serve()
+
+	return cs, nil
+}
+
+func (cs *ControlServer) serve() {
+	defer cs.wg.Done()
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				LogWarn("Control socket stopped: %s", err)
+			}
+			return
+		}
+
+		go cs.handle(conn)
+	}
+}
+
+func (cs *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		req := &ControlRequest{}
+		resp := &ControlResponse{}
+		err := json.Unmarshal(scanner.Bytes(), req)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %s", err)
+		} else if req.Command == ControlAttach {
+			cs.attach(conn, enc, req.VideoID)
+			return
+		} else {
+			cs.run(req, resp)
+		}
+
+		if enc.Encode(resp) != nil {
+			return
+		}
+	}
+}
+
+func (cs *ControlServer) run(req *ControlRequest, resp *ControlResponse) {
+	LogDebug("Control socket: %s %s", req.Command, req.VideoID)
+	switch req.Command {
+	case ControlStatus:
+		resp.OK = true
+		resp.Downloads = cs.archiver.Downloads()
+	case ControlStop:
+		if len(req.VideoID) == 0 {
+			resp.Error = "no video ID given"
+		} else if !cs.archiver.StopVideo(req.VideoID) {
+			resp.Error = fmt.Sprintf("%s is not being downloaded", req.VideoID)
+		} else {
+			resp.OK = true
+		}
+	default:
+		resp.Error = fmt.Sprintf("unknown command %s", req.Command)
+	}
+}
+
+/*
+Send the status of a download until it is gone or the client disconnects.
+With no video ID, the only download running is picked.
+*/
+func (cs *ControlServer) attach(conn net.Conn, enc *json.Encoder, videoID string) {
+	ticker := time.NewTicker(ControlAttachInterval)
+	defer ticker.Stop()
+
+	for {
+		resp := &ControlResponse{}
+		downloads := cs.archiver.Downloads()
+		if len(videoID) == 0 && len(downloads) == 1 {
+			videoID = downloads[0].VideoID
+		}
+
+		for _, dl := range downloads {
+			if dl.VideoID == videoID {
+				resp.OK = true
+				resp.Downloads = []DownloadStatus{dl}
+				break
+			}
+		}
+
+		if !resp.OK {
+			resp.Error = fmt.Sprintf("%s is not being downloaded", videoID)
+			if len(videoID) == 0 {
+				resp.Error = fmt.Sprintf("%d downloads are running, give a video ID", len(downloads))
+			}
+		}
+
+		conn.SetDeadline(time.Now().Add(ControlTimeout))
+		if enc.Encode(resp) != nil || !resp.OK {
+			return
+		}
+
+		<-ticker.C
+	}
+}
+
+// Stop listening and remove the socket
+func (cs *ControlServer) Close() error {
+	err := cs.listener.Close()
+	cs.wg.Wait()
+	return err
+}
+
+/*
+Follow a download of the archiver listening on the control socket at path,
+calling fn with its status until it is gone. Returns the error given for
+the download not running, which is expected once it finishes.
+*/
+func AttachControl(path, videoID string, fn func(*DownloadStatus)) error {
+	conn, err := net.DialTimeout("unix", path, ControlTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(&ControlRequest{Command: ControlAttach, VideoID: videoID})
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ControlTimeout))
+		resp := &ControlResponse{}
+		err = dec.Decode(resp)
+		if err != nil {
+			return err
+		}
+
+		if !resp.OK {
+			return errors.New(resp.Error)
+		}
+
+		fn(&resp.Downloads[0])
+	}
+}
+
+// Send a request to the archiver listening on the control socket at path
+func SendControlRequest(path string, req *ControlRequest) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, ControlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ControlResponse{}
+	err = json.NewDecoder(conn).Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,108 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of Discontinuity
+const (
+	// Fragments given up on to catch up with the stream, see CatchUpFrags
+	DiscontinuitySkip = "skip"
+	// A different video format was downloaded from here on, see FullRefresh
+	DiscontinuityFormatChange = "format-change"
+	// The system slept, so fragments may have been skipped or stalled
+	DiscontinuitySleep = "sleep"
+	// The network changed and requests in flight were retried
+	DiscontinuityNetwork = "network-change"
+)
+
+/*
+Something that happened during a download that makes the archive around
+that point less trustworthy, written out with WriteDiscontinuities.
+*/
+type Discontinuity struct {
+	Kind string `json:"kind"`
+	// Empty when it affected every stream
+	DataType string    `json:"data_type,omitempty"`
+	WallTime time.Time `json:"wall_time"`
+	// Fragments written to the file before this happened, and where that
+	// is in the final file in seconds
+	Fragment  int `json:"fragment"`
+	MediaTime int `json:"media_time"`
+	// Seconds of the stream that are missing or suspect, if known
+	Duration int `json:"duration,omitempty"`
+	// Sequences of the fragments skipped
+	StartSeq int    `json:"start_seq,omitempty"`
+	EndSeq   int    `json:"end_seq,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+
+	// Data type Fragment counts
+	fragType string
+}
+
+type discontinuityLog struct {
+	sync.Mutex
+	entries []Discontinuity
+}
+
+/*
+Note a discontinuity. The wall time is filled in, and so is the fragment
+if it is left at 0, from the written fragments of its data type or of the
+video if it has none.
+*/
+func (di *DownloadInfo) addDiscontinuity(d Discontinuity) {
+	dataType := d.DataType
+	if len(dataType) == 0 {
+		dataType = DtypeVideo
+		if di.Quality == AudioOnlyQuality {
+			dataType = DtypeAudio
+		}
+	}
+
+	if d.Fragment == 0 {
+		mdl := di.MDLInfo[dataType]
+		mdl.RLock()
+		d.Fragment = mdl.Written
+		mdl.RUnlock()
+	}
+	d.WallTime = time.Now()
+	d.fragType = dataType
+
+	di.discontinuities.Lock()
+	defer di.discontinuities.Unlock()
+	di.discontinuities.entries = append(di.discontinuities.entries, d)
+}
+
+/*
+Write every discontinuity noted so far to a JSON file. Media times count
+the holes left for skipped fragments if withGaps is set, see FillGaps.
+*/
+func (di *DownloadInfo) WriteDiscontinuities(fpath string, withGaps bool) error {
+	di.discontinuities.Lock()
+	entries := make([]Discontinuity, len(di.discontinuities.entries))
+	copy(entries, di.discontinuities.entries)
+	di.discontinuities.Unlock()
+
+	for i := range entries {
+		d := &entries[i]
+		frags := d.Fragment
+		if withGaps {
+			for _, skip := range entries {
+				if skip.Kind == DiscontinuitySkip && skip.fragType == d.fragType && skip.Fragment <= d.Fragment && skip.WallTime.Before(d.WallTime) {
+					frags += skip.EndSeq - skip.StartSeq + 1
+				}
+			}
+		}
+		d.MediaTime = frags * di.TargetDuration
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fpath, data, di.FileMode)
+}
@@ -0,0 +1,198 @@
+package ytarchive
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// How often the disk budget is checked while jobs are running
+	DiskBudgetCheckSecs = 10
+	// Downloads paused for the budget resume once usage drops below this
+	// share of it
+	DiskBudgetResumeRatio = 0.9
+)
+
+/*
+Keeps the jobs of a channel monitor within a shared disk budget, counted
+as the fragments each running job has downloaded plus the final files of
+the jobs that finished. Once the budget is used up no new jobs are started,
+and running downloads are paused one at a time, lowest priority and then
+newest first, so the most important keeps going. Downloads paused this way
+resume as usage drops again, highest priority first, which takes the final
+files being moved off the disk, such as to storage.
+*/
+type diskBudget struct {
+	limit  int64
+	paused map[*Archiver]bool
+	ticker *time.Ticker
+	// Final files of the jobs that finished, by job
+	kept map[*Archiver][]string
+}
+
+// Returns nil for no budget, which every method accepts
+func newDiskBudget(limit int64) *diskBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &diskBudget{
+		limit:  limit,
+		paused: make(map[*Archiver]bool),
+		ticker: time.NewTicker(DiskBudgetCheckSecs * time.Second),
+		kept:   make(map[*Archiver][]string),
+	}
+}
+
+// Fires when the budget should be checked again
+func (b *diskBudget) C() <-chan time.Time {
+	if b == nil {
+		return nil
+	}
+
+	return b.ticker.C
+}
+
+func (b *diskBudget) Stop() {
+	if b != nil {
+		b.ticker.Stop()
+	}
+}
+
+// Size of the files on disk, skipping any that are gone
+func filesSize(files []string) int64 {
+	var size int64
+	for _, fname := range files {
+		if fi, err := os.Stat(fname); err == nil {
+			size += fi.Size()
+		}
+	}
+
+	return size
+}
+
+// The files a finished job left on disk
+func jobFiles(job *Archiver) []string {
+	var files []string
+	if job.result != nil {
+		for _, fname := range []string{job.result.FinalFile, job.result.AudioFile} {
+			if len(fname) > 0 {
+				files = append(files, fname)
+			}
+		}
+	}
+
+	return files
+}
+
+// Bytes downloaded by a running job, or left on disk by a finished one
+func jobDiskUsage(job *Archiver) int64 {
+	select {
+	case <-job.done:
+		return filesSize(jobFiles(job))
+	default:
+	}
+
+	info := job.Info()
+	if info == nil {
+		return 0
+	}
+
+	var used int64
+	for _, mdl := range info.MDLInfo {
+		used += mdl.FragStats.Size()
+	}
+
+	return used
+}
+
+func (b *diskBudget) usage(jobs []*Archiver) int64 {
+	var used int64
+	for _, files := range b.kept {
+		used += filesSize(files)
+	}
+	for _, job := range jobs {
+		used += jobDiskUsage(job)
+	}
+
+	return used
+}
+
+/*
+Whether a job with the given priority can start. With the budget used up,
+only one that outranks a running download can, which is then paused.
+*/
+func (b *diskBudget) Admit(jobs []*Archiver, priority int) bool {
+	if b == nil || b.usage(jobs) < b.limit {
+		return true
+	}
+
+	for _, job := range jobs {
+		info := job.Info()
+		if info != nil && !info.IsPaused() && job.Options.Priority < priority {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pause or resume a download depending on usage. Jobs are oldest first.
+func (b *diskBudget) Enforce(jobs []*Archiver) {
+	if b == nil {
+		return
+	}
+
+	used := b.usage(jobs)
+	if used >= b.limit {
+		var running []*Archiver
+		for _, job := range jobs {
+			info := job.Info()
+			if info != nil && info.GetState() == StateDownloading && !info.IsPaused() {
+				running = append(running, job)
+			}
+		}
+
+		if len(running) > 1 {
+			job := running[len(running)-1]
+			for i := len(running) - 2; i >= 0; i-- {
+				if running[i].Options.Priority < job.Options.Priority {
+					job = running[i]
+				}
+			}
+
+			LogWarn("Disk budget of %s reached with %s downloaded, pausing %s", FormatSize(b.limit), FormatSize(used), job.Options.URL)
+			job.Pause()
+			b.paused[job] = true
+		}
+
+		return
+	}
+
+	if float64(used) >= float64(b.limit)*DiskBudgetResumeRatio {
+		return
+	}
+
+	var resume *Archiver
+	for _, job := range jobs {
+		if b.paused[job] && (resume == nil || job.Options.Priority > resume.Options.Priority) {
+			resume = job
+		}
+	}
+
+	if resume != nil {
+		LogInfo("Disk budget has room again, resuming %s", resume.Options.URL)
+		resume.Resume()
+		delete(b.paused, resume)
+	}
+}
+
+// Stop tracking a job that finished, other than the files it left
+func (b *diskBudget) Forget(job *Archiver) {
+	if b != nil {
+		delete(b.paused, job)
+		if files := jobFiles(job); len(files) > 0 {
+			b.kept[job] = files
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package ytarchive
+
+import "errors"
+
+func FreeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
@@ -0,0 +1,115 @@
+package ytarchive
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Room left for container overhead and everything else on the disk
+const DiskSpaceHeadroom = 1.1
+
+/*
+Video quality label of an itag, or an empty string if unknown. AV1 itags
+go by the frame rate of the format, as in av1Itag.
+*/
+func (di *DownloadInfo) itagQuality(itag int) string {
+	for _, q := range VideoQualities {
+		itags := VideoLabelItags[q]
+		if q == "audio_only" {
+			continue
+		}
+
+		if itags.H264 == itag || itags.VP9 == itag {
+			return q
+		}
+		if itags.AV1 == itag && di.highFrameRate(itag) == strings.HasSuffix(q, "p60") {
+			return q
+		}
+	}
+
+	return ""
+}
+
+// Projected size in bytes of downloading the audio and a video itag for secs seconds
+func (di *DownloadInfo) projectedSize(videoItag, secs int) int64 {
+	bitrate := 0
+	if !di.VideoOnly {
+		bitrate += di.formatBitrate(AudioItag)
+	}
+	if videoItag != AudioOnlyQuality {
+		bitrate += di.formatBitrate(videoItag)
+	}
+
+	return int64(float64(bitrate) / 8 * float64(secs) * DiskSpaceHeadroom)
+}
+
+/*
+Check if secs seconds of the audio and a video itag would fit on the disks
+they are written to. Fragments are downloaded to dlDir, and muxing writes a
+copy of the same size to finalDir. Returns an error describing the problem
+if not.
+*/
+func (di *DownloadInfo) checkDiskSpace(dlDir, finalDir string, videoItag, secs int, muxing bool) error {
+	size := di.projectedSize(videoItag, secs)
+	needed := map[string]int64{dlDir: size}
+	if muxing {
+		needed[finalDir] += size
+	}
+
+	for dir, size := range needed {
+		free, err := FreeDiskSpace(dir)
+		if err != nil {
+			return nil
+		}
+
+		if uint64(size) > free {
+			return fmt.Errorf("needs about %s in %s, but only %s is free", FormatSize(size), dir, FormatSize(int64(free)))
+		}
+	}
+
+	return nil
+}
+
+/*
+Make sure a download expected to last secs seconds fits on the disks it is
+written to, given the bitrate of the selected quality. Only warns unless
+stepDown is set, in which case lower video qualities are tried until one
+fits. Must be called before the download state is loaded.
+*/
+func (di *DownloadInfo) FitDiskSpace(dlDir, finalDir string, secs int, muxing, stepDown bool) {
+	if _, err := FreeDiskSpace(dlDir); err != nil {
+		LogWarn("Could not check the free disk space: %s", err)
+		return
+	}
+
+	err := di.checkDiskSpace(dlDir, finalDir, di.Quality, secs, muxing)
+	if err == nil {
+		return
+	}
+
+	duration := SecondsToDurationStr(secs)
+	if !stepDown {
+		LogWarn("%s of the selected quality %s. The disk may fill up before the download finishes.", duration, err)
+		return
+	}
+
+	LogWarn("%s of the selected quality %s, looking for a lower quality that fits", duration, err)
+	quality := di.itagQuality(di.Quality)
+	for i := StringsIndex(VideoQualities, quality) - 1; i > 0; i-- {
+		itag := di.qualityItag(VideoQualities[i], di.FormatURLs)
+		if _, ok := di.FormatURLs[itag]; !ok {
+			continue
+		}
+
+		if di.checkDiskSpace(dlDir, finalDir, itag, secs, muxing) == nil {
+			LogGeneral("Selected quality: %s, which should fit", VideoQualities[i])
+			delete(di.DLState, di.Quality)
+			di.DLState[itag] = &DownloadState{}
+			di.Quality = itag
+			di.SetDownloadUrl(DtypeVideo, di.FormatURLs[itag])
+			return
+		}
+	}
+
+	LogWarn("Even the lowest quality will not fit. The disk may fill up before the download finishes.")
+}
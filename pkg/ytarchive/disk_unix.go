@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package ytarchive
+
+import "golang.org/x/sys/unix"
+
+// Bytes available to this user on the volume holding dir
+func FreeDiskSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package ytarchive
+
+import "golang.org/x/sys/windows"
+
+// Bytes available to this user on the volume holding dir
+func FreeDiskSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree)
+	if err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
@@ -0,0 +1,109 @@
+package ytarchive
+
+// Archive states
+const (
+	StateNone = iota
+	StateStarting
+	StateWaiting
+	StateDownloading
+	StateMuxing
+	StateFinished
+)
+
+var stateNames = map[int]string{
+	StateNone:        "none",
+	StateStarting:    "starting",
+	StateWaiting:     "waiting",
+	StateDownloading: "downloading",
+	StateMuxing:      "muxing",
+	StateFinished:    "finished",
+}
+
+func StateName(state int) string {
+	return stateNames[state]
+}
+
+/*
+Progress of an archive, sent after each downloaded fragment
+*/
+type Progress struct {
+	ProgressInfo
+	VideoFragments int
+	AudioFragments int
+	MaxSeq         int
+	TotalBytes     int64
+	// Fragments between the newest one of the stream and the download
+	Lag int
+}
+
+/*
+Functions called as an archive progresses, for use in library mode.
+Any of them can be left nil. They are called from the archiving goroutine,
+so they should return quickly.
+*/
+type Callbacks struct {
+	Progress func(progress *Progress)
+	State    func(state int)
+	Error    func(err error)
+	Behind   func(behind *BehindInfo)
+
+	// Receives the status line instead of it being printed to the terminal.
+	// Called while the DownloadInfo is locked, so it must not call its methods.
+	Status func(status string)
+}
+
+/*
+Move to a new state, calling the state callback if it changed.
+Uses its own lock since GetVideoInfo holds the main one while waiting.
+*/
+func (di *DownloadInfo) SetState(state int) {
+	di.stateLock.Lock()
+	changed := di.State != state
+	di.State = state
+	di.stateLock.Unlock()
+
+	if changed && di.StateFunc != nil {
+		di.StateFunc(state)
+	}
+}
+
+func (di *DownloadInfo) GetState() int {
+	di.stateLock.Lock()
+	defer di.stateLock.Unlock()
+	return di.State
+}
+
+/*
+Add a function to be called with each fragment once it is written to its
+data file, along with its offset in the file. Must be called before the
+downloads start.
+*/
+func (di *DownloadInfo) OnFragment(f func(dataType string, seq int, offset int64, data []byte)) {
+	prev := di.FragmentFunc
+	if prev == nil {
+		di.FragmentFunc = f
+		return
+	}
+
+	di.FragmentFunc = func(dataType string, seq int, offset int64, data []byte) {
+		prev(dataType, seq, offset, data)
+		f(dataType, seq, offset, data)
+	}
+}
+
+/*
+Add a function to be called with each fragment's data exactly as it was
+downloaded, once it is written. Must be called before the downloads start.
+*/
+func (di *DownloadInfo) OnRawFragment(f func(dataType string, seq int, data []byte)) {
+	prev := di.RawFragmentFunc
+	if prev == nil {
+		di.RawFragmentFunc = f
+		return
+	}
+
+	di.RawFragmentFunc = func(dataType string, seq int, data []byte) {
+		prev(dataType, seq, data)
+		f(dataType, seq, data)
+	}
+}
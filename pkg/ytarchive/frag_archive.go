@@ -0,0 +1,184 @@
+package ytarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Formats for KeepFrags
+const (
+	FragArchiveTar = "tar"
+	FragArchiveZip = "zip"
+)
+
+// Name of the index written as the last entry of a fragment archive
+const FragArchiveIndex = "index.json"
+
+type FragArchiveEntry struct {
+	Name     string `json:"name"`
+	DataType string `json:"type"`
+	Itag     int    `json:"itag"`
+	Seq      int    `json:"seq"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+type fragArchiveIndex struct {
+	VideoID string             `json:"video_id"`
+	Entries []FragArchiveEntry `json:"fragments"`
+}
+
+/*
+Packs the raw fragments, exactly as they were downloaded, into a single tar
+or zip file along with an index, so they can be kept and re-muxed later.
+*/
+type FragArchive struct {
+	sync.Mutex
+	Format string
+
+	name  string
+	file  *os.File
+	tw    *tar.Writer
+	zw    *zip.Writer
+	itags map[string]int
+	index fragArchiveIndex
+}
+
+func IsValidFragArchiveFormat(format string) bool {
+	return format == FragArchiveTar || format == FragArchiveZip
+}
+
+/*
+Create a fragment archive at fname. itags maps each data type to the itag
+being downloaded for it, which is used in the entry names.
+*/
+func NewFragArchive(fname, format, videoId string, itags map[string]int, mode os.FileMode) (*FragArchive, error) {
+	if !IsValidFragArchiveFormat(format) {
+		return nil, fmt.Errorf("unknown fragment archive format %s, use tar or zip", format)
+	}
+
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	fa := &FragArchive{
+		Format: format,
+		name:   fname,
+		file:   f,
+		itags:  itags,
+		index:  fragArchiveIndex{VideoID: videoId},
+	}
+
+	if format == FragArchiveTar {
+		fa.tw = tar.NewWriter(f)
+	} else {
+		fa.zw = zip.NewWriter(f)
+	}
+
+	return fa, nil
+}
+
+// Path of the archive being written
+func (fa *FragArchive) Name() string {
+	return fa.name
+}
+
+// Add a fragment, for use as DownloadInfo.RawFragmentFunc
+func (fa *FragArchive) AddFragment(dataType string, seq int, data []byte) {
+	itag := fa.itags[dataType]
+	name := fmt.Sprintf("%s/f%d/%010d.frag", dataType, itag, seq)
+	sum := sha256.Sum256(data)
+
+	fa.Lock()
+	defer fa.Unlock()
+	if fa.file == nil {
+		return
+	}
+
+	err := fa.writeEntry(name, data)
+	if err != nil {
+		LogWarn("%s: Failed to add fragment %d to %s: %s", dataType, seq, fa.name, err)
+		return
+	}
+
+	fa.index.Entries = append(fa.index.Entries, FragArchiveEntry{
+		Name:     name,
+		DataType: dataType,
+		Itag:     itag,
+		Seq:      seq,
+		Size:     len(data),
+		SHA256:   hex.EncodeToString(sum[:]),
+	})
+}
+
+func (fa *FragArchive) writeEntry(name string, data []byte) error {
+	modTime := time.Now()
+	if fa.tw != nil {
+		err := fa.tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = fa.tw.Write(data)
+		return err
+	}
+
+	// The fragments are already compressed media, so just store them
+	w, err := fa.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// Write the index and finish the archive
+func (fa *FragArchive) Close() error {
+	fa.Lock()
+	defer fa.Unlock()
+
+	if fa.file == nil {
+		return nil
+	}
+	defer func() { fa.file = nil }()
+
+	index, err := json.MarshalIndent(fa.index, "", "  ")
+	if err == nil {
+		err = fa.writeEntry(FragArchiveIndex, index)
+	}
+
+	var closeErr error
+	if fa.tw != nil {
+		closeErr = fa.tw.Close()
+	} else {
+		closeErr = fa.zw.Close()
+	}
+	if err == nil {
+		err = closeErr
+	}
+
+	closeErr = fa.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
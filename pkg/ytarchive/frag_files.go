@@ -0,0 +1,184 @@
+package ytarchive
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Name of the files fragments wait in before being written to the data
+	// file, relative to the directory of the data file
+	DefaultFragNameFormat = "%(name)s.frag%(seq)s.ts"
+	// Fragments per subdirectory when sharding them
+	FragShardSize = 1000
+)
+
+// First byte of a fragment waiting on disk with FragCompress
+const (
+	fragStoredRaw byte = iota
+	fragStoredDeflate
+)
+
+// Sizes of the fragments compressed with FragCompress, before and after
+type fragCompressStats struct {
+	sync.Mutex
+	raw    int64
+	stored int64
+}
+
+// Check that a fragment file name format is valid and names every fragment differently
+func CheckFragNameFormat(format string) error {
+	if !strings.Contains(strings.ToLower(format), "%(seq)s") {
+		return errors.New("the format must include %(seq)s")
+	}
+
+	_, err := fragFileName(format, "name", DtypeVideo, 0, 0)
+	return err
+}
+
+func fragFileName(format, name, dataType string, itag, seq int) (string, error) {
+	return FormatPythonMapString(format, map[string]string{
+		"name": name,
+		"type": dataType,
+		"itag": strconv.Itoa(itag),
+		"seq":  strconv.Itoa(seq),
+	})
+}
+
+/*
+Directory the fragments of the data file at basePath are sharded under,
+basePath.frags, with a subdirectory for every FragShardSize fragments.
+*/
+func fragShardRoot(basePath string) string {
+	return basePath + ".frags"
+}
+
+/*
+Path of the file a fragment waits in before being written to the data file.
+Creates the directory it goes in if needed.
+*/
+func (di *DownloadInfo) fragFilePath(basePath, dataType string, seq int) string {
+	itag := di.Quality
+	if dataType == DtypeAudio {
+		itag = AudioItag
+	}
+
+	format := di.FragNameFormat
+	if len(format) == 0 {
+		format = DefaultFragNameFormat
+	}
+
+	// Checked before downloading, so this can only fail for library users
+	name, err := fragFileName(format, filepath.Base(basePath), dataType, itag, seq)
+	if err != nil {
+		name, _ = fragFileName(DefaultFragNameFormat, filepath.Base(basePath), dataType, itag, seq)
+	}
+
+	dir := filepath.Dir(basePath)
+	if di.FragShard {
+		dir = filepath.Join(fragShardRoot(basePath), strconv.Itoa(seq/FragShardSize*FragShardSize))
+	}
+
+	fpath := filepath.Join(dir, name)
+	if filepath.Dir(fpath) != filepath.Dir(basePath) {
+		err = os.MkdirAll(filepath.Dir(fpath), di.DirMode)
+		if err != nil {
+			LogDebug("Failed to create the directory for fragment %d: %s", seq, err)
+		}
+	}
+
+	return fpath
+}
+
+/*
+Compress a fragment to wait on disk. Uses DEFLATE at its fastest level, as
+the stream data itself is already compressed and gains little from more.
+Fragments that do not get any smaller are kept as they are.
+*/
+func (di *DownloadInfo) compressFragment(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(fragStoredDeflate)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := buf.Bytes()
+	if len(stored) > len(data) {
+		stored = append([]byte{fragStoredRaw}, data...)
+	}
+
+	di.fragCompression.Lock()
+	defer di.fragCompression.Unlock()
+	di.fragCompression.raw += int64(len(data))
+	di.fragCompression.stored += int64(len(stored))
+
+	return stored, nil
+}
+
+func decompressFragment(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty compressed fragment")
+	}
+
+	switch data[0] {
+	case fragStoredRaw:
+		return data[1:], nil
+	case fragStoredDeflate:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+
+		return io.ReadAll(r)
+	}
+
+	return nil, errors.New("unknown compressed fragment format")
+}
+
+// Bytes of fragments compressed with FragCompress, before and after
+func (di *DownloadInfo) FragCompressStats() (raw, stored int64) {
+	di.fragCompression.Lock()
+	defer di.fragCompression.Unlock()
+	return di.fragCompression.raw, di.fragCompression.stored
+}
+
+// Free whatever holds a fragment's data, once written or dropped
+func (frag *Fragment) discard() {
+	if frag.Spool != nil {
+		frag.Spool.Release()
+	} else if len(frag.FileName) > 0 {
+		TryDelete(frag.FileName)
+	}
+}
+
+// Remove the shard directories of a data file that are left empty
+func removeFragShards(basePath string) {
+	root := fragShardRoot(basePath)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			os.Remove(filepath.Join(root, entry.Name()))
+		}
+	}
+	os.Remove(root)
+}
@@ -0,0 +1,141 @@
+package ytarchive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// Size a spool file grows to before switching to the other one
+	FragSpoolRotateSize = 256 * 1024 * 1024
+	// Sequence number and data length before each fragment in a spool file
+	fragSpoolHeaderSize = 16
+)
+
+type spoolFile struct {
+	file    *os.File
+	size    int64
+	pending int
+}
+
+/*
+Holds downloaded fragments waiting to be written to the data file, appended
+to one of two files instead of a file per fragment. Each fragment is written
+after a header with its sequence number and length, so the files can be read
+without the in-memory index after a crash.
+
+A file is truncated once every fragment in it has been written to the data
+file. Appends go to the other file once one passes FragSpoolRotateSize, as
+long as the other has been emptied, so a download that never fully catches
+up does not grow a spool file forever.
+*/
+type FragSpool struct {
+	sync.Mutex
+	files  [2]*spoolFile
+	active int
+	path   string
+}
+
+// Where a fragment's data is in a spool
+type SpoolEntry struct {
+	spool  *FragSpool
+	file   int
+	offset int64
+	length int
+}
+
+// Create the spool files, basePath.spool.0 and basePath.spool.1
+func OpenFragSpool(basePath string, mode os.FileMode) (*FragSpool, error) {
+	spool := &FragSpool{path: basePath + ".spool"}
+	for i := range spool.files {
+		f, err := os.OpenFile(fmt.Sprintf("%s.%d", spool.path, i), os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			spool.Close()
+			return nil, err
+		}
+		spool.files[i] = &spoolFile{file: f}
+	}
+
+	return spool, nil
+}
+
+// Add a fragment to the spool
+func (s *FragSpool) Append(seq int, data []byte) (*SpoolEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	sf := s.files[s.active]
+	other := s.files[1-s.active]
+	if sf.size >= FragSpoolRotateSize && other.pending == 0 {
+		s.active = 1 - s.active
+		sf = other
+	}
+
+	header := make([]byte, fragSpoolHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(seq))
+	binary.BigEndian.PutUint64(header[8:], uint64(len(data)))
+
+	_, err := sf.file.WriteAt(header, sf.size)
+	if err == nil {
+		_, err = sf.file.WriteAt(data, sf.size+fragSpoolHeaderSize)
+	}
+	if err != nil {
+		// Anything partially written is overwritten by the next append
+		return nil, err
+	}
+
+	entry := &SpoolEntry{s, s.active, sf.size + fragSpoolHeaderSize, len(data)}
+	sf.size += int64(fragSpoolHeaderSize + len(data))
+	sf.pending += 1
+
+	return entry, nil
+}
+
+// Close and delete the spool files
+func (s *FragSpool) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, sf := range s.files {
+		if sf == nil {
+			continue
+		}
+
+		sf.file.Close()
+		TryDelete(fmt.Sprintf("%s.%d", s.path, i))
+	}
+}
+
+// Read the fragment's data back from the spool
+func (e *SpoolEntry) Read() ([]byte, error) {
+	e.spool.Lock()
+	defer e.spool.Unlock()
+
+	data := make([]byte, e.length)
+	_, err := e.spool.files[e.file].file.ReadAt(data, e.offset)
+	return data, err
+}
+
+/*
+Mark the fragment as no longer needed, once written to the data file or
+dropped. Empties its spool file if it was the last one waiting in it.
+*/
+func (e *SpoolEntry) Release() {
+	e.spool.Lock()
+	defer e.spool.Unlock()
+
+	sf := e.spool.files[e.file]
+	sf.pending -= 1
+	if sf.pending > 0 {
+		return
+	}
+
+	err := sf.file.Truncate(0)
+	if err != nil {
+		LogDebug("Failed to truncate fragment spool: %s", err)
+		return
+	}
+	sf.size = 0
+}
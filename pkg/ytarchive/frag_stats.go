@@ -0,0 +1,122 @@
+package ytarchive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+How long each fragment of a data type took to download, how big it was, and
+how many tries it needed, for the summary at the end of a download. Helps
+with picking a number of --threads and with spotting throttling.
+*/
+type FragmentStats struct {
+	sync.Mutex
+	Latencies []time.Duration
+	Sizes     []int
+	TotalSize int64
+	// Number of fragments by how many retries they needed
+	Retries map[int]int
+}
+
+// Record a fragment that downloaded successfully
+func (fs *FragmentStats) Add(latency time.Duration, size, retries int) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.Retries == nil {
+		fs.Retries = make(map[int]int)
+	}
+
+	fs.Latencies = append(fs.Latencies, latency)
+	fs.Sizes = append(fs.Sizes, size)
+	fs.TotalSize += int64(size)
+	fs.Retries[retries] += 1
+}
+
+func (fs *FragmentStats) Count() int {
+	fs.Lock()
+	defer fs.Unlock()
+	return len(fs.Latencies)
+}
+
+// Total bytes downloaded
+func (fs *FragmentStats) Size() int64 {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.TotalSize
+}
+
+// The value below which p percent of the sorted values fall, by nearest rank
+func percentileIndex(n int, p float64) int {
+	idx := int(float64(n)*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= n {
+		idx = n - 1
+	}
+
+	return idx
+}
+
+// Get the p50, p95, and p99 of the latencies and sizes
+func (fs *FragmentStats) Percentiles() (latencies [3]time.Duration, sizes [3]int) {
+	fs.Lock()
+	sortedLat := append([]time.Duration(nil), fs.Latencies...)
+	sortedSizes := append([]int(nil), fs.Sizes...)
+	fs.Unlock()
+
+	if len(sortedLat) == 0 {
+		return
+	}
+
+	sort.Slice(sortedLat, func(i, j int) bool { return sortedLat[i] < sortedLat[j] })
+	sort.Ints(sortedSizes)
+	for i, p := range []float64{50, 95, 99} {
+		latencies[i] = sortedLat[percentileIndex(len(sortedLat), p)]
+		sizes[i] = sortedSizes[percentileIndex(len(sortedSizes), p)]
+	}
+
+	return
+}
+
+/*
+Describe the stats in a few lines, e.g.
+
+	latency p50 420ms, p95 1.3s, p99 2.1s
+	size p50 1.20 MiB, p95 1.31 MiB, p99 1.33 MiB
+	retries 0: 1200, 1: 30, 3: 4
+*/
+func (fs *FragmentStats) Summary() []string {
+	if fs.Count() == 0 {
+		return nil
+	}
+
+	latencies, sizes := fs.Percentiles()
+	lines := []string{
+		fmt.Sprintf("latency p50 %s, p95 %s, p99 %s",
+			latencies[0].Round(time.Millisecond), latencies[1].Round(time.Millisecond), latencies[2].Round(time.Millisecond)),
+		fmt.Sprintf("size p50 %s, p95 %s, p99 %s",
+			FormatSize(int64(sizes[0])), FormatSize(int64(sizes[1])), FormatSize(int64(sizes[2]))),
+	}
+
+	fs.Lock()
+	var counts []int
+	for retries := range fs.Retries {
+		counts = append(counts, retries)
+	}
+	sort.Ints(counts)
+
+	var retries []string
+	for _, n := range counts {
+		retries = append(retries, fmt.Sprintf("%d: %d", n, fs.Retries[n]))
+	}
+	fs.Unlock()
+
+	lines = append(lines, "retries "+strings.Join(retries, ", "))
+	return lines
+}
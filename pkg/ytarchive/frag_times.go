@@ -0,0 +1,145 @@
+package ytarchive
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var fragTimesCSVHeader = []string{
+	"data_type",
+	"sequence",
+	"media_time",
+	"produced_utc",
+	"downloaded_utc",
+}
+
+/*
+Records when each fragment written to the data files was produced and
+downloaded, as CSV, so a time of day can be looked up in the archive.
+Produced times come from the X-Walltime-Ms header googlevideo sends with
+live fragments and are left empty without it. Downloaded times are
+corrected for the local clock being off, see ServerNow. Rows are written as
+fragments are, so the file is usable even if the download is cut short.
+*/
+type FragTimeLog struct {
+	sync.Mutex
+	f  *os.File
+	cw *csv.Writer
+}
+
+func NewFragTimeLog(fpath string, mode os.FileMode) (*FragTimeLog, error) {
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := &FragTimeLog{
+		f:  f,
+		cw: csv.NewWriter(f),
+	}
+	fl.cw.Write(fragTimesCSVHeader)
+	fl.cw.Flush()
+
+	return fl, fl.cw.Error()
+}
+
+// Record a fragment written mediaSecs into the data file
+func (fl *FragTimeLog) Add(dataType string, seq, mediaSecs int, produced, downloaded time.Time) {
+	if fl == nil {
+		return
+	}
+
+	producedStr := ""
+	if !produced.IsZero() {
+		producedStr = produced.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+
+	fl.Lock()
+	defer fl.Unlock()
+
+	fl.cw.Write([]string{
+		dataType,
+		strconv.Itoa(seq),
+		strconv.Itoa(mediaSecs),
+		producedStr,
+		downloaded.UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
+	fl.cw.Flush()
+	if err := fl.cw.Error(); err != nil {
+		LogDebug("Failed to write fragment times: %s", err)
+	}
+}
+
+func (fl *FragTimeLog) Close() error {
+	if fl == nil {
+		return nil
+	}
+
+	fl.Lock()
+	defer fl.Unlock()
+
+	fl.cw.Flush()
+	err := fl.cw.Error()
+	if cerr := fl.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// A row of a fragment times file
+type FragTime struct {
+	DataType string
+	Seq      int
+	// Seconds into the data file
+	MediaTime  int
+	Produced   time.Time
+	Downloaded time.Time
+}
+
+// Read back the rows of a file written by FragTimeLog
+func ReadFragTimes(fpath string) ([]FragTime, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		rows = rows[1:]
+	}
+
+	times := make([]FragTime, 0, len(rows))
+	for i, row := range rows {
+		if len(row) != len(fragTimesCSVHeader) {
+			return nil, fmt.Errorf("row %d has %d fields instead of %d", i+2, len(row), len(fragTimesCSVHeader))
+		}
+
+		ft := FragTime{DataType: row[0]}
+		ft.Seq, err = strconv.Atoi(row[1])
+		if err == nil {
+			ft.MediaTime, err = strconv.Atoi(row[2])
+		}
+		if err == nil && len(row[3]) > 0 {
+			ft.Produced, err = time.Parse(time.RFC3339Nano, row[3])
+		}
+		if err == nil {
+			ft.Downloaded, err = time.Parse(time.RFC3339Nano, row[4])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+2, err)
+		}
+
+		times = append(times, ft)
+	}
+
+	return times, nil
+}
@@ -0,0 +1,149 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// 403 and 404 responses in a row for every stream before a full refresh
+	DeadURLErrors = 10
+	// Shortest time between full refreshes
+	FullRefreshInterval = 2 * time.Minute
+)
+
+/*
+Record whether a fragment request got a 403 or 404. Once every stream being
+downloaded got DeadURLErrors of them in a row, refreshing the same itags is
+not helping and a FullRefresh is done.
+*/
+func (di *DownloadInfo) recordURLResult(ctx context.Context, dataType string, dead bool) {
+	mdl := di.MDLInfo[dataType]
+	mdl.Lock()
+	if !dead {
+		mdl.DeadStreak = 0
+		mdl.Unlock()
+		return
+	}
+	mdl.DeadStreak += 1
+	mdl.Unlock()
+
+	active := 0
+	for _, mdl := range di.MDLInfo {
+		mdl.RLock()
+		downloading := len(mdl.DownloadURL) > 0 && !mdl.Finished
+		streak := mdl.DeadStreak
+		mdl.RUnlock()
+
+		if !downloading {
+			continue
+		}
+		if streak < DeadURLErrors {
+			return
+		}
+		active += 1
+	}
+
+	if active > 0 {
+		di.FullRefresh(ctx)
+	}
+}
+
+/*
+Look up the stream's formats again from scratch and pick the quality being
+downloaded again, for when the download URLs of every stream keep failing
+even after being refreshed. YouTube can stop serving the formats a stream
+started with, such as after the streamer changes their encoder settings,
+while the stream itself goes on. If the itag being downloaded is gone, the
+same quality in the other codec or the next best one is used, and the
+download carries on appending to the same files.
+*/
+func (di *DownloadInfo) FullRefresh(ctx context.Context) bool {
+	di.Lock()
+	if di.GVideoDDL || time.Since(di.fullRefreshAt) < FullRefreshInterval {
+		di.Unlock()
+		return false
+	}
+	di.fullRefreshAt = time.Now()
+	// Skip the wait between info refreshes
+	di.LastUpdated = time.Time{}
+	// Before the format details it goes by are replaced
+	oldQuality := di.itagQuality(di.videoItag())
+	di.Unlock()
+
+	LogWarn("The download URLs keep failing, looking up the stream's formats again")
+	di.PrintStatus()
+
+	for _, mdl := range di.MDLInfo {
+		mdl.Lock()
+		mdl.DeadStreak = 0
+		mdl.Unlock()
+	}
+
+	if !di.GetVideoInfo(ctx) {
+		return false
+	}
+
+	di.Lock()
+	defer di.Unlock()
+
+	oldItag := di.videoItag()
+	if oldItag == AudioOnlyQuality || di.AudioOnly {
+		return true
+	}
+	if _, ok := di.FormatURLs[oldItag]; ok {
+		return true
+	}
+
+	// Nothing better than what was being downloaded
+	start := len(VideoQualities) - 1
+	for i, q := range VideoQualities {
+		if q == oldQuality {
+			start = i
+		}
+	}
+
+	newItag := 0
+	for i := start; i > 0; i-- {
+		itag := di.qualityItag(VideoQualities[i], di.FormatURLs)
+		if dlURL, ok := di.FormatURLs[itag]; ok && IsFragmented(dlURL) {
+			newItag = itag
+			break
+		}
+	}
+
+	if newItag == 0 {
+		LogWarn("The stream no longer offers itag %d or any other video format", oldItag)
+		return true
+	}
+
+	LogWarn("The stream no longer offers itag %d, continuing with itag %d (%s). The video changes format at this point.",
+		oldItag, newItag, di.itagQuality(newItag))
+	di.MDLInfo[DtypeVideo].Lock()
+	di.MDLInfo[DtypeVideo].SwitchedItag = newItag
+	di.MDLInfo[DtypeVideo].Unlock()
+	di.SetDownloadUrl(DtypeVideo, di.FormatURLs[newItag])
+	di.addDiscontinuity(Discontinuity{
+		Kind:     DiscontinuityFormatChange,
+		DataType: DtypeVideo,
+		Detail:   fmt.Sprintf("itag %d to %d", oldItag, newItag),
+	})
+
+	return true
+}
+
+/*
+The video itag fragments are downloaded from, which is Quality unless a
+FullRefresh had to switch to another one. Quality is left alone in that
+case, since the download state and muxing go by it. Call with di locked.
+*/
+func (di *DownloadInfo) videoItag() int {
+	di.MDLInfo[DtypeVideo].RLock()
+	defer di.MDLInfo[DtypeVideo].RUnlock()
+
+	if itag := di.MDLInfo[DtypeVideo].SwitchedItag; itag != 0 {
+		return itag
+	}
+	return di.Quality
+}
@@ -0,0 +1,80 @@
+package ytarchive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type concatSegment struct {
+	InPoint  int
+	OutPoint int
+	Hole     int
+}
+
+/*
+Write an ffmpeg concat list that reads dataFile with a hole in the timeline
+as long as each range of fragments skipped in it, where it was skipped, so
+everything after a gap plays at the time it was streamed instead of
+drifting earlier. fragSecs is the length of a fragment.
+*/
+func writeGapConcatList(listFile, dataFile string, gaps []FragmentGap, fragSecs int, mode os.FileMode) error {
+	absFile, err := filepath.Abs(dataFile)
+	if err != nil {
+		return err
+	}
+
+	segments := []concatSegment{{}}
+	for _, gap := range gaps {
+		last := &segments[len(segments)-1]
+		pos := gap.Written * fragSecs
+		hole := (gap.EndSeq - gap.StartSeq + 1) * fragSecs
+
+		// Skipped again before anything was written since the last gap
+		if pos <= last.InPoint && len(segments) > 1 {
+			segments[len(segments)-2].Hole += hole
+			continue
+		}
+
+		last.OutPoint = pos
+		last.Hole = hole
+		segments = append(segments, concatSegment{InPoint: pos})
+	}
+
+	quoted := "'" + strings.ReplaceAll(absFile, "'", `'\''`) + "'"
+	var sb strings.Builder
+	sb.WriteString("ffconcat version 1.0\n")
+	for i, seg := range segments {
+		fmt.Fprintf(&sb, "file %s\n", quoted)
+		if seg.InPoint > 0 {
+			fmt.Fprintf(&sb, "inpoint %d\n", seg.InPoint)
+		}
+
+		// Giving a duration longer than the part read leaves the hole
+		if i < len(segments)-1 {
+			fmt.Fprintf(&sb, "outpoint %d\n", seg.OutPoint)
+			fmt.Fprintf(&sb, "duration %d\n", seg.OutPoint-seg.InPoint+seg.Hole)
+		}
+	}
+
+	return os.WriteFile(listFile, []byte(sb.String()), mode)
+}
+
+// Read an input of the mux through an ffmpeg concat list instead
+func (f *FFMpegArgs) ConcatInput(file, listFile string) bool {
+	for i := 1; i < len(f.Args)-1; i++ {
+		if f.Args[i-1] != "-i" || f.Args[i] != file {
+			continue
+		}
+
+		args := make([]string, 0, len(f.Args)+4)
+		args = append(args, f.Args[:i-1]...)
+		args = append(args, "-f", "concat", "-safe", "0", "-i", listFile)
+		args = append(args, f.Args[i+1:]...)
+		f.Args = args
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,316 @@
+package ytarchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Bodies longer than this are cut short in the HAR file
+const HARMaxBodySize = 64 * 1024
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+/*
+Records every request and response going through it into a HAR file, for
+diagnosing problems such as 403s and throttling. Headers that would hand out
+the account's session are redacted the same as in WARC files, and text
+bodies are cut short at HARMaxBodySize while media bodies are left out.
+Entries are written as they happen, and the file is only valid JSON once
+closed.
+*/
+type HARRecorder struct {
+	sync.Mutex
+	file    *os.File
+	entries int
+}
+
+func NewHARRecorder(fname string, mode os.FileMode) (*HARRecorder, error) {
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.WriteString(`{"log":{"version":"1.2","creator":{"name":"ytarchive","version":""},"entries":[`)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &HARRecorder{file: f}, nil
+}
+
+type harClient struct {
+	har    *HARRecorder
+	client HttpClient
+}
+
+func (c *harClient) Do(req *http.Request) (*http.Response, error) {
+	return c.har.do(c.client, req)
+}
+
+// Record the requests made through client
+func (h *HARRecorder) Through(client HttpClient) HttpClient {
+	return &harClient{har: h, client: client}
+}
+
+func (h *HARRecorder) do(client HttpClient, req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	waited := time.Since(start)
+	if err != nil {
+		h.record(req, reqBody, nil, nil, start, waited, 0, err)
+		return resp, err
+	}
+
+	receiveStart := time.Now()
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	received := time.Since(receiveStart)
+	if err != nil {
+		h.record(req, reqBody, resp, respBody, start, waited, received, err)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	h.record(req, reqBody, resp, respBody, start, waited, received, nil)
+	return resp, nil
+}
+
+func harHeaders(headers http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, vals := range headers {
+		redact := redactedHeader(name)
+
+		for _, val := range vals {
+			if redact {
+				val = "[redacted]"
+			}
+			pairs = append(pairs, harNameValue{Name: name, Value: val})
+		}
+	}
+
+	return pairs
+}
+
+func isTextMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "javascript") ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+func harBodyText(body []byte, mimeType string) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if !isTextMimeType(mimeType) {
+		return "", "body left out"
+	}
+
+	comment := ""
+	if len(body) > HARMaxBodySize {
+		body = body[:HARMaxBodySize]
+		comment = fmt.Sprintf("body cut short at %d bytes", HARMaxBodySize)
+	}
+
+	// Do not leave half a character at the end after cutting it short
+	for len(body) > 0 && !utf8.Valid(body) {
+		body = body[:len(body)-1]
+	}
+
+	return string(body), comment
+}
+
+func msecs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (h *HARRecorder) record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, start time.Time, waited, received time.Duration, reqErr error) {
+	query := []harNameValue{}
+	for name, vals := range req.URL.Query() {
+		for _, val := range vals {
+			query = append(query, harNameValue{Name: name, Value: val})
+		}
+	}
+
+	entry := &harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            msecs(waited + received),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(req.Header),
+			QueryString: query,
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Timings: harTimings{
+			Send:    0,
+			Wait:    msecs(waited),
+			Receive: msecs(received),
+		},
+	}
+
+	if len(reqBody) > 0 {
+		mimeType := req.Header.Get("Content-Type")
+		text, _ := harBodyText(reqBody, mimeType)
+		entry.Request.PostData = &harPostData{MimeType: mimeType, Text: text}
+	}
+
+	if resp != nil {
+		mimeType := resp.Header.Get("Content-Type")
+		text, comment := harBodyText(respBody, mimeType)
+		entry.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Headers:     harHeaders(resp.Header),
+			Cookies:     []harNameValue{},
+			Content: harContent{
+				Size:     len(respBody),
+				MimeType: mimeType,
+				Text:     text,
+				Comment:  comment,
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(respBody),
+		}
+	} else {
+		entry.Response = harResponse{
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+
+	if reqErr != nil {
+		entry.Comment = reqErr.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		LogWarn("Failed to write HAR entry for %s: %s", req.URL.Host, err)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.file == nil {
+		return
+	}
+
+	if h.entries > 0 {
+		h.file.Write([]byte{','})
+	}
+	_, err = h.file.Write(data)
+	if err != nil {
+		LogWarn("Failed to write HAR entry for %s: %s", req.URL.Host, err)
+		return
+	}
+	h.entries += 1
+}
+
+// Finish the HAR file
+func (h *HARRecorder) Close() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+
+	_, err := h.file.Write([]byte("]}}\n"))
+	closeErr := h.file.Close()
+	h.file = nil
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,123 @@
+package ytarchive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// Seconds between heartbeats, unless YouTube asks for longer
+	HeartbeatPollSecs = 10
+	// Offline heartbeats in a row before the stream is taken to have ended
+	HeartbeatOfflineChecks = 2
+
+	HeartbeatPostData = `{
+	'context': {
+		'client': {
+			'clientName': '%s',
+			'clientVersion': '%s',
+			'hl': 'en'
+		}
+	},
+	'videoId': '%s',
+	'heartbeatRequestParams': {
+		'heartbeatChecks': ['HEARTBEAT_CHECK_TYPE_LIVE_STREAM_STATUS']
+	}
+}
+	`
+)
+
+type HeartbeatResponse struct {
+	PlayabilityStatus struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	} `json:"playabilityStatus"`
+	PollDelayMs   string `json:"pollDelayMs"`
+	StopHeartbeat bool   `json:"stopHeartbeat"`
+}
+
+/*
+Get the live status of the stream from the heartbeat endpoint the web player
+polls while watching, which is far lighter than a full player response.
+*/
+func (di *DownloadInfo) Heartbeat(ctx context.Context) (*HeartbeatResponse, error) {
+	di.RLock()
+	defer di.RUnlock()
+
+	ytcfg := di.Ytcfg
+	if ytcfg == nil {
+		ytcfg = GetDefaultYTCFG()
+	}
+
+	hb := &HeartbeatResponse{}
+	data := []byte(fmt.Sprintf(HeartbeatPostData, ytcfg.InnertubeClientName, ytcfg.InnertubeClientVersion, di.VideoID))
+	respData, err := di.postInnertube(ctx, "player/heartbeat", data, ytcfg.InnertubeCtxClientName, ytcfg.InnertubeCtxClientVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(respData, hb)
+	if err != nil {
+		return nil, err
+	}
+
+	return hb, nil
+}
+
+/*
+Poll the heartbeat endpoint while a live stream downloads, to learn that it
+ended or was made unavailable within seconds rather than waiting for the
+hourly info refresh or fragments that keep failing. A heartbeat that is not
+OK gets a full info refresh to find out what happened. Runs until ctx is
+cancelled or the stream is no longer live.
+*/
+func (di *DownloadInfo) WatchHeartbeat(ctx context.Context) {
+	offlineChecks := 0
+	delay := HeartbeatPollSecs * time.Second
+
+	for SleepContext(ctx, delay) {
+		if !di.IsLive() || di.IsUnavailable() || di.IsFinishing() {
+			return
+		}
+
+		hb, err := di.Heartbeat(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				LogDebug("Heartbeat failed: %s", err)
+			}
+			continue
+		}
+
+		delay = HeartbeatPollSecs * time.Second
+		if ms, err := strconv.Atoi(hb.PollDelayMs); err == nil && time.Duration(ms)*time.Millisecond > delay {
+			delay = time.Duration(ms) * time.Millisecond
+		}
+
+		status := hb.PlayabilityStatus.Status
+		if status == PlayableOk {
+			offlineChecks = 0
+			continue
+		}
+
+		LogDebug("Heartbeat status: %s %s", status, hb.PlayabilityStatus.Reason)
+		if status == PlayableOffline {
+			// The stream may only be reconnecting, so make sure it stays offline
+			offlineChecks += 1
+			if offlineChecks < HeartbeatOfflineChecks {
+				continue
+			}
+
+			LogInfo("Heartbeat reports the stream has ended")
+			di.Lock()
+			di.Live = false
+			di.Unlock()
+			di.PrintStatus()
+			return
+		}
+
+		di.GetVideoInfo(ctx)
+	}
+}
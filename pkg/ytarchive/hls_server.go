@@ -0,0 +1,231 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to let viewers finish their current requests when stopping
+	HLSShutdownTimeout = 5 * time.Second
+	// Advertised when the format bitrates are unknown
+	HLSDefaultBandwidth = 5000000
+)
+
+/*
+Where a written fragment lives in the stream's data file
+*/
+type hlsFragment struct {
+	Seq    int
+	Offset int64
+	Size   int
+}
+
+/*
+Serves the fragments downloaded so far as an HLS playlist, so the stream
+can be watched with a short delay while it is still being archived.
+*/
+type HLSServer struct {
+	sync.RWMutex
+	Addr string
+
+	server         *http.Server
+	listener       net.Listener
+	files          map[string]string
+	frags          map[string][]hlsFragment
+	bandwidth      int
+	targetDuration int
+}
+
+func NewHLSServer(addr string) *HLSServer {
+	return &HLSServer{
+		Addr:  addr,
+		files: make(map[string]string),
+		frags: make(map[string][]hlsFragment),
+	}
+}
+
+/*
+Start listening and serving playlists for the given data files,
+keyed by data type.
+*/
+func (s *HLSServer) Start(files map[string]string, targetDuration, bandwidth int) error {
+	s.Lock()
+	for dataType, fname := range files {
+		s.files[dataType] = fname
+	}
+	s.targetDuration = targetDuration
+	s.bandwidth = bandwidth
+	s.Unlock()
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(listener)
+
+	return nil
+}
+
+// The URL of the master playlist
+func (s *HLSServer) URL() string {
+	addr := s.Addr
+	if s.listener != nil {
+		addr = s.listener.Addr().String()
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		addr = net.JoinHostPort("localhost", port)
+	}
+
+	return fmt.Sprintf("http://%s/master.m3u8", addr)
+}
+
+/*
+Stop serving, giving current requests a moment to finish. The data files
+must not be open when they are moved afterwards.
+*/
+func (s *HLSServer) Close() error {
+	if s.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HLSShutdownTimeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
+
+	return err
+}
+
+// Record a fragment written to the data file, making it available to viewers
+func (s *HLSServer) AddFragment(dataType string, seq int, offset int64, data []byte) {
+	s.Lock()
+	defer s.Unlock()
+	s.frags[dataType] = append(s.frags[dataType], hlsFragment{seq, offset, len(data)})
+}
+
+func (s *HLSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case path == "" || path == "master.m3u8":
+		s.serveMaster(w)
+	case strings.HasSuffix(path, ".m3u8"):
+		s.servePlaylist(w, strings.TrimSuffix(path, ".m3u8"))
+	case strings.Contains(path, "/"):
+		parts := strings.SplitN(path, "/", 2)
+		s.serveFragment(w, r, parts[0], strings.TrimSuffix(parts[1], ".mp4"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *HLSServer) serveMaster(w http.ResponseWriter) {
+	s.RLock()
+	_, hasAudio := s.files[DtypeAudio]
+	_, hasVideo := s.files[DtypeVideo]
+	bandwidth := s.bandwidth
+	s.RUnlock()
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	if hasAudio && hasVideo {
+		sb.WriteString(`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="audio",DEFAULT=YES,AUTOSELECT=YES,URI="audio.m3u8"` + "\n")
+		sb.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AUDIO=\"audio\"\nvideo.m3u8\n", bandwidth))
+	} else if hasVideo {
+		sb.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d\nvideo.m3u8\n", bandwidth))
+	} else if hasAudio {
+		sb.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d\naudio.m3u8\n", bandwidth))
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, sb.String())
+}
+
+func (s *HLSServer) servePlaylist(w http.ResponseWriter, dataType string) {
+	s.RLock()
+	_, ok := s.files[dataType]
+	frags := s.frags[dataType]
+	targetDuration := s.targetDuration
+	s.RUnlock()
+
+	if !ok {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+	sb.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+
+	lastSeq := -1
+	for _, frag := range frags {
+		if lastSeq >= 0 && frag.Seq != lastSeq+1 {
+			sb.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		lastSeq = frag.Seq
+		sb.WriteString(fmt.Sprintf("#EXTINF:%d.000,\n%s/%d.mp4\n", targetDuration, dataType, frag.Seq))
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, sb.String())
+}
+
+func (s *HLSServer) serveFragment(w http.ResponseWriter, r *http.Request, dataType, seqStr string) {
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.RLock()
+	fname, ok := s.files[dataType]
+	var frag *hlsFragment
+	for i := range s.frags[dataType] {
+		if s.frags[dataType][i].Seq == seq {
+			frag = &s.frags[dataType][i]
+			break
+		}
+	}
+	s.RUnlock()
+
+	if !ok || frag == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		LogDebug("HLS: Failed to open %s: %s", fname, err)
+		http.Error(w, "fragment unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", dataType+"/mp4")
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(f, frag.Offset, int64(frag.Size)))
+}
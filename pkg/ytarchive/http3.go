@@ -0,0 +1,24 @@
+package ytarchive
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+Creates the transport used for fragment requests with Options.HTTP3.
+The standard library has no QUIC support, so this is nil unless a program
+using ytarchive sets it, e.g. to return an http3.RoundTripper from quic-go.
+*/
+var HTTP3Transport func() http.RoundTripper
+
+// Create a client sending requests over HTTP/3, if a transport for it is set
+func NewHTTP3Client() (*http.Client, error) {
+	if HTTP3Transport == nil {
+		return nil, errors.New("this build of ytarchive does not support HTTP/3")
+	}
+
+	return &http.Client{
+		Transport: HTTP3Transport(),
+	}, nil
+}
@@ -0,0 +1,81 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A format being downloaded, named as yt-dlp names them
+type infoJSONFormat struct {
+	FormatID string  `json:"format_id"`
+	VCodec   string  `json:"vcodec"`
+	ACodec   string  `json:"acodec"`
+	Fps      int     `json:"fps,omitempty"`
+	Tbr      float64 `json:"tbr,omitempty"`
+}
+
+/*
+Write what is known about the stream to fpath, in the spirit of yt-dlp's
+info JSON so tools made for it can index the archive. The fields of
+FormatInfo are at the top level, along with yt-dlp's names for the same
+things, the formats being downloaded, and the player response as YouTube
+served it.
+*/
+func (di *DownloadInfo) WriteInfoJSON(fpath string, itags []int) error {
+	di.RLock()
+	info := make(map[string]interface{})
+	for k, v := range di.FormatInfo {
+		info[k] = v
+	}
+
+	info["webpage_url"] = di.FormatInfo["url"]
+	info["uploader"] = di.FormatInfo["channel"]
+	info["uploader_id"] = di.FormatInfo["channel_id"]
+	info["thumbnail"] = di.Thumbnail
+	info["is_live"] = di.Live
+	info["extractor"] = "youtube"
+	info["extractor_key"] = "Youtube"
+	info["epoch"] = time.Now().Unix()
+
+	var formatIds []string
+	var formats []*infoJSONFormat
+	for _, itag := range itags {
+		format := &infoJSONFormat{
+			FormatID: strconv.Itoa(itag),
+			VCodec:   "none",
+			ACodec:   "none",
+		}
+
+		codecs := ""
+		if details, ok := di.FormatDetails[itag]; ok && details != nil {
+			codecs = details.Codecs
+			format.Fps = details.Fps
+			format.Tbr = float64(details.Bitrate) / 1000
+		}
+		if itag == AudioItag {
+			format.ACodec = codecs
+		} else {
+			format.VCodec = codecs
+		}
+
+		formatIds = append(formatIds, format.FormatID)
+		formats = append(formats, format)
+	}
+	info["format_id"] = strings.Join(formatIds, "+")
+	info["requested_formats"] = formats
+
+	if len(di.PlayerResponseData) > 0 {
+		info["player_response"] = json.RawMessage(di.PlayerResponseData)
+	}
+	di.RUnlock()
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fpath, data, di.FileMode)
+}
@@ -0,0 +1,205 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long a discovered innertube client config is used before looking again
+const InnertubeConfigMaxAge = 24 * time.Hour
+
+// Page the innertube client config is discovered from
+const InnertubeConfigURL = "https://www.youtube.com/"
+
+/*
+The parts of ytcfg that are the same for everyone, which innertube API
+requests need before a watch page has been loaded, and which YouTube rolls
+over every so often.
+*/
+type InnertubeConfig struct {
+	ApiKey           string `json:"api_key"`
+	ClientName       string `json:"client_name"`
+	ClientVersion    string `json:"client_version"`
+	CtxClientName    int    `json:"context_client_name"`
+	CtxClientVersion string `json:"context_client_version"`
+	FetchedAt        int64  `json:"fetched_at"`
+}
+
+var (
+	innertubeLock   sync.RWMutex
+	innertubeConfig *InnertubeConfig
+)
+
+func (ic *InnertubeConfig) fresh() bool {
+	return time.Since(time.Unix(ic.FetchedAt, 0)) < InnertubeConfigMaxAge
+}
+
+func (ic *InnertubeConfig) valid() bool {
+	return len(ic.ApiKey) > 0 && len(ic.ClientName) > 0 && len(ic.ClientVersion) > 0 && ic.CtxClientName > 0
+}
+
+// Where the discovered config is kept between runs
+func innertubeCacheFile() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(cacheDir, "ytarchive", "innertube.json")
+}
+
+func loadInnertubeCache(fname string) *InnertubeConfig {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil
+	}
+
+	ic := &InnertubeConfig{}
+	err = json.Unmarshal(data, ic)
+	if err != nil || !ic.valid() {
+		return nil
+	}
+
+	return ic
+}
+
+func saveInnertubeCache(fname string, ic *InnertubeConfig) error {
+	data, err := json.Marshal(ic)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fname, data, 0644)
+}
+
+// Get every ytcfg.set object in the page merged together
+func parseInnertubeConfig(page []byte) (*InnertubeConfig, error) {
+	ytcfg := &YTCFG{}
+	for {
+		setStart := bytes.Index(page, ytcfgStart)
+		if setStart < 0 {
+			break
+		}
+
+		page = page[setStart+len(ytcfgStart):]
+		if len(page) == 0 || page[0] != '{' {
+			continue
+		}
+
+		objEnd := bytes.Index(page, []byte("});"))
+		if objEnd < 0 {
+			break
+		}
+
+		// Objects that are not JSON are skipped, the rest fill in what they have
+		json.Unmarshal(page[:objEnd+1], ytcfg)
+		page = page[objEnd:]
+	}
+
+	ic := innertubeConfigFromYTCFG(ytcfg)
+	if !ic.valid() {
+		return nil, errors.New("no innertube client config found in the page")
+	}
+
+	return ic, nil
+}
+
+func innertubeConfigFromYTCFG(ytcfg *YTCFG) *InnertubeConfig {
+	ic := &InnertubeConfig{
+		ApiKey:           ytcfg.InnertubeApiKey,
+		ClientName:       ytcfg.InnertubeClientName,
+		ClientVersion:    ytcfg.InnertubeClientVersion,
+		CtxClientName:    ytcfg.InnertubeCtxClientName,
+		CtxClientVersion: ytcfg.InnertubeCtxClientVersion,
+		FetchedAt:        time.Now().Unix(),
+	}
+	if len(ic.CtxClientVersion) == 0 {
+		ic.CtxClientVersion = ic.ClientVersion
+	}
+
+	return ic
+}
+
+/*
+Keep the client config of a ytcfg from a watch page, so runs that go on
+for a long time pick up new client versions as YouTube rolls them out.
+*/
+func updateInnertubeConfig(ytcfg *YTCFG) {
+	ic := innertubeConfigFromYTCFG(ytcfg)
+	if !ic.valid() {
+		return
+	}
+
+	old := getInnertubeConfig()
+	setInnertubeConfig(ic)
+	if old != nil && old.fresh() && old.ApiKey == ic.ApiKey && old.ClientVersion == ic.ClientVersion {
+		return
+	}
+
+	if cacheFile := innertubeCacheFile(); len(cacheFile) > 0 {
+		err := saveInnertubeCache(cacheFile, ic)
+		if err != nil {
+			LogDebug("Failed to save the innertube client config: %s", err)
+		}
+	}
+}
+
+func setInnertubeConfig(ic *InnertubeConfig) {
+	innertubeLock.Lock()
+	defer innertubeLock.Unlock()
+	innertubeConfig = ic
+}
+
+func getInnertubeConfig() *InnertubeConfig {
+	innertubeLock.RLock()
+	defer innertubeLock.RUnlock()
+	return innertubeConfig
+}
+
+/*
+Make sure the innertube API key and client version used before a watch page
+is loaded are recent. They are read from the cache file if it is fresh,
+otherwise from the YouTube home page, and the cache file is updated. The
+hard-coded values from GetDefaultYTCFG are kept if neither works out.
+*/
+func DiscoverInnertubeConfig(ctx context.Context, client HttpClient) {
+	if ic := getInnertubeConfig(); ic != nil && ic.fresh() {
+		return
+	}
+
+	cacheFile := innertubeCacheFile()
+	if len(cacheFile) > 0 {
+		if ic := loadInnertubeCache(cacheFile); ic != nil && ic.fresh() {
+			LogDebug("Using innertube client %s %s from %s", ic.ClientName, ic.ClientVersion, cacheFile)
+			setInnertubeConfig(ic)
+			return
+		}
+	}
+
+	page := DownloadData(ctx, client, InnertubeConfigURL)
+	ic, err := parseInnertubeConfig(page)
+	if err != nil {
+		LogDebug("Failed to discover the innertube client config: %s", err)
+		return
+	}
+
+	LogDebug("Discovered innertube client %s %s", ic.ClientName, ic.ClientVersion)
+	setInnertubeConfig(ic)
+	if len(cacheFile) > 0 {
+		err = saveInnertubeCache(cacheFile, ic)
+		if err != nil {
+			LogDebug("Failed to save the innertube client config: %s", err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+//go:build darwin
+
+package ytarchive
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Exit code of the security command when there is no such keychain item
+const securityItemNotFound = 44
+
+/*
+Secrets kept in the login keychain through the security command. Secrets
+are base64 encoded, and given to it on stdin so they never show up in the
+process list.
+*/
+type keyringStore struct{}
+
+func securityCommand(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("security", args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("security: %s", bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, fmt.Errorf("security: %w", err)
+	}
+
+	return out, nil
+}
+
+func (k *keyringStore) Get(name string) ([]byte, error) {
+	out, err := securityCommand(nil, "find-generic-password", "-s", KeyringService, "-a", name, "-w")
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (k *keyringStore) Set(name string, data []byte) error {
+	// Commands read by the interactive mode are not visible to other users
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		KeyringService, name, base64.StdEncoding.EncodeToString(data))
+	_, err := securityCommand([]byte(command), "-i")
+	if err != nil {
+		return err
+	}
+
+	// The interactive mode does not fail when a command does, so check it took
+	stored, err := k.Get(name)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(stored, data) {
+		return errors.New("the keychain did not store the secret")
+	}
+
+	return nil
+}
+
+func (k *keyringStore) Delete(name string) error {
+	_, err := securityCommand(nil, "delete-generic-password", "-s", KeyringService, "-a", name)
+	return err
+}
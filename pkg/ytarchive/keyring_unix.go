@@ -0,0 +1,73 @@
+//go:build !darwin && !windows
+
+package ytarchive
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/*
+Secrets kept in the Secret Service keyring, such as GNOME Keyring or
+KWallet, through the secret-tool command from libsecret. Secrets are base64
+encoded since secret-tool deals in text.
+*/
+type keyringStore struct{}
+
+func secretTool(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	if errors.Is(cmd.Err, exec.ErrNotFound) {
+		return nil, errors.New("secret-tool was not found, install libsecret or use an encrypted secrets file")
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("secret-tool: %s", bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, fmt.Errorf("secret-tool: %w", err)
+	}
+
+	return out, nil
+}
+
+func (k *keyringStore) Get(name string) ([]byte, error) {
+	out, err := secretTool(nil, "lookup", "service", KeyringService, "name", name)
+	if err != nil {
+		// Nothing found is an exit code of 1 with nothing written
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, ErrSecretNotFound
+		}
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, ErrSecretNotFound
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (k *keyringStore) Set(name string, data []byte) error {
+	_, err := secretTool([]byte(base64.StdEncoding.EncodeToString(data)),
+		"store", "--label", KeyringService+" "+name, "service", KeyringService, "name", name)
+	return err
+}
+
+func (k *keyringStore) Delete(name string) error {
+	_, err := k.Get(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = secretTool(nil, "clear", "service", KeyringService, "name", name)
+	return err
+}
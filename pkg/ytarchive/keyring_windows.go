@@ -0,0 +1,186 @@
+//go:build windows
+
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	credTypeGeneric          = 1
+	credPersistLocalMachine  = 2
+	credMaxCredentialBlobLen = 5 * 512
+)
+
+var (
+	advapi32       = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+// CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+/*
+Secrets kept in the Windows Credential Manager. A credential only holds
+2560 bytes, so bigger secrets such as cookie files are split over several,
+with the number of parts kept in the user name of the first one.
+*/
+type keyringStore struct{}
+
+func credTarget(name string, part int) string {
+	if part == 0 {
+		return fmt.Sprintf("%s:%s", KeyringService, name)
+	}
+
+	return fmt.Sprintf("%s:%s:%d", KeyringService, name, part)
+}
+
+func credRead(target string) ([]byte, string, error) {
+	targetPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(targetPtr)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return nil, "", ErrSecretNotFound
+		}
+		return nil, "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	data := make([]byte, cred.CredentialBlobSize)
+	if cred.CredentialBlobSize > 0 {
+		copy(data, unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize))
+	}
+
+	return data, windows.UTF16PtrToString(cred.UserName), nil
+}
+
+func credWrite(target, userName string, data []byte) error {
+	targetPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+	userPtr, err := windows.UTF16PtrFromString(userName)
+	if err != nil {
+		return err
+	}
+
+	cred := &credential{
+		Type:               credTypeGeneric,
+		TargetName:         targetPtr,
+		CredentialBlobSize: uint32(len(data)),
+		Persist:            credPersistLocalMachine,
+		UserName:           userPtr,
+	}
+	if len(data) > 0 {
+		cred.CredentialBlob = &data[0]
+	}
+
+	r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(cred)), 0)
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func credDelete(target string) error {
+	targetPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(targetPtr)), credTypeGeneric, 0)
+	if r == 0 {
+		if errors.Is(err, windows.ERROR_NOT_FOUND) {
+			return ErrSecretNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (k *keyringStore) Get(name string) ([]byte, error) {
+	data, userName, err := credRead(credTarget(name, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	parts, _ := strconv.Atoi(userName)
+	for part := 1; part < parts; part++ {
+		partData, _, err := credRead(credTarget(name, part))
+		if err != nil {
+			return nil, fmt.Errorf("part %d of the secret: %w", part, err)
+		}
+		data = append(data, partData...)
+	}
+
+	return data, nil
+}
+
+func (k *keyringStore) Set(name string, data []byte) error {
+	err := k.Delete(name)
+	if err != nil && !errors.Is(err, ErrSecretNotFound) {
+		return err
+	}
+
+	parts := (len(data) + credMaxCredentialBlobLen - 1) / credMaxCredentialBlobLen
+	if parts == 0 {
+		parts = 1
+	}
+
+	for part := 0; part < parts; part++ {
+		start := part * credMaxCredentialBlobLen
+		end := start + credMaxCredentialBlobLen
+		if end > len(data) {
+			end = len(data)
+		}
+
+		err = credWrite(credTarget(name, part), strconv.Itoa(parts), data[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *keyringStore) Delete(name string) error {
+	_, userName, err := credRead(credTarget(name, 0))
+	if err != nil {
+		return err
+	}
+
+	parts, _ := strconv.Atoi(userName)
+	for part := 1; part < parts; part++ {
+		credDelete(credTarget(name, part))
+	}
+
+	return credDelete(credTarget(name, 0))
+}
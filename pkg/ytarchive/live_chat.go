@@ -0,0 +1,220 @@
+package ytarchive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// Wait between chat polls when YouTube does not say, and the least waited
+	LiveChatPollSecs    = 5
+	LiveChatMinPollSecs = 1
+
+	LiveChatPostData = `{
+	'context': {
+		'client': {
+			'clientName': '%s',
+			'clientVersion': '%s',
+			'hl': 'en'
+		}
+	},
+	'continuation': '%s'
+}
+	`
+)
+
+type liveChatContinuationData struct {
+	Continuation string `json:"continuation"`
+	TimeoutMs    int    `json:"timeoutMs"`
+}
+
+// The parts of a watch page's ytInitialData that lead to its live chat
+type watchInitialData struct {
+	Contents struct {
+		TwoColumnWatchNextResults struct {
+			ConversationBar struct {
+				LiveChatRenderer struct {
+					Continuations []struct {
+						ReloadContinuationData liveChatContinuationData `json:"reloadContinuationData"`
+					} `json:"continuations"`
+					Header struct {
+						LiveChatHeaderRenderer struct {
+							ViewSelector struct {
+								SortFilterSubMenuRenderer struct {
+									SubMenuItems []struct {
+										Title        string `json:"title"`
+										Continuation struct {
+											ReloadContinuationData liveChatContinuationData `json:"reloadContinuationData"`
+										} `json:"continuation"`
+									} `json:"subMenuItems"`
+								} `json:"sortFilterSubMenuRenderer"`
+							} `json:"viewSelector"`
+						} `json:"liveChatHeaderRenderer"`
+					} `json:"header"`
+				} `json:"liveChatRenderer"`
+			} `json:"conversationBar"`
+		} `json:"twoColumnWatchNextResults"`
+	} `json:"contents"`
+}
+
+type liveChatResponse struct {
+	ContinuationContents struct {
+		LiveChatContinuation struct {
+			Continuations []struct {
+				InvalidationContinuationData liveChatContinuationData `json:"invalidationContinuationData"`
+				TimedContinuationData        liveChatContinuationData `json:"timedContinuationData"`
+				ReloadContinuationData       liveChatContinuationData `json:"reloadContinuationData"`
+			} `json:"continuations"`
+			Actions []json.RawMessage `json:"actions"`
+		} `json:"liveChatContinuation"`
+	} `json:"continuationContents"`
+}
+
+// Where to go on from a chat response, and how long to wait before doing so
+func (lcr *liveChatResponse) next() (string, time.Duration) {
+	for _, cont := range lcr.ContinuationContents.LiveChatContinuation.Continuations {
+		for _, data := range []liveChatContinuationData{
+			cont.InvalidationContinuationData,
+			cont.TimedContinuationData,
+			cont.ReloadContinuationData,
+		} {
+			if len(data.Continuation) == 0 {
+				continue
+			}
+
+			wait := time.Duration(data.TimeoutMs) * time.Millisecond
+			if wait <= 0 {
+				wait = LiveChatPollSecs * time.Second
+			} else if wait < LiveChatMinPollSecs*time.Second {
+				wait = LiveChatMinPollSecs * time.Second
+			}
+
+			return data.Continuation, wait
+		}
+	}
+
+	return "", 0
+}
+
+/*
+Find where the live chat of the stream starts from its watch page. The
+unfiltered "Live chat" view is used over the default "Top chat" one, which
+leaves out messages YouTube deems less relevant.
+*/
+func (di *DownloadInfo) liveChatContinuation(ctx context.Context) (string, error) {
+	watchHtml := DownloadData(ctx, di.HttpClient(), fmt.Sprintf("https://www.youtube.com/watch?v=%s", di.VideoID))
+	if len(watchHtml) == 0 {
+		return "", errors.New("failed to download the watch page")
+	}
+
+	initialData := &watchInitialData{}
+	err := json.Unmarshal(GetJsonFromHtml(watchHtml, ytInitialDataDecl), initialData)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the watch page: %w", err)
+	}
+
+	chat := initialData.Contents.TwoColumnWatchNextResults.ConversationBar.LiveChatRenderer
+	views := chat.Header.LiveChatHeaderRenderer.ViewSelector.SortFilterSubMenuRenderer.SubMenuItems
+	for i := len(views) - 1; i >= 0; i-- {
+		if cont := views[i].Continuation.ReloadContinuationData.Continuation; len(cont) > 0 {
+			return cont, nil
+		}
+	}
+
+	for _, cont := range chat.Continuations {
+		if len(cont.ReloadContinuationData.Continuation) > 0 {
+			return cont.ReloadContinuationData.Continuation, nil
+		}
+	}
+
+	return "", errors.New("the stream has no live chat")
+}
+
+func (di *DownloadInfo) getLiveChat(ctx context.Context, continuation string) (*liveChatResponse, error) {
+	di.RLock()
+	ytcfg := di.Ytcfg
+	di.RUnlock()
+	if ytcfg == nil {
+		ytcfg = GetDefaultYTCFG()
+	}
+
+	data := []byte(fmt.Sprintf(LiveChatPostData, ytcfg.InnertubeClientName, ytcfg.InnertubeClientVersion, continuation))
+	respData, err := di.postInnertube(ctx, "live_chat/get_live_chat", data, ytcfg.InnertubeCtxClientName, ytcfg.InnertubeCtxClientVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	lcr := &liveChatResponse{}
+	err = json.Unmarshal(respData, lcr)
+	if err != nil {
+		return nil, err
+	}
+
+	return lcr, nil
+}
+
+/*
+Save the live chat of the stream to fpath as it comes in, one chat action
+as YouTube sends it per line, until ctx is cancelled or the chat ends. The
+file is appended to, so a resumed download keeps the chat from before, and
+the messages YouTube sends again when the chat is reloaded show up twice.
+*/
+func (di *DownloadInfo) CaptureLiveChat(ctx context.Context, fpath string) error {
+	continuation, err := di.liveChatContinuation(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, di.FileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	actions := 0
+	wait := time.Duration(0)
+	LogInfo("Capturing the live chat to %s", fpath)
+
+	for SleepContext(ctx, wait) {
+		lcr, err := di.getLiveChat(ctx, continuation)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			LogDebug("Failed to get the live chat: %s", err)
+			wait = LiveChatPollSecs * time.Second
+			continue
+		}
+
+		for _, action := range lcr.ContinuationContents.LiveChatContinuation.Actions {
+			w.Write(action)
+			w.WriteByte('\n')
+			actions += 1
+		}
+
+		// Written out every poll so little is lost if the process dies
+		if err = w.Flush(); err != nil {
+			return err
+		}
+
+		continuation, wait = lcr.next()
+		if len(continuation) == 0 {
+			LogInfo("The live chat has ended")
+			break
+		}
+	}
+
+	LogInfo("Saved %d live chat actions to %s", actions, fpath)
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
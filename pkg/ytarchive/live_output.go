@@ -0,0 +1,54 @@
+package ytarchive
+
+import (
+	"fmt"
+)
+
+// Formats for the live output file
+const (
+	LiveOutputMP4 = "mp4"
+	LiveOutputTS  = "ts"
+)
+
+func IsValidLiveOutputFormat(format string) bool {
+	return format == LiveOutputMP4 || format == LiveOutputTS
+}
+
+/*
+Get the ffmpeg output arguments for a live output file. Fragmented MP4 is
+written with an empty moov so it can be played at any point, and packets
+are flushed as they come so a crash loses as little as possible.
+*/
+func LiveOutputArgs(format, fpath string) ([]string, error) {
+	switch format {
+	case LiveOutputMP4:
+		return []string{
+			"-f", "mp4",
+			"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+			"-flush_packets", "1",
+			"-y", fpath,
+		}, nil
+	case LiveOutputTS:
+		return []string{"-f", "mpegts", "-flush_packets", "1", "-y", fpath}, nil
+	}
+
+	return nil, fmt.Errorf("unknown live output format %s, must be mp4 or ts", format)
+}
+
+/*
+Start ffmpeg interleaving the given streams into a single file as they
+download, so a playable file exists even if the download dies before the
+final mux. Like a restream, it failing does not stop the download.
+*/
+func startLiveOutput(ffmpegPath, format, fpath string, codecs []string, dataTypes []string) (*streamMuxer, error) {
+	if err := CheckMergeFormat(format, codecs); err != nil {
+		return nil, err
+	}
+
+	outArgs, err := LiveOutputArgs(format, fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return startQueuedMuxer(ffmpegPath, outArgs, dataTypes)
+}
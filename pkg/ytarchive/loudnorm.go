@@ -0,0 +1,113 @@
+package ytarchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// EBU R128 loudness targets for --normalize-audio, in LUFS, dBTP and LU
+const (
+	LoudnormTargetI   = -23.0
+	LoudnormTargetTP  = -1.0
+	LoudnormTargetLRA = 7.0
+
+	// Bitrate the normalized audio is encoded at
+	LoudnormAudioBitrate = "192k"
+)
+
+/*
+What the first pass of ffmpeg's loudnorm filter measured, given to the
+second pass so it can adjust the whole file evenly.
+*/
+type LoudnessStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+func loudnormFilter(measured *LoudnessStats) string {
+	filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", LoudnormTargetI, LoudnormTargetTP, LoudnormTargetLRA)
+	if measured != nil {
+		filter += fmt.Sprintf(":measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset)
+	}
+
+	return filter
+}
+
+/*
+Run the first loudnorm pass over an audio file to measure its loudness.
+This reads the whole file, so it takes a while for long streams.
+*/
+func MeasureLoudness(ffmpegPath, audioFile string) (*LoudnessStats, error) {
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner",
+		"-nostdin",
+		"-i", audioFile,
+		"-vn",
+		"-af", loudnormFilter(nil)+":print_format=json",
+		"-f", "null",
+		"-",
+	)
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	LogDebug("Executing command: %s", strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// The stats are printed last, after the usual ffmpeg output
+	start := bytes.LastIndexByte(out, '{')
+	end := bytes.LastIndexByte(out, '}')
+	if start < 0 || end < start {
+		return nil, errors.New("ffmpeg did not print the loudness stats")
+	}
+
+	stats := &LoudnessStats{}
+	err = json.Unmarshal(out[start:end+1], stats)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.InputI == "-inf" || len(stats.InputI) == 0 {
+		return nil, errors.New("the audio is silent")
+	}
+
+	return stats, nil
+}
+
+/*
+Re-encode the audio of a mux with the second loudnorm pass, using what
+MeasureLoudness found. Everything else is still copied.
+*/
+func (f *FFMpegArgs) NormalizeAudio(measured *LoudnessStats, container string) {
+	if len(f.Args) == 0 {
+		return
+	}
+
+	codec := "aac"
+	if container == MergeFormatWebM {
+		codec = "libopus"
+	}
+
+	output := f.Args[len(f.Args)-1]
+	args := f.Args[:len(f.Args)-1]
+	args = append(args,
+		"-af", loudnormFilter(measured),
+		// loudnorm upsamples to 192kHz otherwise
+		"-ar", "48000",
+		"-c:a", codec,
+		"-b:a", LoudnormAudioBitrate,
+		output,
+	)
+	f.Args = args
+}
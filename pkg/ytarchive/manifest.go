@@ -0,0 +1,202 @@
+package ytarchive
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const ManifestVersion = 1
+
+type ManifestFragment struct {
+	Seq    int    `json:"seq"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type ManifestFile struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type ManifestStream struct {
+	ManifestFile
+	Itag      int                `json:"itag"`
+	Fragments []ManifestFragment `json:"fragments"`
+}
+
+/*
+A record of the SHA-256 of every fragment as it was written, and where it
+is in the stream's data file, so the archive can later be shown to match
+what was captured. Signed with an Ed25519 key when one is given.
+*/
+type Manifest struct {
+	sync.Mutex `json:"-"`
+
+	Version    int                        `json:"version"`
+	VideoID    string                     `json:"video_id"`
+	URL        string                     `json:"url"`
+	Created    string                     `json:"created"`
+	Streams    map[string]*ManifestStream `json:"streams"`
+	FinalFiles []ManifestFile             `json:"final_files,omitempty"`
+	PublicKey  string                     `json:"public_key,omitempty"`
+
+	key ed25519.PrivateKey
+}
+
+func NewManifest(videoId, url string) *Manifest {
+	return &Manifest{
+		Version: ManifestVersion,
+		VideoID: videoId,
+		URL:     url,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Streams: make(map[string]*ManifestStream),
+	}
+}
+
+/*
+Load a PEM encoded PKCS #8 Ed25519 private key to sign the manifest with,
+such as one made by 'openssl genpkey -algorithm ed25519'.
+*/
+func (m *Manifest) LoadKey(fname string) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("the key is not an Ed25519 key")
+	}
+
+	m.key = edKey
+	m.PublicKey = base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))
+	return nil
+}
+
+// Set which data file and itag a stream's fragments are written to
+func (m *Manifest) SetStream(dataType, file string, itag int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Streams[dataType] = &ManifestStream{
+		ManifestFile: ManifestFile{File: filepath.Base(file)},
+		Itag:         itag,
+	}
+}
+
+// Record a written fragment, for use with DownloadInfo.OnFragment
+func (m *Manifest) AddFragment(dataType string, seq int, offset int64, data []byte) {
+	sum := sha256.Sum256(data)
+
+	m.Lock()
+	defer m.Unlock()
+	stream, ok := m.Streams[dataType]
+	if !ok {
+		return
+	}
+
+	stream.Fragments = append(stream.Fragments, ManifestFragment{
+		Seq:    seq,
+		Offset: offset,
+		Size:   len(data),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+}
+
+// Hash the complete data file of a stream
+func (m *Manifest) HashStream(dataType, fname string) error {
+	file, err := hashFile(fname)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if stream, ok := m.Streams[dataType]; ok {
+		file.File = stream.File
+		stream.ManifestFile = *file
+	}
+
+	return nil
+}
+
+// Hash a final output file
+func (m *Manifest) AddFinalFile(fname string) error {
+	file, err := hashFile(fname)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.FinalFiles = append(m.FinalFiles, *file)
+	return nil
+}
+
+/*
+Write the manifest as JSON to fname, and its base64 encoded signature
+to fname.sig if a key was loaded.
+*/
+func (m *Manifest) Write(fname string, mode os.FileMode) error {
+	m.Lock()
+	data, err := json.MarshalIndent(m, "", "  ")
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(fname, data, mode)
+	if err != nil {
+		return err
+	}
+
+	if m.key == nil {
+		return nil
+	}
+
+	sig := ed25519.Sign(m.key, data)
+	return os.WriteFile(fname+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), mode)
+}
+
+func hashFile(fname string) (*ManifestFile, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing %s: %w", fname, err)
+	}
+
+	return &ManifestFile{
+		File:   filepath.Base(fname),
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package ytarchive
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Containers the final file can be muxed into
+const (
+	MergeFormatMP4  = "mp4"
+	MergeFormatMKV  = "mkv"
+	MergeFormatWebM = "webm"
+	MergeFormatTS   = "ts"
+)
+
+/*
+Codec prefixes, as they appear in a format's codecs string, that each
+container can hold. MKV is left out since it holds anything YouTube sends.
+*/
+var mergeFormatCodecs = map[string][]string{
+	MergeFormatMP4:  {"avc1", "vp9", "vp09", "av01", "mp4a", "opus"},
+	MergeFormatWebM: {"vp9", "vp09", "av01", "opus", "vorbis"},
+	MergeFormatTS:   {"avc1", "mp4a"},
+}
+
+func IsValidMergeFormat(format string) bool {
+	switch format {
+	case MergeFormatMP4, MergeFormatMKV, MergeFormatWebM, MergeFormatTS:
+		return true
+	}
+
+	return false
+}
+
+// Check that every codec given can be muxed into the container
+func CheckMergeFormat(format string, codecs []string) error {
+	allowed, ok := mergeFormatCodecs[format]
+	if !ok {
+		return nil
+	}
+
+	for _, codec := range codecs {
+		fits := false
+		for _, prefix := range allowed {
+			if strings.HasPrefix(codec, prefix) {
+				fits = true
+				break
+			}
+		}
+
+		if !fits {
+			return fmt.Errorf("%s can not be muxed into %s", codec, format)
+		}
+	}
+
+	return nil
+}
+
+/*
+Codecs of the downloaded formats. A video format without details, such as
+one whose URL was given, goes by the codec its itag is known for. Any others
+are skipped.
+*/
+func (di *DownloadInfo) formatCodecs(itags ...int) []string {
+	codecs := make([]string, 0, len(itags))
+	for _, itag := range itags {
+		if details, ok := di.FormatDetails[itag]; ok && len(details.Codecs) > 0 {
+			codecs = append(codecs, details.Codecs)
+		} else if codec := itagCodec(itag); len(codec) > 0 {
+			codecs = append(codecs, codec)
+		}
+	}
+
+	return codecs
+}
+
+// The codec prefix of a video itag in VideoLabelItags, empty if it is not one
+func itagCodec(itag int) string {
+	for label, itags := range VideoLabelItags {
+		if label == "audio_only" {
+			continue
+		}
+
+		switch itag {
+		case itags.H264:
+			return "avc1"
+		case itags.VP9:
+			return "vp09"
+		case itags.AV1:
+			return "av01"
+		}
+	}
+
+	return ""
+}
+
+/*
+Pick the container for the final file. An explicit format wins over --mkv.
+If the downloaded codecs do not fit, fall back to mkv rather than lose the
+mux, or to m4a when only audio is muxed, since YouTube audio is always AAC.
+*/
+func (di *DownloadInfo) resolveMergeFormat(format string, mkv bool, itags ...int) string {
+	if len(format) == 0 {
+		format = MergeFormatMP4
+		if mkv {
+			format = MergeFormatMKV
+		}
+	}
+
+	if err := CheckMergeFormat(format, di.formatCodecs(itags...)); err != nil {
+		fallback := MergeFormatMKV
+		if len(itags) == 1 && itags[0] == AudioItag {
+			fallback = MergeFormatMP4
+		}
+
+		LogWarn("%s, using %s instead", err, fallback)
+		format = fallback
+	}
+
+	return format
+}
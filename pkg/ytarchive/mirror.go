@@ -0,0 +1,145 @@
+package ytarchive
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Server errors in a row from a googlevideo host before switching to another one
+const MirrorFailoverErrors = 4
+
+var (
+	gvideoMnRegex       = regexp.MustCompile(`[?&/]mn[=/]([^&/]+)`)
+	gvideoFallbackRegex = regexp.MustCompile(`[?&/]fallback_host[=/]([^&/]+)`)
+)
+
+// Requests made to a googlevideo host and how many got a server error
+type HostStats struct {
+	Requests int
+	Errors   int
+}
+
+func (hs *HostStats) ErrorRate() float64 {
+	if hs == nil || hs.Requests == 0 {
+		return 0
+	}
+
+	return float64(hs.Errors) / float64(hs.Requests)
+}
+
+// Host of a download URL, which may be a format string that url.Parse rejects
+func urlHost(dlURL string) string {
+	host := dlURL
+	if idx := strings.Index(host, "://"); idx >= 0 {
+		host = host[idx+3:]
+	}
+	if idx := strings.IndexAny(host, "/?"); idx >= 0 {
+		host = host[:idx]
+	}
+
+	return host
+}
+
+func unescapeGvideoParam(val string) string {
+	unescaped, err := url.QueryUnescape(strings.ReplaceAll(val, "%%", "%"))
+	if err != nil {
+		return val
+	}
+
+	return unescaped
+}
+
+/*
+Get the other googlevideo hosts that serve the same stream as a download
+URL, from its mn parameter listing the edge nodes it is cached on and its
+fallback_host parameter.
+*/
+func AlternateGvideoHosts(dlURL string) []string {
+	host := urlHost(dlURL)
+	if !strings.HasSuffix(host, ".googlevideo.com") {
+		return nil
+	}
+
+	var hosts []string
+	addHost := func(alt string) {
+		if alt != host && !Contains(hosts, alt) {
+			hosts = append(hosts, alt)
+		}
+	}
+
+	// Hosts look like rr3---sn-abcdefgh.googlevideo.com
+	prefixIdx := strings.Index(host, "---")
+	if match := gvideoMnRegex.FindStringSubmatch(dlURL); match != nil && prefixIdx > 0 {
+		for _, node := range strings.Split(unescapeGvideoParam(match[1]), ",") {
+			if len(node) > 0 {
+				addHost(fmt.Sprintf("%s%s.googlevideo.com", host[:prefixIdx+3], node))
+			}
+		}
+	}
+
+	if match := gvideoFallbackRegex.FindStringSubmatch(dlURL); match != nil {
+		addHost(unescapeGvideoParam(match[1]))
+	}
+
+	return hosts
+}
+
+/*
+Record how a fragment request to the host of dlURL went. After
+MirrorFailoverErrors server errors in a row, the download URL is switched
+to the alternate host with the lowest error rate, if it is doing better.
+*/
+func (di *DownloadInfo) recordHostResult(dataType, dlURL string, serverError bool) {
+	mdl := di.MDLInfo[dataType]
+	mdl.Lock()
+	defer mdl.Unlock()
+
+	host := urlHost(dlURL)
+	if mdl.HostStats == nil {
+		mdl.HostStats = make(map[string]*HostStats)
+	}
+	stats, ok := mdl.HostStats[host]
+	if !ok {
+		stats = &HostStats{}
+		mdl.HostStats[host] = stats
+	}
+
+	stats.Requests += 1
+	if !serverError {
+		mdl.ErrorStreak = 0
+		return
+	}
+	stats.Errors += 1
+
+	// Another fragment already moved on from this URL
+	if mdl.DownloadURL != dlURL {
+		return
+	}
+
+	mdl.ErrorStreak += 1
+	if mdl.ErrorStreak < MirrorFailoverErrors {
+		return
+	}
+	mdl.ErrorStreak = 0
+
+	bestHost := ""
+	bestRate := stats.ErrorRate()
+	for _, alt := range AlternateGvideoHosts(dlURL) {
+		rate := mdl.HostStats[alt].ErrorRate()
+		if rate < bestRate {
+			bestHost = alt
+			bestRate = rate
+		}
+	}
+
+	if len(bestHost) == 0 {
+		LogDebug("%s: %s keeps returning server errors, but there is no better host to switch to", dataType, host)
+		return
+	}
+
+	LogInfo("%s: %s keeps returning server errors, switching to %s", dataType, host, bestHost)
+	mdl.DownloadURL = strings.Replace(dlURL, host, bestHost, 1)
+	mdl.URLHost = bestHost
+}
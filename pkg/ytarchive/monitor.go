@@ -0,0 +1,100 @@
+package ytarchive
+
+import (
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+var channelIdRe = regexp.MustCompile(`^UC[0-9A-Za-z_-]{22}$`)
+
+/*
+Turn a bare channel ID such as UCvaTdHTWBGv3MKj3KVqJVCw, or a handle such
+as @name, into the channel's URL. Anything else is returned as is.
+*/
+func ExpandChannelURL(s string) string {
+	s = strings.TrimSpace(s)
+	if channelIdRe.MatchString(s) {
+		return "https://www.youtube.com/channel/" + s
+	}
+
+	if strings.HasPrefix(s, "@") && !strings.Contains(s, "/") {
+		return "https://www.youtube.com/" + s
+	}
+
+	return s
+}
+
+/*
+Split the URL given for monitoring into the channels it lists, separated
+by commas, expanding channel IDs and handles.
+*/
+func MonitorURLs(urls string) []string {
+	var channels []string
+	for _, u := range strings.Split(urls, ",") {
+		u = ExpandChannelURL(u)
+		if len(u) > 0 {
+			channels = append(channels, u)
+		}
+	}
+
+	return channels
+}
+
+/*
+Monitor several channels at once, each with a job of its own that keeps
+going back to waiting on its channel after every stream, as a single
+monitored channel does. Runs until stopped, then stops the jobs and waits
+for them to finish.
+*/
+func (a *Archiver) runChannels(channels []string) int {
+	o := a.Options
+	if len(o.Quality) == 0 {
+		return a.fail("You must specify a channel AND quality when choosing to monitor a channel")
+	}
+	if len(o.QueueFile) > 0 {
+		LogWarn("The queue file is not used when monitoring several channels")
+	}
+
+	if o.HandleSignals {
+		signal.Notify(a.stopChan, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(a.stopChan)
+	}
+
+	LogGeneral("Monitoring %d channels", len(channels))
+	jobs := make([]*Archiver, 0, len(channels))
+	for _, channel := range channels {
+		jobOpts := a.jobOptions(channel, o.Priority)
+		jobOpts.MonitorChannel = true
+		jobOpts.MonitorScheduled = o.MonitorScheduled
+		jobs = append(jobs, a.startJob(jobOpts))
+	}
+
+	// Jobs only finish on their own if they fail to start, such as for a
+	// URL that is not a channel
+	running := len(jobs)
+	for running > 0 && !a.isStopRequested() {
+		select {
+		case <-a.stopChan:
+			a.Lock()
+			a.stopRequested = true
+			a.Unlock()
+		case <-jobs[len(jobs)-running].done:
+			running -= 1
+		}
+	}
+
+	stopped := a.isStopRequested()
+	for _, job := range jobs {
+		job.Stop()
+	}
+	a.waitViews()
+
+	if !stopped {
+		return a.fail("None of the channels could be monitored")
+	}
+
+	return 0
+}
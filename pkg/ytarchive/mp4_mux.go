@@ -0,0 +1,621 @@
+package ytarchive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A box inside a byte slice, such as a moov or moof read into memory
+type mp4Box struct {
+	Type string
+	// Offsets of the box and of its payload in the slice
+	Start   int
+	Payload int
+	End     int
+}
+
+// The boxes directly inside data, stopping at the first malformed one
+func mp4Children(data []byte) []mp4Box {
+	var boxes []mp4Box
+	pos := 0
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		hdr := 8
+		if size == 1 {
+			if pos+16 > len(data) {
+				break
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			hdr = 16
+		} else if size == 0 {
+			size = len(data) - pos
+		}
+		if size < hdr || pos+size > len(data) {
+			break
+		}
+
+		boxes = append(boxes, mp4Box{
+			Type:    string(data[pos+4 : pos+8]),
+			Start:   pos,
+			Payload: pos + hdr,
+			End:     pos + size,
+		})
+		pos += size
+	}
+
+	return boxes
+}
+
+func mp4Child(data []byte, boxType string) (mp4Box, bool) {
+	for _, box := range mp4Children(data) {
+		if box.Type == boxType {
+			return box, true
+		}
+	}
+
+	return mp4Box{}, false
+}
+
+// Follow a path of box types down from data, such as mdia/mdhd in a trak
+func mp4Find(data []byte, path ...string) ([]byte, bool) {
+	for _, boxType := range path {
+		box, ok := mp4Child(data, boxType)
+		if !ok {
+			return nil, false
+		}
+		data = data[box.Payload:box.End]
+	}
+
+	return data, true
+}
+
+func makeMP4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], boxType)
+	for _, p := range payloads {
+		box = append(box, p...)
+	}
+
+	return box
+}
+
+// A moof and the mdat after it, with what is needed to order and rewrite it
+type mp4Fragment struct {
+	input   *mp4Input
+	moof    []byte
+	moofPos int64
+	mdatPos int64
+	mdatLen int64
+	fields  *mp4MoofFields
+	// In the track's timescale, before and after rebasing to the start
+	decodeTime uint64
+	duration   uint64
+}
+
+// One fragmented MP4 data file, holding a single track
+type mp4Input struct {
+	path      string
+	f         *os.File
+	trak      []byte
+	trex      []byte
+	mvhd      []byte
+	timescale uint64
+	// From the trex, used for samples that give no duration of their own
+	defaultDuration uint64
+	frags           []*mp4Fragment
+	trackID         uint32
+}
+
+/*
+Read the boxes of a data file written by DownloadStream, which holds every
+fragment as YouTube sent it: an init segment (moov) followed by a moof and
+mdat, with the moov repeated in each fragment. Only the first moov is kept.
+A box cut short at the end of the file, by a download that was killed, ends
+the file there.
+*/
+func openMP4Input(path string) (*mp4Input, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &mp4Input{path: path, f: f}
+	err = in.scan()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return in, nil
+}
+
+func (in *mp4Input) scan() error {
+	stat, err := in.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fileSize := stat.Size()
+	r := bufio.NewReader(in.f)
+	var pos int64
+	var pending *mp4Fragment
+	hdr := make([]byte, 16)
+
+	for pos+8 <= fileSize {
+		if _, err = io.ReadFull(r, hdr[:8]); err != nil {
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr))
+		boxType := string(hdr[4:8])
+		hdrLen := int64(8)
+		if size == 1 {
+			if _, err = io.ReadFull(r, hdr[8:16]); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hdrLen = 16
+		} else if size == 0 {
+			size = fileSize - pos
+		}
+
+		if pos == 0 && !isMP4TopLevelBox(boxType) {
+			return fmt.Errorf("%s is not a fragmented MP4 file", in.path)
+		}
+		if size < hdrLen || pos+size > fileSize {
+			LogWarn("%s ends in a box cut short at byte %d, muxing what comes before it", in.path, pos)
+			break
+		}
+
+		bodyLen := size - hdrLen
+		switch {
+		case boxType == "moov" && in.trak == nil, boxType == "moof":
+			body := make([]byte, size)
+			copy(body, hdr[:hdrLen])
+			if _, err = io.ReadFull(r, body[hdrLen:]); err != nil {
+				return err
+			}
+
+			if boxType == "moov" {
+				err = in.parseMoov(body[hdrLen:])
+				if err != nil {
+					return fmt.Errorf("%s: %w", in.path, err)
+				}
+			} else {
+				pending = &mp4Fragment{input: in, moof: body, moofPos: pos}
+			}
+		default:
+			if boxType == "mdat" && pending != nil {
+				pending.mdatPos = pos
+				pending.mdatLen = size
+				in.frags = append(in.frags, pending)
+				pending = nil
+			}
+
+			if _, err = r.Discard(int(bodyLen)); err != nil {
+				return err
+			}
+		}
+
+		pos += size
+	}
+
+	if in.trak == nil {
+		return fmt.Errorf("%s has no moov box", in.path)
+	}
+	if len(in.frags) == 0 {
+		return fmt.Errorf("%s has no fragments", in.path)
+	}
+
+	for _, frag := range in.frags {
+		frag.fields, err = in.moofFields(frag)
+		if err != nil {
+			return fmt.Errorf("%s: %w", in.path, err)
+		}
+	}
+
+	return nil
+}
+
+func isMP4TopLevelBox(boxType string) bool {
+	switch boxType {
+	case "ftyp", "styp", "moov", "moof", "mdat", "sidx", "emsg", "prft", "free", "skip":
+		return true
+	}
+
+	return false
+}
+
+func (in *mp4Input) parseMoov(moov []byte) error {
+	var traks [][]byte
+	for _, box := range mp4Children(moov) {
+		switch box.Type {
+		case "mvhd":
+			in.mvhd = moov[box.Start:box.End]
+		case "trak":
+			traks = append(traks, moov[box.Start:box.End])
+		case "mvex":
+			if trex, ok := mp4Child(moov[box.Payload:box.End], "trex"); ok {
+				in.trex = moov[box.Payload+trex.Start : box.Payload+trex.End]
+			}
+		}
+	}
+
+	if len(traks) != 1 {
+		return fmt.Errorf("expected a single track, found %d", len(traks))
+	}
+	if in.mvhd == nil {
+		return errors.New("no mvhd box")
+	}
+
+	mdhd, ok := mp4Find(traks[0][8:], "mdia", "mdhd")
+	if !ok || len(mdhd) < 24 {
+		return errors.New("no mdhd box")
+	}
+	if mdhd[0] == 1 {
+		in.timescale = uint64(binary.BigEndian.Uint32(mdhd[20:]))
+	} else {
+		in.timescale = uint64(binary.BigEndian.Uint32(mdhd[12:]))
+	}
+	if in.timescale == 0 {
+		return errors.New("the track has no timescale")
+	}
+
+	// trex: version and flags, track_ID, default_sample_description_index,
+	// default_sample_duration
+	if in.trex != nil && len(in.trex) >= 24 {
+		in.defaultDuration = uint64(binary.BigEndian.Uint32(in.trex[8+12:]))
+	}
+
+	in.trak = traks[0]
+	return nil
+}
+
+// Offsets of the parts of a moof that get rewritten, see moofFields
+type mp4MoofFields struct {
+	mfhdSeq     int
+	tfhdTrackID int
+	// -1 if the tfhd has none
+	tfhdBaseOffset int
+	tfdt           int
+	tfdtVersion    byte
+}
+
+/*
+Find the fields of a moof holding a single traf, and fill in the decode
+time and duration of the fragment.
+*/
+func (in *mp4Input) moofFields(frag *mp4Fragment) (*mp4MoofFields, error) {
+	moof := frag.moof
+	fields := &mp4MoofFields{tfhdBaseOffset: -1, tfdt: -1}
+	hdr := 8
+	if binary.BigEndian.Uint32(moof) == 1 {
+		hdr = 16
+	}
+
+	var traf *mp4Box
+	for _, box := range mp4Children(moof[hdr:]) {
+		box := box
+		box.Start += hdr
+		box.Payload += hdr
+		box.End += hdr
+		switch box.Type {
+		case "mfhd":
+			fields.mfhdSeq = box.Payload + 4
+		case "traf":
+			if traf != nil {
+				return nil, errors.New("a fragment holds more than one track")
+			}
+			traf = &box
+		}
+	}
+	if traf == nil || fields.mfhdSeq == 0 {
+		return nil, fmt.Errorf("malformed moof at byte %d", frag.moofPos)
+	}
+
+	defaultDuration := in.defaultDuration
+	var duration uint64
+	for _, box := range mp4Children(moof[traf.Payload:traf.End]) {
+		payload := moof[traf.Payload+box.Payload : traf.Payload+box.End]
+		if len(payload) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(payload) & 0xffffff
+
+		switch box.Type {
+		case "tfhd":
+			fields.tfhdTrackID = traf.Payload + box.Payload + 4
+			off := 8
+			if flags&0x01 != 0 {
+				fields.tfhdBaseOffset = traf.Payload + box.Payload + off
+				off += 8
+			}
+			if flags&0x02 != 0 {
+				off += 4
+			}
+			if flags&0x08 != 0 && off+4 <= len(payload) {
+				defaultDuration = uint64(binary.BigEndian.Uint32(payload[off:]))
+			}
+		case "tfdt":
+			fields.tfdt = traf.Payload + box.Payload + 4
+			fields.tfdtVersion = payload[0]
+			if payload[0] == 1 && len(payload) >= 12 {
+				frag.decodeTime = binary.BigEndian.Uint64(payload[4:])
+			} else {
+				frag.decodeTime = uint64(binary.BigEndian.Uint32(payload[4:]))
+			}
+		case "trun":
+			samples := int(binary.BigEndian.Uint32(payload[4:]))
+			off := 8
+			if flags&0x001 != 0 {
+				off += 4
+			}
+			if flags&0x004 != 0 {
+				off += 4
+			}
+
+			if flags&0x100 == 0 {
+				duration += uint64(samples) * defaultDuration
+				continue
+			}
+
+			sampleLen := 4
+			for _, bit := range []uint32{0x200, 0x400, 0x800} {
+				if flags&bit != 0 {
+					sampleLen += 4
+				}
+			}
+			for i := 0; i < samples && off+4 <= len(payload); i++ {
+				duration += uint64(binary.BigEndian.Uint32(payload[off:]))
+				off += sampleLen
+			}
+		}
+	}
+
+	if fields.tfhdTrackID == 0 || fields.tfdt < 0 {
+		return nil, fmt.Errorf("moof at byte %d has no tfhd or tfdt", frag.moofPos)
+	}
+
+	frag.duration = duration
+	return fields, nil
+}
+
+// The fragment's decode time in seconds, for ordering the tracks
+func (frag *mp4Fragment) seconds() float64 {
+	return float64(frag.decodeTime) / float64(frag.input.timescale)
+}
+
+/*
+Mux fragmented MP4 data files, each holding a single track, into a single
+fragmented MP4 file at output without ffmpeg, with the JPEG or PNG image at
+coverArt as its cover if given. Samples are copied as they are. The tracks
+are rebased to start at 0 while keeping them in sync, and their fragments
+are interleaved by time. Gaps left by skipped fragments stay gaps in the
+timeline. Format changes partway through a data file are not handled, as
+only its first moov is used.
+*/
+func MuxMP4(output, coverArt string, inputs ...string) error {
+	var cover []byte
+	if len(coverArt) > 0 {
+		var err error
+		cover, err = os.ReadFile(coverArt)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ins []*mp4Input
+	defer func() {
+		for _, in := range ins {
+			in.f.Close()
+		}
+	}()
+
+	for i, path := range inputs {
+		in, err := openMP4Input(path)
+		if err != nil {
+			return err
+		}
+		in.trackID = uint32(i + 1)
+		ins = append(ins, in)
+	}
+	if len(ins) == 0 {
+		return errors.New("nothing to mux")
+	}
+
+	// Rebase from whichever track starts first, so they stay in sync
+	first := ins[0].frags[0]
+	for _, in := range ins[1:] {
+		if in.frags[0].seconds() < first.seconds() {
+			first = in.frags[0]
+		}
+	}
+
+	var frags []*mp4Fragment
+	movieTimescale := uint64(binary.BigEndian.Uint32(mvhdTimescale(ins[0].mvhd)))
+	var movieDuration uint64
+	for _, in := range ins {
+		offset := scaleTime(first.decodeTime, first.input.timescale, in.timescale)
+		var end uint64
+		for _, frag := range in.frags {
+			if frag.decodeTime < offset {
+				frag.decodeTime = 0
+			} else {
+				frag.decodeTime -= offset
+			}
+			if frag.decodeTime+frag.duration > end {
+				end = frag.decodeTime + frag.duration
+			}
+		}
+		frags = append(frags, in.frags...)
+
+		if d := scaleTime(end, in.timescale, movieTimescale); d > movieDuration {
+			movieDuration = d
+		}
+	}
+
+	sort.SliceStable(frags, func(i, j int) bool {
+		return frags[i].seconds() < frags[j].seconds()
+	})
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	ftyp := makeMP4Box("ftyp", []byte("isom"), []byte{0, 0, 2, 0}, []byte("isomiso6mp41"))
+	moov := buildMP4Moov(ins, movieDuration, cover)
+	if _, err = w.Write(ftyp); err != nil {
+		return err
+	}
+	if _, err = w.Write(moov); err != nil {
+		return err
+	}
+
+	// The first fragment's time is rebased along with the others
+	pos := int64(len(ftyp) + len(moov))
+	for i, frag := range frags {
+		in := frag.input
+		fields := frag.fields
+		moof := frag.moof
+		binary.BigEndian.PutUint32(moof[fields.mfhdSeq:], uint32(i+1))
+		binary.BigEndian.PutUint32(moof[fields.tfhdTrackID:], in.trackID)
+		if fields.tfhdBaseOffset >= 0 {
+			base := binary.BigEndian.Uint64(moof[fields.tfhdBaseOffset:])
+			binary.BigEndian.PutUint64(moof[fields.tfhdBaseOffset:], uint64(int64(base)-frag.moofPos+pos))
+		}
+		if fields.tfdtVersion == 1 {
+			binary.BigEndian.PutUint64(moof[fields.tfdt:], frag.decodeTime)
+		} else {
+			binary.BigEndian.PutUint32(moof[fields.tfdt:], uint32(frag.decodeTime))
+		}
+
+		if _, err = w.Write(moof); err != nil {
+			return err
+		}
+
+		// Anything between the moof and mdat is left out, so the mdat must
+		// follow right after for the sample offsets to still hold
+		if frag.mdatPos != frag.moofPos+int64(len(moof)) && fields.tfhdBaseOffset < 0 {
+			return fmt.Errorf("%s: boxes between the moof and mdat at byte %d", in.path, frag.moofPos)
+		}
+
+		_, err = io.Copy(w, io.NewSectionReader(in.f, frag.mdatPos, frag.mdatLen))
+		if err != nil {
+			return err
+		}
+
+		pos += int64(len(moof)) + frag.mdatLen
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Convert a time from one timescale to another without overflowing
+func scaleTime(t, from, to uint64) uint64 {
+	return t/from*to + t%from*to/from
+}
+
+// The timescale field of an mvhd box
+func mvhdTimescale(mvhd []byte) []byte {
+	if mvhd[8] == 1 {
+		return mvhd[8+4+16:]
+	}
+
+	return mvhd[8+4+8:]
+}
+
+/*
+Build the iTunes style metadata holding the cover art, which is what
+players look for in an mp4 rather than a video track marked as a picture.
+*/
+func buildMP4Cover(image []byte) ([]byte, error) {
+	// Data types of the covr atom
+	var dataType uint32
+	switch {
+	case bytes.HasPrefix(image, []byte{0xff, 0xd8, 0xff}):
+		dataType = 13
+	case bytes.HasPrefix(image, []byte("\x89PNG")):
+		dataType = 14
+	default:
+		return nil, errors.New("the cover art must be a JPEG or PNG image")
+	}
+
+	data := make([]byte, 8, 8+len(image))
+	binary.BigEndian.PutUint32(data, dataType)
+	data = append(data, image...)
+
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:], "mdirappl")
+	ilst := makeMP4Box("ilst", makeMP4Box("covr", makeMP4Box("data", data)))
+	meta := makeMP4Box("meta", make([]byte, 4), makeMP4Box("hdlr", hdlr), ilst)
+
+	return makeMP4Box("udta", meta), nil
+}
+
+/*
+Build the moov for the muxed file from the tracks of every input, numbered
+in order, with the duration of the whole file in the mehd and the cover
+art, if any. Cover art that can not be used is left out after saying why.
+*/
+func buildMP4Moov(ins []*mp4Input, duration uint64, cover []byte) []byte {
+	mvhd := append([]byte(nil), ins[0].mvhd...)
+	binary.BigEndian.PutUint32(mvhd[len(mvhd)-4:], uint32(len(ins)+1))
+
+	mehd := make([]byte, 12)
+	mehd[0] = 1
+	binary.BigEndian.PutUint64(mehd[4:], duration)
+	mvex := [][]byte{makeMP4Box("mehd", mehd)}
+
+	parts := [][]byte{mvhd}
+	for _, in := range ins {
+		trak := append([]byte(nil), in.trak...)
+		if tkhd, ok := mp4Child(trak[8:], "tkhd"); ok {
+			idOffset := 8 + tkhd.Payload + 4 + 8
+			if trak[8+tkhd.Payload] == 1 {
+				idOffset = 8 + tkhd.Payload + 4 + 16
+			}
+			binary.BigEndian.PutUint32(trak[idOffset:], in.trackID)
+		}
+		parts = append(parts, trak)
+
+		trex := make([]byte, 24)
+		if in.trex != nil && len(in.trex) >= 32 {
+			copy(trex, in.trex[8:32])
+		} else {
+			binary.BigEndian.PutUint32(trex[8:], 1)
+		}
+		binary.BigEndian.PutUint32(trex[4:], in.trackID)
+		mvex = append(mvex, makeMP4Box("trex", trex))
+	}
+	parts = append(parts, makeMP4Box("mvex", mvex...))
+
+	if len(cover) > 0 {
+		udta, err := buildMP4Cover(cover)
+		if err != nil {
+			LogWarn("Not adding the cover art: %s", err)
+		} else {
+			parts = append(parts, udta)
+		}
+	}
+
+	return makeMP4Box("moov", parts...)
+}
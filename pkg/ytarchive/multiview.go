@@ -0,0 +1,65 @@
+package ytarchive
+
+import (
+	"context"
+	"strconv"
+)
+
+/*
+Start archiving the other feeds of a multiview broadcast in the background,
+each with its own archiver and its view number in the view format field.
+The main stream is view 1.
+*/
+func (a *Archiver) startViews(ctx context.Context, info *DownloadInfo) {
+	o := a.Options
+	info.FormatInfo["view"] = "1"
+	if len(o.View) > 0 {
+		info.FormatInfo["view"] = o.View
+	}
+
+	coStreams := info.GetCoStreams(ctx)
+	if len(coStreams) == 0 {
+		LogInfo("No other views found for %s", info.VideoID)
+		return
+	}
+
+	LogGeneral("Found %d other views, archiving them alongside this one", len(coStreams))
+	for i, streamUrl := range coStreams {
+		viewOpts := a.jobOptions(streamUrl, a.Options.Priority)
+		viewOpts.View = strconv.Itoa(i + 2)
+		viewOpts.Multiview = false
+
+		LogGeneral("View %s: %s", viewOpts.View, streamUrl)
+		view := NewArchiver(viewOpts)
+		view.har = a.har
+		view.Start()
+
+		a.Lock()
+		a.views = append(a.views, view)
+		a.Unlock()
+	}
+}
+
+// Wait for the other views of a multiview broadcast, or scheduled jobs, to finish
+func (a *Archiver) waitViews() {
+	a.Lock()
+	views := a.views
+	a.views = nil
+	a.Unlock()
+
+	for _, view := range views {
+		result := view.Wait()
+		if result.Retcode != 0 {
+			LogWarn("%s finished with exit code %d", view.Options.URL, result.Retcode)
+		}
+	}
+}
+
+func (a *Archiver) getViews() []*Archiver {
+	a.Lock()
+	defer a.Unlock()
+
+	views := make([]*Archiver, len(a.views))
+	copy(views, a.views)
+	return views
+}
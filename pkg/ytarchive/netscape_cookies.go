@@ -0,0 +1,329 @@
+package ytarchive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	CookieDomain = iota
+	CookieHostOnly
+	CookiePath
+	CookieSecure
+	CookieExpiration
+	CookieName
+	CookieValue
+	CookiePieces
+)
+
+func (di *DownloadInfo) ParseNetscapeCookiesFile(fname string) (*cookiejar.Jar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = di.loadNetscapeCookies(jar, fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return jar, nil
+}
+
+/*
+Read the cookies file again into the cookie jar in use, picking up cookies
+that were refreshed since it was loaded, e.g. by exporting them again.
+*/
+func (di *DownloadInfo) ReloadCookies() error {
+	if di.CookieJar == nil || len(di.CookieFile) == 0 {
+		return errors.New("no cookies file loaded")
+	}
+
+	// What is in the file is not news to write back to it
+	jar := di.CookieJar
+	if recorder, ok := jar.(*CookieRecorder); ok {
+		jar = recorder.CookieJar
+	}
+
+	return di.loadNetscapeCookies(jar, di.CookieFile)
+}
+
+/*
+Get the contents of a cookies file, or of the secret in Secrets it names
+with SecretPrefix.
+*/
+func (di *DownloadInfo) ReadCookies(fname string) ([]byte, error) {
+	if name, ok := SecretName(fname); ok {
+		if di.Secrets == nil {
+			return nil, fmt.Errorf("no secret store to get %s from", fname)
+		}
+		return di.Secrets.Get(name)
+	}
+
+	return os.ReadFile(fname)
+}
+
+func (di *DownloadInfo) loadNetscapeCookies(jar http.CookieJar, fname string) error {
+	data, err := di.ReadCookies(fname)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	cookieMap := make(map[string][]*http.Cookie)
+
+	for scanner.Scan() {
+		// Could move everything in this loop into its own function
+		cookieParts := strings.Split(scanner.Text(), "\t")
+		secure := false
+		httpOnly := false
+		var expire int64
+		var domain string
+
+		// Netscape cookie entries should always have 7 pieces to them
+		if len(cookieParts) != CookiePieces {
+			continue
+		}
+
+		// Google started setting a json cookie.
+		// Technically speaking this is not considered valid as far as the RFC is concerned.
+		// Just skip them to avoid dumb logging Go does because ???
+		if strings.Contains(cookieParts[CookieValue], `"`) {
+			continue
+		}
+
+		domain = strings.ToLower(cookieParts[CookieDomain])
+		expire, _ = strconv.ParseInt(cookieParts[CookieExpiration], 10, 64)
+		// 0 is a session cookie, which must not be taken as expired in 1970
+		var expireTime time.Time
+		if expire > 0 {
+			expireTime = time.Unix(expire, 0)
+		}
+
+		if strings.HasPrefix(domain, "#httponly_") {
+			httpOnly = true
+			domain = strings.TrimPrefix(domain, "#httponly_")
+		}
+
+		if strings.ToLower(cookieParts[CookieSecure]) == "true" {
+			secure = true
+		}
+
+		cookie := &http.Cookie{
+			Domain:   domain,
+			Path:     cookieParts[CookiePath],
+			Secure:   secure,
+			Expires:  expireTime,
+			Name:     cookieParts[CookieName],
+			Value:    cookieParts[CookieValue],
+			HttpOnly: httpOnly,
+		}
+
+		if _, ok := cookieMap[domain]; !ok {
+			cookieMap[domain] = make([]*http.Cookie, 0)
+		}
+
+		cookieMap[domain] = append(cookieMap[domain], cookie)
+	}
+
+	if len(cookieMap) > 0 {
+		for _, cookies := range cookieMap {
+			url, err := url.Parse(fmt.Sprintf("https://%s", cookies[0].Domain))
+
+			if err == nil {
+				jar.SetCookies(url, cookies)
+				if strings.HasSuffix(url.Host, "youtube.com") {
+					di.CookiesURL = url
+				}
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Keeps writes of the same cookies file by concurrent downloads apart
+var cookieFileLock sync.Mutex
+
+type recordedCookie struct {
+	*http.Cookie
+	// Only sent to the host that set it, rather than its subdomains too
+	HostOnly bool
+	Deleted  bool
+}
+
+func (rc *recordedCookie) key() string {
+	return strings.ToLower(rc.Domain) + "\t" + rc.Path + "\t" + rc.Name
+}
+
+// The cookie as a line of a Netscape cookies file
+func (rc *recordedCookie) netscapeLine() string {
+	domain := rc.Domain
+	if rc.HttpOnly {
+		domain = "#HttpOnly_" + domain
+	}
+
+	var expire int64
+	if !rc.Expires.IsZero() {
+		expire = rc.Expires.Unix()
+	}
+
+	return strings.Join([]string{
+		domain,
+		strings.ToUpper(strconv.FormatBool(!rc.HostOnly)),
+		rc.Path,
+		strings.ToUpper(strconv.FormatBool(rc.Secure)),
+		strconv.FormatInt(expire, 10),
+		rc.Name,
+		rc.Value,
+	}, "\t")
+}
+
+/*
+A cookie jar that remembers the cookies responses set, such as the session
+cookies YouTube rotates during long streams, so they can be written back to
+the cookies file they were loaded from. See SaveCookies.
+*/
+type CookieRecorder struct {
+	http.CookieJar
+	sync.Mutex
+	changed map[string]*recordedCookie
+}
+
+func NewCookieRecorder(jar http.CookieJar) *CookieRecorder {
+	return &CookieRecorder{
+		CookieJar: jar,
+		changed:   make(map[string]*recordedCookie),
+	}
+}
+
+func (cr *CookieRecorder) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	cr.CookieJar.SetCookies(u, cookies)
+
+	cr.Lock()
+	defer cr.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		rc := &recordedCookie{Cookie: &http.Cookie{}}
+		*rc.Cookie = *c
+
+		if len(rc.Domain) == 0 {
+			rc.Domain = strings.ToLower(u.Hostname())
+			rc.HostOnly = true
+		} else {
+			rc.Domain = "." + strings.TrimPrefix(strings.ToLower(rc.Domain), ".")
+		}
+		if len(rc.Path) == 0 {
+			rc.Path = "/"
+		}
+
+		if rc.MaxAge > 0 {
+			rc.Expires = now.Add(time.Duration(rc.MaxAge) * time.Second)
+		}
+		rc.Deleted = rc.MaxAge < 0 || (!rc.Expires.IsZero() && rc.Expires.Before(now))
+
+		cr.changed[rc.key()] = rc
+	}
+}
+
+// Take the cookies set since the last call
+func (cr *CookieRecorder) takeChanged() map[string]*recordedCookie {
+	cr.Lock()
+	defer cr.Unlock()
+
+	changed := cr.changed
+	cr.changed = make(map[string]*recordedCookie)
+	return changed
+}
+
+/*
+Write the cookies responses set back to the cookies file, or the secret it
+names, so the next run starts from a session that is still valid. Cookies
+in the file are updated in place, ones the responses deleted are removed,
+and new ones are added at the end. Everything else in the file is kept, as
+it is read again first in case it was exported anew since it was loaded.
+Does nothing unless the cookie jar is a CookieRecorder.
+*/
+func (di *DownloadInfo) SaveCookies() error {
+	recorder, ok := di.CookieJar.(*CookieRecorder)
+	if !ok || len(di.CookieFile) == 0 {
+		return nil
+	}
+
+	changed := recorder.takeChanged()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	cookieFileLock.Lock()
+	defer cookieFileLock.Unlock()
+
+	data, err := di.ReadCookies(di.CookieFile)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		parts := strings.Split(line, "\t")
+		if len(parts) == CookiePieces {
+			domain := parts[CookieDomain]
+			if strings.HasPrefix(strings.ToLower(domain), "#httponly_") {
+				domain = domain[len("#httponly_"):]
+			}
+
+			key := strings.ToLower(domain) + "\t" + parts[CookiePath] + "\t" + parts[CookieName]
+			if rc, ok := changed[key]; ok {
+				delete(changed, key)
+				if !rc.Deleted {
+					sb.WriteString(rc.netscapeLine() + "\n")
+				}
+				continue
+			}
+		}
+
+		sb.WriteString(line + "\n")
+	}
+
+	for _, rc := range changed {
+		if !rc.Deleted {
+			sb.WriteString(rc.netscapeLine() + "\n")
+		}
+	}
+
+	if name, ok := SecretName(di.CookieFile); ok {
+		if di.Secrets == nil {
+			return fmt.Errorf("no secret store to save %s to", di.CookieFile)
+		}
+		return di.Secrets.Set(name, []byte(sb.String()))
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(di.CookieFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Write to the side and rename, so a crash never leaves half the cookies
+	tmpFile := di.CookieFile + ".tmp"
+	err = os.WriteFile(tmpFile, []byte(sb.String()), mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, di.CookieFile)
+}
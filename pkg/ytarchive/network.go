@@ -0,0 +1,142 @@
+package ytarchive
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the network interfaces are checked for changes
+const NetworkCheckInterval = 2 * time.Second
+
+/*
+Notices the network changing under a download, such as roaming to another
+Wi-Fi network or a VPN being turned on or off. Connections made over the
+old network usually stay open but dead until a TCP timeout gives up on
+them, which can take much longer than a fragment lasts.
+*/
+type networkWatch struct {
+	sync.Mutex
+	fingerprint string
+	changed     chan struct{}
+}
+
+// Closed the next time the network changes
+func (nw *networkWatch) changedChan() <-chan struct{} {
+	nw.Lock()
+	defer nw.Unlock()
+
+	if nw.changed == nil {
+		nw.changed = make(chan struct{})
+	}
+	return nw.changed
+}
+
+// Returns true if the network changed since the last check
+func (nw *networkWatch) check() bool {
+	fingerprint := networkFingerprint()
+
+	nw.Lock()
+	defer nw.Unlock()
+
+	last := nw.fingerprint
+	nw.fingerprint = fingerprint
+	if len(last) == 0 || last == fingerprint {
+		return false
+	}
+
+	if nw.changed != nil {
+		close(nw.changed)
+		nw.changed = nil
+	}
+	return true
+}
+
+/*
+Derive a context for a single request that is also cancelled when the
+network changes, so a request stuck on a dead connection fails right away.
+*/
+func (nw *networkWatch) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	changed := nw.changedChan()
+
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	return reqCtx, cancel
+}
+
+/*
+Describe the current network: the addresses of every interface that is
+up, and the local address the default routes go out of.
+*/
+func networkFingerprint() string {
+	parts := []string{}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		LogTrace("Failed to list network interfaces: %s", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			parts = append(parts, iface.Name+"="+addr.String())
+		}
+	}
+
+	// Connecting a UDP socket only looks up the route, nothing is sent.
+	// The addresses are reserved for documentation and never local.
+	for _, target := range []string{"192.0.2.1:9", "[2001:db8::1]:9"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			parts = append(parts, "route="+addr.IP.String())
+		}
+		conn.Close()
+	}
+
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+/*
+Watch for the network changing while downloading. When it does, drop the
+idle connections and cancel the fragment requests in flight so they are
+retried over the new network straight away. Runs until ctx is cancelled.
+*/
+func (di *DownloadInfo) WatchNetwork(ctx context.Context) {
+	di.network.check()
+
+	for SleepContext(ctx, NetworkCheckInterval) {
+		if !di.network.check() {
+			continue
+		}
+
+		LogInfo("The network changed, reconnecting")
+		di.PrintStatus()
+		di.addDiscontinuity(Discontinuity{Kind: DiscontinuityNetwork})
+
+		closeIdleConnections(di.HttpClient())
+		closeIdleConnections(di.MediaHttpClient())
+	}
+}
@@ -0,0 +1,1096 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	PlayableOk         = "OK"
+	PlayableOffline    = "LIVE_STREAM_OFFLINE"
+	PlayableUnplayable = "UNPLAYABLE"
+	PlayableError      = "ERROR"
+	PlayableLogin      = "LOGIN_REQUIRED"
+	PlayableAgeCheck   = "AGE_CHECK_REQUIRED"
+	PlayableAgeVerify  = "AGE_VERIFICATION_REQUIRED"
+
+	// How many times to reload the cookies when they are not accepted for a members-only stream
+	MaxSessionRefreshes = 2
+
+	WebAPIPostData = `{
+	'context': {
+		'client': {
+			'clientName': '%s',
+			'clientVersion': '%s',
+			'hl': 'en'
+		}
+	},
+	'videoId': '%s',
+	'playbackContext': {
+		'contentPlaybackContext': {
+			'html5Preference': 'HTML5_PREF_WANTS'
+		}
+	},
+	'serviceIntegrityDimensions': {
+		'poToken': '%s'
+	}
+}
+	`
+
+	// Client for getting around the age check on age-restricted streams
+	EmbedClientName    = "TVHTML5_SIMPLY_EMBEDDED_PLAYER"
+	EmbedCtxClientName = 85
+	EmbedClientVersion = "2.0"
+	EmbedAPIPostData   = `{
+	'context': {
+		'client': {
+			'clientName': '%s',
+			'clientVersion': '%s',
+			'clientScreen': 'EMBED',
+			'hl': 'en'
+		},
+		'thirdParty': {
+			'embedUrl': 'https://www.youtube.com/'
+		}
+	},
+	'videoId': '%s',
+	'playbackContext': {
+		'contentPlaybackContext': {
+			'html5Preference': 'HTML5_PREF_WANTS'
+		}
+	}
+}
+	`
+)
+
+const (
+	PlayerResponseFound = iota
+	PlayerResponseNotFound
+	PlayerResponseNotUsable
+)
+
+var (
+	playerRespDecl    = []byte("var ytInitialPlayerResponse =")
+	ytInitialDataDecl = []byte("var ytInitialData =")
+)
+
+/*
+Auto-generated using https://mholt.github.io/json-to-go/
+Trimmed after to relevent fields
+*/
+type PlayerResponse struct {
+	ResponseContext struct {
+		MainAppWebResponseContext struct {
+			LoggedOut bool `json:"loggedOut"`
+		} `json:"mainAppWebResponseContext"`
+	} `json:"responseContext"`
+	PlayabilityStatus struct {
+		Status            string `json:"status"`
+		Reason            string `json:"reason"`
+		LiveStreamability struct {
+			LiveStreamabilityRenderer struct {
+				VideoID      string `json:"videoId"`
+				OfflineSlate struct {
+					LiveStreamOfflineSlateRenderer struct {
+						ScheduledStartTime string `json:"scheduledStartTime"`
+					} `json:"liveStreamOfflineSlateRenderer"`
+				} `json:"offlineSlate"`
+				PollDelayMs string `json:"pollDelayMs"`
+			} `json:"liveStreamabilityRenderer"`
+		} `json:"liveStreamability"`
+		ErrorScreen struct {
+			PlayerLegacyDesktopYpcOfferRenderer struct {
+				OfferID string `json:"offerId"`
+			} `json:"playerLegacyDesktopYpcOfferRenderer"`
+			PlayerErrorMessageRenderer struct {
+				Subreason struct {
+					SimpleText string `json:"simpleText"`
+					Runs       []struct {
+						Text string `json:"text"`
+					} `json:"runs"`
+				} `json:"subreason"`
+			} `json:"playerErrorMessageRenderer"`
+		} `json:"errorScreen"`
+	} `json:"playabilityStatus"`
+	StreamingData struct {
+		ExpiresInSeconds string `json:"expiresInSeconds"`
+		AdaptiveFormats  []struct {
+			Itag              int     `json:"itag"`
+			URL               string  `json:"url"`
+			MimeType          string  `json:"mimeType"`
+			QualityLabel      string  `json:"qualityLabel,omitempty"`
+			Bitrate           int     `json:"bitrate"`
+			Fps               int     `json:"fps"`
+			TargetDurationSec float64 `json:"targetDurationSec"`
+			AudioTrack        struct {
+				ID string `json:"id"`
+			} `json:"audioTrack"`
+		} `json:"adaptiveFormats"`
+		DashManifestURL string `json:"dashManifestUrl"`
+	} `json:"streamingData"`
+	VideoDetails struct {
+		VideoID          string  `json:"videoId"`
+		Title            string  `json:"title"`
+		LengthSeconds    string  `json:"lengthSeconds"`
+		IsLive           bool    `json:"isLive"`
+		ChannelID        string  `json:"channelId"`
+		IsOwnerViewing   bool    `json:"isOwnerViewing"`
+		ShortDescription string  `json:"shortDescription"`
+		AverageRating    float64 `json:"averageRating"`
+		AllowRatings     bool    `json:"allowRatings"`
+		ViewCount        string  `json:"viewCount"`
+		Author           string  `json:"author"`
+		IsLiveContent    bool    `json:"isLiveContent"`
+	} `json:"videoDetails"`
+	Microformat struct {
+		PlayerMicroformatRenderer struct {
+			Thumbnail struct {
+				Thumbnails []struct {
+					URL string `json:"url"`
+				} `json:"thumbnails"`
+			} `json:"thumbnail"`
+			LiveBroadcastDetails struct {
+				IsLiveNow      bool   `json:"isLiveNow"`
+				StartTimestamp string `json:"startTimestamp"`
+				EndTimestamp   string `json:"endTimestamp"`
+			} `json:"liveBroadcastDetails"`
+			PublishDate        string   `json:"publishDate"`
+			UploadDate         string   `json:"uploadDate"`
+			AvailableCountries []string `json:"availableCountries"`
+			Category           string   `json:"category"`
+		} `json:"playerMicroformatRenderer"`
+	} `json:"microformat"`
+	Captions struct {
+		PlayerCaptionsTracklistRenderer struct {
+			CaptionTracks []struct {
+				LanguageCode string `json:"languageCode"`
+			} `json:"captionTracks"`
+		} `json:"playerCaptionsTracklistRenderer"`
+	} `json:"captions"`
+}
+
+type YtInitialData struct {
+	Metadata struct {
+		ChannelMetadataRenderer struct {
+			ExternalID string `json:"externalId"`
+		} `json:"channelMetadataRenderer"`
+	} `json:"metadata"`
+	Contents struct {
+		Twocolumnbrowseresultsrenderer struct {
+			Tabs []struct {
+				Tabrenderer struct {
+					Endpoint struct {
+						Commandmetadata struct {
+							Webcommandmetadata struct {
+								URL string `json:"url"`
+							} `json:"webCommandMetadata"`
+						} `json:"commandMetadata"`
+					} `json:"endpoint"`
+					Content struct {
+						Richgridrenderer struct {
+							Contents []RichGridContent `json:"contents"`
+						} `json:"richGridRenderer"`
+					} `json:"content"`
+				} `json:"tabRenderer"`
+			} `json:"tabs"`
+		} `json:"twoColumnBrowseResultsRenderer"`
+	} `json:"contents"`
+}
+
+type RichGridContent struct {
+	Richitemrenderer struct {
+		Content struct {
+			Videorenderer struct {
+				Videoid string `json:"videoId"`
+				Title   struct {
+					Runs []struct {
+						Text string `json:"text"`
+					} `json:"runs"`
+					SimpleText string `json:"simpleText"`
+				} `json:"title"`
+				Thumbnailoverlays []struct {
+					Thumbnailoverlaytimestatusrenderer struct {
+						Style string `json:"style"`
+					} `json:"thumbnailOverlayTimeStatusRenderer"`
+				} `json:"thumbnailOverlays"`
+				Badges []struct {
+					Metadatabadgerenderer struct {
+						Style string `json:"style"`
+					} `json:"metadataBadgeRenderer"`
+				} `json:"badges"`
+			} `json:"videoRenderer"`
+		} `json:"content"`
+	} `json:"richItemRenderer"`
+}
+
+// Get the scheduled start time of an upcoming stream as a unix timestamp
+/*
+Get the scheduled start of an upcoming stream as a unix timestamp, from the
+offline slate in the playability status, or the start timestamp of the
+broadcast details when the slate does not have it.
+*/
+func (pr *PlayerResponse) ScheduledStartTime() (int64, error) {
+	slateTime := pr.PlayabilityStatus.LiveStreamability.LiveStreamabilityRenderer.OfflineSlate.LiveStreamOfflineSlateRenderer.ScheduledStartTime
+	if len(slateTime) > 0 {
+		return strconv.ParseInt(slateTime, 10, 64)
+	}
+
+	startTimestamp := pr.Microformat.PlayerMicroformatRenderer.LiveBroadcastDetails.StartTimestamp
+	if len(startTimestamp) == 0 {
+		return 0, errors.New("no scheduled start time given")
+	}
+
+	startTime, err := time.Parse(time.RFC3339, startTimestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return startTime.Unix(), nil
+}
+
+// Whether the stream asks to confirm the viewer's age before playing
+func (pr *PlayerResponse) IsAgeRestricted() bool {
+	switch pr.PlayabilityStatus.Status {
+	case PlayableAgeCheck, PlayableAgeVerify:
+		return true
+	case PlayableLogin, PlayableUnplayable:
+		return strings.Contains(strings.ToLower(pr.PlayabilityStatus.Reason), "confirm your age")
+	}
+
+	return false
+}
+
+/*
+Get around the age check of an age-restricted stream with the player
+response of the embedded player client, which is sent the cookies from
+--cookies if there are any. The details of the stream are kept from the
+original response when the embedded one leaves them out.
+*/
+func (di *DownloadInfo) bypassAgeCheck(ctx context.Context, pr *PlayerResponse) (*PlayerResponse, error) {
+	embedPr, err := di.DownloadEmbedPlayerResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if embedPr.IsAgeRestricted() || len(embedPr.PlayabilityStatus.Status) == 0 {
+		return nil, fmt.Errorf("the embedded player was also refused: %s", embedPr.PlayabilityStatus.Reason)
+	}
+
+	pr.PlayabilityStatus = embedPr.PlayabilityStatus
+	pr.StreamingData = embedPr.StreamingData
+	if len(pr.VideoDetails.VideoID) == 0 {
+		pr.VideoDetails = embedPr.VideoDetails
+	}
+
+	return pr, nil
+}
+
+// The reason given for the stream not playing, including the details under it
+func (pr *PlayerResponse) FullReason() string {
+	reason := pr.PlayabilityStatus.Reason
+	subreason := pr.PlayabilityStatus.ErrorScreen.PlayerErrorMessageRenderer.Subreason
+	subText := subreason.SimpleText
+	for _, run := range subreason.Runs {
+		subText += run.Text
+	}
+
+	if len(subText) > 0 {
+		reason = strings.TrimSpace(reason + " " + subText)
+	}
+
+	return reason
+}
+
+// Whether the stream is blocked in the country the request came from
+func (pr *PlayerResponse) IsRegionLocked() bool {
+	if pr.PlayabilityStatus.Status == PlayableOk {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(pr.FullReason()), "in your country")
+}
+
+func (di *DownloadInfo) reportRegionLock(pr *PlayerResponse) {
+	LogError("%s is not available in your country.", di.URL)
+	LogError("Reason: %s", pr.FullReason())
+
+	countries := pr.Microformat.PlayerMicroformatRenderer.AvailableCountries
+	if len(countries) > 0 {
+		LogError("It is only available in: %s", strings.Join(countries, ", "))
+		LogError("Use --proxy with a proxy in one of those countries to download it.")
+	} else {
+		LogError("Use --proxy with a proxy in a country where it is available to download it.")
+	}
+}
+
+// Whether the stream can only be watched by channel members
+func (pr *PlayerResponse) IsMembersOnly() bool {
+	if pr.PlayabilityStatus.ErrorScreen.PlayerLegacyDesktopYpcOfferRenderer.OfferID == "sponsors_only_video" {
+		return true
+	}
+
+	reason := strings.ToLower(pr.PlayabilityStatus.Reason)
+	return strings.Contains(reason, "members-only") || strings.Contains(reason, "members only")
+}
+
+/*
+Reload the cookies file and drop the cached ytcfg, so the next request
+starts a fresh session with the latest cookies.
+*/
+func (di *DownloadInfo) RefreshSession() error {
+	di.Ytcfg = nil
+	return di.ReloadCookies()
+}
+
+// Search the given HTML for the player response object
+func GetJsonFromHtml(htmlData []byte, jsonDecl []byte) []byte {
+	var objData []byte
+	reader := bytes.NewReader(htmlData)
+	tokenizer := html.NewTokenizer(reader)
+	isScript := false
+
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return objData
+		case html.TextToken:
+			if isScript {
+				data := tokenizer.Text()
+				declStart := bytes.Index(data, jsonDecl)
+				if declStart < 0 {
+					continue
+				}
+
+				// Maybe add a LogTrace in the future for stuff like this
+				//LogDebug("Found script element with player response in watch page.")
+				objStart := bytes.Index(data[declStart:], []byte("{")) + declStart
+				objEnd := bytes.LastIndex(data[objStart:], []byte("};")) + 1 + objStart
+
+				if objEnd > objStart {
+					objData = data[objStart:objEnd]
+				}
+
+				return objData
+			}
+		case html.StartTagToken:
+			tn, _ := tokenizer.TagName()
+			if string(tn) == "script" {
+				isScript = true
+			} else {
+				isScript = false
+			}
+		}
+	}
+}
+
+// Surely there won't be more than 5 simultaneous streams when looking for membership streams, right?
+const maxStreamItemCheck = 5
+
+func (di *DownloadInfo) GetNewestStreamFromStreams(ctx context.Context) string {
+	if !di.LiveURL {
+		return ""
+	}
+
+	streamsUrl := strings.Replace(di.URL, "/live", "/streams", 1)
+	streams := di.getStreamsTabStreams(ctx, streamsUrl, maxStreamItemCheck, false, true)
+	if len(streams) == 0 {
+		return ""
+	}
+
+	return streams[0]
+}
+
+/*
+Get the URLs of the streams currently live on a channel's streams tab,
+newest first. Only members-only streams are included if MembersOnly is set.
+*/
+func (di *DownloadInfo) GetLiveStreams(ctx context.Context, streamsUrl string) []string {
+	return di.getStreamsTabStreams(ctx, streamsUrl, maxStreamItemCheck, false, false)
+}
+
+/*
+Get the URLs of the streams live or scheduled on a channel's streams tab.
+Only members-only streams are included if MembersOnly is set, and only
+those the Filter allows.
+*/
+func (di *DownloadInfo) GetScheduledStreams(ctx context.Context, streamsUrl string) []string {
+	// Everything on the first page of the tab, scheduled streams are listed first
+	return di.getStreamsTabStreams(ctx, streamsUrl, 0, true, true)
+}
+
+func (di *DownloadInfo) getStreamsTabStreams(ctx context.Context, streamsUrl string, maxItems int, upcoming, filtered bool) []string {
+	var streams []string
+
+	initialData := &YtInitialData{}
+	var contents []RichGridContent
+	streamsHtml := DownloadData(ctx, di.HttpClient(), streamsUrl)
+	ytInitialData := GetJsonFromHtml(streamsHtml, ytInitialDataDecl)
+
+	err := json.Unmarshal(ytInitialData, initialData)
+	if err != nil {
+		return streams
+	}
+
+	for _, tab := range initialData.Contents.Twocolumnbrowseresultsrenderer.Tabs {
+		if strings.HasSuffix(tab.Tabrenderer.Endpoint.Commandmetadata.Webcommandmetadata.URL, "/streams") {
+			contents = tab.Tabrenderer.Content.Richgridrenderer.Contents
+		}
+	}
+
+	for i, content := range contents {
+		if maxItems > 0 && i >= maxItems {
+			break
+		}
+
+		videoRenderer := content.Richitemrenderer.Content.Videorenderer
+		if di.MembersOnly {
+			mengen := false
+			for _, badge := range videoRenderer.Badges {
+				if badge.Metadatabadgerenderer.Style == "BADGE_STYLE_TYPE_MEMBERS_ONLY" {
+					mengen = true
+					break
+				}
+			}
+
+			if !mengen {
+				continue
+			}
+		}
+
+		if filtered && di.Filter != nil {
+			title := videoRenderer.Title.SimpleText
+			for _, run := range videoRenderer.Title.Runs {
+				title += run.Text
+			}
+
+			filter := di.Filter.ForChannel(initialData.Metadata.ChannelMetadataRenderer.ExternalID)
+			if ok, reason := filter.Allows(title); !ok {
+				LogDebug("Skipping %s, %s", videoRenderer.Videoid, reason)
+				continue
+			}
+		}
+
+		for _, thumbnailRenderer := range videoRenderer.Thumbnailoverlays {
+			style := thumbnailRenderer.Thumbnailoverlaytimestatusrenderer.Style
+			if style == "LIVE" || (upcoming && style == "UPCOMING") {
+				streams = append(streams, fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoRenderer.Videoid))
+				break
+			}
+		}
+	}
+
+	return streams
+}
+
+/*
+Find the other feeds of a multiview broadcast, which show up as streams
+live on the same channel at the same time as this one.
+*/
+func (di *DownloadInfo) GetCoStreams(ctx context.Context) []string {
+	var coStreams []string
+	channelId := di.FormatInfo["channel_id"]
+	if len(channelId) == 0 {
+		return coStreams
+	}
+
+	streamsUrl := fmt.Sprintf("https://www.youtube.com/channel/%s/streams", channelId)
+	for _, streamUrl := range di.GetLiveStreams(ctx, streamsUrl) {
+		if !strings.HasSuffix(streamUrl, "="+di.VideoID) {
+			coStreams = append(coStreams, streamUrl)
+		}
+	}
+
+	return coStreams
+}
+
+// New PO Token stuff requires calling the API instead of
+// using the URLs from scraping the watch page.
+// Credit to yt-dlp devs for POST data and headers.
+func (di *DownloadInfo) DownloadWebPlayerResponse(ctx context.Context) (*PlayerResponse, error) {
+	if len(di.PoToken) == 0 {
+		return nil, fmt.Errorf("Cannot retrieve web api player response without a PO Token set")
+	}
+	ytcfg := di.Ytcfg
+
+	if ytcfg == nil {
+		ytcfg = GetDefaultYTCFG()
+	}
+
+	data := []byte(fmt.Sprintf(WebAPIPostData, ytcfg.InnertubeClientName, ytcfg.InnertubeClientVersion, di.VideoID, di.PoToken))
+	respData, pr, err := di.downloadApiPlayerResponse(ctx, data, ytcfg.InnertubeCtxClientName, ytcfg.InnertubeCtxClientVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	di.writeSource(SourceWebPlayerResponse, respData)
+	return pr, nil
+}
+
+/*
+Get the player response from the embedded TV player client, which serves
+age-restricted streams without the age check the web client asks for.
+*/
+func (di *DownloadInfo) DownloadEmbedPlayerResponse(ctx context.Context) (*PlayerResponse, error) {
+	data := []byte(fmt.Sprintf(EmbedAPIPostData, EmbedClientName, EmbedClientVersion, di.VideoID))
+	_, pr, err := di.downloadApiPlayerResponse(ctx, data, EmbedCtxClientName, EmbedClientVersion)
+	return pr, err
+}
+
+func (di *DownloadInfo) downloadApiPlayerResponse(ctx context.Context, data []byte, clientName int, clientVersion string) ([]byte, *PlayerResponse, error) {
+	pr := &PlayerResponse{}
+	respData, err := di.postInnertube(ctx, "player", data, clientName, clientVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = json.Unmarshal(respData, pr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return respData, pr, nil
+}
+
+// POST to an innertube API endpoint with the session of the cookies, if any
+func (di *DownloadInfo) postInnertube(ctx context.Context, endpoint string, data []byte, clientName int, clientVersion string) ([]byte, error) {
+	auth := GenerateSAPISIDHash(di.CookieJar, di.CookiesURL)
+	queryParams := ""
+	ytcfg := di.Ytcfg
+
+	if ytcfg == nil {
+		ytcfg = GetDefaultYTCFG()
+	}
+
+	if len(ytcfg.InnertubeApiKey) > 0 {
+		queryParams = fmt.Sprintf("?innertube_key=%s", ytcfg.InnertubeApiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://www.youtube.com/youtubei/v1/%s%s", endpoint, queryParams), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("X-YouTube-Client-Name", strconv.Itoa(clientName))
+	req.Header.Add("X-YouTube-Client-Version", clientVersion)
+	req.Header.Add("Origin", "https://www.youtube.com")
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("Accept-Encoding", AcceptEncodings)
+
+	if len(auth) > 0 {
+		req.Header.Add("X-Origin", "https://www.youtube.com")
+		req.Header.Add("Authorization", auth)
+	}
+
+	if len(ytcfg.IdToken) > 0 {
+		req.Header.Add("X-Youtube-Identity-Token", ytcfg.IdToken)
+	}
+
+	if len(ytcfg.DelegatedSessionId) > 0 {
+		req.Header.Add("X-Goog-PageId", ytcfg.DelegatedSessionId)
+	}
+
+	if len(ytcfg.VisitorData) > 0 {
+		req.Header.Add("X-Goog-Visitor-Id", ytcfg.VisitorData)
+	}
+
+	if len(ytcfg.SessionIndex) > 0 {
+		req.Header.Add("X-Goog-AuthUser", ytcfg.SessionIndex)
+	}
+
+	LogTrace("%v", req)
+	resp, err := di.HttpClient().Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	CheckClockSkew(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned non-200 status code %d", resp.StatusCode)
+	}
+
+	return ReadResponseBody(resp)
+}
+
+func (di *DownloadInfo) GetVideoHtml(ctx context.Context) []byte {
+	var videoHtml []byte
+
+	if di.LiveURL {
+		streamUrl := di.GetNewestStreamFromStreams(ctx)
+
+		if len(streamUrl) > 0 {
+			videoHtml = DownloadData(ctx, di.HttpClient(), streamUrl)
+		}
+	}
+
+	if len(videoHtml) == 0 && !di.MembersOnly {
+		videoHtml = DownloadData(ctx, di.HttpClient(), di.URL)
+	}
+
+	return videoHtml
+}
+
+// Get the player response object from youtube
+func (di *DownloadInfo) GetPlayerResponse(videoHtml []byte) (*PlayerResponse, error) {
+	pr := &PlayerResponse{}
+
+	if len(videoHtml) == 0 {
+		return nil, fmt.Errorf("unable to retrieve data from video page")
+	}
+
+	prData := GetJsonFromHtml(videoHtml, playerRespDecl)
+	if len(prData) == 0 {
+		if GetLogLevel() >= LoglevelDebug && di.InProgress {
+			LogDebug("Could not find player response from video watch page. Writing html file to %s.html", di.VideoID)
+			os.WriteFile(fmt.Sprintf("%s.html", di.VideoID), videoHtml, di.FileMode)
+		}
+		return nil, fmt.Errorf("unable to retrieve player response object from watch page")
+	}
+
+	err := json.Unmarshal(prData, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	if di.LiveURL {
+		videoId := GetVideoIdFromWatchPage(videoHtml)
+		if len(videoId) > 0 {
+			di.VideoID = videoId
+		}
+	}
+
+	return pr, nil
+}
+
+func (di *DownloadInfo) GetPlayablePlayerResponse(ctx context.Context) (retrieved int, pr *PlayerResponse, selectedQualities []string) {
+	firstWait := true
+	isLiveURL := di.LiveURL
+	waitOnLiveURL := isLiveURL && di.RetrySecs > 0 && !di.InProgress
+	liveWaited := 0
+	retryCount := 0
+	sessionRefreshes := 0
+	var secsLate int
+	var lastSchedTime int64
+	var err error
+	// Streams the Filter rejected, so each is only reported once
+	rejected := make(map[string]bool)
+
+	if len(di.SelectedQuality) > 0 {
+		selectedQualities = ParseQualitySelection(VideoQualities, di.SelectedQuality)
+	}
+
+	for {
+		videoHtml := di.GetVideoHtml(ctx)
+		if ctx.Err() != nil {
+			return PlayerResponseNotUsable, nil, nil
+		}
+
+		pr, err = di.GetPlayerResponse(videoHtml)
+		if err == nil && pr.IsAgeRestricted() {
+			LogInfo("Stream is age-restricted, trying the embedded player client")
+			if di.VideoID == "" {
+				di.VideoID = pr.VideoDetails.VideoID
+			}
+
+			pr, err = di.bypassAgeCheck(ctx, pr)
+			if err != nil {
+				LogError("Stream is age-restricted and the age check could not be skipped: %s", err)
+				LogError("Try --cookies with the cookies of an account that has confirmed its age.")
+				di.Unavailable = true
+				return PlayerResponseNotUsable, nil, nil
+			}
+		}
+
+		if err == nil && pr.IsRegionLocked() {
+			di.reportRegionLock(pr)
+			di.RegionLocked = true
+			di.Unavailable = true
+			if di.InProgress {
+				di.printStatusWithoutLock()
+			}
+
+			return PlayerResponseNotUsable, nil, nil
+		}
+
+		// Checked again on every retry, since the duration is only known once live
+		if err == nil && di.Filter != nil && !di.InProgress {
+			videoId := pr.VideoDetails.VideoID
+			filter := di.Filter.ForChannel(pr.VideoDetails.ChannelID)
+			if ok, reason := filter.allowsPlayerResponse(pr); !ok {
+				if !rejected[videoId] {
+					rejected[videoId] = true
+					LogGeneral("Not archiving %s, %s: %s", videoId, reason, pr.VideoDetails.Title)
+				}
+
+				if !waitOnLiveURL {
+					di.Filtered = true
+					return PlayerResponseNotUsable, nil, nil
+				}
+				err = errors.New("the stream was filtered out")
+			}
+		}
+
+		if err != nil {
+			if waitOnLiveURL {
+				if len(selectedQualities) < 1 {
+					fmt.Fprintln(os.Stderr)
+					selectedQualities, di.pickErr = GetQualityFromUser(VideoQualities, DescribeQualityLabels(VideoQualities), true)
+					if di.pickErr != nil {
+						return PlayerResponseNotUsable, nil, nil
+					}
+				}
+
+				di.SetState(StateWaiting)
+				if liveWaited == 0 {
+					LogGeneral("You have opted to wait for a livestream to be scheduled. Retrying about every %d seconds.\n", di.RetrySecs)
+				}
+
+				pollSecs := WaitPollSecs(di.RetrySecs, liveWaited, -1)
+				if !SleepContext(ctx, time.Duration(pollSecs)*time.Second) {
+					return PlayerResponseNotUsable, nil, nil
+				}
+				liveWaited += pollSecs
+				retryCount += 1
+				if GetLogLevel() > LoglevelQuiet {
+					msg := "Retries: %d (Last retry: %s), Total time waited: %d seconds"
+					if !di.StatusNewlines {
+						msg = "\r" + msg
+					} else {
+						msg = msg + "\n"
+					}
+
+					fmt.Fprintf(os.Stderr, msg,
+						retryCount,
+						time.Now().Format("2006/01/02 15:04:05"),
+						liveWaited,
+					)
+				}
+				continue
+			}
+
+			fmt.Fprintln(os.Stderr)
+			LogError("Error retrieving player response: %s", err.Error())
+			return PlayerResponseNotFound, nil, nil
+		}
+
+		if len(pr.VideoDetails.VideoID) == 0 {
+			if di.InProgress {
+				LogWarn("Video details no longer available mid download.")
+				LogWarn("Stream was likely privated after finishing.")
+				LogWarn("We will continue to download, but if it starts to fail, nothing can be done.")
+				di.printStatusWithoutLock()
+			}
+
+			LogError("Video Details not found, video is likely private or does not exist.")
+			di.Live = false
+			di.Unavailable = true
+
+			return PlayerResponseNotUsable, nil, nil
+		}
+
+		if len(pr.PlayabilityStatus.LiveStreamability.LiveStreamabilityRenderer.VideoID) == 0 && !pr.VideoDetails.IsLiveContent {
+			if di.Live {
+				di.Live = false
+			} else {
+				LogError("%s is not a livestream. It would be better to use yt-dlp to download it.", di.URL)
+			}
+
+			return PlayerResponseNotUsable, nil, nil
+		}
+
+		switch pr.PlayabilityStatus.Status {
+		case PlayableError:
+			if di.InProgress {
+				LogInfo("Finishing download")
+			}
+
+			LogError("Playability status: ERROR. Reason: %s", pr.PlayabilityStatus.Reason)
+			di.Live = false
+
+			return PlayerResponseNotUsable, nil, nil
+
+		case PlayableUnplayable, PlayableLogin:
+			loggedIn := !pr.ResponseContext.MainAppWebResponseContext.LoggedOut
+
+			if pr.IsMembersOnly() {
+				if di.CookieJar != nil && !loggedIn && sessionRefreshes < MaxSessionRefreshes {
+					sessionRefreshes += 1
+					LogWarn("The cookies were not accepted for this members-only stream. Refreshing the session and trying again (%d/%d)...", sessionRefreshes, MaxSessionRefreshes)
+					err = di.RefreshSession()
+					if err != nil {
+						LogWarn("Failed to reload cookies: %s", err)
+					}
+
+					if !SleepContext(ctx, time.Duration(DefaultPollTime)*time.Second) {
+						return PlayerResponseNotUsable, nil, nil
+					}
+					continue
+				}
+
+				LogError("%s is a members-only stream.", di.URL)
+				if di.CookieJar == nil {
+					LogError("Use --cookies with the cookies of an account that is a member of the channel.")
+				} else if !loggedIn {
+					LogError("The cookies were not accepted even after refreshing the session. They have likely expired, export them again from a logged in browser.")
+				} else {
+					LogError("The account the cookies belong to is not a member of the channel.")
+				}
+
+				di.NeedsMembership = true
+				di.Unavailable = true
+				if di.InProgress {
+					di.printStatusWithoutLock()
+				}
+
+				return PlayerResponseNotUsable, nil, nil
+			}
+
+			LogError("Playability status: %s.", pr.PlayabilityStatus.Status)
+			LogError("Reason: %s", pr.PlayabilityStatus.Reason)
+			LogError("Logged in status: %t", loggedIn)
+			LogError("If this is a members only stream, you provided a cookies.txt file, and the above 'logged in' status is not True, please try updating your cookies file.")
+
+			di.Unavailable = true
+			if di.InProgress {
+				di.printStatusWithoutLock()
+			}
+
+			return PlayerResponseNotUsable, nil, nil
+
+		case PlayableOffline:
+			if di.InProgress {
+				LogDebug("Livestream status is %s mid-download", PlayableOffline)
+				return PlayerResponseNotUsable, nil, nil
+			}
+
+			if di.LiveFromVal != "" && strings.HasPrefix(di.LiveFromVal, "-") {
+				LogError("Option --live-from with a negative duration is not valid for a scheduled stream.")
+				return PlayerResponseNotUsable, nil, nil
+			}
+
+			if di.Wait == ActionDoNot {
+				LogError("Stream has not started, and you have opted not to wait.")
+				return PlayerResponseNotUsable, nil, nil
+			}
+
+			if firstWait && di.Wait == ActionAsk && di.RetrySecs == 0 {
+				if !di.AskWaitForStream() {
+					return PlayerResponseNotUsable, nil, nil
+				}
+			}
+
+			if firstWait {
+				if !(isLiveURL && di.RetrySecs > 0) {
+					di.printChannelAndTitle(pr)
+				}
+				fmt.Fprintln(os.Stderr)
+				if len(selectedQualities) < 1 {
+					selectedQualities, di.pickErr = GetQualityFromUser(VideoQualities, DescribeQualityLabels(VideoQualities), true)
+					if di.pickErr != nil {
+						return PlayerResponseNotUsable, nil, nil
+					}
+				}
+			}
+
+			// Set again once the stream starts, known now for what is told
+			// about the wait, such as webhooks
+			di.setFormatInfo(pr)
+			di.SetState(StateWaiting)
+			if di.RetrySecs > 0 {
+				if firstWait {
+					firstWait = false
+					LogGeneral("Waiting for stream, retrying about every %d seconds...\n", di.RetrySecs)
+				}
+
+				waited := true
+				var pollSecs int
+				if schedTime, err := pr.ScheduledStartTime(); err == nil && schedTime > ServerNow().Unix() {
+					pollSecs = WaitPollSecs(di.RetrySecs, liveWaited, schedTime-ServerNow().Unix())
+					waited = WaitWithCountdown(ctx, schedTime, int64(pollSecs), di.StatusNewlines)
+				} else {
+					pollSecs = WaitPollSecs(di.RetrySecs, liveWaited, -1)
+					waited = SleepContext(ctx, time.Duration(pollSecs)*time.Second)
+				}
+
+				if !waited {
+					return PlayerResponseNotUsable, nil, nil
+				}
+
+				liveWaited += pollSecs
+				retryCount += 1
+				if GetLogLevel() > LoglevelQuiet {
+					msg := "Retries: %d (Last retry: %s), Total time waited: %d seconds"
+					if !di.StatusNewlines {
+						msg = "\r" + msg
+					} else {
+						msg = msg + "\n"
+					}
+
+					fmt.Fprintf(os.Stderr, msg,
+						retryCount,
+						time.Now().Format("2006/01/02 15:04:05"),
+						liveWaited,
+					)
+				}
+				continue
+			}
+
+			schedTime, err := pr.ScheduledStartTime()
+			if err != nil {
+				LogWarn("Failed to get stream start time: %s.", err)
+				LogWarn("Falling back to polling.")
+				di.RetrySecs = DefaultPollTime
+				if !SleepContext(ctx, time.Duration(JitterSecs(di.RetrySecs))*time.Second) {
+					return PlayerResponseNotUsable, nil, nil
+				}
+				continue
+			}
+
+			curTime := ServerNow().Unix()
+			slepTime := schedTime - curTime
+
+			if slepTime > 0 {
+				if firstWait || schedTime != lastSchedTime {
+					if !firstWait {
+						LogGeneral("Stream rescheduled.")
+					}
+
+					LogGeneral("Stream starts at %s in %d seconds. ",
+						time.Unix(schedTime, 0).Format(time.RFC3339),
+						slepTime)
+					LogGeneral("Waiting for this time to elapse...")
+				}
+
+				firstWait = false
+				secsLate = 0
+				lastSchedTime = schedTime
+
+				/*
+					Only check back occasionally for a reschedule while the start is far off,
+					then poll aggressively in the final minutes in case the stream starts early.
+				*/
+				waitSecs := slepTime - FinalCountdownTime
+				if waitSecs <= 0 {
+					waitSecs = int64(JitterSecs(DefaultPollTime))
+				} else if waitSecs > ScheduleRecheckTime {
+					waitSecs = int64(JitterSecs(ScheduleRecheckTime))
+				}
+
+				if waitSecs > slepTime {
+					waitSecs = slepTime
+				}
+
+				if !WaitWithCountdown(ctx, schedTime, waitSecs, di.StatusNewlines) {
+					return PlayerResponseNotUsable, nil, nil
+				}
+				continue
+			}
+
+			if firstWait {
+				LogGeneral("Stream should have started. Checking back every %d seconds\n", DefaultPollTime)
+				firstWait = false
+			}
+
+			/*
+				If we get this far, the stream's scheduled time has passed but it's still not started
+				Check every 15 seconds
+			*/
+			pollSecs := JitterSecs(DefaultPollTime)
+			if !SleepContext(ctx, time.Duration(pollSecs)*time.Second) {
+				return PlayerResponseNotUsable, nil, nil
+			}
+			secsLate += pollSecs
+			LogGeneral("Stream is %d seconds late...", secsLate)
+			continue
+
+		case PlayableOk:
+			// player response returned from /live does not include full information
+			if isLiveURL {
+				di.URL = fmt.Sprintf("https://www.youtube.com/watch?v=%s", di.VideoID)
+				di.MembersOnly = false
+				isLiveURL = false
+				continue
+			}
+
+			di.printChannelAndTitle(pr)
+			streamData := pr.StreamingData
+			liveDetails := pr.Microformat.PlayerMicroformatRenderer.LiveBroadcastDetails
+			isLive := liveDetails.IsLiveNow
+
+			if !isLive && !di.InProgress {
+				/*
+					The livestream has likely ended already.
+					Check if the stream has been processed.
+					If not, then download it.
+				*/
+				if len(liveDetails.EndTimestamp) > 0 {
+					if len(streamData.AdaptiveFormats) > 0 {
+						// Assume that all formats will be fully processed if one is, and vice versa
+						if len(streamData.AdaptiveFormats[0].URL) == 0 {
+							LogGeneral("Livestream has ended and is being processed. Download URLs not available.")
+							return PlayerResponseNotUsable, nil, nil
+						}
+
+						if !IsFragmented(streamData.AdaptiveFormats[0].URL) {
+							LogGeneral("Livestream has been processed. Use yt-dlp instead.")
+							return PlayerResponseNotUsable, nil, nil
+						}
+					} else {
+						LogGeneral("Livestream has ended and is being processed. Download URLs not available.")
+						return PlayerResponseNotUsable, nil, nil
+					}
+				} else {
+					/*
+						I actually ran into this case once so far.
+						Stream is set as playable, but has not started.
+					*/
+					LogGeneral("Livestream is offline, should have started, and does not have an end timestamp.")
+					LogGeneral("Waiting %d seconds and trying again.\n", DefaultPollTime)
+					if !SleepContext(ctx, time.Duration(DefaultPollTime)*time.Second) {
+						return PlayerResponseNotUsable, nil, nil
+					}
+					continue
+				}
+			}
+
+			err = di.GetYTCFG(videoHtml)
+			if err != nil {
+				LogDebug("Error getting ytcfg: %s", err.Error())
+			}
+		default:
+			if secsLate > 0 {
+				fmt.Fprintln(os.Stderr)
+			}
+
+			LogError("Unknown playability status: %s", pr.PlayabilityStatus.Status)
+			if di.InProgress {
+				di.Live = false
+			}
+
+			return PlayerResponseNotUsable, nil, nil
+		}
+
+		if secsLate > 0 {
+			fmt.Fprintln(os.Stderr)
+		}
+
+		di.writeSource(SourceWatchPage, videoHtml)
+		di.PlayerResponseData = GetJsonFromHtml(videoHtml, playerRespDecl)
+		di.writeSource(SourcePlayerResponse, di.PlayerResponseData)
+		break
+	}
+
+	return PlayerResponseFound, pr, selectedQualities
+}
@@ -0,0 +1,146 @@
+package ytarchive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type YtPlaylistData struct {
+	Contents struct {
+		Twocolumnbrowseresultsrenderer struct {
+			Tabs []struct {
+				Tabrenderer struct {
+					Content struct {
+						Sectionlistrenderer struct {
+							Contents []struct {
+								Itemsectionrenderer struct {
+									Contents []struct {
+										Playlistvideolistrenderer struct {
+											Contents []PlaylistVideoContent `json:"contents"`
+										} `json:"playlistVideoListRenderer"`
+									} `json:"contents"`
+								} `json:"itemSectionRenderer"`
+							} `json:"contents"`
+						} `json:"sectionListRenderer"`
+					} `json:"content"`
+				} `json:"tabRenderer"`
+			} `json:"tabs"`
+		} `json:"twoColumnBrowseResultsRenderer"`
+	} `json:"contents"`
+}
+
+type PlaylistVideoContent struct {
+	Playlistvideorenderer struct {
+		Videoid           string `json:"videoId"`
+		Upcomingeventdata struct {
+			Starttime string `json:"startTime"`
+		} `json:"upcomingEventData"`
+		Thumbnailoverlays []struct {
+			Thumbnailoverlaytimestatusrenderer struct {
+				Style string `json:"style"`
+			} `json:"thumbnailOverlayTimeStatusRenderer"`
+		} `json:"thumbnailOverlays"`
+	} `json:"playlistVideoRenderer"`
+}
+
+// A live or upcoming stream found in a playlist
+type PlaylistStream struct {
+	URL       string
+	VideoID   string
+	Live      bool
+	StartTime int64
+}
+
+// Whether the URL is a youtube playlist, rather than a single stream or channel
+func IsPlaylistUrl(playlistUrl string) bool {
+	parsedUrl, err := url.Parse(playlistUrl)
+	if err != nil {
+		return false
+	}
+
+	lowerHost := strings.TrimPrefix(strings.ToLower(parsedUrl.Host), "www.")
+	lowerPath := strings.ToLower(parsedUrl.EscapedPath())
+	return lowerHost == "youtube.com" && lowerPath == "/playlist" && len(parsedUrl.Query().Get("list")) > 0
+}
+
+/*
+Get the streams in a playlist that are live or upcoming, live streams first
+and then upcoming ones by their scheduled start. Entries that already ended
+or are regular videos are left out. Only the entries youtube includes in
+the playlist page are seen, which is the first 100.
+*/
+func GetPlaylistStreams(ctx context.Context, client HttpClient, playlistUrl string) ([]*PlaylistStream, error) {
+	playlistHtml := DownloadData(ctx, client, playlistUrl)
+	if len(playlistHtml) == 0 {
+		return nil, errors.New("could not download the playlist page")
+	}
+
+	playlistData := &YtPlaylistData{}
+	err := json.Unmarshal(GetJsonFromHtml(playlistHtml, ytInitialDataDecl), playlistData)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the playlist page: %w", err)
+	}
+
+	var streams []*PlaylistStream
+	for _, tab := range playlistData.Contents.Twocolumnbrowseresultsrenderer.Tabs {
+		for _, section := range tab.Tabrenderer.Content.Sectionlistrenderer.Contents {
+			for _, item := range section.Itemsectionrenderer.Contents {
+				for _, content := range item.Playlistvideolistrenderer.Contents {
+					stream := playlistStream(content)
+					if stream != nil {
+						streams = append(streams, stream)
+					}
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(streams, func(i, j int) bool {
+		if streams[i].Live != streams[j].Live {
+			return streams[i].Live
+		}
+		return streams[i].StartTime < streams[j].StartTime
+	})
+
+	return streams, nil
+}
+
+func playlistStream(content PlaylistVideoContent) *PlaylistStream {
+	renderer := content.Playlistvideorenderer
+	if len(renderer.Videoid) == 0 {
+		return nil
+	}
+
+	stream := &PlaylistStream{
+		URL:     fmt.Sprintf("https://www.youtube.com/watch?v=%s", renderer.Videoid),
+		VideoID: renderer.Videoid,
+	}
+
+	isStream := false
+	for _, overlay := range renderer.Thumbnailoverlays {
+		switch overlay.Thumbnailoverlaytimestatusrenderer.Style {
+		case "LIVE":
+			stream.Live = true
+			isStream = true
+		case "UPCOMING":
+			isStream = true
+		}
+	}
+
+	if len(renderer.Upcomingeventdata.Starttime) > 0 {
+		stream.StartTime, _ = strconv.ParseInt(renderer.Upcomingeventdata.Starttime, 10, 64)
+		isStream = true
+	}
+
+	if !isStream {
+		return nil
+	}
+
+	return stream
+}
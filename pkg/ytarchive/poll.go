@@ -0,0 +1,70 @@
+package ytarchive
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Poll intervals are moved randomly by up to this fraction either way
+	PollJitter = 0.2
+	// How much longer the poll interval gets for every hour spent waiting
+	PollBackoffPerHour = 0.5
+	// The most the poll interval can grow to, as a multiple of the chosen one
+	PollMaxBackoff = 4
+)
+
+var (
+	pollRandLock sync.Mutex
+	pollRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+/*
+Randomize a poll interval by up to PollJitter either way, so long running
+waits and monitors do not hit YouTube at an exact, recognizable rhythm.
+Intervals are not pushed below DefaultPollTime unless they already were.
+*/
+func JitterSecs(secs int) int {
+	pollRandLock.Lock()
+	offset := (pollRand.Float64()*2 - 1) * PollJitter
+	pollRandLock.Unlock()
+
+	jittered := int(float64(secs)*(1+offset) + 0.5)
+	if jittered < DefaultPollTime && secs >= DefaultPollTime {
+		jittered = DefaultPollTime
+	}
+	if jittered < 1 {
+		jittered = 1
+	}
+
+	return jittered
+}
+
+/*
+Seconds to wait before checking on a stream that has not started again.
+The interval starts at baseSecs and widens the longer the wait has gone on,
+up to PollMaxBackoff times baseSecs, since a stream that has not started
+after hours is unlikely to start in the next few seconds. If the scheduled
+start is known, secsToStart being 0 or more, the interval tightens back
+up so the last stretch before the start is polled at baseSecs.
+*/
+func WaitPollSecs(baseSecs, waitedSecs int, secsToStart int64) int {
+	scale := 1 + PollBackoffPerHour*float64(waitedSecs)/3600
+	if scale > PollMaxBackoff {
+		scale = PollMaxBackoff
+	}
+	secs := int(float64(baseSecs) * scale)
+
+	if secsToStart >= 0 {
+		untilCountdown := int(secsToStart) - FinalCountdownTime
+		if untilCountdown < secs {
+			secs = untilCountdown
+		}
+		if secs < baseSecs {
+			secs = baseSecs
+		}
+	}
+
+	return JitterSecs(secs)
+}
@@ -0,0 +1,81 @@
+package ytarchive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Download threads for each stream with Options.PostLive, unless more are set
+const PostLiveThreads = 8
+
+/*
+Get ready to download a stream that has already ended, while its fragments
+are still up. The last fragment is found up front, so fragments can be
+downloaded in parallel up to it without ever waiting on a live edge.
+*/
+func (di *DownloadInfo) preparePostLive(ctx context.Context) error {
+	if di.IsLive() {
+		return errors.New("the stream is still live, --post-live is for streams that have ended")
+	}
+
+	dataType := DtypeVideo
+	if len(di.GetDownloadUrl(dataType)) == 0 {
+		dataType = DtypeAudio
+	}
+
+	headSeq, err := di.probeHeadSeq(ctx, dataType)
+	if err != nil {
+		if di.LastSq <= 0 {
+			return fmt.Errorf("could not find the last fragment of the stream: %w", err)
+		}
+		LogDebug("Could not get the last fragment from googlevideo, using the manifest's: %s", err)
+		headSeq = di.LastSq
+	}
+
+	di.Lock()
+	di.LastSq = headSeq
+	di.PostLive = true
+	if di.Jobs < PostLiveThreads {
+		di.Jobs = PostLiveThreads
+	}
+	jobs := di.Jobs
+	di.Unlock()
+
+	LogInfo("The stream has ended with %d fragments, downloading them with %d threads each for audio and video", headSeq+1, jobs)
+	return nil
+}
+
+// Ask googlevideo for the newest fragment of a stream through X-Head-Seqnum
+func (di *DownloadInfo) probeHeadSeq(ctx context.Context, dataType string) (int, error) {
+	dlUrl := di.GetDownloadUrl(dataType)
+	if len(dlUrl) == 0 {
+		return 0, errors.New("no download URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(dlUrl, 0), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:87.0) Gecko/20100101 Firefox/87.0")
+	req.Header.Add("Origin", "https://www.youtube.com")
+
+	resp, err := di.MediaHttpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("HTTP %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	headSeq, err := strconv.Atoi(resp.Header.Get("X-Head-Seqnum"))
+	if err != nil {
+		return 0, errors.New("no X-Head-Seqnum header in the response")
+	}
+
+	return headSeq, nil
+}
@@ -0,0 +1,18 @@
+//go:build darwin
+
+package ytarchive
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reserve size bytes of disk space after the end of f without changing its size
+func preallocate(f *os.File, offset, size int64) error {
+	return unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, &unix.Fstore_t{
+		Flags:   unix.F_ALLOCATEALL,
+		Posmode: unix.F_PEOFPOSMODE,
+		Length:  size,
+	})
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package ytarchive
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reserve size bytes of disk space after offset in f without changing its size
+func preallocate(f *os.File, offset, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, offset, size)
+}
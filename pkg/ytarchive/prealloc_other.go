@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package ytarchive
+
+import (
+	"errors"
+	"os"
+)
+
+func preallocate(f *os.File, offset, size int64) error {
+	return errors.New("preallocating files is not supported on this platform")
+}
@@ -0,0 +1,90 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of events written by ProgressJSONWriter
+const (
+	ProgressEventState    = "state"
+	ProgressEventProgress = "progress"
+)
+
+/*
+A single line written by ProgressJSONWriter. State events have the new
+state, progress events the counts, which are on the same level.
+*/
+type ProgressEvent struct {
+	Event   string `json:"event"`
+	Time    string `json:"time"`
+	VideoID string `json:"video_id,omitempty"`
+	State   string `json:"state,omitempty"`
+	*ProgressCounts
+}
+
+// How far a download has got, sent after each downloaded fragment
+type ProgressCounts struct {
+	Itag           int   `json:"itag"`
+	VideoFragments int   `json:"video_fragments"`
+	AudioFragments int   `json:"audio_fragments"`
+	MaxSeq         int   `json:"max_seq"`
+	TotalBytes     int64 `json:"total_bytes"`
+	// Measured bitrate of the download in bits per second, 0 until known
+	Bitrate int `json:"bitrate"`
+	// How far the download is behind the newest fragment of the stream
+	LagFragments int `json:"lag_fragments"`
+	LagSecs      int `json:"lag_secs"`
+}
+
+/*
+Writes the progress of archives as newline-delimited JSON, one event per
+line, for wrappers and dashboards to read instead of the status line.
+Shared by every job of an archiver, so the lines of several downloads never
+interleave.
+*/
+type ProgressJSONWriter struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func NewProgressJSONWriter(w io.Writer) *ProgressJSONWriter {
+	return &ProgressJSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (pw *ProgressJSONWriter) Write(event *ProgressEvent) {
+	if len(event.Time) == 0 {
+		event.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	pw.Lock()
+	defer pw.Unlock()
+	err := pw.enc.Encode(event)
+	if err != nil {
+		LogDebug("Failed to write a progress event: %s", err)
+	}
+}
+
+/*
+Send the states and status of the download to pw instead of printing the
+status line, still calling the callbacks that were set.
+*/
+func (di *DownloadInfo) withProgressJSON(pw *ProgressJSONWriter) {
+	stateFunc := di.StateFunc
+	di.StateFunc = func(state int) {
+		pw.Write(&ProgressEvent{
+			Event:   ProgressEventState,
+			VideoID: di.VideoID,
+			State:   StateName(state),
+		})
+		if stateFunc != nil {
+			stateFunc(state)
+		}
+	}
+
+	if di.StatusFunc == nil {
+		di.StatusFunc = func(status string) {}
+	}
+}
@@ -0,0 +1,194 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// Failed connections to a proxy in a row before failing over to the next one
+const ProxyFailoverErrors = 3
+
+/*
+A span of the download that went through one proxy, with the range of
+fragment sequences it served. FirstSeq is -1 if it served none.
+*/
+type ProxyPeriod struct {
+	Proxy    string
+	FirstSeq int
+	LastSeq  int
+}
+
+/*
+An ordered list of proxies where the next one takes over once the current
+one fails to connect ProxyFailoverErrors times in a row. After the last one
+it goes back to the first.
+*/
+type ProxyChain struct {
+	sync.Mutex
+	proxies []*url.URL
+	current int
+	errors  int
+	periods []ProxyPeriod
+}
+
+type proxyChainTransport struct {
+	chain *ProxyChain
+	inner http.RoundTripper
+}
+
+/*
+Create a client that sends requests through the first of proxies, failing
+over to the next ones in order.
+*/
+func NewProxyChainClient(proxies []*url.URL) (*http.Client, *ProxyChain) {
+	return withProxyChain(NewHttpClient(nil), proxies)
+}
+
+func withProxyChain(client *http.Client, proxies []*url.URL) (*http.Client, *ProxyChain) {
+	chain := &ProxyChain{proxies: proxies}
+	chain.startPeriod()
+
+	tr := client.Transport.(*http.Transport)
+	tr.Proxy = chain.proxy
+	client.Transport = &proxyChainTransport{chain, tr}
+
+	return client, chain
+}
+
+/*
+Create the client for requests to YouTube, using a ProxyChain if there are
+proxies to fail over to. The chain is nil otherwise.
+*/
+func (o *Options) newHttpClient() (*http.Client, *ProxyChain) {
+	client := newHttpClient(o.Proxy, o.Network, o.IgnoreEnvProxy)
+	if len(o.ProxyFallbacks) == 0 {
+		return client, nil
+	}
+
+	proxies := []*url.URL{o.Proxy}
+	return withProxyChain(client, append(proxies, o.ProxyFallbacks...))
+}
+
+// Create the client for fragment downloads with MediaProxy or NoMediaProxy
+func (o *Options) newMediaHttpClient() *http.Client {
+	client := newHttpClient(o.MediaProxy, o.Network, o.IgnoreEnvProxy)
+	if o.NoMediaProxy {
+		client.Transport.(*http.Transport).Proxy = nil
+	}
+
+	return client
+}
+
+func (t *proxyChainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.chain.Lock()
+	used := t.chain.current
+	t.chain.Unlock()
+
+	resp, err := t.inner.RoundTrip(req)
+	t.chain.result(req, used, err)
+	return resp, err
+}
+
+func (t *proxyChainTransport) CloseIdleConnections() {
+	if tr, ok := t.inner.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+func (pc *ProxyChain) proxy(req *http.Request) (*url.URL, error) {
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.proxies[pc.current], nil
+}
+
+// Start a new period for the current proxy. Must be called with the lock held.
+func (pc *ProxyChain) startPeriod() {
+	pc.periods = append(pc.periods, ProxyPeriod{
+		Proxy:    pc.proxies[pc.current].Redacted(),
+		FirstSeq: -1,
+		LastSeq:  -1,
+	})
+}
+
+/*
+Count a request that failed to connect to the proxy towards failing over,
+and note the fragment of a request that went through.
+*/
+func (pc *ProxyChain) result(req *http.Request, used int, err error) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	// Sent before failing over, so it says nothing about the current proxy
+	if used != pc.current {
+		return
+	}
+
+	if err == nil {
+		pc.errors = 0
+		seq, serr := strconv.Atoi(req.URL.Query().Get("sq"))
+		if serr != nil {
+			return
+		}
+
+		period := &pc.periods[len(pc.periods)-1]
+		if period.FirstSeq < 0 || seq < period.FirstSeq {
+			period.FirstSeq = seq
+		}
+		if seq > period.LastSeq {
+			period.LastSeq = seq
+		}
+		return
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "proxyconnect" {
+		return
+	}
+
+	pc.errors += 1
+	if pc.errors < ProxyFailoverErrors || len(pc.proxies) < 2 {
+		return
+	}
+
+	failed := pc.proxies[pc.current].Redacted()
+	pc.current = (pc.current + 1) % len(pc.proxies)
+	pc.errors = 0
+
+	LogWarn("Failed to connect to proxy %s %d times in a row, switching to %s", failed, ProxyFailoverErrors, pc.proxies[pc.current].Redacted())
+	pc.startPeriod()
+}
+
+// Which proxy served which fragments so far, in order
+func (pc *ProxyChain) Periods() []ProxyPeriod {
+	pc.Lock()
+	defer pc.Unlock()
+
+	periods := make([]ProxyPeriod, len(pc.periods))
+	copy(periods, pc.periods)
+	return periods
+}
+
+// Log which proxy served which fragments, if there was more than one
+func (pc *ProxyChain) LogPeriods() {
+	if pc == nil {
+		return
+	}
+
+	periods := pc.Periods()
+	if len(periods) < 2 {
+		return
+	}
+
+	for _, p := range periods {
+		served := "no fragments"
+		if p.FirstSeq >= 0 {
+			served = fmt.Sprintf("fragments %d to %d", p.FirstSeq, p.LastSeq)
+		}
+		LogInfo("Proxy %s served %s", p.Proxy, served)
+	}
+}
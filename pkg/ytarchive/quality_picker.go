@@ -0,0 +1,232 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Returned when the user cancels picking a quality with Ctrl+C
+var ErrQualityPickCancelled = errors.New("quality selection was cancelled")
+
+const (
+	keyNone = iota
+	keyUp
+	keyDown
+	keyToggle
+	keyConfirm
+	keyInterrupt
+)
+
+/*
+A single entry in the interactive quality picker
+*/
+type QualityOption struct {
+	Label       string
+	Description string
+}
+
+// Check if both stdin and stdout are attached to a terminal
+func IsInteractiveTerminal() bool {
+	in := os.Stdin.Fd()
+	out := os.Stdout.Fd()
+
+	return (isatty.IsTerminal(in) || isatty.IsCygwinTerminal(in)) &&
+		(isatty.IsTerminal(out) || isatty.IsCygwinTerminal(out))
+}
+
+// Describe a quality using only what we know from the itag tables.
+// Used when waiting for a stream, where no format information exists yet.
+func DescribeQualityLabel(label string) string {
+	if label == "audio_only" {
+		return "aac"
+	}
+
+	fps := 30
+	if strings.HasSuffix(label, "p60") {
+		fps = 60
+	}
+
+	return fmt.Sprintf("h264/vp9, %dfps", fps)
+}
+
+func DescribeQualityLabels(labels []string) map[string]string {
+	descriptions := make(map[string]string)
+	for _, label := range labels {
+		descriptions[label] = DescribeQualityLabel(label)
+	}
+
+	return descriptions
+}
+
+// Human readable codec/fps/bitrate summary for a format
+func (fd *FormatDetails) String() string {
+	var parts []string
+
+	if len(fd.Codecs) > 0 {
+		codec := fd.Codecs
+		switch {
+		case strings.HasPrefix(codec, "avc1"):
+			codec = fmt.Sprintf("h264 (%s)", fd.Codecs)
+		case strings.HasPrefix(codec, "vp9"), strings.HasPrefix(codec, "vp09"):
+			codec = fmt.Sprintf("vp9 (%s)", fd.Codecs)
+		case strings.HasPrefix(codec, "av01"):
+			codec = fmt.Sprintf("av1 (%s)", fd.Codecs)
+		case strings.HasPrefix(codec, "mp4a"):
+			codec = fmt.Sprintf("aac (%s)", fd.Codecs)
+		}
+		parts = append(parts, codec)
+	}
+
+	if fd.Fps > 0 {
+		parts = append(parts, fmt.Sprintf("%dfps", fd.Fps))
+	}
+
+	if fd.Bitrate > 0 && fd.MeasuredBitrate > 0 {
+		parts = append(parts, fmt.Sprintf("%s (measured %s)", FormatBitrate(fd.Bitrate), FormatBitrate(fd.MeasuredBitrate)))
+	} else if fd.Bitrate > 0 {
+		parts = append(parts, FormatBitrate(fd.Bitrate))
+	} else if fd.MeasuredBitrate > 0 {
+		parts = append(parts, "measured "+FormatBitrate(fd.MeasuredBitrate))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func readKey(buf []byte) int {
+	n, err := os.Stdin.Read(buf)
+	if err != nil || n == 0 {
+		return keyInterrupt
+	}
+
+	switch {
+	case n >= 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'A':
+		return keyUp
+	case n >= 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'B':
+		return keyDown
+	}
+
+	switch buf[0] {
+	case 'k':
+		return keyUp
+	case 'j':
+		return keyDown
+	case ' ':
+		return keyToggle
+	case '\r', '\n':
+		return keyConfirm
+	case 0x03, 0x04:
+		return keyInterrupt
+	}
+
+	return keyNone
+}
+
+func drawPicker(options []QualityOption, cursor int, selected []int, redraw bool) {
+	labelWidth := 0
+	for _, opt := range options {
+		if len(opt.Label) > labelWidth {
+			labelWidth = len(opt.Label)
+		}
+	}
+
+	if redraw {
+		fmt.Printf("\033[%dA", len(options))
+	}
+
+	for i, opt := range options {
+		pointer := " "
+		if i == cursor {
+			pointer = ">"
+		}
+
+		order := "   "
+		for pos, idx := range selected {
+			if idx == i {
+				order = fmt.Sprintf("[%d]", pos+1)
+				break
+			}
+		}
+
+		line := fmt.Sprintf("%s %s %-*s  %s", pointer, order, labelWidth, opt.Label, opt.Description)
+		if i == cursor {
+			line = fmt.Sprintf("\033[1m%s\033[0m", line)
+		}
+
+		fmt.Printf("\r%s\033[K\n", line)
+	}
+}
+
+/*
+Let the user pick one or more qualities with the arrow keys.
+Qualities toggled with space are returned in the order they were selected,
+giving the fallback order. If nothing was toggled, the highlighted quality
+is returned. Returns nil if the terminal could not be put into raw mode, and
+ErrQualityPickCancelled if the user pressed Ctrl+C.
+*/
+func PickQualities(options []QualityOption) ([]string, error) {
+	restore, err := MakeRawTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		LogDebug("Unable to use the interactive quality picker: %s", err)
+		return nil, nil
+	}
+
+	cursor := 0
+	selected := make([]int, 0, len(options))
+	buf := make([]byte, 8)
+
+	fmt.Println("Use the arrow keys to move, space to add or remove a quality from the")
+	fmt.Println("fallback list (in order of preference), and enter to confirm.")
+	drawPicker(options, cursor, selected, false)
+
+	for {
+		switch readKey(buf) {
+		case keyUp:
+			if cursor > 0 {
+				cursor -= 1
+			}
+		case keyDown:
+			if cursor < len(options)-1 {
+				cursor += 1
+			}
+		case keyToggle:
+			found := false
+			for pos, idx := range selected {
+				if idx == cursor {
+					selected = append(selected[:pos], selected[pos+1:]...)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				selected = append(selected, cursor)
+			}
+		case keyConfirm:
+			restore()
+
+			if len(selected) == 0 {
+				selected = append(selected, cursor)
+			}
+
+			labels := make([]string, 0, len(selected))
+			for _, idx := range selected {
+				labels = append(labels, options[idx].Label)
+			}
+
+			fmt.Printf("Selected qualities: %s\n", strings.Join(labels, "/"))
+			return labels, nil
+		case keyInterrupt:
+			restore()
+			fmt.Println("\nExiting...")
+			return nil, ErrQualityPickCancelled
+		default:
+			continue
+		}
+
+		drawPicker(options, cursor, selected, true)
+	}
+}
@@ -0,0 +1,365 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How many times a queued stream can fail before it is dropped
+const QueueMaxTries = 3
+
+/*
+A stream waiting in the queue or being downloaded. StateFiles are the resume
+checkpoints of the download, see DownloadState.
+*/
+type QueueItem struct {
+	URL        string   `json:"url"`
+	Quality    string   `json:"quality,omitempty"`
+	Priority   int      `json:"priority,omitempty"`
+	VideoID    string   `json:"video_id,omitempty"`
+	AddedAt    string   `json:"added_at"`
+	StartedAt  string   `json:"started_at,omitempty"`
+	Tries      int      `json:"tries,omitempty"`
+	StateFiles []string `json:"state_files,omitempty"`
+}
+
+/*
+Streams to download, kept in a JSON file that is rewritten on every change
+so a restarted daemon carries on with the download it was in the middle of,
+then the ones still pending. Streams taken to run alongside others are kept
+as running until they are done, and go back to pending when the queue is
+loaded again. Kept only in memory if there is no file.
+*/
+type Queue struct {
+	sync.Mutex
+	Current *QueueItem   `json:"current,omitempty"`
+	Running []*QueueItem `json:"running,omitempty"`
+	Pending []*QueueItem `json:"pending"`
+
+	file string
+	mode os.FileMode
+}
+
+// Load the queue from fname, or start an empty one if it does not exist yet
+func LoadQueue(fname string, mode os.FileMode) (*Queue, error) {
+	q := &Queue{
+		file: fname,
+		mode: mode,
+	}
+	if len(fname) == 0 {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(fname)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever was running when the last run ended never got to finish
+	q.Pending = append(q.Pending, q.Running...)
+	q.Running = nil
+
+	return q, nil
+}
+
+func (q *Queue) save() error {
+	if len(q.file) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(q.file)
+	if dir != "." {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write to the side and rename, so a crash never leaves half a queue
+	tmpFile := q.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, q.mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, q.file)
+}
+
+func (q *Queue) has(url string) bool {
+	if q.Current != nil && q.Current.URL == url {
+		return true
+	}
+
+	for _, item := range q.Running {
+		if item.URL == url {
+			return true
+		}
+	}
+
+	for _, item := range q.Pending {
+		if item.URL == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add a stream to the end of the queue, unless it is already in it
+func (q *Queue) Add(url, quality string) error {
+	return q.AddWithPriority(url, quality, 0)
+}
+
+/*
+Add a stream to the queue with a priority. Streams with a higher priority
+are downloaded first. A stream already pending has its priority raised if
+the new one is higher.
+*/
+func (q *Queue) AddWithPriority(url, quality string, priority int) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.has(url) {
+		for _, item := range q.Pending {
+			if item.URL == url && item.Priority < priority {
+				item.Priority = priority
+				return q.save()
+			}
+		}
+
+		return nil
+	}
+
+	q.Pending = append(q.Pending, &QueueItem{
+		URL:      url,
+		Quality:  quality,
+		Priority: priority,
+		AddedAt:  time.Now().Format(time.RFC3339),
+	})
+
+	return q.save()
+}
+
+// Whether there is anything left to download
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := len(q.Pending)
+	if q.Current != nil {
+		n += 1
+	}
+
+	return n
+}
+
+// Index of the first pending stream with the highest priority
+func (q *Queue) nextPending() int {
+	next := 0
+	for i, item := range q.Pending {
+		if item.Priority > q.Pending[next].Priority {
+			next = i
+		}
+	}
+
+	return next
+}
+
+// The pending stream Take would return, or nil if nothing is pending
+func (q *Queue) Peek() *QueueItem {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.Pending) == 0 {
+		return nil
+	}
+
+	item := *q.Pending[q.nextPending()]
+	return &item
+}
+
+/*
+Take the next pending stream without making it the current download, for
+running several downloads at once. It stays in the queue as running until
+it is passed to Done, or to Return if it fails. Returns nil if nothing is
+pending.
+*/
+func (q *Queue) Take() *QueueItem {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.Pending) == 0 {
+		return nil
+	}
+
+	next := q.nextPending()
+	item := q.Pending[next]
+	q.Pending = append(q.Pending[:next], q.Pending[next+1:]...)
+	q.Running = append(q.Running, item)
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+
+	return item
+}
+
+func (q *Queue) removeRunning(item *QueueItem) {
+	for i, running := range q.Running {
+		if running == item {
+			q.Running = append(q.Running[:i], q.Running[i+1:]...)
+			return
+		}
+	}
+}
+
+// Drop a stream from Take that finished downloading
+func (q *Queue) Done(item *QueueItem) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.removeRunning(item)
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+}
+
+/*
+Put back a stream from Take that was stopped or failed, unless it has
+failed too often.
+*/
+func (q *Queue) Return(item *QueueItem, failed bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.removeRunning(item)
+	if failed {
+		item.Tries += 1
+	}
+	if item.Tries >= QueueMaxTries {
+		LogWarn("Removing %s from the queue", item.URL)
+	} else {
+		q.Pending = append(q.Pending, item)
+	}
+
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+}
+
+/*
+Get the stream to download next. A download that was in progress comes
+first, then the pending streams by priority, in the order they were added
+within the same priority. Returns nil if the queue is empty.
+*/
+func (q *Queue) Next() *QueueItem {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.Current == nil {
+		if len(q.Pending) == 0 {
+			return nil
+		}
+
+		next := q.nextPending()
+		q.Current = q.Pending[next]
+		q.Pending = append(q.Pending[:next], q.Pending[next+1:]...)
+	}
+
+	q.Current.StartedAt = time.Now().Format(time.RFC3339)
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+
+	item := *q.Current
+	return &item
+}
+
+/*
+Record the stream now being downloaded along with its resume checkpoints.
+Used both for queued streams and streams found while monitoring a channel,
+which become the current item if there is none.
+*/
+func (q *Queue) Started(url, quality, videoId string, stateFiles []string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.Current == nil {
+		q.Current = &QueueItem{
+			URL:       url,
+			Quality:   quality,
+			AddedAt:   time.Now().Format(time.RFC3339),
+			StartedAt: time.Now().Format(time.RFC3339),
+		}
+	}
+
+	q.Current.VideoID = videoId
+	q.Current.StateFiles = stateFiles
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+}
+
+/*
+Done with the current stream. It stays in the queue to be picked up again
+if it was stopped or failed and can still be resumed, either because its
+resume checkpoints are still around or because the download never got that
+far. Streams that keep failing are dropped after QueueMaxTries.
+*/
+func (q *Queue) Finish(stopped, failed bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.Current == nil {
+		return
+	}
+
+	resumable := false
+	if stopped || failed {
+		resumable = len(q.Current.StateFiles) == 0
+		for _, stateFile := range q.Current.StateFiles {
+			if Exists(stateFile) {
+				resumable = true
+				break
+			}
+		}
+	}
+
+	if failed {
+		q.Current.Tries += 1
+	}
+
+	if resumable && q.Current.Tries < QueueMaxTries {
+		LogInfo("Keeping %s queued to resume later", q.Current.URL)
+	} else {
+		if failed {
+			LogWarn("Removing %s from the queue", q.Current.URL)
+		}
+		q.Current = nil
+	}
+
+	err := q.save()
+	if err != nil {
+		LogWarn("Failed to save the queue: %s", err)
+	}
+}
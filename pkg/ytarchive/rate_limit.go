@@ -0,0 +1,153 @@
+package ytarchive
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest read between waits, so concurrent downloads interleave finely
+	RateLimitChunk = 16 * 1024
+	// A download counts towards its group's share for this long after a read
+	RateActiveWindow = 2 * time.Second
+)
+
+/*
+A bandwidth cap shared by several downloads, such as every job of a channel
+monitor. The cap is split between the downloads that are reading at the
+moment by their priority, evenly if they have the same, so one catching up
+on a backlog can not starve the others, and a download sitting idle waiting
+for the next fragment gives up its share.
+*/
+type RateGroup struct {
+	sync.Mutex
+	limit  float64
+	active map[*RateLimiter]time.Time
+}
+
+// Create a group capped at the given bytes per second
+func NewRateGroup(bytesPerSec int64) *RateGroup {
+	return &RateGroup{
+		limit:  float64(bytesPerSec),
+		active: make(map[*RateLimiter]time.Time),
+	}
+}
+
+// Mark the limiter as reading and get its share of the cap
+func (g *RateGroup) share(rl *RateLimiter, now time.Time) float64 {
+	g.Lock()
+	defer g.Unlock()
+
+	g.active[rl] = now
+	total := 0.0
+	for member, last := range g.active {
+		if now.Sub(last) > RateActiveWindow {
+			delete(g.active, member)
+			continue
+		}
+		total += member.weight
+	}
+
+	return g.limit * rl.weight / total
+}
+
+/*
+How much of a shared resource a download with the given priority gets
+compared to one with priority 0. Each step up adds as much again, each step
+down divides it further: -1 gets half, 1 twice, 2 three times as much.
+*/
+func priorityWeight(priority int) float64 {
+	if priority < 0 {
+		return 1 / float64(1-priority)
+	}
+
+	return float64(1 + priority)
+}
+
+/*
+Caps the bandwidth of one download, optionally also sharing the cap of a
+group with other downloads. The download's threads wait their turn for
+each chunk they read, so they share its rate between them.
+*/
+type RateLimiter struct {
+	sync.Mutex
+	limit float64
+	group *RateGroup
+	// Share of the group's cap, see priorityWeight
+	weight float64
+	// When the bytes reserved so far will have been paid for
+	next time.Time
+}
+
+/*
+Create a limiter for a download capped at the given bytes per second, 0 for
+no cap of its own, within the group if not nil, where it gets a share by its
+priority. Returns nil if there is nothing to limit, which Reader accepts.
+*/
+func NewRateLimiter(bytesPerSec int64, group *RateGroup, priority int) *RateLimiter {
+	if bytesPerSec <= 0 && group == nil {
+		return nil
+	}
+
+	return &RateLimiter{
+		limit:  float64(bytesPerSec),
+		group:  group,
+		weight: priorityWeight(priority),
+	}
+}
+
+// Wait until n more bytes can be read
+func (rl *RateLimiter) Wait(ctx context.Context, n int) bool {
+	now := time.Now()
+	rl.Lock()
+	rate := rl.limit
+	if rl.group != nil {
+		share := rl.group.share(rl, now)
+		if rate <= 0 || share < rate {
+			rate = share
+		}
+	}
+
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+	rl.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	return SleepContext(ctx, wait)
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	rl  *RateLimiter
+	r   io.Reader
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > RateLimitChunk {
+		p = p[:RateLimitChunk]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 && !r.rl.Wait(r.ctx, n) {
+		return n, r.ctx.Err()
+	}
+
+	return n, err
+}
+
+// Wrap a reader so reading from it is limited, or return it as-is if nil
+func (rl *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if rl == nil {
+		return r
+	}
+
+	return &rateLimitedReader{ctx, rl, r}
+}
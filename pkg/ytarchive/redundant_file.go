@@ -0,0 +1,272 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// What DownloadStream writes a data file through
+type dataSink interface {
+	io.Writer
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+/*
+A data file written to two places at once, such as a local disk and a NAS
+mount, so losing one of them during a capture does not lose the archive.
+Writes go to every file. When one fails it is dropped and the others carry
+on alone, so writes only fail once all of them have.
+*/
+type RedundantFile struct {
+	files  []*os.File
+	failed []bool
+	// Called when the file at index i is dropped
+	onFail func(i int, err error)
+}
+
+func NewRedundantFile(onFail func(i int, err error), files ...*os.File) *RedundantFile {
+	return &RedundantFile{
+		files:  files,
+		failed: make([]bool, len(files)),
+		onFail: onFail,
+	}
+}
+
+func (rf *RedundantFile) drop(i int, err error) {
+	rf.failed[i] = true
+	rf.files[i].Close()
+	if rf.onFail != nil {
+		rf.onFail(i, err)
+	}
+}
+
+// Run fn on every file still being written, dropping those it fails on
+func (rf *RedundantFile) each(fn func(f *os.File) error) error {
+	var lastErr error
+	alive := 0
+	for i, f := range rf.files {
+		if rf.failed[i] {
+			continue
+		}
+
+		if err := fn(f); err != nil {
+			rf.drop(i, err)
+			lastErr = err
+			continue
+		}
+		alive += 1
+	}
+
+	if alive == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("every copy of the file failed")
+		}
+		return lastErr
+	}
+
+	return nil
+}
+
+func (rf *RedundantFile) Write(p []byte) (int, error) {
+	err := rf.each(func(f *os.File) error {
+		_, err := f.Write(p)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (rf *RedundantFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64 = -1
+	err := rf.each(func(f *os.File) error {
+		p, err := f.Seek(offset, whence)
+		if err == nil && pos < 0 {
+			pos = p
+		}
+		return err
+	})
+
+	return pos, err
+}
+
+func (rf *RedundantFile) Sync() error {
+	return rf.each(func(f *os.File) error { return f.Sync() })
+}
+
+func (rf *RedundantFile) Truncate(size int64) error {
+	return rf.each(func(f *os.File) error { return f.Truncate(size) })
+}
+
+func (rf *RedundantFile) Close() error {
+	var err error
+	for i, f := range rf.files {
+		if !rf.failed[i] {
+			if cerr := f.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+
+	return err
+}
+
+// Preallocate every file still being written, see preallocate
+func (rf *RedundantFile) preallocate(offset, size int64) error {
+	var err error
+	for i, f := range rf.files {
+		if !rf.failed[i] {
+			if perr := preallocate(f, offset, size); perr != nil {
+				err = perr
+			}
+		}
+	}
+
+	return err
+}
+
+func preallocateSink(f dataSink, offset, size int64) error {
+	switch sink := f.(type) {
+	case *os.File:
+		return preallocate(sink, offset, size)
+	case *RedundantFile:
+		return sink.preallocate(offset, size)
+	}
+
+	return errors.New("can not preallocate this file")
+}
+
+/*
+Open the copy of dataFile in CopyDir, at offset if resuming a download that
+has written that much already. Nil is returned if the copy can not be used,
+after saying why.
+*/
+func (di *DownloadInfo) openDataCopy(dataType, dataFile string, offset int64) *os.File {
+	copyFile := filepath.Join(di.CopyDir, filepath.Base(dataFile))
+	absCopy, _ := filepath.Abs(copyFile)
+	absData, _ := filepath.Abs(dataFile)
+	if absCopy == absData {
+		LogWarn("%s: The copy directory is where %s is written already, not writing a copy", dataType, dataFile)
+		return nil
+	}
+
+	if offset <= 0 {
+		f, err := os.Create(copyFile)
+		if err != nil {
+			LogError("%s: Failed to create the copy %s, only writing %s: %s", dataType, copyFile, dataFile, err)
+			return nil
+		}
+
+		return f
+	}
+
+	f, err := os.OpenFile(copyFile, os.O_RDWR, 0666)
+	if err == nil {
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err == nil && info.Size() < offset {
+			err = fmt.Errorf("it only has %s of the %s written", FormatSize(info.Size()), FormatSize(offset))
+		}
+		if err == nil {
+			err = f.Truncate(offset)
+		}
+		if err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+		}
+	}
+
+	if err != nil {
+		LogError("%s: Can not resume the copy %s, only writing %s: %s", dataType, copyFile, dataFile, err)
+		return nil
+	}
+
+	return f
+}
+
+/*
+Write the data file for dataType to its copy in CopyDir as well, if one is
+set. The copy in use is recorded in MDLInfo, along with the data file
+itself being lost if it fails.
+*/
+func (di *DownloadInfo) withDataCopy(dataType, dataFile string, f *os.File) dataSink {
+	if len(di.CopyDir) == 0 {
+		return f
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		offset = 0
+	}
+
+	cf := di.openDataCopy(dataType, dataFile, offset)
+	if cf == nil {
+		return f
+	}
+
+	mdl := di.MDLInfo[dataType]
+	mdl.Lock()
+	mdl.CopyFile = cf.Name()
+	mdl.Unlock()
+
+	return NewRedundantFile(func(i int, err error) {
+		mdl.Lock()
+		defer mdl.Unlock()
+
+		if i == 0 {
+			LogError("%s: Writing %s failed, carrying on with only the copy %s: %s", dataType, dataFile, mdl.CopyFile, err)
+			mdl.DataFileLost = true
+		} else {
+			LogError("%s: Writing the copy %s failed, carrying on with only %s: %s", dataType, mdl.CopyFile, dataFile, err)
+			mdl.CopyFile = ""
+		}
+	}, f, cf)
+}
+
+// Copies of the data files that are still complete, see CopyDir
+func (di *DownloadInfo) dataCopies() []string {
+	var copies []string
+	for _, mdl := range di.MDLInfo {
+		mdl.RLock()
+		if len(mdl.CopyFile) > 0 {
+			copies = append(copies, mdl.CopyFile)
+		}
+		mdl.RUnlock()
+	}
+
+	return copies
+}
+
+/*
+Put the copy in place of any data file that was lost while downloading.
+Returns an error naming the copy if it can not be, so it is not lost too.
+*/
+func (di *DownloadInfo) restoreDataFiles(dataFiles map[string]string) error {
+	for dataType, dataFile := range dataFiles {
+		mdl := di.MDLInfo[dataType]
+		if !mdl.DataFileLost || len(mdl.CopyFile) == 0 {
+			continue
+		}
+
+		LogWarn("Restoring the %s data file from its copy %s", dataType, mdl.CopyFile)
+		err := TryMove(mdl.CopyFile, dataFile)
+		if err != nil {
+			return fmt.Errorf("failed to restore the %s data file, it is kept in %s: %w", dataType, mdl.CopyFile, err)
+		}
+
+		mdl.CopyFile = ""
+		mdl.DataFileLost = false
+	}
+
+	return nil
+}
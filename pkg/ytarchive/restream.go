@@ -0,0 +1,159 @@
+package ytarchive
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// How many fragments a restream can fall behind before it is dropped
+const RestreamBacklog = 64
+
+/*
+Queues writes to a restream so a slow or stuck server never holds up the
+archive itself. Once the queue fills up or a write fails, every later write
+returns the error and the restream is dropped.
+*/
+type restreamWriter struct {
+	sync.Mutex
+	w      io.WriteCloser
+	queue  chan []byte
+	done   chan struct{}
+	err    error
+	closed bool
+}
+
+func newRestreamWriter(w io.WriteCloser) *restreamWriter {
+	rw := &restreamWriter{
+		w:     w,
+		queue: make(chan []byte, RestreamBacklog),
+		done:  make(chan struct{}),
+	}
+
+	go rw.run()
+	return rw
+}
+
+func (rw *restreamWriter) run() {
+	defer close(rw.done)
+	for data := range rw.queue {
+		if rw.getErr() != nil {
+			continue
+		}
+
+		_, err := rw.w.Write(data)
+		if err != nil {
+			rw.setErr(err)
+		}
+	}
+}
+
+func (rw *restreamWriter) getErr() error {
+	rw.Lock()
+	defer rw.Unlock()
+	return rw.err
+}
+
+func (rw *restreamWriter) setErr(err error) {
+	rw.Lock()
+	defer rw.Unlock()
+	if rw.err == nil {
+		rw.err = err
+	}
+}
+
+func (rw *restreamWriter) Write(data []byte) (int, error) {
+	rw.Lock()
+	defer rw.Unlock()
+	if rw.closed {
+		return 0, errors.New("restream closed")
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	// The caller may reuse data once we return
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	select {
+	case rw.queue <- buf:
+		return len(data), nil
+	default:
+		rw.err = errors.New("restream is too far behind")
+		return 0, rw.err
+	}
+}
+
+/*
+Finish writing what is queued, then close the underlying writer.
+Writes after this return an error rather than panicking, since a
+cancelled download can still be winding down.
+*/
+func (rw *restreamWriter) Close() error {
+	rw.Lock()
+	if rw.closed {
+		rw.Unlock()
+		return nil
+	}
+	rw.closed = true
+	close(rw.queue)
+	rw.Unlock()
+
+	<-rw.done
+	return rw.w.Close()
+}
+
+/*
+Get the ffmpeg output arguments for pushing to the given RTMP or SRT URL
+*/
+func RestreamArgs(restreamUrl string) ([]string, error) {
+	parsed, err := url.Parse(restreamUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var format string
+	switch strings.ToLower(parsed.Scheme) {
+	case "rtmp", "rtmps":
+		format = "flv"
+	case "srt", "udp":
+		format = "mpegts"
+	default:
+		return nil, errors.New("restream URL must be rtmp://, rtmps://, srt:// or udp://")
+	}
+
+	return []string{"-f", format, restreamUrl}, nil
+}
+
+/*
+Start ffmpeg pushing the given streams to restreamUrl as they download.
+Unlike the stream output, a restream failing does not stop the download.
+*/
+func startRestream(ffmpegPath, restreamUrl string, dataTypes []string) (*streamMuxer, error) {
+	outArgs, err := RestreamArgs(restreamUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return startQueuedMuxer(ffmpegPath, outArgs, dataTypes)
+}
+
+// Start ffmpeg writing to outArgs with each input queued by a restreamWriter
+func startQueuedMuxer(ffmpegPath string, outArgs []string, dataTypes []string) (*streamMuxer, error) {
+	m, err := startMuxer(ffmpegPath, outArgs, nil, dataTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	m.closers = m.closers[:0]
+	for dataType, in := range m.inputs {
+		rw := newRestreamWriter(in.(io.WriteCloser))
+		m.inputs[dataType] = rw
+		m.closers = append(m.closers, rw)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,103 @@
+package ytarchive
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+How long to keep the local copies of files that were stored elsewhere, per
+channel. Copies older than MaxAge, or beyond the newest MaxBytes worth, are
+deleted, or moved into MoveTo if it is set. A zero value does not limit.
+*/
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	MoveTo   string
+}
+
+func (p *RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0
+}
+
+/*
+Apply the policy to the local copies recorded in the archive database.
+Copies are only recorded once the files were stored without error, so
+nothing that has not been uploaded is touched. Returns how many captures
+had their local copies removed.
+*/
+func ApplyRetention(dbFile string, policy *RetentionPolicy) (int, error) {
+	records, err := ReadArchiveDB(dbFile)
+	if err != nil {
+		return 0, err
+	}
+
+	channels := make(map[string][]*ArchiveRecord)
+	for _, rec := range records {
+		if len(rec.LocalFiles) == 0 {
+			continue
+		}
+
+		key := rec.ChannelID
+		if len(key) == 0 {
+			key = rec.Channel
+		}
+		channels[key] = append(channels[key], rec)
+	}
+
+	if len(policy.MoveTo) > 0 {
+		err = os.MkdirAll(policy.MoveTo, 0755)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	removed := 0
+	now := time.Now()
+	for _, recs := range channels {
+		// Newest first, RFC 3339 times in UTC sort as strings
+		sort.SliceStable(recs, func(i, j int) bool {
+			return recs[i].CapturedAt > recs[j].CapturedAt
+		})
+
+		var kept int64
+		for _, rec := range recs {
+			var files []string
+			var size int64
+			for _, fpath := range rec.LocalFiles {
+				if stat, err := os.Stat(fpath); err == nil {
+					files = append(files, fpath)
+					size += stat.Size()
+				}
+			}
+
+			if len(files) == 0 {
+				continue
+			}
+
+			expired := false
+			if captured, err := time.Parse(time.RFC3339, rec.CapturedAt); err == nil && policy.MaxAge > 0 {
+				expired = now.Sub(captured) > policy.MaxAge
+			}
+
+			if !expired && (policy.MaxBytes <= 0 || kept+size <= policy.MaxBytes) {
+				kept += size
+				continue
+			}
+
+			LogInfo("Retention: removing the local copies of %s", rec.VideoID)
+			for _, fpath := range files {
+				if len(policy.MoveTo) > 0 {
+					TryMove(fpath, filepath.Join(policy.MoveTo, filepath.Base(fpath)))
+				} else {
+					TryDelete(fpath)
+				}
+			}
+			removed += 1
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,333 @@
+package ytarchive
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+Options for archiving a stream in the background alongside this archiver,
+such as another view of a multiview broadcast or a scheduled stream. Outputs
+that only one stream can go to are left to this archiver, and nothing is
+asked since nobody would know which stream is asking. A job with a higher
+priority than the archiver gets more threads, one with a lower gets fewer.
+*/
+func (a *Archiver) jobOptions(streamUrl string, priority int) *Options {
+	jobOpts := *a.Options
+	jobOpts.URL = streamUrl
+	jobOpts.Priority = priority
+	jobOpts.Threads = priorityThreads(a.Options.Threads, a.Options.Priority, priority)
+	jobOpts.URLs = nil
+	jobOpts.BatchFile = ""
+	jobOpts.MonitorChannel = false
+	jobOpts.MonitorScheduled = false
+	jobOpts.QueueFile = ""
+	jobOpts.StreamOutput = nil
+	jobOpts.RestreamURL = ""
+	jobOpts.ServeAddr = ""
+	jobOpts.ControlSocket = ""
+	jobOpts.DebugHAR = ""
+	// Signals are passed on by Stop, catching them too would count twice
+	jobOpts.HandleSignals = false
+
+	if jobOpts.Wait == ActionAsk {
+		jobOpts.Wait = ActionDo
+	}
+	if jobOpts.MergeOnCancel == ActionAsk {
+		jobOpts.MergeOnCancel = ActionDo
+	}
+
+	return &jobOpts
+}
+
+/*
+Monitor a channel by starting a waiting job for every stream that is live
+or scheduled on its streams tab, so streams that overlap or run back to back
+are all captured. Checks again every RetrySecs until stopped, then stops
+the jobs and waits for them to finish.
+*/
+func (a *Archiver) runScheduled() int {
+	o := a.Options
+	if len(o.URL) == 0 || len(o.Quality) == 0 {
+		return a.fail("You must specify a channel AND quality when choosing to monitor a channel")
+	}
+
+	info := NewDownloadInfo()
+	ctx := info.WithCancel(context.Background())
+	defer info.cancel()
+	info.MembersOnly = o.MembersOnly
+	info.URL = o.URL
+	a.setInfo(info)
+
+	filter, err := o.StreamFilter()
+	if err != nil {
+		return a.fail("%s", err)
+	}
+	info.Filter = filter
+
+	httpClient, _ := o.newHttpClient()
+	info.Client = httpClient
+	if o.Client != nil {
+		info.Client = o.Client
+	}
+
+	if len(o.CookieFile) > 0 {
+		cjar, err := info.ParseNetscapeCookiesFile(o.CookieFile)
+		if err != nil {
+			return a.fail("Failed to load cookies file: %s", err)
+		}
+		httpClient.Jar = cjar
+	}
+
+	err = info.ParseInputUrl()
+	if err != nil {
+		return a.fail("%s", err)
+	}
+	if !info.LiveURL {
+		return a.fail("--monitor-scheduled needs a channel URL")
+	}
+
+	retrySecs := o.RetrySecs
+	if retrySecs < MinimumMonitorTime {
+		retrySecs = DefaultMonitorTime
+	}
+
+	if o.HandleSignals {
+		signal.Notify(a.stopChan, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(a.stopChan)
+	}
+
+	streamsUrl := strings.Replace(info.URL, "/live", "/streams", 1)
+	jobs := make(map[string]*Archiver)
+	finished := make(map[string]bool)
+	queued := make(map[string]*QueueItem)
+	budget := newDiskBudget(o.DiskBudget)
+	defer budget.Stop()
+
+	for !a.isStopRequested() {
+		for _, streamUrl := range info.GetScheduledStreams(ctx, streamsUrl) {
+			if jobs[streamUrl] != nil || finished[streamUrl] {
+				continue
+			}
+
+			// Still listed next time, so it gets started once there is room
+			if !budget.Admit(a.getViews(), o.Priority) {
+				LogWarn("Not starting a job for %s yet, the disk budget is used up", streamUrl)
+				continue
+			}
+
+			jobs[streamUrl] = a.startJob(a.jobOptions(streamUrl, o.Priority))
+		}
+
+		// Queued streams run alongside the channel's, highest priority first
+		for a.queue != nil {
+			next := a.queue.Peek()
+			if next == nil || jobs[next.URL] != nil || !budget.Admit(a.getViews(), next.Priority) {
+				break
+			}
+
+			item := a.queue.Take()
+			jobOpts := a.jobOptions(item.URL, item.Priority)
+			if len(item.Quality) > 0 {
+				jobOpts.Quality = item.Quality
+			}
+
+			jobs[item.URL] = a.startJob(jobOpts)
+			queued[item.URL] = item
+		}
+
+		// Failed jobs are tried again if the stream is still listed
+		for streamUrl, job := range jobs {
+			select {
+			case <-job.done:
+				delete(jobs, streamUrl)
+				a.removeView(job)
+				budget.Forget(job)
+				if job.result.Retcode == 0 || job.result.Retcode == RetcodeFiltered {
+					finished[streamUrl] = true
+					if item := queued[streamUrl]; item != nil {
+						a.queue.Done(item)
+					}
+				} else {
+					LogWarn("Job for %s finished with exit code %d", streamUrl, job.result.Retcode)
+					if item := queued[streamUrl]; item != nil {
+						a.queue.Return(item, true)
+					}
+				}
+				delete(queued, streamUrl)
+			default:
+			}
+		}
+
+		pollSecs := JitterSecs(retrySecs)
+		LogDebug("%d jobs running, checking %s again in %d seconds", len(jobs), streamsUrl, pollSecs)
+		pollTimer := time.After(time.Duration(pollSecs) * time.Second)
+	wait:
+		for {
+			select {
+			case <-pollTimer:
+				break wait
+			case <-a.stopChan:
+				a.Lock()
+				a.stopRequested = true
+				a.Unlock()
+				break wait
+			case <-budget.C():
+				budget.Enforce(a.getViews())
+			}
+		}
+	}
+
+	LogGeneral("Waiting for %d jobs to finish...", len(jobs))
+	for _, job := range jobs {
+		job.Stop()
+	}
+	a.waitViews()
+
+	// Left in the queue for the next run, like a stopped queued download
+	for streamUrl, item := range queued {
+		job := jobs[streamUrl]
+		if job != nil && job.result.Retcode != 0 && job.result.Retcode != RetcodeFiltered {
+			a.queue.Return(item, false)
+		} else {
+			a.queue.Done(item)
+		}
+	}
+
+	return 0
+}
+
+// Split a number of threads between jobs, leaving each at least one
+func shareThreads(threads uint, jobs int) uint {
+	if jobs <= 1 || threads == 0 {
+		return threads
+	}
+
+	share := threads / uint(jobs)
+	if share < 1 {
+		share = 1
+	}
+
+	return share
+}
+
+/*
+Scale the threads of an archiver with priority for a job of it with
+jobPriority, by how their priorityWeight compares. Leaves each at least one.
+*/
+func priorityThreads(threads uint, priority, jobPriority int) uint {
+	if threads == 0 || priority == jobPriority {
+		return threads
+	}
+
+	scaled := uint(math.Round(float64(threads) * priorityWeight(jobPriority) / priorityWeight(priority)))
+	if scaled < 1 {
+		scaled = 1
+	}
+
+	return scaled
+}
+
+/*
+Archive several streams at once, each with a job of its own. The download
+threads are shared out between them, and their status lines are shown
+together on a StatusBoard. Waits for every job to finish, passing a stop on
+to all of them.
+*/
+func (a *Archiver) runURLs(urls []string) int {
+	o := a.Options
+	if len(o.Quality) == 0 {
+		return a.fail("You must specify a quality when archiving several streams at once")
+	}
+
+	// Passed on to the jobs by Signal, which catching them would count twice
+	sigChan := make(chan os.Signal, 1)
+	if o.HandleSignals {
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigChan)
+	}
+
+	var board *StatusBoard
+	if o.Callbacks.Status == nil && o.ProgressJSON == nil && GetLogLevel() >= LoglevelError {
+		board = NewStatusBoard(os.Stderr, a.Options.StatusNewlines)
+		log.SetOutput(board)
+		defer func() {
+			board.Close()
+			log.SetOutput(os.Stderr)
+		}()
+	}
+
+	threads := shareThreads(o.Threads, len(urls))
+	burstThreads := shareThreads(o.BurstThreads, len(urls))
+	LogGeneral("Archiving %d streams at once with %d threads each", len(urls), threads)
+
+	finished := make(chan *Archiver, len(urls))
+	for _, streamUrl := range urls {
+		jobOpts := a.jobOptions(streamUrl, o.Priority)
+		jobOpts.Threads = threads
+		jobOpts.BurstThreads = burstThreads
+		if board != nil {
+			jobOpts.Callbacks.Status = board.Line(streamLabel(streamUrl))
+		}
+
+		job := a.startJob(jobOpts)
+		go func() {
+			<-job.done
+			finished <- job
+		}()
+	}
+
+	retcode := 0
+	stopping := false
+	for running := len(urls); running > 0; {
+		select {
+		case sig := <-sigChan:
+			// A second one stops the jobs immediately, like a single download
+			a.Signal(sig)
+		case <-a.stopChan:
+			if !stopping {
+				stopping = true
+				LogGeneral("Stopping %d downloads...", running)
+			}
+		case job := <-finished:
+			running -= 1
+			if job.result.Retcode != 0 {
+				retcode = job.result.Retcode
+			}
+		}
+	}
+	a.waitViews()
+
+	return retcode
+}
+
+func (a *Archiver) startJob(jobOpts *Options) *Archiver {
+	LogGeneral("Starting a job for %s", jobOpts.URL)
+	job := NewArchiver(jobOpts)
+	job.har = a.har
+	job.Start()
+
+	a.Lock()
+	a.views = append(a.views, job)
+	a.Unlock()
+
+	return job
+}
+
+func (a *Archiver) removeView(view *Archiver) {
+	a.Lock()
+	defer a.Unlock()
+
+	for i, v := range a.views {
+		if v == view {
+			a.views = append(a.views[:i], a.views[i+1:]...)
+			return
+		}
+	}
+}
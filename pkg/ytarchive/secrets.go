@@ -0,0 +1,416 @@
+package ytarchive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Secret store that uses the keyring of the operating system
+	SecretStoreKeyring = "keyring"
+	// Service name secrets are kept under in the keyring
+	KeyringService = "ytarchive"
+	// Environment variable with the passphrase of an encrypted secrets file
+	SecretsPassphraseEnv = "YTARCHIVE_PASSPHRASE"
+	// Prefix for options that take a secret from the secret store instead of a file
+	SecretPrefix = "secret:"
+
+	secretsFileMagic     = "YTASECRETS1\n"
+	secretsKDFIterations = 600000
+	secretsSaltSize      = 16
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+/*
+Somewhere to keep cookies and tokens other than plain files on disk, for
+servers that several people archive from.
+*/
+type SecretStore interface {
+	Get(name string) ([]byte, error)
+	Set(name string, data []byte) error
+	Delete(name string) error
+}
+
+/*
+Open the secret store described by spec, either SecretStoreKeyring for the
+keyring of the operating system, or the path of a secrets file encrypted
+with a passphrase, which is created on the first Set. The passphrase is
+taken from SecretsPassphraseEnv, or asked for if not set.
+*/
+func OpenSecretStore(spec string) (SecretStore, error) {
+	if spec == SecretStoreKeyring {
+		return &keyringStore{}, nil
+	}
+
+	passphrase, err := ReadPassphrase(fmt.Sprintf("Passphrase for %s: ", spec))
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFileStore{file: spec, passphrase: passphrase}, nil
+}
+
+// Get the secret name refers to if it has SecretPrefix, or false if it does not
+func SecretName(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, SecretPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(ref, SecretPrefix), true
+}
+
+// Secret names are passed to keyring tools, so keep them to plain characters
+func CheckSecretName(name string) error {
+	if len(name) == 0 {
+		return errors.New("empty secret name")
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return fmt.Errorf("invalid secret name %s, use only letters, numbers, '-', '_', and '.'", name)
+		}
+	}
+
+	return nil
+}
+
+/*
+Get the passphrase from SecretsPassphraseEnv, or ask for it on the terminal
+without echoing it.
+*/
+func ReadPassphrase(prompt string) ([]byte, error) {
+	if passphrase := os.Getenv(SecretsPassphraseEnv); len(passphrase) > 0 {
+		return []byte(passphrase), nil
+	}
+
+	if !IsInteractiveTerminal() {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase on, set %s", SecretsPassphraseEnv)
+	}
+
+	restore, err := MakeRawTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprint(os.Stderr, "\r\n")
+
+	var passphrase []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		switch buf[0] {
+		case '\r', '\n':
+			if len(passphrase) == 0 {
+				return nil, errors.New("empty passphrase")
+			}
+			return passphrase, nil
+		case 3: // Ctrl+C
+			return nil, errors.New("cancelled")
+		case 8, 127: // Backspace
+			if len(passphrase) > 0 {
+				passphrase = passphrase[:len(passphrase)-1]
+			}
+		default:
+			passphrase = append(passphrase, buf[0])
+		}
+	}
+}
+
+// PBKDF2 with HMAC-SHA256, for a single block of output
+func deriveSecretsKey(passphrase, salt []byte) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	prf.Write(salt)
+	binary.Write(prf, binary.BigEndian, uint32(1))
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < secretsKDFIterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+/*
+Secrets kept as JSON in a single file, encrypted with AES-256-GCM using a
+key derived from the passphrase with PBKDF2. A wrong passphrase fails the
+decryption instead of giving garbage.
+*/
+type encryptedFileStore struct {
+	sync.Mutex
+	file       string
+	passphrase []byte
+}
+
+func newSecretsGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (s *encryptedFileStore) load() (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(secretsFileMagic)) {
+		return nil, fmt.Errorf("%s is not a ytarchive secrets file", s.file)
+	}
+	data = data[len(secretsFileMagic):]
+	if len(data) < secretsSaltSize {
+		return nil, fmt.Errorf("%s is cut short", s.file)
+	}
+
+	gcm, err := newSecretsGCM(deriveSecretsKey(s.passphrase, data[:secretsSaltSize]))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < secretsSaltSize+gcm.NonceSize() {
+		return nil, fmt.Errorf("%s is cut short", s.file)
+	}
+
+	nonce := data[secretsSaltSize : secretsSaltSize+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[secretsSaltSize+gcm.NonceSize():], []byte(secretsFileMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the secrets file is damaged")
+	}
+
+	err = json.Unmarshal(plain, &secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+func (s *encryptedFileStore) save(secrets map[string][]byte) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	// A new salt and nonce every time, so no nonce is ever used twice
+	salt := make([]byte, secretsSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newSecretsGCM(deriveSecretsKey(s.passphrase, salt))
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	data := []byte(secretsFileMagic)
+	data = append(data, salt...)
+	data = append(data, nonce...)
+	data = gcm.Seal(data, nonce, plain, []byte(secretsFileMagic))
+
+	dir := filepath.Dir(s.file)
+	if dir != "." {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmpFile := s.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, s.file)
+}
+
+func (s *encryptedFileStore) Get(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secrets[name]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+
+	return data, nil
+}
+
+func (s *encryptedFileStore) Set(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	secrets[name] = data
+	return s.save(secrets)
+}
+
+func (s *encryptedFileStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := secrets[name]; !ok {
+		return ErrSecretNotFound
+	}
+
+	delete(secrets, name)
+	return s.save(secrets)
+}
+
+const (
+	// Prefix of option and environment values encrypted with EncryptConfigValue
+	EncryptedValuePrefix = "enc:"
+	// Environment variables giving the key for encrypted values, or a file with it
+	ConfigKeyEnv     = "YTARCHIVE_CONFIG_KEY"
+	ConfigKeyFileEnv = "YTARCHIVE_CONFIG_KEY_FILE"
+)
+
+/*
+Get the key encrypted values use, from ConfigKeyEnv or the file named by
+ConfigKeyFileEnv. It should be long and random, so it is only hashed into
+an AES-256 key rather than stretched like a passphrase.
+*/
+func configKey() ([]byte, error) {
+	key := os.Getenv(ConfigKeyEnv)
+	if len(key) == 0 {
+		keyFile := os.Getenv(ConfigKeyFileEnv)
+		if len(keyFile) == 0 {
+			return nil, fmt.Errorf("encrypted values need a key in %s or a key file in %s", ConfigKeyEnv, ConfigKeyFileEnv)
+		}
+
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.New("the key for encrypted values is empty")
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	return hash[:], nil
+}
+
+// Encrypt value with the configured key, for use as an option or environment value
+func EncryptConfigValue(value string) (string, error) {
+	key, err := configKey()
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newSecretsGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return EncryptedValuePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt value if it has EncryptedValuePrefix, otherwise give it back as is
+func DecryptConfigValue(value string) (string, error) {
+	if !strings.HasPrefix(value, EncryptedValuePrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, EncryptedValuePrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+
+	key, err := configKey()
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newSecretsGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted value is cut short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt a value, the key is likely wrong")
+	}
+
+	return string(plain), nil
+}
+
+// Get an environment variable, decrypting it if it is encrypted
+func GetenvDecrypted(name string) (string, error) {
+	value, err := DecryptConfigValue(os.Getenv(name))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	return value, nil
+}
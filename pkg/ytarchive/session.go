@@ -0,0 +1,79 @@
+package ytarchive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How often the session is refreshed while downloading with cookies
+const SessionRefreshInterval = 30 * time.Minute
+
+/*
+Load the watch page with the cookies every SessionRefreshInterval while the
+stream downloads, so the session cookies YouTube rotates make it into the
+cookie jar and the ytcfg stays current. Without this, a stream that goes on
+for many hours can outlive its session, and the info refreshes needed to
+get new download URLs start failing near the end. If the page says the
+session is no longer logged in, the cookies file is read again in case
+fresher cookies were exported since. Runs until ctx is cancelled.
+*/
+func (di *DownloadInfo) KeepSessionFresh(ctx context.Context) {
+	warned := false
+
+	for SleepContext(ctx, SessionRefreshInterval) {
+		if di.IsUnavailable() || di.IsFinishing() {
+			return
+		}
+
+		watchUrl := fmt.Sprintf("https://www.youtube.com/watch?v=%s", di.VideoID)
+		page := DownloadData(ctx, di.HttpClient(), watchUrl)
+		if ctx.Err() != nil {
+			return
+		}
+
+		cfgData := GetYTCFGFromHtml(page)
+		if len(cfgData) == 0 {
+			LogDebug("Session refresh: no ytcfg found in the watch page")
+			continue
+		}
+
+		ytcfg := GetDefaultYTCFG()
+		err := json.Unmarshal(cfgData, ytcfg)
+		if err != nil {
+			LogDebug("Session refresh: %s", err)
+			continue
+		}
+
+		if !ytcfg.LoggedIn {
+			if !warned {
+				LogWarn("The cookies no longer give a logged in session. Reading the cookies file again in case it was updated.")
+				di.PrintStatus()
+				warned = true
+			}
+
+			err = di.ReloadCookies()
+			if err != nil {
+				LogDebug("Failed to reload cookies: %s", err)
+			}
+			continue
+		}
+
+		if warned {
+			LogInfo("The session is logged in again")
+			di.PrintStatus()
+			warned = false
+		}
+
+		di.Lock()
+		di.Ytcfg = ytcfg
+		di.Unlock()
+		updateInnertubeConfig(ytcfg)
+		LogDebug("Refreshed the session")
+
+		if err = di.SaveCookies(); err != nil {
+			LogDebug("Failed to save the updated cookies: %s", err)
+		}
+	}
+}
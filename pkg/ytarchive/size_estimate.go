@@ -0,0 +1,110 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+)
+
+// Estimated size of the final file for one quality
+type SizeEstimate struct {
+	Quality string
+	Itag    int
+	// Bits per second of the audio and video together
+	Bitrate int
+	// 0 if how long the stream lasts is not known
+	Bytes int64
+}
+
+/*
+Estimate the size of the final file for every quality the stream offers,
+lowest first, if it lasts secs seconds. Bitrates are measured from the
+newest fragments of each format, falling back to the manifest's. Sizes are
+left at 0 if secs is.
+*/
+func (di *DownloadInfo) EstimateSizes(ctx context.Context, secs int) []SizeEstimate {
+	di.MeasureFormats(ctx)
+
+	var estimates []SizeEstimate
+	for _, quality := range VideoQualities {
+		itag := di.qualityItag(quality, di.FormatURLs)
+		if _, ok := di.FormatURLs[itag]; !ok {
+			continue
+		}
+
+		bitrate := di.formatBitrate(itag)
+		if itag != AudioItag && !di.VideoOnly {
+			bitrate += di.formatBitrate(AudioItag)
+		}
+		if bitrate <= 0 {
+			continue
+		}
+
+		estimates = append(estimates, SizeEstimate{
+			Quality: quality,
+			Itag:    itag,
+			Bitrate: bitrate,
+			Bytes:   int64(bitrate) / 8 * int64(secs),
+		})
+	}
+
+	return estimates
+}
+
+// Print the estimates, marking the one for the selected itag
+func printSizeEstimates(estimates []SizeEstimate, secs, selected int) {
+	if secs > 0 {
+		LogGeneral("Estimated final file sizes for %s:", SecondsToDurationStr(secs))
+	} else {
+		LogGeneral("Estimated final file sizes per hour, as how long the stream lasts is not known:")
+	}
+
+	for _, est := range estimates {
+		size := est.Bytes
+		if secs <= 0 {
+			size = int64(est.Bitrate) / 8 * 3600
+		}
+
+		mark := ""
+		if est.Itag == selected {
+			mark = " (selected)"
+		}
+
+		LogGeneral("  %-8s %10s  %s%s", est.Quality, FormatSize(size), FormatBitrate(est.Bitrate), mark)
+	}
+}
+
+/*
+Estimate the size of the final file and print it for every quality. Returns
+an error if the selected quality's estimate is over maxSize, unless maxSize
+is 0 or how long the stream lasts is not known.
+*/
+func (di *DownloadInfo) CheckEstimatedSize(ctx context.Context, secs int, maxSize int64) error {
+	estimates := di.EstimateSizes(ctx, secs)
+	if len(estimates) == 0 {
+		LogWarn("Could not estimate the size of the final file, no bitrates are known")
+		return nil
+	}
+
+	selected := di.Quality
+	if selected == AudioOnlyQuality {
+		selected = AudioItag
+	}
+
+	printSizeEstimates(estimates, secs, selected)
+	if maxSize <= 0 {
+		return nil
+	}
+
+	if secs <= 0 {
+		LogWarn("Not checking the estimated size against %s, as how long the download will last is not known. Set it with --expected-duration.", FormatSize(maxSize))
+		return nil
+	}
+
+	for _, est := range estimates {
+		if est.Itag == selected && est.Bytes > maxSize {
+			return fmt.Errorf("the final file is estimated at %s, over the limit of %s", FormatSize(est.Bytes), FormatSize(maxSize))
+		}
+	}
+
+	return nil
+}
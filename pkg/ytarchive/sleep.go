@@ -0,0 +1,132 @@
+package ytarchive
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the clock is checked for the system having slept
+	SleepCheckInterval = 5 * time.Second
+	// How much longer than SleepCheckInterval a check can take before it counts as a sleep
+	SleepJumpThreshold = 30 * time.Second
+)
+
+/*
+Notices the system sleeping, such as a laptop lid being closed, by how far
+the clock moved between checks.
+*/
+type sleepWatch struct {
+	sync.Mutex
+	last    time.Time
+	resumes int
+}
+
+/*
+Returns how long the system slept since the last check, or 0 if it did not.
+Go's monotonic clock stops while the system is suspended on most platforms
+while the wall clock keeps going, so whichever moved further is used.
+*/
+func (sw *sleepWatch) check() time.Duration {
+	sw.Lock()
+	defer sw.Unlock()
+
+	now := time.Now()
+	last := sw.last
+	sw.last = now
+	if last.IsZero() {
+		return 0
+	}
+
+	elapsed := now.Sub(last)
+	if wall := now.Round(0).Sub(last.Round(0)); wall > elapsed {
+		elapsed = wall
+	}
+
+	if elapsed < SleepCheckInterval+SleepJumpThreshold {
+		return 0
+	}
+
+	sw.resumes += 1
+	return elapsed
+}
+
+func (sw *sleepWatch) reset() {
+	sw.Lock()
+	defer sw.Unlock()
+	sw.last = time.Time{}
+}
+
+// Number of times the system woke up from sleeping so far
+func (sw *sleepWatch) count() int {
+	sw.Lock()
+	defer sw.Unlock()
+	return sw.resumes
+}
+
+/*
+Watch for the system sleeping while downloading. By the time it wakes up
+the download URLs have likely expired and every open connection is dead, so
+instead of letting the fragment threads burn through their retries on them,
+get fresh URLs right away. Runs until ctx is cancelled.
+*/
+func (di *DownloadInfo) WatchSleep(ctx context.Context) {
+	di.sleep.check()
+	defer di.sleep.reset()
+
+	for SleepContext(ctx, SleepCheckInterval) {
+		di.checkResumed(ctx)
+	}
+}
+
+/*
+Refresh the download URLs if the system slept since the last check.
+Fragment threads call this as well, since they can wake up before
+WatchSleep does.
+*/
+func (di *DownloadInfo) checkResumed(ctx context.Context) {
+	slept := di.sleep.check()
+	if slept == 0 {
+		return
+	}
+
+	LogInfo("Resumed after the system slept for about %s, refreshing the download URLs", SecondsToDurationStr(int(slept.Seconds())))
+	di.PrintStatus()
+	di.addDiscontinuity(Discontinuity{
+		Kind:     DiscontinuitySleep,
+		Duration: int(slept.Seconds()),
+	})
+
+	closeIdleConnections(di.HttpClient())
+	closeIdleConnections(di.MediaHttpClient())
+	if !di.IsGVideoDDL() {
+		di.GetVideoInfo(ctx)
+	}
+}
+
+/*
+Give a fragment thread its retries back if the system slept since it last
+checked, so the fragment it is on gets tried again with the new URLs
+rather than given up on.
+*/
+func (di *DownloadInfo) resetAfterSleep(ctx context.Context, state *fragThreadState) {
+	di.checkResumed(ctx)
+
+	resumes := di.sleep.count()
+	if resumes == state.Resumes {
+		return
+	}
+
+	LogDebug("%s: Retrying fragment %d after the system slept", state.Name, state.SeqNum)
+	state.Resumes = resumes
+	state.Tries = 0
+	state.FullRetries = 3
+	state.Is403 = false
+}
+
+func closeIdleConnections(client HttpClient) {
+	if c, ok := client.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,119 @@
+package ytarchive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Saves a JPEG frame from the video every so often while the stream downloads,
+as a quick visual index of a long stream. Frames are named after how far
+into the stream they are, and extracted with ffmpeg in the background so
+the download is never held up.
+*/
+type Snapshotter struct {
+	sync.Mutex
+	FFmpegPath     string
+	Dir            string
+	Prefix         string
+	IntervalSecs   int
+	TargetDuration int
+	DirMode        os.FileMode
+
+	lastSecs int
+	busy     bool
+	wg       sync.WaitGroup
+}
+
+func NewSnapshotter(ffmpegPath, dir, prefix string, intervalSecs, targetDuration int) *Snapshotter {
+	if targetDuration < 1 {
+		targetDuration = 1
+	}
+
+	return &Snapshotter{
+		FFmpegPath:     ffmpegPath,
+		Dir:            dir,
+		Prefix:         prefix,
+		IntervalSecs:   intervalSecs,
+		TargetDuration: targetDuration,
+		DirMode:        0755,
+		lastSecs:       -1,
+	}
+}
+
+// Take a snapshot from the fragment if one is due, for DownloadInfo.OnRawFragment
+func (s *Snapshotter) AddFragment(dataType string, seq int, data []byte) {
+	if dataType != DtypeVideo {
+		return
+	}
+
+	secs := seq * s.TargetDuration
+	s.Lock()
+	if s.busy || (s.lastSecs >= 0 && secs-s.lastSecs < s.IntervalSecs) {
+		s.Unlock()
+		return
+	}
+	s.lastSecs = secs
+	s.busy = true
+	s.wg.Add(1)
+	s.Unlock()
+
+	frag := make([]byte, len(data))
+	copy(frag, data)
+
+	go func() {
+		defer s.wg.Done()
+		err := s.extract(frag, secs)
+		if err != nil {
+			LogWarn("Failed to take a snapshot at %s: %s", SecondsToDurationStr(secs), err)
+		}
+
+		s.Lock()
+		s.busy = false
+		s.Unlock()
+	}()
+}
+
+func (s *Snapshotter) extract(frag []byte, secs int) error {
+	err := os.MkdirAll(s.Dir, s.DirMode)
+	if err != nil {
+		return err
+	}
+
+	fname := filepath.Join(s.Dir, fmt.Sprintf("%s.%02d-%02d-%02d.jpg", s.Prefix, secs/3600, secs/60%60, secs%60))
+	cmd := exec.Command(s.FFmpegPath,
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-i", "pipe:0",
+		"-frames:v", "1",
+		"-q:v", "2",
+		fname,
+	)
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(frag)
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return err
+	}
+
+	LogDebug("Saved snapshot %s", fname)
+	return nil
+}
+
+// Wait for any snapshot still being extracted
+func (s *Snapshotter) Wait() {
+	s.wg.Wait()
+}
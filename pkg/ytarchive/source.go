@@ -0,0 +1,101 @@
+package ytarchive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of source data saved by SourceWriter, used as the file extension
+const (
+	SourceWatchPage         = "watch.html"
+	SourcePlayerResponse    = "player_response.json"
+	SourceWebPlayerResponse = "web_player_response.json"
+)
+
+type sourceSnapshot struct {
+	Kind string
+	At   time.Time
+	Data []byte
+}
+
+/*
+Saves the raw watch page and player responses exactly as YouTube served
+them, each time they are retrieved. Until the output location is known,
+only the latest snapshot of each kind is kept.
+*/
+type SourceWriter struct {
+	sync.Mutex
+	FileMode os.FileMode
+
+	dir     string
+	prefix  string
+	pending map[string]*sourceSnapshot
+	files   []string
+}
+
+func NewSourceWriter(mode os.FileMode) *SourceWriter {
+	return &SourceWriter{
+		FileMode: mode,
+		pending:  make(map[string]*sourceSnapshot),
+	}
+}
+
+// Save a snapshot of the given kind, or hold on to it until SetOutput
+func (s *SourceWriter) Add(kind string, data []byte) {
+	snap := &sourceSnapshot{kind, time.Now().UTC(), data}
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.dir) == 0 {
+		s.pending[kind] = snap
+		return
+	}
+
+	s.write(snap)
+}
+
+/*
+Set where snapshots go, named PREFIX.TIMESTAMP.KIND in dir, and write out
+any that were held on to.
+*/
+func (s *SourceWriter) SetOutput(dir, prefix string) {
+	s.Lock()
+	defer s.Unlock()
+	s.dir = dir
+	s.prefix = prefix
+
+	for _, kind := range []string{SourceWatchPage, SourcePlayerResponse, SourceWebPlayerResponse} {
+		if snap, ok := s.pending[kind]; ok {
+			s.write(snap)
+		}
+	}
+	s.pending = make(map[string]*sourceSnapshot)
+}
+
+// The files written so far
+func (s *SourceWriter) Files() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.files...)
+}
+
+func (s *SourceWriter) write(snap *sourceSnapshot) {
+	fname := filepath.Join(s.dir, fmt.Sprintf("%s.%s.%s", s.prefix, snap.At.Format("20060102T150405Z"), snap.Kind))
+	err := os.WriteFile(fname, snap.Data, s.FileMode)
+	if err != nil {
+		LogWarn("Failed to write %s: %s", fname, err)
+		return
+	}
+
+	LogDebug("Wrote source snapshot %s", fname)
+	s.files = append(s.files, fname)
+}
+
+func (di *DownloadInfo) writeSource(kind string, data []byte) {
+	if di.SourceFunc != nil && len(data) > 0 {
+		di.SourceFunc(kind, data)
+	}
+}
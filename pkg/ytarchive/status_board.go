@@ -0,0 +1,124 @@
+package ytarchive
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+/*
+Shows the status lines of several downloads at once, one line per stream
+kept at the bottom of the terminal, with log messages printed above them
+when it is set as the log output. When not writing to a terminal, or with
+status newlines, each status is printed on a line of its own instead,
+prefixed with its stream.
+*/
+type StatusBoard struct {
+	sync.Mutex
+	out    *os.File
+	redraw bool
+	labels []string
+	lines  map[string]string
+	// Lines of the board on screen, cleared before anything else is printed
+	drawn int
+}
+
+func NewStatusBoard(out *os.File, newlines bool) *StatusBoard {
+	fd := out.Fd()
+	return &StatusBoard{
+		out:    out,
+		redraw: !newlines && (isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)),
+		lines:  make(map[string]string),
+	}
+}
+
+// A short name for a stream on the board, its video ID if the URL has one
+func streamLabel(streamUrl string) string {
+	if u, err := url.Parse(streamUrl); err == nil {
+		if v := u.Query().Get("v"); len(v) > 0 {
+			return v
+		}
+		if strings.EqualFold(strings.TrimPrefix(u.Host, "www."), "youtu.be") {
+			return strings.TrimPrefix(u.Path, "/")
+		}
+	}
+
+	return streamUrl
+}
+
+/*
+Add a line for the stream to the board, returning the function to show its
+status with, such as for Callbacks.Status.
+*/
+func (sb *StatusBoard) Line(label string) func(status string) {
+	sb.Lock()
+	sb.labels = append(sb.labels, label)
+	sb.Unlock()
+
+	return func(status string) {
+		sb.Set(label, status)
+	}
+}
+
+func (sb *StatusBoard) Set(label, status string) {
+	status = strings.TrimLeft(status, "\r")
+	status = strings.TrimRight(status, "\n")
+	status = strings.TrimSuffix(status, "\033[K")
+	if len(status) == 0 {
+		return
+	}
+
+	sb.Lock()
+	defer sb.Unlock()
+	sb.lines[label] = status
+	if !sb.redraw {
+		fmt.Fprintf(sb.out, "[%s] %s\n", label, status)
+		return
+	}
+
+	sb.clear()
+	sb.draw()
+}
+
+// Print log output above the board, for use with log.SetOutput
+func (sb *StatusBoard) Write(p []byte) (int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+
+	sb.clear()
+	n, err := sb.out.Write(p)
+	sb.draw()
+	return n, err
+}
+
+// Leave the last status of every stream on screen
+func (sb *StatusBoard) Close() {
+	sb.Lock()
+	defer sb.Unlock()
+	sb.drawn = 0
+	sb.redraw = false
+}
+
+func (sb *StatusBoard) clear() {
+	if sb.drawn > 0 {
+		fmt.Fprintf(sb.out, "\033[%dA\r\033[J", sb.drawn)
+		sb.drawn = 0
+	}
+}
+
+func (sb *StatusBoard) draw() {
+	if !sb.redraw {
+		return
+	}
+
+	for _, label := range sb.labels {
+		if status, ok := sb.lines[label]; ok {
+			fmt.Fprintf(sb.out, "[%s] %s\033[K\n", label, status)
+			sb.drawn += 1
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ytarchive
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+Destination for finished output files, so they can be sent somewhere
+other than the output directory once muxed. Backends are picked by the
+scheme of the storage URL, e.g. file:///mnt/archive. Fragments and the data
+files being downloaded are always written locally, since they are appended
+to as the stream goes and read back for the mux.
+*/
+type Storage interface {
+	// Store the local file under the given slash-separated name, relative to the storage root.
+	// The local file may be moved or removed.
+	Store(ctx context.Context, localPath, name string) error
+	// Where the given name ends up, for logging
+	Location(name string) string
+}
+
+// Creates a Storage from a storage URL
+type StorageOpener func(u *url.URL) (Storage, error)
+
+var (
+	storageLock     sync.Mutex
+	storageBackends = map[string]StorageOpener{
+		"":     openLocalStorage,
+		"file": openLocalStorage,
+	}
+)
+
+/*
+Make a storage backend available under the given URL scheme
+*/
+func RegisterStorage(scheme string, opener StorageOpener) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	storageBackends[strings.ToLower(scheme)] = opener
+}
+
+/*
+Open the storage backend for the given URL. A plain path is treated as a
+local directory.
+*/
+func OpenStorage(rawUrl string) (Storage, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (len(u.Scheme) == 1 && filepath.VolumeName(rawUrl) != "") {
+		// Windows drive letters parse as a scheme
+		u = &url.URL{Path: rawUrl}
+	}
+
+	storageLock.Lock()
+	opener, ok := storageBackends[strings.ToLower(u.Scheme)]
+	storageLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no storage backend for scheme %s", u.Scheme)
+	}
+
+	return opener(u)
+}
+
+/*
+Stores files in a directory on the local filesystem
+*/
+type LocalStorage struct {
+	Dir     string
+	DirMode os.FileMode
+}
+
+func openLocalStorage(u *url.URL) (Storage, error) {
+	dir := u.Path
+	if len(u.Host) > 0 && u.Host != "localhost" {
+		dir = "//" + u.Host + dir
+	}
+
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("no directory given for local storage")
+	}
+
+	return &LocalStorage{Dir: filepath.FromSlash(dir), DirMode: 0755}, nil
+}
+
+func (ls *LocalStorage) Location(name string) string {
+	return filepath.Join(ls.Dir, filepath.FromSlash(name))
+}
+
+func (ls *LocalStorage) Store(ctx context.Context, localPath, name string) error {
+	dest := ls.Location(name)
+	err := os.MkdirAll(filepath.Dir(dest), ls.DirMode)
+	if err != nil {
+		return err
+	}
+
+	return TryMove(localPath, dest)
+}
+
+/*
+Send the given files to storage, named relative to dir.
+Returns the stored locations, in the same order.
+*/
+func StoreFiles(ctx context.Context, storage Storage, dir string, files []string) ([]string, error) {
+	locations := make([]string, 0, len(files))
+	for _, file := range files {
+		name := filepath.ToSlash(filepath.Join(dir, filepath.Base(file)))
+
+		LogInfo("Storing %s at %s", file, storage.Location(name))
+		err := storage.Store(ctx, file, name)
+		if err != nil {
+			return locations, fmt.Errorf("failed to store %s: %w", file, err)
+		}
+
+		locations = append(locations, storage.Location(name))
+	}
+
+	return locations, nil
+}
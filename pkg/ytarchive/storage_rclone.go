@@ -0,0 +1,122 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+Moves files to any rclone remote, such as gdrive:archive, by running rclone.
+Each file is checked against the remote copy before the local one is deleted.
+*/
+type RcloneStorage struct {
+	Remote     string
+	RclonePath string
+}
+
+type rcloneListEntry struct {
+	Size   int64
+	Hashes map[string]string
+}
+
+func NewRcloneStorage(remote string) *RcloneStorage {
+	return &RcloneStorage{
+		Remote:     strings.TrimRight(remote, "/"),
+		RclonePath: "rclone",
+	}
+}
+
+func (rs *RcloneStorage) Location(name string) string {
+	if strings.HasSuffix(rs.Remote, ":") {
+		return rs.Remote + name
+	}
+
+	return rs.Remote + "/" + name
+}
+
+func (rs *RcloneStorage) run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, rs.RclonePath, args...)
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	LogDebug("Running %s %s", rs.RclonePath, strings.Join(args, " "))
+
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("rclone %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+func (rs *RcloneStorage) Store(ctx context.Context, localPath, name string) error {
+	dest := rs.Location(name)
+	_, err := rs.run(ctx, "copyto", localPath, dest)
+	if err != nil {
+		return err
+	}
+
+	err = rs.verify(ctx, localPath, dest)
+	if err != nil {
+		return fmt.Errorf("%s was uploaded but could not be verified, keeping the local copy: %w", dest, err)
+	}
+
+	return os.Remove(localPath)
+}
+
+/*
+Compare the size, and the MD5 hash if the remote supports it,
+of the uploaded file with the local one
+*/
+func (rs *RcloneStorage) verify(ctx context.Context, localPath, dest string) error {
+	out, err := rs.run(ctx, "lsjson", "--hash", "--hash-type", "md5", dest)
+	if err != nil {
+		return err
+	}
+
+	var entries []rcloneListEntry
+	err = json.Unmarshal(out, &entries)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) != 1 {
+		return fmt.Errorf("expected one file at %s, found %d", dest, len(entries))
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+
+	if entries[0].Size != size {
+		return fmt.Errorf("size mismatch, local %d bytes and remote %d bytes", size, entries[0].Size)
+	}
+
+	remoteHash := entries[0].Hashes["md5"]
+	localHash := hex.EncodeToString(hash.Sum(nil))
+	if len(remoteHash) > 0 && !strings.EqualFold(remoteHash, localHash) {
+		return fmt.Errorf("MD5 mismatch, local %s and remote %s", localHash, remoteHash)
+	}
+
+	return nil
+}
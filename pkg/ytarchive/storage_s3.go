@@ -0,0 +1,445 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3DefaultRegion   = "us-east-1"
+	S3DefaultPartSize = 16 * 1024 * 1024
+	S3MinPartSize     = 5 * 1024 * 1024
+	S3MaxTries        = 5
+)
+
+/*
+Uploads files to an S3 compatible bucket. Opened from URLs like
+s3://bucket/prefix?region=eu-west-1&endpoint=https://s3.example.com
+Credentials come from the usual AWS environment variables.
+*/
+type S3Storage struct {
+	Client       HttpClient
+	Bucket       string
+	Prefix       string
+	Region       string
+	Endpoint     *url.URL
+	PathStyle    bool
+	PartSize     int64
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func init() {
+	RegisterStorage("s3", openS3Storage)
+}
+
+func openS3Storage(u *url.URL) (Storage, error) {
+	var err error
+	query := u.Query()
+	s3 := &S3Storage{
+		Bucket:   u.Host,
+		Prefix:   strings.Trim(u.Path, "/"),
+		Region:   query.Get("region"),
+		PartSize: S3DefaultPartSize,
+	}
+
+	// Credentials may be encrypted, see EncryptConfigValue
+	for _, cred := range []struct {
+		env   string
+		value *string
+	}{
+		{"AWS_ACCESS_KEY_ID", &s3.AccessKey},
+		{"AWS_SECRET_ACCESS_KEY", &s3.SecretKey},
+		{"AWS_SESSION_TOKEN", &s3.SessionToken},
+	} {
+		*cred.value, err = GetenvDecrypted(cred.env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s3.Bucket) == 0 {
+		return nil, errors.New("no bucket given for s3 storage")
+	}
+
+	if len(s3.AccessKey) == 0 || len(s3.SecretKey) == 0 {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 storage")
+	}
+
+	if len(s3.Region) == 0 {
+		s3.Region = os.Getenv("AWS_REGION")
+	}
+	if len(s3.Region) == 0 {
+		s3.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if len(s3.Region) == 0 {
+		s3.Region = S3DefaultRegion
+	}
+
+	endpoint := query.Get("endpoint")
+	if len(endpoint) == 0 {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL_S3")
+	}
+	if len(endpoint) == 0 {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+
+	if len(endpoint) > 0 {
+		// Most S3 compatible services want path style requests
+		s3.PathStyle = true
+	} else {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3.Region)
+	}
+
+	s3.Endpoint, err = url.Parse(endpoint)
+	if err != nil || len(s3.Endpoint.Host) == 0 {
+		return nil, fmt.Errorf("invalid s3 endpoint %s", endpoint)
+	}
+
+	if pathStyle := query.Get("path_style"); len(pathStyle) > 0 {
+		s3.PathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_style value %s", pathStyle)
+		}
+	}
+
+	if partSize := query.Get("part_size"); len(partSize) > 0 {
+		mib, err := strconv.ParseInt(partSize, 10, 64)
+		if err != nil || mib*1024*1024 < S3MinPartSize {
+			return nil, fmt.Errorf("part_size must be a number of MiB, at least %d", S3MinPartSize/1024/1024)
+		}
+		s3.PartSize = mib * 1024 * 1024
+	}
+
+	return s3, nil
+}
+
+func (s3 *S3Storage) key(name string) string {
+	if len(s3.Prefix) == 0 {
+		return name
+	}
+
+	return s3.Prefix + "/" + name
+}
+
+func (s3 *S3Storage) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s3.Bucket, s3.key(name))
+}
+
+func (s3 *S3Storage) httpClient() HttpClient {
+	if s3.Client != nil {
+		return s3.Client
+	}
+
+	return DefaultHttpClient()
+}
+
+func (s3 *S3Storage) Store(ctx context.Context, localPath, name string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := s3.key(name)
+	if stat.Size() <= s3.PartSize {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = s3.do(ctx, "PUT", key, nil, data)
+		return err
+	}
+
+	return s3.storeMultipart(ctx, f, key)
+}
+
+func (s3 *S3Storage) storeMultipart(ctx context.Context, f io.Reader, key string) error {
+	_, body, err := s3.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+
+	initResult := &s3InitiateMultipartUploadResult{}
+	err = xml.Unmarshal(body, initResult)
+	if err != nil || len(initResult.UploadId) == 0 {
+		return fmt.Errorf("failed to start multipart upload: %s", body)
+	}
+
+	uploadId := initResult.UploadId
+	complete := &s3CompleteMultipartUpload{}
+	buf := make([]byte, s3.PartSize)
+
+	err = func() error {
+		for partNum := 1; ; partNum++ {
+			n, err := io.ReadFull(f, buf)
+			if err == io.EOF {
+				break
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+
+			LogDebug("Uploading part %d of %s", partNum, key)
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNum)},
+				"uploadId":   {uploadId},
+			}
+			header, _, err := s3.do(ctx, "PUT", key, query, buf[:n])
+			if err != nil {
+				return err
+			}
+
+			complete.Parts = append(complete.Parts, s3CompletedPart{
+				PartNumber: partNum,
+				ETag:       header.Get("ETag"),
+			})
+		}
+
+		data, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+
+		_, body, err := s3.do(ctx, "POST", key, url.Values{"uploadId": {uploadId}}, data)
+		if err != nil {
+			return err
+		}
+
+		// Completing can fail after a 200 response has been sent
+		s3Err := &s3Error{}
+		if xml.Unmarshal(body, s3Err) == nil && len(s3Err.Code) > 0 {
+			return fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		LogDebug("Aborting multipart upload of %s", key)
+		s3.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadId}}, nil)
+	}
+
+	return err
+}
+
+/*
+Send a signed request, retrying on connection problems and server errors
+*/
+func (s3 *S3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte) (http.Header, []byte, error) {
+	var lastErr error
+
+	for tries := 0; tries < S3MaxTries; tries++ {
+		if tries > 0 {
+			LogDebug("S3 %s %s failed, retrying: %s", method, key, lastErr)
+			if !SleepContext(ctx, time.Duration(1<<(tries-1))*time.Second) {
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		req, err := s3.newRequest(ctx, method, key, query, body)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := s3.httpClient().Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+
+			lastErr = err
+			continue
+		}
+
+		respData, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
+			continue
+		}
+
+		if resp.StatusCode >= 300 {
+			s3Err := &s3Error{}
+			xml.Unmarshal(respData, s3Err)
+			return nil, nil, fmt.Errorf("HTTP %d %s: %s", resp.StatusCode, s3Err.Code, s3Err.Message)
+		}
+
+		return resp.Header, respData, nil
+	}
+
+	return nil, nil, fmt.Errorf("giving up after %d tries: %w", S3MaxTries, lastErr)
+}
+
+func (s3 *S3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	host := s3.Endpoint.Host
+	path := "/" + s3UriEncode(key, false)
+	if s3.PathStyle {
+		path = "/" + s3UriEncode(s3.Bucket, true) + path
+	} else {
+		host = s3.Bucket + "." + host
+	}
+
+	rawQuery := s3CanonicalQuery(query)
+	reqUrl := fmt.Sprintf("%s://%s%s", s3.Endpoint.Scheme, host, path)
+	if len(rawQuery) > 0 {
+		reqUrl += "?" + rawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the path exactly as it was signed
+	req.URL.Opaque = "//" + host + path
+	req.URL.RawQuery = rawQuery
+	req.ContentLength = int64(len(body))
+
+	payloadHash := sha256.Sum256(body)
+	s3.sign(req, host, path, rawQuery, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	return req, nil
+}
+
+// AWS Signature Version 4
+func (s3 *S3Storage) sign(req *http.Request, host, path, rawQuery, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+
+	if len(s3.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s3.SessionToken)
+		headers["x-amz-security-token"] = s3.SessionToken
+	}
+
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s3.Region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s3.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI encode the way S3 expects, leaving only unreserved characters alone
+func s3UriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+
+	return sb.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3UriEncode(k, true)+"="+s3UriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
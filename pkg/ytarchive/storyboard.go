@@ -0,0 +1,94 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Layout of the storyboard sprite sheet
+const (
+	StoryboardColumns    = 10
+	StoryboardMaxTiles   = 100
+	StoryboardTileWidth  = 240
+	StoryboardTileHeight = 135
+)
+
+/*
+Generate a storyboard sprite sheet of evenly spaced frames from videoFile
+with ffmpeg, written to FILE.storyboard.jpg, along with a WebVTT thumbnails
+track at FILE.storyboard.vtt mapping each stretch of time to its tile, as
+review tools and web players use for scrubbing. Only keyframes are decoded,
+so this is quick even for long streams.
+Returns the names of the written files.
+*/
+func GenerateStoryboard(ffmpegPath, videoFile, outBase string, durationSecs int, mode os.FileMode) ([]string, error) {
+	if durationSecs < 1 {
+		return nil, errors.New("unknown video duration")
+	}
+
+	tiles := durationSecs
+	if tiles > StoryboardMaxTiles {
+		tiles = StoryboardMaxTiles
+	}
+	interval := float64(durationSecs) / float64(tiles)
+
+	cols := StoryboardColumns
+	if tiles < cols {
+		cols = tiles
+	}
+	rows := (tiles + cols - 1) / cols
+
+	sheetFile := outBase + ".storyboard.jpg"
+	vttFile := outBase + ".storyboard.vtt"
+	filter := fmt.Sprintf(
+		"fps=1/%f,scale=%[2]d:%[3]d:force_original_aspect_ratio=decrease,pad=%[2]d:%[3]d:(ow-iw)/2:(oh-ih)/2,tile=%[4]dx%[5]d",
+		interval, StoryboardTileWidth, StoryboardTileHeight, cols, rows,
+	)
+
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-skip_frame", "nokey",
+		"-i", videoFile,
+		"-an",
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "3",
+		sheetFile,
+	)
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	sheetName := filepath.Base(sheetFile)
+	for i := 0; i < tiles; i++ {
+		start := int(float64(i) * interval * 1000)
+		end := int(float64(i+1) * interval * 1000)
+		x := (i % cols) * StoryboardTileWidth
+		y := (i / cols) * StoryboardTileHeight
+		vtt.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), sheetName, x, y, StoryboardTileWidth, StoryboardTileHeight))
+	}
+
+	err = os.WriteFile(vttFile, []byte(vtt.String()), mode)
+	if err != nil {
+		return []string{sheetFile}, err
+	}
+
+	return []string{sheetFile, vttFile}, nil
+}
+
+func vttTimestamp(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
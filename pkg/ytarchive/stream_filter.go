@@ -0,0 +1,363 @@
+package ytarchive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Decides which streams get archived. Streams it rejects while waiting on a
+channel are waited past as if they were not there.
+*/
+type StreamFilter struct {
+	// Titles must match MatchTitle, if set, and must not match RejectTitle.
+	// The same for descriptions.
+	MatchTitle        *regexp.Regexp
+	RejectTitle       *regexp.Regexp
+	MatchDescription  *regexp.Regexp
+	RejectDescription *regexp.Regexp
+
+	// The category and language must be one of these, if any are given.
+	// Streams with no known language are let through, see streamLanguages.
+	Categories []string
+	Languages  []string
+
+	// Bounds on how long the stream runs, 0 for none. YouTube does not say
+	// how long a stream is scheduled for, so a stream that is still live is
+	// only rejected once it has run longer than MaxDuration.
+	MinDuration time.Duration
+	MaxDuration time.Duration
+
+	// Used instead for the streams of these channel IDs
+	Channels map[string]*StreamFilter
+}
+
+/*
+The criteria of a StreamFilter as given by the user, as options or for a
+channel in the ChannelFilters file. Durations are strings such as 1h30m.
+*/
+type streamFilterSpec struct {
+	MatchTitle        *string  `json:"match_title"`
+	RejectTitle       *string  `json:"reject_title"`
+	MatchDescription  *string  `json:"match_description"`
+	RejectDescription *string  `json:"reject_description"`
+	Categories        []string `json:"categories"`
+	Languages         []string `json:"languages"`
+	MinDuration       *string  `json:"min_duration"`
+	MaxDuration       *string  `json:"max_duration"`
+}
+
+/*
+Create the filter for the options, with a filter for each channel in the
+ChannelFilters file made from the options overridden by what is set for
+the channel. Returns nil if nothing is filtered, which Allows accepts.
+*/
+func (o *Options) StreamFilter() (*StreamFilter, error) {
+	defaults := &StreamFilter{
+		Categories:  o.MatchCategories,
+		Languages:   o.MatchLanguages,
+		MinDuration: o.MinDuration,
+		MaxDuration: o.MaxDuration,
+	}
+
+	var err error
+	regexes := []struct {
+		re   **regexp.Regexp
+		expr string
+		name string
+	}{
+		{&defaults.MatchTitle, o.MatchTitle, "title to match"},
+		{&defaults.RejectTitle, o.RejectTitle, "title to reject"},
+		{&defaults.MatchDescription, o.MatchDescription, "description to match"},
+		{&defaults.RejectDescription, o.RejectDescription, "description to reject"},
+	}
+	for _, r := range regexes {
+		*r.re, err = compileFilterRegex(r.expr, r.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = defaults.check(); err != nil {
+		return nil, err
+	}
+
+	if len(o.ChannelFilters) > 0 {
+		data, err := os.ReadFile(o.ChannelFilters)
+		if err != nil {
+			return nil, err
+		}
+
+		var specs map[string]streamFilterSpec
+		err = json.Unmarshal(data, &specs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", o.ChannelFilters, err)
+		}
+
+		defaults.Channels = make(map[string]*StreamFilter, len(specs))
+		for channelId, spec := range specs {
+			channel, err := defaults.override(spec)
+			if err != nil {
+				return nil, fmt.Errorf("%s in %s: %w", channelId, o.ChannelFilters, err)
+			}
+			defaults.Channels[channelId] = channel
+		}
+	}
+
+	if defaults.isEmpty() && len(defaults.Channels) == 0 {
+		return nil, nil
+	}
+
+	return defaults, nil
+}
+
+func compileFilterRegex(expr, name string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+
+	return re, nil
+}
+
+// Copy the filter with what spec sets replaced, leaving out the channels
+func (sf *StreamFilter) override(spec streamFilterSpec) (*StreamFilter, error) {
+	channel := *sf
+	channel.Channels = nil
+
+	var err error
+	regexes := []struct {
+		re   **regexp.Regexp
+		expr *string
+		name string
+	}{
+		{&channel.MatchTitle, spec.MatchTitle, "title to match"},
+		{&channel.RejectTitle, spec.RejectTitle, "title to reject"},
+		{&channel.MatchDescription, spec.MatchDescription, "description to match"},
+		{&channel.RejectDescription, spec.RejectDescription, "description to reject"},
+	}
+	for _, r := range regexes {
+		if r.expr == nil {
+			continue
+		}
+
+		*r.re, err = compileFilterRegex(*r.expr, r.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if spec.Categories != nil {
+		channel.Categories = spec.Categories
+	}
+	if spec.Languages != nil {
+		channel.Languages = spec.Languages
+	}
+
+	durations := []struct {
+		d   *time.Duration
+		val *string
+	}{
+		{&channel.MinDuration, spec.MinDuration},
+		{&channel.MaxDuration, spec.MaxDuration},
+	}
+	for _, d := range durations {
+		if d.val == nil {
+			continue
+		}
+
+		*d.d = 0
+		if len(*d.val) > 0 {
+			*d.d, err = ParseDurationStr(*d.val)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &channel, channel.check()
+}
+
+func (sf *StreamFilter) check() error {
+	if sf.MinDuration > 0 && sf.MaxDuration > 0 && sf.MinDuration > sf.MaxDuration {
+		return fmt.Errorf("the minimum duration %s is longer than the maximum %s", sf.MinDuration, sf.MaxDuration)
+	}
+
+	return nil
+}
+
+func (sf *StreamFilter) isEmpty() bool {
+	return sf.MatchTitle == nil && sf.RejectTitle == nil &&
+		sf.MatchDescription == nil && sf.RejectDescription == nil &&
+		len(sf.Categories) == 0 && len(sf.Languages) == 0 &&
+		sf.MinDuration <= 0 && sf.MaxDuration <= 0
+}
+
+// The filter for the streams of a channel
+func (sf *StreamFilter) ForChannel(channelId string) *StreamFilter {
+	if sf == nil {
+		return nil
+	}
+
+	if channel, ok := sf.Channels[channelId]; ok {
+		return channel
+	}
+
+	return sf
+}
+
+// Check the title of a stream, returning why it is rejected if it is
+func (sf *StreamFilter) Allows(title string) (bool, string) {
+	if sf == nil {
+		return true, ""
+	}
+
+	return checkFilterRegexes("title", title, sf.MatchTitle, sf.RejectTitle)
+}
+
+func checkFilterRegexes(field, value string, match, reject *regexp.Regexp) (bool, string) {
+	// Without the (?i) they were compiled with
+	if match != nil && !match.MatchString(value) {
+		return false, fmt.Sprintf("the %s does not match %s", field, match.String()[4:])
+	}
+
+	if reject != nil && reject.MatchString(value) {
+		return false, fmt.Sprintf("the %s matches %s", field, reject.String()[4:])
+	}
+
+	return true, ""
+}
+
+/*
+Check how long a stream has run, or ran in total if it ended, returning why
+it is rejected if it is.
+*/
+func (sf *StreamFilter) AllowsDuration(duration time.Duration, ended bool) (bool, string) {
+	if sf == nil {
+		return true, ""
+	}
+
+	if sf.MaxDuration > 0 && duration > sf.MaxDuration {
+		if ended {
+			return false, fmt.Sprintf("it ran for %s, longer than %s", duration.Round(time.Second), sf.MaxDuration)
+		}
+		return false, fmt.Sprintf("it has been live for %s, longer than %s", duration.Round(time.Second), sf.MaxDuration)
+	}
+
+	if ended && sf.MinDuration > 0 && duration < sf.MinDuration {
+		return false, fmt.Sprintf("it ran for %s, shorter than %s", duration.Round(time.Second), sf.MinDuration)
+	}
+
+	return true, ""
+}
+
+/*
+Check a stream's category and the languages it is in, returning why it is
+rejected if it is. A stream in no known language is let through.
+*/
+func (sf *StreamFilter) AllowsCategory(category string, languages []string) (bool, string) {
+	if sf == nil {
+		return true, ""
+	}
+
+	if len(sf.Categories) > 0 {
+		found := false
+		for _, c := range sf.Categories {
+			if strings.EqualFold(c, category) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false, fmt.Sprintf("the category %s is not one of %s", category, strings.Join(sf.Categories, ", "))
+		}
+	}
+
+	if len(sf.Languages) > 0 && len(languages) > 0 {
+		for _, want := range sf.Languages {
+			for _, lang := range languages {
+				if strings.EqualFold(lang, want) || strings.HasPrefix(strings.ToLower(lang), strings.ToLower(want)+"-") {
+					return true, ""
+				}
+			}
+		}
+
+		return false, fmt.Sprintf("it is in %s, not %s", strings.Join(languages, ", "), strings.Join(sf.Languages, ", "))
+	}
+
+	return true, ""
+}
+
+/*
+Languages a stream is in, as far as the player response tells: those of its
+audio tracks when it has several, otherwise those of its captions. Live
+streams usually have neither.
+*/
+func streamLanguages(pr *PlayerResponse) []string {
+	var languages []string
+	seen := make(map[string]bool)
+	add := func(lang string) {
+		if len(lang) > 0 && !seen[lang] {
+			seen[lang] = true
+			languages = append(languages, lang)
+		}
+	}
+
+	// Track IDs look like en.4 or en-US.3
+	for _, format := range pr.StreamingData.AdaptiveFormats {
+		lang, _, _ := strings.Cut(format.AudioTrack.ID, ".")
+		add(lang)
+	}
+
+	if len(languages) == 0 {
+		for _, track := range pr.Captions.PlayerCaptionsTracklistRenderer.CaptionTracks {
+			add(track.LanguageCode)
+		}
+	}
+
+	return languages
+}
+
+/*
+Check everything the player response tells about a stream. How long it runs
+is only known once it is live.
+*/
+func (sf *StreamFilter) allowsPlayerResponse(pr *PlayerResponse) (bool, string) {
+	if ok, reason := sf.Allows(pr.VideoDetails.Title); !ok {
+		return false, reason
+	}
+
+	if ok, reason := checkFilterRegexes("description", pr.VideoDetails.ShortDescription, sf.MatchDescription, sf.RejectDescription); !ok {
+		return false, reason
+	}
+
+	if ok, reason := sf.AllowsCategory(pr.Microformat.PlayerMicroformatRenderer.Category, streamLanguages(pr)); !ok {
+		return false, reason
+	}
+
+	liveDetails := pr.Microformat.PlayerMicroformatRenderer.LiveBroadcastDetails
+	start, err := time.Parse(time.RFC3339, liveDetails.StartTimestamp)
+	if err != nil {
+		return true, ""
+	}
+
+	if liveDetails.IsLiveNow {
+		return sf.AllowsDuration(ServerNow().Sub(start), false)
+	}
+
+	end, err := time.Parse(time.RFC3339, liveDetails.EndTimestamp)
+	if err != nil {
+		return true, ""
+	}
+
+	return sf.AllowsDuration(end.Sub(start), true)
+}
@@ -0,0 +1,162 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+/*
+Muxes the streams with ffmpeg into matroska as they download, for watching
+or processing the stream while it is being archived
+*/
+type streamMuxer struct {
+	cmd     *exec.Cmd
+	inputs  map[string]io.Writer
+	closers []io.Closer
+}
+
+func startStreamMuxer(ffmpegPath string, out io.Writer, dataTypes []string) (*streamMuxer, error) {
+	return startMuxer(ffmpegPath, []string{"-f", "matroska", "pipe:1"}, out, dataTypes)
+}
+
+/*
+Start ffmpeg copying the given streams to outArgs. Each data type gets its
+own pipe in the returned muxer's inputs.
+*/
+func startMuxer(ffmpegPath string, outArgs []string, out io.Writer, dataTypes []string) (*streamMuxer, error) {
+	if len(dataTypes) > 1 && runtime.GOOS == "windows" {
+		return nil, errors.New("streaming both audio and video is not supported on Windows, use --no-audio or --no-video")
+	}
+
+	m := &streamMuxer{inputs: make(map[string]io.Writer)}
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	var readers []*os.File
+	var stdin *os.File
+
+	for i, dataType := range dataTypes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			m.closePipes(readers)
+			m.closeInputs()
+			return nil, err
+		}
+
+		readers = append(readers, r)
+		m.closers = append(m.closers, w)
+		m.inputs[dataType] = w
+
+		// A single stream goes through stdin, which also works on Windows
+		input := "pipe:0"
+		if len(dataTypes) > 1 {
+			input = fmt.Sprintf("pipe:%d", 3+i)
+		} else {
+			stdin = r
+		}
+
+		args = append(args,
+			"-seekable", "0",
+			"-thread_queue_size", "1024",
+			"-i", input,
+		)
+	}
+
+	args = append(args, "-c", "copy")
+	args = append(args, outArgs...)
+	m.cmd = exec.Command(ffmpegPath, args...)
+	if errors.Is(m.cmd.Err, exec.ErrDot) {
+		m.cmd.Err = nil
+	}
+
+	if stdin != nil {
+		m.cmd.Stdin = stdin
+	} else {
+		m.cmd.ExtraFiles = readers
+	}
+	m.cmd.Stdout = out
+	m.cmd.Stderr = os.Stderr
+
+	LogDebug("Streaming output with: %s %v", ffmpegPath, args)
+	err := m.cmd.Start()
+
+	// ffmpeg has its own copies of the read ends now
+	m.closePipes(readers)
+	if err != nil {
+		m.closeInputs()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *streamMuxer) closePipes(pipes []*os.File) {
+	for _, p := range pipes {
+		p.Close()
+	}
+}
+
+func (m *streamMuxer) closeInputs() {
+	for _, c := range m.closers {
+		c.Close()
+	}
+}
+
+// Signal the end of the streams and wait for ffmpeg to finish
+func (m *streamMuxer) Close() error {
+	m.closeInputs()
+	return m.cmd.Wait()
+}
+
+func (di *DownloadInfo) HasStreamOutput(dataType string) bool {
+	di.RLock()
+	defer di.RUnlock()
+	return di.StreamOutputs[dataType] != nil || di.RestreamOutputs[dataType] != nil || di.LiveOutputs[dataType] != nil
+}
+
+/*
+Pass a written fragment on to the stream output. If whatever is reading
+the output goes away, finish the download like a SIGTERM would.
+*/
+func (di *DownloadInfo) writeStreamOutput(dataType string, data []byte) {
+	di.RLock()
+	out := di.StreamOutputs[dataType]
+	restream := di.RestreamOutputs[dataType]
+	live := di.LiveOutputs[dataType]
+	di.RUnlock()
+
+	if live != nil {
+		_, err := live.Write(data)
+		if err != nil {
+			LogWarn("%s: Live output file stopped, the download will continue: %s", dataType, err)
+			di.Lock()
+			delete(di.LiveOutputs, dataType)
+			di.Unlock()
+		}
+	}
+
+	if restream != nil {
+		_, err := restream.Write(data)
+		if err != nil {
+			LogWarn("%s: Restream stopped, the download will continue: %s", dataType, err)
+			di.Lock()
+			delete(di.RestreamOutputs, dataType)
+			di.Unlock()
+		}
+	}
+
+	if out == nil {
+		return
+	}
+
+	_, err := out.Write(data)
+	if err != nil {
+		LogWarn("%s: Stream output closed, finishing download: %s", dataType, err)
+		di.Lock()
+		delete(di.StreamOutputs, dataType)
+		di.Unlock()
+		di.Finish()
+	}
+}
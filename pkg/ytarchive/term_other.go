@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package ytarchive
+
+import "errors"
+
+func MakeRawTerminal(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
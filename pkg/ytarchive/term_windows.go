@@ -0,0 +1,29 @@
+//go:build windows
+
+package ytarchive
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// Put the console connected to fd into raw mode so single key presses
+// can be read. Returns a function that restores the previous state.
+func MakeRawTerminal(fd int) (func(), error) {
+	var oldMode uint32
+	h := windows.Handle(fd)
+
+	if err := windows.GetConsoleMode(h, &oldMode); err != nil {
+		return nil, err
+	}
+
+	mode := oldMode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT)
+	mode |= windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+
+	if err := windows.SetConsoleMode(h, mode); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		windows.SetConsoleMode(h, oldMode)
+	}, nil
+}
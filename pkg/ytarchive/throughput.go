@@ -0,0 +1,172 @@
+package ytarchive
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// How far back download throughput is measured
+	ThroughputWindow = 2 * time.Minute
+	// How far behind live the download must be before warning about it
+	BehindWarnSecs = 60
+)
+
+type throughputSample struct {
+	At      time.Time
+	Bytes   int
+	LagSecs int
+}
+
+/*
+Sent to the Behind callback when a live download starts falling behind the
+stream, and again with Behind unset once it catches back up.
+*/
+type BehindInfo struct {
+	Behind bool
+	// Seconds of stream between the newest fragment and the download
+	LagSecs int
+	// Measured download rate and the rate the stream needs, in bytes per second
+	BytesPerSec   float64
+	BitrateNeeded float64
+}
+
+/*
+Compares how fast fragments are downloading against the bitrate of the
+formats being downloaded, to notice a live download that can not keep up
+long before it ends up hours behind the stream.
+
+Lag alone is not enough, since it grows for a bit after every stall and
+shrinks again. Throughput alone is not either, since a download that has
+caught up can only go as fast as the stream does. Falling behind means both:
+more than BehindWarnSecs behind, further behind than last check, and
+downloading slower than the stream's bitrate.
+*/
+type ThroughputMonitor struct {
+	// Bytes per second the stream needs, from the formats' advertised bitrates
+	bitrateNeeded float64
+	fragDuration  int
+	started       time.Time
+	samples       []throughputSample
+	behind        bool
+}
+
+/*
+Create a monitor for formats with the given bitrates in bits per second.
+Formats with an unknown bitrate of 0 are skipped. Returns nil if none of
+them are known, which Add accepts.
+*/
+func NewThroughputMonitor(fragDuration int, bitrates ...int) *ThroughputMonitor {
+	total := 0
+	for _, b := range bitrates {
+		total += b
+	}
+
+	if total <= 0 || fragDuration <= 0 {
+		return nil
+	}
+
+	return &ThroughputMonitor{
+		bitrateNeeded: float64(total) / 8,
+		fragDuration:  fragDuration,
+		started:       time.Now(),
+	}
+}
+
+/*
+Record a downloaded fragment along with how many fragments the download is
+behind the newest one. Returns the new state if the download just started
+falling behind or just caught up, otherwise nil.
+*/
+func (tm *ThroughputMonitor) Add(bytes, lagFrags int) *BehindInfo {
+	if tm == nil {
+		return nil
+	}
+
+	now := time.Now()
+	lag := lagFrags * tm.fragDuration
+	tm.samples = append(tm.samples, throughputSample{now, bytes, lag})
+
+	cutoff := now.Add(-ThroughputWindow)
+	i := 0
+	for i < len(tm.samples) && tm.samples[i].At.Before(cutoff) {
+		i += 1
+	}
+	tm.samples = tm.samples[i:]
+
+	if now.Sub(tm.started) < ThroughputWindow {
+		return nil
+	}
+
+	rate := tm.Rate()
+	info := &BehindInfo{
+		LagSecs:       lag,
+		BytesPerSec:   rate,
+		BitrateNeeded: tm.bitrateNeeded,
+	}
+
+	// Compared against the start of the window so a single slow fragment
+	// does not count as falling further behind
+	growing := lag > tm.samples[0].LagSecs
+	if !tm.behind && lag > BehindWarnSecs && growing && rate < tm.bitrateNeeded {
+		tm.behind = true
+		info.Behind = true
+		return info
+	}
+
+	// Some lag is normal with several fragments in flight
+	if tm.behind && lag <= BehindWarnSecs/2 {
+		tm.behind = false
+		return info
+	}
+
+	return nil
+}
+
+// Download rate over the window in bytes per second
+func (tm *ThroughputMonitor) Rate() float64 {
+	if tm == nil {
+		return 0
+	}
+
+	window := time.Since(tm.started)
+	if window > ThroughputWindow {
+		window = ThroughputWindow
+	}
+	if window <= 0 {
+		return 0
+	}
+
+	total := 0
+	for _, s := range tm.samples {
+		total += s.Bytes
+	}
+
+	return float64(total) / window.Seconds()
+}
+
+/*
+Run the user's command for a download falling behind or catching up, as
+COMMAND behind|caught-up VIDEO_ID LAG_SECS.
+*/
+func runBehindCommand(path, videoID string, behind *BehindInfo) {
+	event := "caught-up"
+	if behind.Behind {
+		event = "behind"
+	}
+
+	cmd := exec.Command(path, event, videoID, strconv.Itoa(behind.LagSecs))
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		LogWarn("Error running %s: %s", path, err)
+		if len(out) > 0 {
+			LogDebug("%s output: %s", path, out)
+		}
+	}
+}
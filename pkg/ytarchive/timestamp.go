@@ -0,0 +1,145 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+)
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+// PKIStatus values from RFC 3161 that mean a token was issued
+const (
+	TSAGranted         = 0
+	TSAGrantedWithMods = 1
+)
+
+type tsMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsRequest struct {
+	Version        int
+	MessageImprint tsMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type tsStatusInfo struct {
+	Status       int
+	StatusString asn1.RawValue  `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type tsResponse struct {
+	Status         tsStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+/*
+Request an RFC 3161 timestamp token over the SHA-256 of fname from the
+timestamp authority at tsaUrl, returning the DER encoded TimeStampResp.
+The reply can be checked with 'openssl ts -verify -in FILE.tsr -data FILE'.
+*/
+func RequestTimestamp(ctx context.Context, client HttpClient, tsaUrl, fname string) ([]byte, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	reqData, err := asn1.Marshal(tsRequest{
+		Version: 1,
+		MessageImprint: tsMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tsaUrl, bytes.NewReader(reqData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/timestamp-query")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp authority returned HTTP %d", resp.StatusCode)
+	}
+
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tsResp tsResponse
+	_, err = asn1.Unmarshal(respData, &tsResp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp response: %w", err)
+	}
+
+	status := tsResp.Status.Status
+	if status != TSAGranted && status != TSAGrantedWithMods {
+		return nil, fmt.Errorf("timestamp request rejected with status %d", status)
+	}
+
+	// The token is signed CMS data, but the TSTInfo inside holds our hash and
+	// nonce as they were sent, which is enough to know it is the right one
+	token := tsResp.TimeStampToken.FullBytes
+	if !bytes.Contains(token, digest) || !bytes.Contains(token, nonce.Bytes()) {
+		return nil, errors.New("timestamp token does not match the request")
+	}
+
+	return respData, nil
+}
+
+/*
+Timestamp fname and write the reply next to it as fname.tsr,
+returning the name of the written file.
+*/
+func TimestampFile(ctx context.Context, client HttpClient, tsaUrl, fname string, mode os.FileMode) (string, error) {
+	reply, err := RequestTimestamp(ctx, client, tsaUrl, fname)
+	if err != nil {
+		return "", err
+	}
+
+	tsrFile := fname + ".tsr"
+	err = os.WriteFile(tsrFile, reply, mode)
+	if err != nil {
+		return "", err
+	}
+
+	return tsrFile, nil
+}
@@ -0,0 +1,223 @@
+package ytarchive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Ways the wall-clock timestamp track can end up in the final file
+const (
+	TimestampTrackSoft = "soft"
+	TimestampTrackBurn = "burn"
+)
+
+// How each timestamp is shown
+const TimestampTrackLayout = "2006-01-02 15:04:05 MST"
+
+func IsValidTimestampTrack(mode string) bool {
+	return mode == TimestampTrackSoft || mode == TimestampTrackBurn
+}
+
+/*
+Look up the time zone timestamps are shown in: UTC, local for the system's
+zone, or an IANA name like Asia/Tokyo.
+*/
+func TimestampLocation(zone string) (*time.Location, error) {
+	switch strings.ToLower(zone) {
+	case "", "utc":
+		return time.UTC, nil
+	case "local":
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(zone)
+}
+
+// Format seconds as a WebVTT timestamp
+func vttTime(secs int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.000", secs/3600, secs/60%60, secs%60)
+}
+
+/*
+Write a WebVTT track showing the wall-clock time throughout the final file,
+from the produced times of the dataType fragments in times. Fragments
+YouTube sent no time for are placed from the nearest one it did. Holes left
+for skipped fragments are counted if gaps is given, and show no time. See
+FillGaps.
+*/
+func WriteTimestampTrack(fpath string, times []FragTime, dataType string, gaps []FragmentGap, fragSecs int, loc *time.Location, mode os.FileMode) error {
+	if fragSecs <= 0 {
+		return errors.New("the fragment duration is unknown")
+	}
+
+	var frags []FragTime
+	anchor := -1
+	for _, ft := range times {
+		if ft.DataType != dataType {
+			continue
+		}
+		if anchor < 0 && !ft.Produced.IsZero() {
+			anchor = len(frags)
+		}
+		frags = append(frags, ft)
+	}
+
+	if anchor < 0 {
+		return errors.New("no fragment had a produced time, which YouTube only sends while the stream is live")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n")
+
+	// Fragments before the first with a time count back from it
+	base := frags[anchor].Produced.Add(-time.Duration(frags[anchor].MediaTime) * time.Second)
+	baseMedia := 0
+	for _, ft := range frags {
+		if !ft.Produced.IsZero() {
+			base = ft.Produced
+			baseMedia = ft.MediaTime
+		}
+
+		start := ft.MediaTime
+		for _, gap := range gaps {
+			if gap.Written*fragSecs <= ft.MediaTime {
+				start += (gap.EndSeq - gap.StartSeq + 1) * fragSecs
+			}
+		}
+
+		for s := 0; s < fragSecs; s++ {
+			wall := base.Add(time.Duration(ft.MediaTime-baseMedia+s) * time.Second)
+			fmt.Fprintf(&sb, "\n%s --> %s\n%s\n",
+				vttTime(start+s),
+				vttTime(start+s+1),
+				wall.In(loc).Format(TimestampTrackLayout),
+			)
+		}
+	}
+
+	return os.WriteFile(fpath, []byte(sb.String()), mode)
+}
+
+/*
+Write the timestamp track for the final file from the fragment times file
+written during the download, following the video unless it is audio only.
+*/
+func (di *DownloadInfo) writeTimestampTrack(trackFile, fragTimesFile, zone string, withGaps bool) error {
+	loc, err := TimestampLocation(zone)
+	if err != nil {
+		return err
+	}
+
+	times, err := ReadFragTimes(fragTimesFile)
+	if err != nil {
+		return err
+	}
+
+	dataType := DtypeVideo
+	if di.Quality == AudioOnlyQuality {
+		dataType = DtypeAudio
+	}
+
+	var gaps []FragmentGap
+	if withGaps {
+		gaps = di.MDLInfo[dataType].Gaps
+	}
+
+	return WriteTimestampTrack(trackFile, times, dataType, gaps, di.TargetDuration, loc, di.FileMode)
+}
+
+// Subtitle codec each container holds a text track in
+func timestampTrackCodec(container string) string {
+	switch container {
+	case MergeFormatMP4:
+		return "mov_text"
+	case MergeFormatMKV:
+		return "srt"
+	case MergeFormatWebM:
+		return "webvtt"
+	}
+
+	return ""
+}
+
+/*
+Escape a path for use as a filter option value, first for the option and
+then for the filtergraph around it.
+*/
+func escapeFilterPath(fpath string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	r2 := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+	return r2.Replace(r.Replace(fpath))
+}
+
+/*
+Add the track written by WriteTimestampTrack to a mux. Soft adds it as a
+subtitle stream, which the container must be able to hold. Burn draws it
+onto the video, re-encoding it, which needs an ffmpeg built with libass.
+*/
+func (f *FFMpegArgs) AddTimestampTrack(trackFile, mode, container string) error {
+	if len(f.Args) == 0 {
+		return errors.New("nothing to mux")
+	}
+
+	// An mp4 thumbnail is the first video stream when embedded
+	videoIdx := 0
+	mapped := false
+	lastInput := -1
+	inputs := 0
+	for i, arg := range f.Args {
+		switch arg {
+		case "attached_pic":
+			videoIdx = 1
+		case "-map":
+			mapped = true
+		case "-i":
+			lastInput = i + 1
+			inputs += 1
+		}
+	}
+
+	output := f.Args[len(f.Args)-1]
+	args := make([]string, 0, len(f.Args)+10)
+	if mode == TimestampTrackBurn {
+		codec := "libx264"
+		quality := []string{"-crf", "18", "-preset", "veryfast"}
+		if container == MergeFormatWebM {
+			codec = "libvpx-vp9"
+			quality = []string{"-crf", "32", "-b:v", "0", "-row-mt", "1"}
+		}
+
+		args = append(args, f.Args[:len(f.Args)-1]...)
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", videoIdx), "subtitles="+escapeFilterPath(trackFile),
+			fmt.Sprintf("-c:v:%d", videoIdx), codec,
+		)
+		args = append(args, quality...)
+		f.Args = append(args, output)
+		return nil
+	}
+
+	codec := timestampTrackCodec(container)
+	if len(codec) == 0 {
+		return fmt.Errorf("%s can not hold a subtitle track", container)
+	}
+
+	// Inputs have to come before the output options
+	args = append(args, f.Args[:lastInput+1]...)
+	args = append(args, "-i", trackFile)
+	args = append(args, f.Args[lastInput+1:len(f.Args)-1]...)
+	if mapped {
+		args = append(args, "-map", fmt.Sprint(inputs))
+	}
+	args = append(args,
+		"-c:s", codec,
+		"-metadata:s:s:0", "title=Wall clock",
+		output,
+	)
+	f.Args = args
+
+	return nil
+}
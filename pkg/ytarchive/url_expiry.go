@@ -0,0 +1,85 @@
+package ytarchive
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long before the download URLs expire they are refreshed
+	URLRefreshMargin = 5 * time.Minute
+	// How often the expiry of the download URLs is checked
+	URLExpiryCheckInterval = time.Minute
+)
+
+var gvideoExpireRegex = regexp.MustCompile(`[?&/]expire[=/](\d+)`)
+
+// When a googlevideo URL expires, from its expire parameter. Zero if unknown.
+func URLExpiry(dlURL string) time.Time {
+	match := gvideoExpireRegex.FindStringSubmatch(dlURL)
+	if match == nil {
+		return time.Time{}
+	}
+
+	secs, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(secs, 0)
+}
+
+// The soonest any of the download URLs in use expires. Zero if unknown.
+func (di *DownloadInfo) urlsExpire() time.Time {
+	var soonest time.Time
+	for _, mdl := range di.MDLInfo {
+		mdl.RLock()
+		expiry := URLExpiry(mdl.DownloadURL)
+		finished := mdl.Finished
+		mdl.RUnlock()
+
+		if finished || expiry.IsZero() {
+			continue
+		}
+		if soonest.IsZero() || expiry.Before(soonest) {
+			soonest = expiry
+		}
+	}
+
+	return soonest
+}
+
+/*
+Refresh the download URLs URLRefreshMargin before they expire, so long
+downloads do not have to wait for fragments to start failing with 403s
+first. Only done while the stream is live. Runs until ctx is cancelled or
+the download is finishing.
+*/
+func (di *DownloadInfo) KeepURLsFresh(ctx context.Context) {
+	for SleepContext(ctx, URLExpiryCheckInterval) {
+		if di.IsUnavailable() || di.IsFinishing() {
+			return
+		}
+
+		// Same as for failing fragments, ended streams are not refreshed
+		if !di.IsLive() {
+			continue
+		}
+
+		expiry := di.urlsExpire()
+		if expiry.IsZero() || ServerNow().Add(URLRefreshMargin).Before(expiry) {
+			continue
+		}
+
+		LogDebug("The download URLs expire at %s, refreshing them", expiry.Local().Format(time.Kitchen))
+		if !di.GetVideoInfo(ctx) {
+			continue
+		}
+
+		if newExpiry := di.urlsExpire(); !newExpiry.After(expiry) {
+			LogDebug("Refreshing did not give download URLs that expire later")
+		}
+	}
+}
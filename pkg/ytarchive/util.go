@@ -1,8 +1,11 @@
-package main
+package ytarchive
 
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"crypto/sha1"
 	"crypto/tls"
@@ -23,6 +26,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/alessio/shellescape"
@@ -34,8 +40,11 @@ type MPD struct {
 
 // DASH Manifest element containing Youtube's media ID and a download URL
 type Representation struct {
-	Id      string `xml:"id,attr"`
-	BaseURL string
+	Id        string `xml:"id,attr"`
+	Codecs    string `xml:"codecs,attr"`
+	Bandwidth int    `xml:"bandwidth,attr"`
+	FrameRate int    `xml:"frameRate,attr"`
+	BaseURL   string
 
 	// we need the last sq value of the format
 	SegmentList []MpdSegments `xml:"SegmentList>SegmentURL"`
@@ -54,6 +63,15 @@ type Atom struct {
 	Length int
 }
 
+/*
+Sends HTTP requests. *http.Client satisfies it, so a client with a custom
+transport, proxy, instrumentation, or recorded responses can be used in
+place of the default one.
+*/
+type HttpClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 type FFMpegArgs struct {
 	Args     []string
 	FileName string
@@ -80,6 +98,8 @@ const (
 	NetworkIPv4         = "tcp4"
 	NetworkIPv6         = "tcp6"
 	DefaultPollTime     = 15
+	FinalCountdownTime  = 300
+	ScheduleRecheckTime = 1800
 	MinimumMonitorTime  = 30
 	DefaultMonitorTime  = 60
 	DefaultVideoQuality = "best"
@@ -93,7 +113,7 @@ const MaxFileNameLength = 243 // 255 - len(".description")
 var (
 	HtmlVideoLinkTag = []byte(`<link rel="canonical" href="https://www.youtube.com/watch?v=`)
 
-	loglevel              = LoglevelWarning
+	loglevel              = int32(LoglevelWarning)
 	networkType           = NetworkBoth // Set to force IPv4 or IPv6
 	networkOverrideDialer = &net.Dialer{
 		Timeout:   15 * time.Second,
@@ -102,16 +122,74 @@ var (
 	tlsNetworkOverrideDialer = &tls.Dialer{
 		NetDialer: networkOverrideDialer,
 	}
-	client *http.Client
+	defaultClient  *http.Client
+	ignoreEnvProxy bool // Do not use the proxies set in HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// Guards networkType, ignoreEnvProxy and defaultClient, which programs
+	// embedding the package may set while archivers are running
+	settingsLock sync.Mutex
 )
 
+// Set how much gets logged, using one of the Loglevel constants
+func SetLogLevel(level int) {
+	atomic.StoreInt32(&loglevel, int32(level))
+}
+
+func GetLogLevel() int {
+	return int(atomic.LoadInt32(&loglevel))
+}
+
+/*
+Force IPv4 or IPv6 with NetworkIPv4 or NetworkIPv6. Applies to clients
+initialized afterwards with NewHttpClient. Archivers use Options.Network.
+*/
+func SetNetworkType(network string) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	networkType = network
+}
+
+/*
+Ignore the proxy environment variables. Applies to clients initialized
+afterwards with NewHttpClient. Archivers use Options.IgnoreEnvProxy.
+*/
+func SetIgnoreEnvProxy(ignore bool) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	ignoreEnvProxy = ignore
+}
+
+func getNetworkType() string {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	return networkType
+}
+
+// The HTTP client used when a DownloadInfo is not given one
+func DefaultHttpClient() *http.Client {
+	settingsLock.Lock()
+	client := defaultClient
+	settingsLock.Unlock()
+	if client != nil {
+		return client
+	}
+
+	client = NewHttpClient(nil)
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	if defaultClient == nil {
+		defaultClient = client
+	}
+
+	return defaultClient
+}
+
 /*
 Logging functions;
 ansi sgr 0=reset, 1=bold, while 3x sets the foreground color:
 0black 1red 2green 3yellow 4blue 5magenta 6cyan 7white
 */
 func LogGeneral(format string, args ...interface{}) {
-	if loglevel >= LoglevelError {
+	if GetLogLevel() >= LoglevelError {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -121,7 +199,7 @@ func LogGeneral(format string, args ...interface{}) {
 }
 
 func LogError(format string, args ...interface{}) {
-	if loglevel >= LoglevelError {
+	if GetLogLevel() >= LoglevelError {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -131,7 +209,7 @@ func LogError(format string, args ...interface{}) {
 }
 
 func LogWarn(format string, args ...interface{}) {
-	if loglevel >= LoglevelWarning {
+	if GetLogLevel() >= LoglevelWarning {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -141,7 +219,7 @@ func LogWarn(format string, args ...interface{}) {
 }
 
 func LogInfo(format string, args ...interface{}) {
-	if loglevel >= LoglevelInfo {
+	if GetLogLevel() >= LoglevelInfo {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -151,7 +229,7 @@ func LogInfo(format string, args ...interface{}) {
 }
 
 func LogDebug(format string, args ...interface{}) {
-	if loglevel >= LoglevelDebug {
+	if GetLogLevel() >= LoglevelDebug {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -161,7 +239,7 @@ func LogDebug(format string, args ...interface{}) {
 }
 
 func LogTrace(format string, args ...interface{}) {
-	if loglevel >= LoglevelTrace {
+	if GetLogLevel() >= LoglevelTrace {
 		msg := format
 		if len(args) > 0 {
 			msg = fmt.Sprintf(format, args...)
@@ -171,31 +249,77 @@ func LogTrace(format string, args ...interface{}) {
 }
 
 func DialContextOverride(ctx context.Context, network, addr string) (net.Conn, error) {
-	return networkOverrideDialer.DialContext(ctx, networkType, addr)
+	return networkOverrideDialer.DialContext(ctx, getNetworkType(), addr)
 }
 
 func DialTLSContextOverride(ctx context.Context, network, addr string) (net.Conn, error) {
-	return tlsNetworkOverrideDialer.DialContext(ctx, networkType, addr)
+	return tlsNetworkOverrideDialer.DialContext(ctx, getNetworkType(), addr)
 }
 
+// Set up the default HTTP client
 func InitializeHttpClient(proxyUrl *url.URL) {
+	client := NewHttpClient(proxyUrl)
+
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	defaultClient = client
+}
+
+func NewHttpClient(proxyUrl *url.URL) *http.Client {
+	settingsLock.Lock()
+	network, ignoreEnv := networkType, ignoreEnvProxy
+	settingsLock.Unlock()
+
+	return newHttpClient(proxyUrl, network, ignoreEnv)
+}
+
+/*
+Create a client connecting over network, one of the Network constants, and
+leaving out the proxy environment variables if ignoreEnv is set. An empty
+network falls back to the one set with SetNetworkType.
+*/
+func newHttpClient(proxyUrl *url.URL, network string, ignoreEnv bool) *http.Client {
+	if len(network) == 0 {
+		network = getNetworkType()
+	}
+
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 
-	tr.DialContext = DialContextOverride
-	tr.DialTLSContext = DialTLSContextOverride
+	tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return networkOverrideDialer.DialContext(ctx, network, addr)
+	}
+	tr.DialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return tlsNetworkOverrideDialer.DialContext(ctx, network, addr)
+	}
 	tr.ResponseHeaderTimeout = 10 * time.Second
 	tr.IdleConnTimeout = 45 * time.Second
 	tr.TLSHandshakeTimeout = 10 * time.Second
 	if proxyUrl != nil {
 		// Override ProxyFromEnvironment (default setting)
 		tr.Proxy = http.ProxyURL(proxyUrl)
+	} else if ignoreEnv {
+		tr.Proxy = nil
 	}
 
-	client = &http.Client{
+	return &http.Client{
 		Transport: tr,
 	}
 }
 
+/*
+Create a client for fragment downloads. Uses proxyUrl if set, no proxy at
+all if direct is set, and otherwise the proxy from the environment unless
+it is ignored.
+*/
+func NewMediaHttpClient(proxyUrl *url.URL, direct bool) *http.Client {
+	client := NewHttpClient(proxyUrl)
+	if direct {
+		client.Transport.(*http.Transport).Proxy = nil
+	}
+
+	return client
+}
+
 // Remove any illegal filename chars
 func SterilizeFilename(s string, lookalikeChars bool) string {
 	var fnameReplacer *strings.Replacer
@@ -242,6 +366,39 @@ func FormatSize(bsize int64) string {
 	return fmt.Sprintf("%dB", bsize)
 }
 
+/*
+Parse a byte count such as 500M, 4GiB, or 1.5G. Suffixes are powers of 1024,
+with or without a trailing iB or B.
+*/
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	mult := 1.0
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'K':
+			mult = KiB
+		case 'M':
+			mult = MiB
+		case 'G':
+			mult = GiB
+		case 'T':
+			mult = GiB * 1024
+		}
+	}
+	if mult != 1 {
+		str = str[:len(str)-1]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return int64(n * mult), nil
+}
+
 /*
 This is pretty dumb but the only way to handle sigint in a custom way
 Thankfully we don't call this often enough to really care
@@ -261,8 +418,8 @@ func GetUserInput(prompt string) string {
 	var input string
 	inputChan := make(chan string)
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	defer signal.Reset(os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
 
 	fmt.Print(prompt)
 	go getInput(inputChan)
@@ -339,16 +496,62 @@ func Execute(prog string, args []string) int {
 }
 
 // Download data from the given URL
-func DownloadData(url string) []byte {
+// Encodings asked for on page and API requests, see ReadResponseBody
+const AcceptEncodings = "gzip, deflate"
+
+/*
+Read a response body, decompressing it according to its Content-Encoding.
+Go only does this by itself for gzip, and only when it set Accept-Encoding.
+*/
+func ReadResponseBody(resp *http.Response) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		return io.ReadAll(gz)
+	case "deflate":
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		// Supposed to be zlib wrapped, but some servers send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		}
+		defer zr.Close()
+
+		return io.ReadAll(zr)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func DownloadData(ctx context.Context, client HttpClient, url string) []byte {
 	var data []byte
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		LogWarn("Failed to retrieve data from %s: %v", url, err)
 		return data
 	}
+	req.Header.Set("Accept-Encoding", AcceptEncodings)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogWarn("Failed to retrieve data from %s: %v", url, err)
+		}
+		return data
+	}
 	defer resp.Body.Close()
+	CheckClockSkew(resp)
 
-	data, err = io.ReadAll(resp.Body)
+	data, err = ReadResponseBody(resp)
 	if err != nil {
 		LogWarn("Failed to retrieve data from %s: %v", url, err)
 		return data
@@ -361,8 +564,14 @@ func DownloadData(url string) []byte {
 Download the given url to the given file name.
 Obviously meant to be used for thumbnail images.
 */
-func DownloadThumbnail(url, fname string, fileMode os.FileMode) bool {
-	resp, err := client.Get(url)
+func DownloadThumbnail(ctx context.Context, client HttpClient, url, fname string, fileMode os.FileMode) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		LogWarn("Failed to download thumbnail: %v", err)
+		return false
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		LogWarn("Failed to download thumbnail: %v", err)
 		return false
@@ -393,7 +602,8 @@ func MakeQualityList(formats []string) string {
 		fmt.Fprintf(&sb, "%s, ", v)
 	}
 
-	sb.WriteString("best")
+	sb.WriteString("best, ")
+	sb.WriteString(AutoQuality)
 	return sb.String()
 }
 
@@ -406,7 +616,7 @@ func ParseQualitySelection(formats []string, quality string) []string {
 	for _, q := range qualities {
 		stripped := strings.TrimSpace(q)
 
-		if stripped == "best" {
+		if stripped == "best" || stripped == AutoQuality {
 			selQualities = append(selQualities, stripped)
 			continue
 		} else if stripped == "audio" {
@@ -429,8 +639,13 @@ func ParseQualitySelection(formats []string, quality string) []string {
 	return selQualities
 }
 
-// Prompt the user to select a video quality
-func GetQualityFromUser(formats []string, waiting bool) []string {
+/*
+Prompt the user to select a video quality.
+descriptions maps quality labels to a short codec/fps/bitrate summary shown
+by the interactive picker. The plain text prompt is used when not running
+in a terminal. The only error is ErrQualityPickCancelled.
+*/
+func GetQualityFromUser(formats []string, descriptions map[string]string, waiting bool) ([]string, error) {
 	var selQualities []string
 	qualities := MakeQualityList(formats)
 
@@ -442,6 +657,20 @@ func GetQualityFromUser(formats []string, waiting bool) []string {
 		)
 	}
 
+	if IsInteractiveTerminal() {
+		options := make([]QualityOption, 0, len(formats)+1)
+		options = append(options, QualityOption{Label: DefaultVideoQuality, Description: "highest available quality"})
+		options = append(options, QualityOption{Label: AutoQuality, Description: "highest quality the connection can keep up with"})
+		for i := len(formats) - 1; i >= 0; i-- {
+			options = append(options, QualityOption{Label: formats[i], Description: descriptions[formats[i]]})
+		}
+
+		selQualities, err := PickQualities(options)
+		if err != nil || len(selQualities) > 0 {
+			return selQualities, err
+		}
+	}
+
 	fmt.Printf("Available video qualities: %s\n", qualities)
 
 	for len(selQualities) < 1 {
@@ -454,7 +683,7 @@ func GetQualityFromUser(formats []string, waiting bool) []string {
 		selQualities = ParseQualitySelection(formats, quality)
 	}
 
-	return selQualities
+	return selQualities, nil
 }
 
 /*
@@ -467,14 +696,15 @@ func IsFragmented(url string) bool {
 }
 
 // Prase the DASH manifest XML and get the download URLs from it
-func GetUrlsFromManifest(manifest []byte, poToken string) (map[int]string, int) {
+func GetUrlsFromManifest(manifest []byte, poToken string) (map[int]string, map[int]*FormatDetails, int) {
 	urls := make(map[int]string)
+	details := make(map[int]*FormatDetails)
 	var mpd MPD
 
 	err := xml.Unmarshal(manifest, &mpd)
 	if err != nil {
 		LogDebug("Error parsing DASH manifest: %s", err)
-		return urls, -1
+		return urls, details, -1
 	}
 
 	lastSq := -1
@@ -509,10 +739,16 @@ func GetUrlsFromManifest(manifest []byte, poToken string) (map[int]string, int)
 				formatUrl = fmt.Sprintf("%s/pot/%s", formatUrl, poToken)
 			}
 			urls[itag] = formatUrl
+			details[itag] = &FormatDetails{
+				Itag:    itag,
+				Codecs:  r.Codecs,
+				Fps:     r.FrameRate,
+				Bitrate: r.Bandwidth,
+			}
 		}
 	}
 
-	return urls, lastSq
+	return urls, details, lastSq
 }
 
 func StringsIndex(arr []string, s string) int {
@@ -638,7 +874,7 @@ func ParseGvideoUrl(gvUrl, dataType string) (string, int) {
 	return newUrl, itag
 }
 
-func RefreshURL(di *DownloadInfo, dataType, currentUrl string) {
+func RefreshURL(ctx context.Context, di *DownloadInfo, dataType, currentUrl string) {
 	if !di.IsGVideoDDL() {
 		newUrl := di.GetDownloadUrl(dataType)
 
@@ -646,13 +882,21 @@ func RefreshURL(di *DownloadInfo, dataType, currentUrl string) {
 			LogDebug("%s: Attempting to retrieve a new download URL", dataType)
 			di.PrintStatus()
 
-			di.GetVideoInfo()
+			di.GetVideoInfo(ctx)
 		}
 	}
 }
 
-func ContinueFragmentDownload(di *DownloadInfo, state *fragThreadState) bool {
-	if di.IsFinished(state.DataType) {
+func ContinueFragmentDownload(ctx context.Context, di *DownloadInfo, state *fragThreadState) bool {
+	if ctx.Err() != nil || di.IsFinished(state.DataType) {
+		return false
+	}
+	di.resetAfterSleep(ctx, state)
+
+	// Fragments past the newest known sequence may not exist for a while.
+	// Don't hold up finishing the download waiting for them.
+	if di.IsFinishing() && (state.MaxSeq < 0 || state.SeqNum > state.MaxSeq) {
+		LogDebug("%s: Finishing download, giving up on fragment %d", state.Name, state.SeqNum)
 		return false
 	}
 
@@ -664,12 +908,14 @@ func ContinueFragmentDownload(di *DownloadInfo, state *fragThreadState) bool {
 
 		// Update video info to be safe if we are known to still be live
 		if di.IsLive() {
-			di.GetVideoInfo()
+			di.GetVideoInfo(ctx)
 		}
 
 		if !di.IsLive() || di.IsUnavailable() {
 			if state.Is403 {
-				if di.IsUnavailable() {
+				if di.IsRegionLocked() {
+					LogWarn("%s: Download link likely expired and stream is no longer available in this country, cannot continue download", state.Name)
+				} else if di.IsUnavailable() {
 					LogWarn("%s: Download link likely expired and stream is privated or members only, cannot continue download", state.Name)
 				} else {
 					LogWarn("%s: Download link has likely expired and the stream has probably finished processing.", state.Name)
@@ -686,6 +932,8 @@ func ContinueFragmentDownload(di *DownloadInfo, state *fragThreadState) bool {
 				di.SetFinished(state.DataType)
 				return false
 			}
+		} else if di.IsFinishing() {
+			return false
 		} else {
 			LogDebug("%s: Fragment %d: Stream still live, continuing download attempt", state.Name, state.SeqNum)
 			di.PrintStatus()
@@ -696,13 +944,17 @@ func ContinueFragmentDownload(di *DownloadInfo, state *fragThreadState) bool {
 	return true
 }
 
-func HandleFragHttpError(di *DownloadInfo, state *fragThreadState, statusCode int, url string) {
+func HandleFragHttpError(ctx context.Context, di *DownloadInfo, state *fragThreadState, statusCode int, url string) {
 	LogDebug("%s: HTTP Error for fragment %d: %d %s", state.Name, state.SeqNum, statusCode, http.StatusText(statusCode))
 	di.PrintStatus()
 
+	if statusCode == http.StatusForbidden || statusCode == http.StatusNotFound {
+		di.recordURLResult(ctx, state.DataType, true)
+	}
+
 	if statusCode == http.StatusForbidden {
 		state.Is403 = true
-		RefreshURL(di, state.DataType, url)
+		RefreshURL(ctx, di, state.DataType, url)
 	} else if statusCode == http.StatusNotFound && state.MaxSeq > -1 && !di.IsLive() && state.SeqNum > (state.MaxSeq-2) {
 		LogDebug("%s: Stream has ended and fragment within the last two not found, probably not actually created", state.Name)
 		di.PrintStatus()
@@ -770,6 +1022,28 @@ func TryMove(srcFileName, dstFileName string) error {
 	return nil
 }
 
+/*
+Move a file so that it only ever shows up at dstFileName complete. A rename
+already is atomic, otherwise it is copied next to the destination as
+dstFileName.part first and renamed into place once the copy is done.
+*/
+func AtomicMove(srcFileName, dstFileName string) error {
+	err := os.Rename(srcFileName, dstFileName)
+	if err == nil {
+		LogInfo("Moved file %s to %s", srcFileName, dstFileName)
+		return nil
+	}
+
+	partFile := dstFileName + ".part"
+	err = TryMove(srcFileName, partFile)
+	if err != nil {
+		TryDelete(partFile)
+		return err
+	}
+
+	return os.Rename(partFile, dstFileName)
+}
+
 func TryDelete(fname string) {
 	_, err := os.Stat(fname)
 	if err != nil {
@@ -873,16 +1147,16 @@ func Contains(arr []string, val string) bool {
 // Logic taken from youtube-dl/yt-dlp, who got the hashing method from stack overflow
 // https://github.com/yt-dlp/yt-dlp/blob/e3950399e4d471b987a2d693f8a6a476568e7c8a/yt_dlp/extractor/youtube.py#L541
 // https://stackoverflow.com/a/32065323
-func GenerateSAPISIDHash(origin *url.URL) string {
+func GenerateSAPISIDHash(jar http.CookieJar, origin *url.URL) string {
 	var sapisidHash string
 	var sapisidCookie *http.Cookie
 	var papisidCookie *http.Cookie
 
-	if origin == nil {
+	if jar == nil || origin == nil {
 		return sapisidHash
 	}
 
-	cookies := client.Jar.Cookies(origin)
+	cookies := jar.Cookies(origin)
 	if len(cookies) == 0 {
 		return sapisidHash
 	}
@@ -911,10 +1185,11 @@ func GenerateSAPISIDHash(origin *url.URL) string {
 		}
 
 		cookies = append(cookies, sapisidCookie)
-		client.Jar.SetCookies(origin, cookies)
+		jar.SetCookies(origin, cookies)
 	}
 
-	now := time.Now().Unix()
+	// The hash is rejected if its time is too far off
+	now := ServerNow().Unix()
 	hashBytes := sha1.Sum([]byte(fmt.Sprintf("%d %s https://www.youtube.com", now, sapisidCookie.Value)))
 	sapisidHash = hex.EncodeToString(hashBytes[:])
 
@@ -947,7 +1222,18 @@ func TruncateString(s string, maxBytes int) string {
 	return b.String()
 }
 
-func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, onlyAudio, onlyVideo bool) FFMpegArgs {
+/*
+Build the ffmpeg arguments for muxing the downloaded files.
+Metadata is only added when metadata is non-nil. The container is one of
+the MergeFormat values, and the thumbnail is only embedded in mp4 and mkv.
+*/
+func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, onlyAudio, onlyVideo, embedThumbnail bool, container string, metadata MetaInfo) FFMpegArgs {
+	mkv := container == MergeFormatMKV
+	mp4 := container == MergeFormatMP4
+	if !mkv && !mp4 {
+		embedThumbnail = false
+	}
+
 	mergeFile := ""
 	ext := ""
 	ffmpegArgs := make([]string, 0, 12)
@@ -958,16 +1244,14 @@ func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, on
 		"-stats",
 	)
 
-	if downloadThumbnail && !mkv {
+	if embedThumbnail && !mkv {
 		ffmpegArgs = append(ffmpegArgs, "-i", thumbnail)
 	}
 
-	if onlyAudio {
+	if onlyAudio && (mp4 || mkv) {
 		ext = "m4a"
-	} else if mkv {
-		ext = "mkv"
 	} else {
-		ext = "mp4"
+		ext = container
 	}
 
 	mergeCounter := 0
@@ -991,11 +1275,11 @@ func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, on
 			"-thread_queue_size", "1024",
 			"-i", videoFile,
 		)
-		if !mkv {
+		if mp4 {
 			ffmpegArgs = append(ffmpegArgs, "-movflags", "faststart")
 		}
 
-		if downloadThumbnail && !mkv {
+		if embedThumbnail && !mkv {
 			ffmpegArgs = append(ffmpegArgs,
 				"-map", "0",
 				"-map", "1",
@@ -1008,20 +1292,20 @@ func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, on
 	}
 
 	ffmpegArgs = append(ffmpegArgs, "-c", "copy")
-	if downloadThumbnail {
+	if embedThumbnail {
 		if mkv {
 			ffmpegArgs = append(ffmpegArgs,
 				"-attach", thumbnail,
-				"-metadata:s:t", "filename=cover_land.jpg",
-				"-metadata:s:t", "mimetype=image/jpeg",
+				"-metadata:s:t:0", "filename=cover_land.jpg",
+				"-metadata:s:t:0", "mimetype=image/jpeg",
 			)
 		} else {
 			ffmpegArgs = append(ffmpegArgs, "-disposition:v:0", "attached_pic")
 		}
 	}
 
-	if addMeta {
-		for k, v := range info.Metadata {
+	if metadata != nil {
+		for k, v := range metadata {
 			if len(v) > 0 {
 				ffmpegArgs = append(ffmpegArgs,
 					"-metadata",
@@ -1039,6 +1323,70 @@ func GetFFmpegArgs(audioFile, videoFile, thumbnail, fileDir, fileName string, on
 	}
 }
 
+/*
+Attach files to an mkv mux, after any thumbnail already attached. Each is
+named after the file itself and typed by its extension.
+*/
+func (f *FFMpegArgs) AddAttachments(files []string) {
+	if len(files) == 0 || len(f.Args) == 0 {
+		return
+	}
+
+	idx := 0
+	for _, arg := range f.Args {
+		if arg == "-attach" {
+			idx += 1
+		}
+	}
+
+	output := f.Args[len(f.Args)-1]
+	args := f.Args[:len(f.Args)-1]
+	for _, fpath := range files {
+		args = append(args,
+			"-attach", fpath,
+			fmt.Sprintf("-metadata:s:t:%d", idx), fmt.Sprintf("filename=%s", filepath.Base(fpath)),
+			fmt.Sprintf("-metadata:s:t:%d", idx), fmt.Sprintf("mimetype=%s", attachmentMimeType(fpath)),
+		)
+		idx += 1
+	}
+
+	f.Args = append(args, output)
+}
+
+func attachmentMimeType(fpath string) string {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".json":
+		return "application/json"
+	case ".html":
+		return "text/html"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	}
+
+	return "text/plain"
+}
+
+/*
+Point the arguments at other copies of the input files, given as a map of
+old path to new path, and write the output into dir under the same name.
+*/
+func (f *FFMpegArgs) Relocate(dir string, inputs map[string]string) {
+	output := filepath.Join(dir, filepath.Base(f.FileName))
+	for i, arg := range f.Args {
+		if moved, ok := inputs[arg]; ok {
+			f.Args[i] = moved
+		} else if arg == f.FileName {
+			f.Args[i] = output
+		}
+	}
+
+	f.FileName = output
+}
+
 func SecondsToDurationStr(seconds int) string {
 	days := seconds / (60 * 60 * 24)
 	seconds -= days * (60 * 60 * 24)
@@ -1064,6 +1412,69 @@ func SecondsToDurationStr(seconds int) string {
 	return outputStr
 }
 
+/*
+Sleep for the given number of seconds while showing a countdown to the
+given unix timestamp. The countdown updates every second, or once a minute
+with newlines, where each update goes on a line of its own.
+Returns false if the context was cancelled before the time was up.
+*/
+func WaitWithCountdown(ctx context.Context, target, secs int64, newlines bool) bool {
+	end := time.Now().Add(time.Duration(secs) * time.Second)
+	startStr := time.Unix(target, 0).Format("2006/01/02 15:04:05")
+	lastMinute := int64(-1)
+	shown := false
+
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			break
+		}
+
+		remaining := target - ServerNow().Unix()
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if GetLogLevel() > LoglevelQuiet {
+			if !newlines {
+				fmt.Fprintf(os.Stderr, "\rStream starts in %s (%s)\033[K", SecondsToDurationStr(int(remaining)), startStr)
+				shown = true
+			} else if remaining/60 != lastMinute {
+				fmt.Fprintf(os.Stderr, "Stream starts in %s (%s)\n", SecondsToDurationStr(int(remaining)), startStr)
+				lastMinute = remaining / 60
+				shown = true
+			}
+		}
+
+		sleepTime := end.Sub(now)
+		if sleepTime > time.Second {
+			sleepTime = time.Second
+		}
+		if !SleepContext(ctx, sleepTime) {
+			break
+		}
+	}
+
+	if shown && !newlines {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+
+	return ctx.Err() == nil
+}
+
+// Sleep for the given duration. Returns false if the context was cancelled first.
+func SleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 func SecondsToTimeStr(seconds int) string {
 	hours := seconds / (60 * 60)
 	seconds -= hours * (60 * 60)
@@ -1,10 +1,12 @@
 //go:build !windows
 
-package main
+package ytarchive
 
 import (
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mattn/go-colorable"
 )
@@ -16,3 +18,8 @@ func Setup() {
 func Exit(code int) {
 	os.Exit(code)
 }
+
+// Toggle pausing the download with SIGUSR1
+func NotifyPauseSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
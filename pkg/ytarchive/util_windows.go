@@ -1,6 +1,6 @@
 //go:build windows
 
-package main
+package ytarchive
 
 import (
 	"log"
@@ -39,6 +39,9 @@ func Exit(code int) {
 	os.Exit(code)
 }
 
+// There is no equivalent to SIGUSR1 on Windows
+func NotifyPauseSignal(c chan<- os.Signal) {}
+
 func disableQuickEditMode() {
 	h := os.Stdin.Fd()
 	if r, _, _ := procGetConsoleMode.Call(h, uintptr(unsafe.Pointer(&previousMode))); r == 0 {
@@ -0,0 +1,233 @@
+package ytarchive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers that would hand out the account's session if the WARC is shared
+var WARCRedactedHeaders = []string{"Authorization", "Cookie", "X-Goog-Authuser"}
+
+// Whether a header's values are left out of recorded traffic. Refreshed
+// session cookies sent back by the server count as well.
+func redactedHeader(name string) bool {
+	if strings.EqualFold(name, "Set-Cookie") {
+		return true
+	}
+
+	for _, redacted := range WARCRedactedHeaders {
+		if strings.EqualFold(name, redacted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Copy of headers with the redacted ones replaced by a placeholder
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for name, vals := range redacted {
+		if redactedHeader(name) {
+			for i := range vals {
+				vals[i] = "[redacted]"
+			}
+		}
+	}
+
+	return redacted
+}
+
+/*
+Records the HTTP traffic going through Client into a gzipped WARC 1.1 file,
+giving provenance for what was archived. Each record is its own gzip member,
+as web archive tools expect.
+*/
+type WARCWriter struct {
+	sync.Mutex
+	Client HttpClient
+
+	file *os.File
+}
+
+/*
+Create a WARC file in dir, or the system temporary directory if dir is
+empty, recording requests made through client.
+*/
+func NewWARCWriter(dir string, client HttpClient) (*WARCWriter, error) {
+	f, err := os.CreateTemp(dir, "ytarchive-*.warc.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WARCWriter{Client: client, file: f}
+	info := "software: ytarchive\r\nformat: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"
+
+	err = w.writeRecord([][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Date", warcDate()},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info), "")
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Path of the WARC file being written
+func (w *WARCWriter) Name() string {
+	return w.file.Name()
+}
+
+func (w *WARCWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
+
+func (w *WARCWriter) Do(req *http.Request) (*http.Response, error) {
+	return w.do(w.Client, req)
+}
+
+type warcClient struct {
+	warc   *WARCWriter
+	client HttpClient
+}
+
+func (c *warcClient) Do(req *http.Request) (*http.Response, error) {
+	return c.warc.do(c.client, req)
+}
+
+// Record the requests made through another client into the same WARC file
+func (w *WARCWriter) Through(client HttpClient) HttpClient {
+	return &warcClient{warc: w, client: client}
+}
+
+func (w *WARCWriter) do(client HttpClient, req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	err = w.record(req, reqBody, resp, respBody)
+	if err != nil {
+		LogWarn("Failed to write WARC record for %s: %s", req.URL.Host, err)
+	}
+
+	return resp, nil
+}
+
+func (w *WARCWriter) record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) error {
+	var reqBlock bytes.Buffer
+	fmt.Fprintf(&reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	redactHeaders(req.Header).Write(&reqBlock)
+	reqBlock.WriteString("\r\n")
+	reqBlock.Write(reqBody)
+
+	var respBlock bytes.Buffer
+	fmt.Fprintf(&respBlock, "%s %s\r\n", resp.Proto, resp.Status)
+	redactHeaders(resp.Header).Write(&respBlock)
+	respBlock.WriteString("\r\n")
+	respBlock.Write(respBody)
+
+	uri := req.URL.String()
+	date := warcDate()
+	respId := newWARCRecordID()
+
+	w.Lock()
+	defer w.Unlock()
+
+	err := w.writeRecord([][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", respId},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", uri},
+		{"WARC-Payload-Digest", warcDigest(respBody)},
+		{"Content-Type", "application/http;msgtype=response"},
+	}, respBlock.Bytes(), uri)
+	if err != nil {
+		return err
+	}
+
+	return w.writeRecord([][2]string{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", uri},
+		{"WARC-Concurrent-To", respId},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, reqBlock.Bytes(), uri)
+}
+
+func (w *WARCWriter) writeRecord(headers [][2]string, block []byte, uri string) error {
+	var sb strings.Builder
+	sb.WriteString("WARC/1.1\r\n")
+	for _, h := range headers {
+		sb.WriteString(fmt.Sprintf("%s: %s\r\n", h[0], h[1]))
+	}
+	sb.WriteString(fmt.Sprintf("WARC-Block-Digest: %s\r\n", warcDigest(block)))
+	sb.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(block)))
+
+	gz := gzip.NewWriter(w.file)
+	gz.Write([]byte(sb.String()))
+	gz.Write(block)
+	gz.Write([]byte("\r\n\r\n"))
+
+	err := gz.Close()
+	if err != nil {
+		return err
+	}
+
+	LogTrace("Wrote WARC record for %s", uri)
+	return nil
+}
+
+func warcDate() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05Z")
+}
+
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func newWARCRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
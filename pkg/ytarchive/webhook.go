@@ -0,0 +1,155 @@
+package ytarchive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Events sent to webhooks
+const (
+	WebhookWaiting         = "waiting"
+	WebhookLive            = "live"
+	WebhookDownloadStarted = "download_started"
+	WebhookStreamEnded     = "stream_ended"
+	WebhookMuxComplete     = "mux_complete"
+	WebhookError           = "error"
+
+	// How long a webhook has to answer
+	WebhookTimeout = 15 * time.Second
+)
+
+var WebhookEvents = []string{
+	WebhookWaiting,
+	WebhookLive,
+	WebhookDownloadStarted,
+	WebhookStreamEnded,
+	WebhookMuxComplete,
+	WebhookError,
+}
+
+// The JSON body POSTed to webhooks
+type WebhookPayload struct {
+	Event   string   `json:"event"`
+	Time    string   `json:"time"`
+	VideoID string   `json:"video_id"`
+	Title   string   `json:"title"`
+	Channel string   `json:"channel"`
+	URL     string   `json:"url"`
+	Files   []string `json:"files,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+/*
+Parse a comma-separated list of webhook events, such as
+"live,mux_complete". Empty means every event.
+*/
+func ParseWebhookEvents(list string) ([]string, error) {
+	var events []string
+	for _, event := range strings.Split(list, ",") {
+		event = strings.TrimSpace(event)
+		if len(event) == 0 {
+			continue
+		}
+
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown webhook event %s, it must be one of %s", event, strings.Join(WebhookEvents, ", "))
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func (a *Archiver) wantsWebhook(event string) bool {
+	o := a.Options
+	if len(o.Webhooks) == 0 {
+		return false
+	}
+	if len(o.WebhookEvents) == 0 {
+		return true
+	}
+
+	for _, e := range o.WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+POST event to every webhook in the background. The archiver waits for them
+to be sent before Run returns. Does not lock info, so it can be called
+from the state callback.
+*/
+func (a *Archiver) notify(info *DownloadInfo, event string, files []string, err error) {
+	if !a.wantsWebhook(event) {
+		return
+	}
+
+	payload := &WebhookPayload{
+		Event: event,
+		Time:  time.Now().UTC().Format(time.RFC3339),
+		Files: files,
+	}
+	if info != nil {
+		payload.VideoID = info.VideoID
+		payload.Title = info.FormatInfo["title"]
+		payload.Channel = info.FormatInfo["channel"]
+		payload.URL = info.FormatInfo["url"]
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	data, jsonErr := json.Marshal(payload)
+	if jsonErr != nil {
+		LogWarn("Failed to make the %s webhook: %s", event, jsonErr)
+		return
+	}
+
+	for _, hook := range a.Options.Webhooks {
+		a.webhooks.Add(1)
+		go func(hook string) {
+			defer a.webhooks.Done()
+			err := postWebhook(hook, data)
+			if err != nil {
+				LogWarn("Failed to send the %s webhook to %s: %s", event, hook, err)
+			}
+		}(hook)
+	}
+}
+
+func postWebhook(hook string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
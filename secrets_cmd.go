@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Kethsar/ytarchive/pkg/ytarchive"
+)
+
+/*
+Add, replace, or delete a secret in the OS keyring or an encrypted secrets
+file, for use with --cookies and --potoken as secret:NAME. Also encrypts
+values for options and environment variables that take encrypted values.
+*/
+func runSecretsCommand(args []string) int {
+	secretsFlags := flag.NewFlagSet("secrets", flag.ExitOnError)
+	store := secretsFlags.String("store", ytarchive.SecretStoreKeyring, "keyring, or the path of an encrypted secrets file.")
+	secretsFlags.Parse(args)
+	args = secretsFlags.Args()
+
+	if len(args) > 0 && args[0] == "encrypt" {
+		return runEncryptCommand(args[1:])
+	}
+
+	if len(args) < 2 || (args[0] != "set" && args[0] != "delete") {
+		ytarchive.LogError("Usage: secrets [--store keyring|FILE] set NAME [FILE] | delete NAME | encrypt [VALUE]")
+		return 1
+	}
+
+	name := args[1]
+	err := ytarchive.CheckSecretName(name)
+	if err != nil {
+		ytarchive.LogError("%s", err)
+		return 1
+	}
+
+	var data []byte
+	if args[0] == "set" {
+		// Read before any passphrase is asked for, in case it comes from a file
+		if len(args) > 2 {
+			data, err = os.ReadFile(args[2])
+		} else {
+			data, err = io.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			ytarchive.LogError("Failed to read the secret: %s", err)
+			return 1
+		}
+	}
+
+	secrets, err := ytarchive.OpenSecretStore(*store)
+	if err != nil {
+		ytarchive.LogError("Failed to open the secret store: %s", err)
+		return 1
+	}
+
+	if args[0] == "set" {
+		err = secrets.Set(name, data)
+		if err != nil {
+			ytarchive.LogError("Failed to store %s: %s", name, err)
+			return 1
+		}
+
+		ytarchive.LogGeneral("Stored %s, use it as %s%s", name, ytarchive.SecretPrefix, name)
+		return 0
+	}
+
+	err = secrets.Delete(name)
+	if errors.Is(err, ytarchive.ErrSecretNotFound) {
+		ytarchive.LogError("There is no secret named %s", name)
+		return 1
+	} else if err != nil {
+		ytarchive.LogError("Failed to delete %s: %s", name, err)
+		return 1
+	}
+
+	ytarchive.LogGeneral("Deleted %s", name)
+	return 0
+}
+
+// Print VALUE, or stdin, encrypted with the key from the environment
+func runEncryptCommand(args []string) int {
+	var value string
+	if len(args) > 0 {
+		value = args[0]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			ytarchive.LogError("Failed to read the value: %s", err)
+			return 1
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	encrypted, err := ytarchive.EncryptConfigValue(value)
+	if err != nil {
+		ytarchive.LogError("Failed to encrypt the value: %s", err)
+		return 1
+	}
+
+	fmt.Println(encrypted)
+	return 0
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("running as a service is only supported on Windows")
+
+func IsService() bool {
+	return false
+}
+
+func RunService(run func() int) int {
+	return run()
+}
+
+func InstallService(args []string) error {
+	return errServiceUnsupported
+}
+
+func RemoveService() error {
+	return errServiceUnsupported
+}
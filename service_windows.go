@@ -0,0 +1,208 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Kethsar/ytarchive/pkg/ytarchive"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	ServiceName        = "ytarchive"
+	ServiceDescription = "Monitors YouTube channels and archives their livestreams"
+	ServiceStopTimeout = 60 * time.Second
+)
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*[A-Za-z]")
+
+/*
+Writes log output to the Windows event log, picking the event type
+based on the log level prefix of each message
+*/
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := ansiEscape.ReplaceAllString(string(p), "")
+	msg = strings.TrimSpace(strings.ReplaceAll(msg, "\r", ""))
+	if len(msg) == 0 {
+		return len(p), nil
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(msg, "ERROR:"):
+		err = w.elog.Error(1, msg)
+	case strings.HasPrefix(msg, "WARNING:"):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+type serviceHandler struct {
+	run     func() int
+	retcode int
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	done := make(chan struct{})
+
+	s <- svc.Status{State: svc.StartPending}
+	go func() {
+		h.retcode = h.run()
+		close(done)
+	}()
+	s <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case <-done:
+			s <- svc.Status{State: svc.StopPending}
+			return false, uint32(h.retcode)
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				ytarchive.LogGeneral("Service stop requested")
+				s <- svc.Status{State: svc.StopPending, WaitHint: uint32(ServiceStopTimeout / time.Millisecond)}
+				RequestStop(syscall.SIGTERM)
+				waitForServiceRun(done)
+				return false, uint32(h.retcode)
+			}
+		}
+	}
+}
+
+/*
+Give a running download the chance to finish its fragments and mux, up to
+the wait hint given to the service manager. The archiver only returns once
+the final file is done, so stopping any earlier could cut the mux short.
+*/
+func waitForServiceRun(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(ServiceStopTimeout):
+		ytarchive.LogWarn("Timed out waiting for the download to finish")
+	}
+}
+
+func IsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// Run the given function as the service's work, logging to the event log
+func RunService(run func() int) int {
+	elog, err := eventlog.Open(ServiceName)
+	if err == nil {
+		defer elog.Close()
+		log.SetFlags(0)
+		log.SetPrefix("")
+		log.SetOutput(&eventLogWriter{elog: elog})
+	}
+
+	if len(serviceDir) > 0 {
+		if err = os.Chdir(serviceDir); err != nil {
+			ytarchive.LogError("Failed to change to the service directory: %s", err)
+		}
+	}
+
+	h := &serviceHandler{run: run}
+	err = svc.Run(ServiceName, h)
+	if err != nil {
+		ytarchive.LogError("Failed to run as a service: %s", err)
+		return 1
+	}
+
+	return h.retcode
+}
+
+// Register a service that runs ytarchive with the given arguments
+func InstallService(args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ServiceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", ServiceName)
+	}
+
+	svcArgs := append([]string{"--service-dir", cwd}, args...)
+	s, err = m.CreateService(ServiceName, exePath, mgr.Config{
+		DisplayName: ServiceName,
+		Description: ServiceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, svcArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(ServiceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to set up event log source: %s", err)
+	}
+
+	return nil
+}
+
+func RemoveService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ServiceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", ServiceName)
+	}
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+
+	err = eventlog.Remove(ServiceName)
+	if err != nil {
+		return fmt.Errorf("failed to remove event log source: %s", err)
+	}
+
+	return nil
+}